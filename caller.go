@@ -0,0 +1,100 @@
+package nibbler
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CallerResolver identifies the user making a request - the session extension does so from the session cookie, and
+// the jwt extension from a bearer token.  A nil user (with a nil error) means the request is anonymous
+type CallerResolver interface {
+	GetCaller(r *http.Request) (*User, error)
+}
+
+// ScopedCallerResolver is a CallerResolver whose callers can be restricted to a subset of their privileges (e.g. by
+// the scopes of an API key).  Scopes are actions ("delete-group"), actions on one resource ("delete-group:<id>") or "*"
+type ScopedCallerResolver interface {
+	CallerResolver
+
+	// GetCallerScopes returns the scopes the request's caller is restricted to, and false if they aren't restricted
+	GetCallerScopes(r *http.Request) ([]string, bool, error)
+}
+
+// CallerResolvers tries each resolver in order, returning the first caller found, so that (for example) routes can be
+// called with either a session cookie or a bearer token
+type CallerResolvers []CallerResolver
+
+func (c CallerResolvers) GetCaller(r *http.Request) (*User, error) {
+	for _, resolver := range c {
+		caller, err := resolver.GetCaller(r)
+		if err != nil || caller != nil {
+			return caller, err
+		}
+	}
+	return nil, nil
+}
+
+// GetCallerScopes returns the scopes from the resolver that found the caller, if it restricts callers
+func (c CallerResolvers) GetCallerScopes(r *http.Request) ([]string, bool, error) {
+	for _, resolver := range c {
+		caller, err := resolver.GetCaller(r)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if caller != nil {
+			return CallerScopes(resolver, r)
+		}
+	}
+	return nil, false, nil
+}
+
+// ResolverOrDefault returns the resolver, or the fallback if no resolver was provided - extensions with an optional
+// CallerResolver use it to fall back to their session extension
+func ResolverOrDefault(resolver CallerResolver, fallback CallerResolver) CallerResolver {
+	if resolver != nil {
+		return resolver
+	}
+	return fallback
+}
+
+// CallerScopes returns the scopes the request's caller is restricted to, if the resolver restricts callers
+func CallerScopes(resolver CallerResolver, r *http.Request) ([]string, bool, error) {
+	if scoped, ok := resolver.(ScopedCallerResolver); ok {
+		return scoped.GetCallerScopes(r)
+	}
+	return nil, false, nil
+}
+
+// ScopesAllow states whether the scopes allow an action - on the given resource, or resource-agnostic if resourceId is nil
+func ScopesAllow(scopes []string, resourceId *string, action string) bool {
+	for _, scope := range scopes {
+		if scope == "*" || scope == action {
+			return true
+		}
+
+		if resourceId != nil && strings.HasPrefix(scope, action+":") && scope[len(action)+1:] == *resourceId {
+			return true
+		}
+	}
+	return false
+}
+
+// EnforceCaller will return a 500 if the resolver fails, and a 401 if there is no caller.  It will pass through to the
+// routerFunc if there is a caller
+func EnforceCaller(resolver CallerResolver, routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := resolver.GetCaller(r)
+		if err != nil {
+			Write500Json(w, err.Error())
+			return
+		}
+
+		if caller == nil {
+			Write401Json(w)
+			return
+		}
+
+		routerFunc(w, r)
+	}
+}
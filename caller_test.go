@@ -0,0 +1,85 @@
+package nibbler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fixedCallerResolver struct {
+	caller *User
+}
+
+func (f fixedCallerResolver) GetCaller(r *http.Request) (*User, error) {
+	return f.caller, nil
+}
+
+func TestCallerResolvers_GetCaller(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	resolvers := CallerResolvers{fixedCallerResolver{}, fixedCallerResolver{caller: &User{ID: "bob"}}, fixedCallerResolver{caller: &User{ID: "alice"}}}
+	if caller, err := resolvers.GetCaller(req); err != nil || caller == nil || caller.ID != "bob" {
+		t.Fatal("the first caller found was not returned")
+	}
+
+	if caller, err := (CallerResolvers{fixedCallerResolver{}}).GetCaller(req); err != nil || caller != nil {
+		t.Fatal("a caller was returned when no resolver found one")
+	}
+}
+
+func TestResolverOrDefault(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	fallback := fixedCallerResolver{caller: &User{ID: "bob"}}
+
+	if caller, _ := ResolverOrDefault(nil, fallback).GetCaller(req); caller == nil || caller.ID != "bob" {
+		t.Fatal("the fallback was not used when no resolver was provided")
+	}
+
+	if caller, _ := ResolverOrDefault(fixedCallerResolver{caller: &User{ID: "alice"}}, fallback).GetCaller(req); caller == nil || caller.ID != "alice" {
+		t.Fatal("the fallback was used when a resolver was provided")
+	}
+}
+
+func TestEnforceCaller(t *testing.T) {
+	reached := false
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}
+
+	res := httptest.NewRecorder()
+	EnforceCaller(fixedCallerResolver{}, handler)(res, httptest.NewRequest("GET", "/", nil))
+	if reached || res.Code != http.StatusUnauthorized {
+		t.Fatal("an anonymous request was allowed")
+	}
+
+	EnforceCaller(fixedCallerResolver{caller: &User{ID: "bob"}}, handler)(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !reached {
+		t.Fatal("a request with a caller was rejected")
+	}
+}
+
+func TestScopesAllow(t *testing.T) {
+	group := "group-a"
+	other := "group-b"
+	scopes := []string{"list-groups", "delete-group:group-a"}
+
+	if !ScopesAllow(scopes, nil, "list-groups") || !ScopesAllow(scopes, &group, "list-groups") {
+		t.Fatal("an action scope did not allow the action")
+	}
+
+	if !ScopesAllow(scopes, &group, "delete-group") {
+		t.Fatal("a resource scope did not allow the action on the resource")
+	}
+
+	if ScopesAllow(scopes, &other, "delete-group") || ScopesAllow(scopes, nil, "delete-group") {
+		t.Fatal("a resource scope allowed the action beyond the resource")
+	}
+
+	if ScopesAllow(scopes, nil, "create-group") || ScopesAllow(nil, nil, "create-group") {
+		t.Fatal("an action was allowed without a scope for it")
+	}
+
+	if !ScopesAllow([]string{"*"}, &other, "create-group") {
+		t.Fatal("the wildcard scope did not allow the action")
+	}
+}
@@ -1,16 +1,173 @@
 package nibbler
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrMailFeatureNotSupported is returned when a message uses something the sender can't express (see ToMessageSender)
+var ErrMailFeatureNotSupported = errors.New("the mail sender does not support a feature used by the message")
+
 type MailSender interface {
 	SendMail(from *EmailAddress, subject string, to []*EmailAddress, plainTextContent string, htmlContent string) (*MailSendResponse, error)
 }
 
+// AttachmentMailSender is implemented by senders that can also attach files to what they send
+type AttachmentMailSender interface {
+	MailSender
+	SendMailWithAttachments(from *EmailAddress, subject string, to []*EmailAddress, plainTextContent string, htmlContent string, attachments []*MailAttachment) (*MailSendResponse, error)
+}
+
+// MessageSender is implemented by senders that can send a complete MailMessage.  Use ToMessageSender to get one from
+// any MailSender
+type MessageSender interface {
+	SendMessage(ctx context.Context, message *MailMessage) (*MailSendResponse, error)
+}
+
+// QueueingMailSender is implemented by senders that only accept mail for later delivery (like mail/queue), so sending
+// with them is quick, and only fails if the mail can't be accepted.  Extensions send to them in the request, rather
+// than in the background
+type QueueingMailSender interface {
+	MessageSender
+	QueuesMail() bool
+}
+
+// IsQueueingMailSender states whether the sender queues mail (see QueueingMailSender)
+func IsQueueingMailSender(sender MailSender) bool {
+	queueing, ok := sender.(QueueingMailSender)
+	return ok && queueing.QueuesMail()
+}
+
 type EmailAddress struct {
 	Name    string
 	Address string
 }
 
+// MailMessage is a complete email.  Bcc recipients receive the message, but are never listed in its headers
+type MailMessage struct {
+	From             *EmailAddress     `json:"from"`
+	To               []*EmailAddress   `json:"to,omitempty"`
+	Cc               []*EmailAddress   `json:"cc,omitempty"`
+	Bcc              []*EmailAddress   `json:"bcc,omitempty"`
+	ReplyTo          []*EmailAddress   `json:"replyTo,omitempty"`
+	Subject          string            `json:"subject"`
+	PlainTextContent string            `json:"plainTextContent,omitempty"`
+	HtmlContent      string            `json:"htmlContent,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"` // extra headers, e.g. "X-Campaign-ID"
+	Attachments      []*MailAttachment `json:"attachments,omitempty"`
+}
+
+// MailAttachment is a file to attach to an email.  Inline attachments (e.g. images referenced from the HTML content
+// as "cid:<ContentID>") are shown within the message rather than as a separate file
+type MailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"` // e.g. "application/pdf" - defaults to "application/octet-stream" if not provided
+	Content     []byte `json:"content"`
+	ContentID   string `json:"contentId,omitempty"`
+	Inline      bool   `json:"inline,omitempty"`
+}
+
 type MailSendResponse struct {
 	StatusCode int
 	Body       string
 	Headers    map[string][]string
 }
+
+// Validate checks that the message has a sender and at least one recipient
+func (m *MailMessage) Validate() error {
+	if m.From == nil || m.From.Address == "" {
+		return errors.New("an email needs a from address")
+	}
+
+	if len(m.Recipients()) == 0 {
+		return errors.New("an email needs at least one recipient")
+	}
+
+	for _, a := range m.Attachments {
+		if a.Inline && a.ContentID == "" {
+			return errors.New("inline attachment " + a.Filename + " needs a content ID")
+		}
+	}
+
+	return nil
+}
+
+// Recipients lists every address the message should be delivered to (to, cc and bcc)
+func (m *MailMessage) Recipients() []*EmailAddress {
+	var result []*EmailAddress
+	for _, list := range [][]*EmailAddress{m.To, m.Cc, m.Bcc} {
+		for _, a := range list {
+			if a != nil && a.Address != "" {
+				result = append(result, a)
+			}
+		}
+	}
+	return result
+}
+
+// ToMessageSender returns the sender itself if it implements MessageSender.  Otherwise, it wraps it in an adapter that
+// sends the message with SendMail (or SendMailWithAttachments).  The adapter lists cc recipients with the "to"
+// recipients, sends a separate copy to each bcc recipient, and returns ErrMailFeatureNotSupported for reply-to,
+// custom headers, inline attachments, and attachments for senders that aren't AttachmentMailSenders
+func ToMessageSender(sender MailSender) MessageSender {
+	if messageSender, ok := sender.(MessageSender); ok {
+		return messageSender
+	}
+	return &mailSenderAdapter{sender: sender}
+}
+
+type mailSenderAdapter struct {
+	sender MailSender
+}
+
+func (a *mailSenderAdapter) SendMessage(ctx context.Context, message *MailMessage) (*MailSendResponse, error) {
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+
+	if len(message.ReplyTo) > 0 || len(message.Headers) > 0 {
+		return nil, ErrMailFeatureNotSupported
+	}
+
+	attachmentSender, canAttach := a.sender.(AttachmentMailSender)
+	for _, attachment := range message.Attachments {
+		if attachment.Inline || !canAttach {
+			return nil, ErrMailFeatureNotSupported
+		}
+	}
+
+	send := func(to []*EmailAddress) (*MailSendResponse, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if len(message.Attachments) > 0 {
+			return attachmentSender.SendMailWithAttachments(message.From, message.Subject, to, message.PlainTextContent, message.HtmlContent, message.Attachments)
+		}
+		return a.sender.SendMail(message.From, message.Subject, to, message.PlainTextContent, message.HtmlContent)
+	}
+
+	var response *MailSendResponse
+	var err error
+
+	// everyone who can see each other gets the same message
+	visible := append(append([]*EmailAddress{}, message.To...), message.Cc...)
+	if len(visible) > 0 {
+		if response, err = send(visible); err != nil {
+			return response, err
+		}
+	}
+
+	// each bcc recipient gets their own copy, so they never appear in anyone else's
+	for _, b := range message.Bcc {
+		if b == nil {
+			continue
+		}
+
+		if response, err = send([]*EmailAddress{b}); err != nil {
+			return response, err
+		}
+	}
+
+	return response, nil
+}
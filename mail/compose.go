@@ -0,0 +1,260 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/markdicksonjr/nibbler"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reservedHeaders can't be set through MailMessage.Headers, as Compose manages them
+var reservedHeaders = map[string]bool{
+	"Bcc":                       true,
+	"Cc":                        true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"From":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Reply-To":                  true,
+	"Subject":                   true,
+	"To":                        true,
+}
+
+// Compose builds an RFC 5322 message (suitable for SMTP DATA or a .eml file).  Plain text and HTML content are sent
+// as multipart/alternative when both are provided, inline attachments wrap the HTML in multipart/related, and other
+// attachments wrap everything in multipart/mixed.  Bcc recipients are left out of the headers
+func Compose(message *nibbler.MailMessage) ([]byte, error) {
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	for k, v := range message.Headers {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if k == "" || strings.ContainsAny(k, "\r\n: ") {
+			return nil, errors.New("invalid header name " + k)
+		}
+		if reservedHeaders[k] {
+			return nil, errors.New("the " + k + " header can't be set directly")
+		}
+		header.Set(k, v)
+	}
+
+	header.Set("From", FormatAddress(message.From))
+	if len(message.To) > 0 {
+		header.Set("To", FormatAddressList(message.To))
+	} else if len(message.Cc) == 0 {
+		header.Set("To", "undisclosed-recipients:;")
+	}
+	if len(message.Cc) > 0 {
+		header.Set("Cc", FormatAddressList(message.Cc))
+	}
+	if len(message.ReplyTo) > 0 {
+		header.Set("Reply-To", FormatAddressList(message.ReplyTo))
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", message.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+uuid.New().String()+"@"+domainOf(message.From.Address)+">")
+	header.Set("MIME-Version", "1.0")
+
+	var inline []*nibbler.MailAttachment
+	var attached []*nibbler.MailAttachment
+	for _, a := range message.Attachments {
+		if a.Inline {
+			inline = append(inline, a)
+		} else {
+			attached = append(attached, a)
+		}
+	}
+
+	contentHeader, content, err := composeContent(message.PlainTextContent, message.HtmlContent, inline)
+	if err != nil {
+		return nil, err
+	}
+
+	// with attachments, the content is the first part of a multipart/mixed body
+	if len(attached) > 0 {
+		parts := []part{{header: contentHeader, body: content}}
+		for _, a := range attached {
+			parts = append(parts, attachmentPart(a))
+		}
+
+		if contentHeader, content, err = multipartOf("mixed", parts); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range contentHeader {
+		header[k] = v
+	}
+	return writeMessage(header, content), nil
+}
+
+// FormatAddress formats the address for a header, encoding the name if needed
+func FormatAddress(address *nibbler.EmailAddress) string {
+	return (&netmail.Address{Name: address.Name, Address: address.Address}).String()
+}
+
+// FormatAddressList formats the addresses for a header like "To"
+func FormatAddressList(addresses []*nibbler.EmailAddress) string {
+	var formatted []string
+	for _, a := range addresses {
+		if a != nil {
+			formatted = append(formatted, FormatAddress(a))
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// part is a single MIME part (or multipart body) and its headers
+type part struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// composeContent returns the headers and body for the text content - a single part if only one of the two is
+// provided, otherwise multipart/alternative.  Inline attachments are related to the HTML content
+func composeContent(plainTextContent string, htmlContent string, inline []*nibbler.MailAttachment) (textproto.MIMEHeader, []byte, error) {
+	var alternatives []part
+
+	if plainTextContent != "" || htmlContent == "" {
+		header, body := textPart("text/plain", plainTextContent)
+		alternatives = append(alternatives, part{header: header, body: body})
+	}
+
+	// the preferred (richest) alternative goes last
+	if htmlContent != "" {
+		header, body := textPart("text/html", htmlContent)
+
+		if len(inline) > 0 {
+			related := []part{{header: header, body: body}}
+			for _, a := range inline {
+				related = append(related, attachmentPart(a))
+			}
+
+			var err error
+			if header, body, err = multipartOf("related", related); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		alternatives = append(alternatives, part{header: header, body: body})
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0].header, alternatives[0].body, nil
+	}
+	return multipartOf("alternative", alternatives)
+}
+
+// multipartOf combines the parts into a multipart body of the given subtype (e.g. "mixed")
+func multipartOf(subtype string, parts []part) (textproto.MIMEHeader, []byte, error) {
+	body := bytes.Buffer{}
+	writer := multipart.NewWriter(&body)
+
+	for _, p := range parts {
+		partWriter, err := writer.CreatePart(p.header)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if _, err := partWriter.Write(p.body); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": writer.Boundary()}))
+	return header, body.Bytes(), nil
+}
+
+// textPart encodes the content as quoted-printable utf-8
+func textPart(contentType string, content string) (textproto.MIMEHeader, []byte) {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	// writes to a bytes.Buffer can't fail
+	body := bytes.Buffer{}
+	writer := quotedprintable.NewWriter(&body)
+	writer.Write([]byte(content))
+	writer.Close()
+
+	return header, body.Bytes()
+}
+
+// attachmentPart encodes the attachment as base64, as either an attachment or inline content
+func attachmentPart(attachment *nibbler.MailAttachment) part {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	disposition := "attachment"
+	if attachment.Inline {
+		disposition = "inline"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	if attachment.ContentID != "" {
+		header.Set("Content-ID", "<"+strings.NewReplacer("\r", "", "\n", "").Replace(attachment.ContentID)+">")
+	}
+
+	// base64 lines can be no longer than 76 characters
+	body := bytes.Buffer{}
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded + "\r\n")
+
+	return part{header: header, body: body.Bytes()}
+}
+
+// writeMessage writes the headers (sorted, for predictable output) followed by the body.  CR and LF are removed from
+// header values to prevent header injection
+func writeMessage(header textproto.MIMEHeader, body []byte) []byte {
+	var keys []string
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := bytes.Buffer{}
+	for _, k := range keys {
+		for _, v := range header[k] {
+			v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+			result.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+
+	result.WriteString("\r\n")
+	result.Write(body)
+	return result.Bytes()
+}
+
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 && i < len(address)-1 {
+		return address[i+1:]
+	}
+	return "localhost"
+}
@@ -0,0 +1,149 @@
+package mail
+
+import (
+	"bytes"
+	"github.com/markdicksonjr/nibbler"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"testing"
+)
+
+func TestCompose_Alternative(t *testing.T) {
+	raw, err := Compose(&nibbler.MailMessage{
+		From:             &nibbler.EmailAddress{Name: "Support", Address: "support@example.com"},
+		Subject:          "Héllo",
+		To:               []*nibbler.EmailAddress{{Address: "bob@example.com"}},
+		Cc:               []*nibbler.EmailAddress{{Address: "support@example.com"}},
+		Bcc:              []*nibbler.EmailAddress{{Address: "audit@example.com"}},
+		ReplyTo:          []*nibbler.EmailAddress{{Address: "help@example.com"}},
+		Headers:          map[string]string{"x-campaign-id": "123"},
+		PlainTextContent: "plain body",
+		HtmlContent:      "<p>html body</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != "Héllo" {
+		t.Fatal("the subject was not encoded correctly")
+	}
+
+	if message.Header.Get("From") != "\"Support\" <support@example.com>" {
+		t.Fatal("unexpected from header " + message.Header.Get("From"))
+	}
+
+	if message.Header.Get("Cc") != "<support@example.com>" || message.Header.Get("Reply-To") != "<help@example.com>" {
+		t.Fatal("the cc or reply-to header is wrong")
+	}
+
+	if message.Header.Get("Bcc") != "" {
+		t.Fatal("bcc recipients were listed in the headers")
+	}
+
+	if message.Header.Get("X-Campaign-Id") != "123" {
+		t.Fatal("the custom header is missing")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatal("the message was not multipart/alternative")
+	}
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	for _, expected := range []string{"plain body", "<p>html body</p>"} {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content, _ := ioutil.ReadAll(part)
+		if string(content) != expected {
+			t.Fatal("unexpected part content " + string(content))
+		}
+	}
+}
+
+func TestCompose_Attachment(t *testing.T) {
+	raw, err := Compose(&nibbler.MailMessage{
+		From:             &nibbler.EmailAddress{Address: "support@example.com"},
+		Subject:          "Invoice",
+		To:               []*nibbler.EmailAddress{{Address: "bob@example.com"}},
+		PlainTextContent: "see attached",
+		HtmlContent:      "<img src=\"cid:logo\">",
+		Attachments: []*nibbler.MailAttachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Content: []byte("%PDF")},
+			{Filename: "logo.png", ContentType: "image/png", Content: []byte("PNG"), ContentID: "logo", Inline: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatal("the message was not multipart/mixed")
+	}
+
+	reader := multipart.NewReader(message.Body, params["boundary"])
+	content, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(content.Header.Get("Content-Type")); mediaType != "multipart/alternative" {
+		t.Fatal("the content was not multipart/alternative")
+	}
+
+	attachment, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attachment.FileName() != "invoice.pdf" {
+		t.Fatal("the attachment file name was lost")
+	}
+}
+
+func TestCompose_NoHeaderInjection(t *testing.T) {
+	raw, err := Compose(&nibbler.MailMessage{
+		From:             &nibbler.EmailAddress{Address: "support@example.com"},
+		Subject:          "hi\r\nBcc: evil@example.com",
+		To:               []*nibbler.EmailAddress{{Address: "bob@example.com"}},
+		PlainTextContent: "body",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := netmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message.Header.Get("Bcc") != "" {
+		t.Fatal("a header was injected through the subject")
+	}
+}
+
+func TestCompose_ReservedHeader(t *testing.T) {
+	if _, err := Compose(&nibbler.MailMessage{
+		From:    &nibbler.EmailAddress{Address: "support@example.com"},
+		To:      []*nibbler.EmailAddress{{Address: "bob@example.com"}},
+		Headers: map[string]string{"bcc": "evil@example.com"},
+	}); err == nil {
+		t.Fatal("a reserved header was allowed")
+	}
+}
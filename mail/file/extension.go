@@ -0,0 +1,95 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Extension is a nibbler.MailSender (as well as a nibbler.AttachmentMailSender and nibbler.MessageSender) for
+// development - instead of delivering mail, it writes each email as a .eml file into Directory, where it can be opened
+// with most mail clients
+type Extension struct {
+	nibbler.NoOpExtension
+	Directory string // defaults to the "mail.file.directory" configuration value, or "./mail"
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.Directory == "" && app.Config != nil && app.Config.Raw != nil {
+		s.Directory = app.Config.Raw.Get("mail", "file", "directory").String("")
+	}
+
+	if s.Directory == "" {
+		s.Directory = "./mail"
+	}
+
+	return os.MkdirAll(s.Directory, 0700)
+}
+
+func (s *Extension) GetName() string {
+	return "mail file"
+}
+
+func (s *Extension) SendMail(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMailWithAttachments(from, subject, to, plainTextContent, htmlContent, nil)
+}
+
+func (s *Extension) SendMailWithAttachments(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+	attachments []*nibbler.MailAttachment,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMessage(context.Background(), &nibbler.MailMessage{
+		From:             from,
+		Subject:          subject,
+		To:               to,
+		PlainTextContent: plainTextContent,
+		HtmlContent:      htmlContent,
+		Attachments:      attachments,
+	})
+}
+
+// SendMessage writes the message to a new .eml file.  As a .eml file has no envelope, bcc recipients are added as a
+// header so they can be inspected
+func (s *Extension) SendMessage(ctx context.Context, message *nibbler.MailMessage) (*nibbler.MailSendResponse, error) {
+	if s.Directory == "" {
+		return nil, errors.New("mail file extension was not initialized")
+	}
+
+	content, err := mail.Compose(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(message.Bcc) > 0 {
+		content = append([]byte("Bcc: "+mail.FormatAddressList(message.Bcc)+"\r\n"), content...)
+	}
+
+	// prefix with the time so a directory listing is in the order mail was sent
+	path := filepath.Join(s.Directory, time.Now().UTC().Format("20060102T150405.000000000")+"-"+uuid.New().String()+".eml")
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		return nil, err
+	}
+
+	s.Logger.Debug("wrote email \"" + message.Subject + "\" to " + path)
+	return &nibbler.MailSendResponse{StatusCode: 200, Body: path}, nil
+}
@@ -0,0 +1,41 @@
+package file
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtension_SendMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := Extension{Directory: dir}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.SendMail(
+		&nibbler.EmailAddress{Address: "support@example.com"},
+		"Hello",
+		[]*nibbler.EmailAddress{{Address: "bob@example.com"}},
+		"plain body",
+		"",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Fatal("an .eml file was not written")
+	}
+}
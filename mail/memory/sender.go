@@ -0,0 +1,120 @@
+package memory
+
+import (
+	"context"
+	"github.com/markdicksonjr/nibbler"
+	"sync"
+	"time"
+)
+
+// Message is a captured email
+type Message struct {
+	nibbler.MailMessage
+	SentAt time.Time
+}
+
+// Sender is a nibbler.MailSender (as well as a nibbler.AttachmentMailSender and nibbler.MessageSender) that captures
+// mail in memory instead of sending it, for making assertions in tests.  It is also an extension, so it can be put in
+// an app's extension list.  Set Err to make every send fail
+type Sender struct {
+	nibbler.NoOpExtension
+	Err error
+
+	messages []Message
+	mutex    sync.Mutex
+}
+
+func (s *Sender) GetName() string {
+	return "mail memory"
+}
+
+func (s *Sender) SendMail(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMailWithAttachments(from, subject, to, plainTextContent, htmlContent, nil)
+}
+
+func (s *Sender) SendMailWithAttachments(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+	attachments []*nibbler.MailAttachment,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMessage(context.Background(), &nibbler.MailMessage{
+		From:             from,
+		Subject:          subject,
+		To:               to,
+		PlainTextContent: plainTextContent,
+		HtmlContent:      htmlContent,
+		Attachments:      attachments,
+	})
+}
+
+func (s *Sender) SendMessage(ctx context.Context, message *nibbler.MailMessage) (*nibbler.MailSendResponse, error) {
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+
+	s.messages = append(s.messages, Message{
+		MailMessage: *message,
+		SentAt:      time.Now(),
+	})
+	return &nibbler.MailSendResponse{StatusCode: 200}, nil
+}
+
+// Messages returns a copy of everything captured so far, oldest first
+func (s *Sender) Messages() []Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make([]Message, len(s.messages))
+	copy(result, s.messages)
+	return result
+}
+
+// Last returns the most recently captured message, or nil if nothing has been sent
+func (s *Sender) Last() *Message {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.messages) == 0 {
+		return nil
+	}
+	m := s.messages[len(s.messages)-1]
+	return &m
+}
+
+// SentTo returns the captured messages that had the given address as a recipient (to, cc or bcc)
+func (s *Sender) SentTo(address string) []Message {
+	var result []Message
+	for _, m := range s.Messages() {
+		for _, r := range m.Recipients() {
+			if r.Address == address {
+				result = append(result, m)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Reset discards everything captured so far
+func (s *Sender) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = nil
+}
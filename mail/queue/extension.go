@@ -0,0 +1,314 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("mail queue is full")
+var ErrQueueClosed = errors.New("mail queue is closed")
+
+// Extension is a nibbler.MailSender (and nibbler.MessageSender) that queues mail for delivery by another
+// nibbler.MailSender.  Delivery happens on a pool of workers, with failed attempts retried with exponential backoff
+// until MaxAttempts is reached, at which point the job is moved to dead-letter storage.  Queued mail is flushed when
+// the app is destroyed, so list this extension after the extension that provides Sender
+type Extension struct {
+	nibbler.NoOpExtension
+
+	Sender nibbler.MailSender // the sender that does the actual delivery
+	Store  Store              // defaults to a MemoryStore - use a FileStore for mail to survive restarts
+
+	QueueSize       int           // defaults to 100
+	Workers         int           // defaults to 2
+	MaxAttempts     int           // defaults to 5
+	InitialBackoff  time.Duration // defaults to 5 seconds, doubled after each failed attempt
+	MaxBackoff      time.Duration // defaults to 10 minutes
+	ShutdownTimeout time.Duration // defaults to 30 seconds
+
+	// callbacks (for extending default behavior)
+	OnDeadLetter *func(job Job)
+
+	jobs    chan Job
+	retries map[string]*retry
+	closed  bool
+	mutex   sync.Mutex
+	workers sync.WaitGroup
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.Sender == nil {
+		return errors.New("mail queue extension requires a sender")
+	}
+
+	if s.Store == nil {
+		s.Store = &MemoryStore{}
+	}
+
+	if s.QueueSize <= 0 {
+		s.QueueSize = 100
+	}
+
+	if s.Workers <= 0 {
+		s.Workers = 2
+	}
+
+	if s.MaxAttempts <= 0 {
+		s.MaxAttempts = 5
+	}
+
+	if s.InitialBackoff <= 0 {
+		s.InitialBackoff = 5 * time.Second
+	}
+
+	if s.MaxBackoff <= 0 {
+		s.MaxBackoff = 10 * time.Minute
+	}
+
+	if s.ShutdownTimeout <= 0 {
+		s.ShutdownTimeout = 30 * time.Second
+	}
+
+	s.jobs = make(chan Job, s.QueueSize)
+	s.retries = make(map[string]*retry)
+	s.closed = false
+
+	for i := 0; i < s.Workers; i++ {
+		s.workers.Add(1)
+		go s.work()
+	}
+
+	// resume any jobs that were persisted before the last shutdown
+	pending, err := s.Store.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range pending {
+		s.scheduleRetry(job, 0)
+	}
+
+	if len(pending) > 0 {
+		s.Logger.Info("resuming " + strconv.Itoa(len(pending)) + " queued emails")
+	}
+
+	return nil
+}
+
+// Destroy stops accepting mail and waits (up to ShutdownTimeout) for the queued mail to be delivered.  Jobs waiting
+// on a retry are attempted once more rather than waiting out their backoff - any that fail again, or that can't be
+// handed to the workers in time, are left in the store
+func (s *Extension) Destroy(app *nibbler.Application) error {
+	s.mutex.Lock()
+	if s.closed || s.jobs == nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+
+	var waiting []Job
+	for id, r := range s.retries {
+		if r.timer.Stop() {
+			waiting = append(waiting, r.job)
+		}
+		delete(s.retries, id)
+	}
+	s.mutex.Unlock()
+
+	timeout := time.NewTimer(s.ShutdownTimeout)
+	defer timeout.Stop()
+
+	// nothing else can queue jobs once closed, so the workers (which are still running) can be handed the jobs that
+	// were waiting, without holding the lock they need to report failures.  Workers stuck on a slow Sender may not
+	// take them all before the deadline
+	for i, job := range waiting {
+		select {
+		case s.jobs <- job:
+		case <-timeout.C:
+			close(s.jobs)
+			s.Logger.Warn("left " + strconv.Itoa(len(waiting)-i) + " emails waiting on a retry in the mail queue store")
+			return errors.New("timed out while flushing mail queue")
+		}
+	}
+	close(s.jobs)
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-timeout.C:
+		return errors.New("timed out while flushing mail queue")
+	}
+}
+
+func (s *Extension) GetName() string {
+	return "mail queue"
+}
+
+// SendMail queues the email for delivery.  The response has a status code of 202 (accepted) - delivery results are
+// only visible through logs, the store and OnDeadLetter
+func (s *Extension) SendMail(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMessage(context.Background(), &nibbler.MailMessage{
+		From:             from,
+		Subject:          subject,
+		To:               to,
+		PlainTextContent: plainTextContent,
+		HtmlContent:      htmlContent,
+	})
+}
+
+// SendMessage queues the message for delivery, in the same way as SendMail.  The message is delivered with Sender's
+// SendMessage if it has one, otherwise with the adapter from nibbler.ToMessageSender
+func (s *Extension) SendMessage(ctx context.Context, message *nibbler.MailMessage) (*nibbler.MailSendResponse, error) {
+	if err := message.Validate(); err != nil {
+		return nil, err
+	}
+
+	job := Job{
+		ID:        uuid.New().String(),
+		CreatedAt: time.Now(),
+		Message:   message,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.jobs == nil {
+		return nil, ErrQueueClosed
+	}
+
+	if err := s.Store.Save(job); err != nil {
+		return nil, err
+	}
+
+	select {
+	case s.jobs <- job:
+	default:
+		if err := s.Store.Delete(job.ID); err != nil {
+			s.Logger.Error("while removing rejected job " + job.ID + " from mail queue store, error = " + err.Error())
+		}
+		return nil, ErrQueueFull
+	}
+
+	return &nibbler.MailSendResponse{StatusCode: http.StatusAccepted}, nil
+}
+
+// QueuesMail marks the queue as a nibbler.QueueingMailSender, so extensions hand it mail during the request
+func (s *Extension) QueuesMail() bool {
+	return true
+}
+
+// GetDeadLetters lists the jobs that could not be delivered
+func (s *Extension) GetDeadLetters() ([]Job, error) {
+	return s.Store.DeadLetters()
+}
+
+func (s *Extension) work() {
+	defer s.workers.Done()
+	for job := range s.jobs {
+		s.attempt(job)
+	}
+}
+
+func (s *Extension) attempt(job Job) {
+	now := time.Now()
+	job.Attempts++
+	job.LastAttemptAt = &now
+
+	_, err := nibbler.ToMessageSender(s.Sender).SendMessage(context.Background(), job.Message)
+	if err == nil {
+		if err := s.Store.Delete(job.ID); err != nil {
+			s.Logger.Error("while removing delivered job " + job.ID + " from mail queue store, error = " + err.Error())
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+
+	// if we're out of attempts (or retrying can't help), move the job to dead-letter storage
+	if job.Attempts >= s.MaxAttempts || err == nibbler.ErrMailFeatureNotSupported {
+		s.Logger.Error("giving up on mail job " + job.ID + " after " + strconv.Itoa(job.Attempts) + " attempts, error = " + err.Error())
+		if err := s.Store.DeadLetter(job); err != nil {
+			s.Logger.Error("while dead-lettering mail job " + job.ID + ", error = " + err.Error())
+		}
+
+		if s.OnDeadLetter != nil {
+			(*s.OnDeadLetter)(job)
+		}
+		return
+	}
+
+	s.Logger.Warn("mail job " + job.ID + " failed on attempt " + strconv.Itoa(job.Attempts) + ", error = " + err.Error())
+	if err := s.Store.Save(job); err != nil {
+		s.Logger.Error("while saving failed job " + job.ID + " to mail queue store, error = " + err.Error())
+	}
+
+	s.scheduleRetry(job, s.backoff(job.Attempts))
+}
+
+// backoff computes the delay before the next attempt, given how many attempts have been made
+func (s *Extension) backoff(attempts int) time.Duration {
+	delay := s.InitialBackoff
+	for i := 1; i < attempts && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > s.MaxBackoff {
+		return s.MaxBackoff
+	}
+	return delay
+}
+
+// retry is a job waiting for its next attempt
+type retry struct {
+	timer *time.Timer
+	job   Job
+}
+
+// scheduleRetry puts the job back on the queue after the delay - if the queue is full at that point, it tries again
+// after another InitialBackoff
+func (s *Extension) scheduleRetry(job Job, delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.retries[job.ID] = &retry{job: job, timer: time.AfterFunc(delay, func() {
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return
+		}
+		delete(s.retries, job.ID)
+
+		select {
+		case s.jobs <- job:
+			s.mutex.Unlock()
+		default:
+			s.mutex.Unlock()
+			s.scheduleRetry(job, s.InitialBackoff)
+		}
+	})}
+}
@@ -0,0 +1,292 @@
+package queue
+
+import (
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flakySender struct {
+	failuresLeft int
+	sent         int
+	delivered    chan struct{} // signalled (if not nil) when an email is delivered
+	mutex        sync.Mutex
+}
+
+func (f *flakySender) SendMail(from *nibbler.EmailAddress, subject string, to []*nibbler.EmailAddress, plainTextContent string, htmlContent string) (*nibbler.MailSendResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failuresLeft > 0 {
+		f.failuresLeft--
+		return nil, errors.New("mail server unavailable")
+	}
+	f.sent++
+	if f.delivered != nil {
+		f.delivered <- struct{}{}
+	}
+	return &nibbler.MailSendResponse{StatusCode: 200}, nil
+}
+
+func TestImplements(t *testing.T) {
+	e := Extension{}
+	var base nibbler.Extension = &e
+	var sender nibbler.MailSender = &e
+	if base == nil || sender == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+func TestExtension_RetriesUntilDelivered(t *testing.T) {
+	sender := &flakySender{failuresLeft: 2, delivered: make(chan struct{}, 1)}
+	e := Extension{
+		Sender:         sender,
+		InitialBackoff: time.Millisecond,
+	}
+
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.SendMail(&nibbler.EmailAddress{Address: "a@example.com"}, "hi", []*nibbler.EmailAddress{{Address: "b@example.com"}}, "hi", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the retries to deliver it, then flush
+	select {
+	case <-sender.delivered:
+	case <-time.After(time.Second):
+		t.Fatal("the email was never delivered")
+	}
+
+	if err := e.Destroy(&nibbler.Application{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if sender.sent != 1 {
+		t.Fatal("the email was not delivered after retrying")
+	}
+
+	if pending, _ := e.Store.Pending(); len(pending) != 0 {
+		t.Fatal("a delivered job was left in the store")
+	}
+
+	if _, err := e.SendMail(&nibbler.EmailAddress{Address: "a@example.com"}, "hi", []*nibbler.EmailAddress{{Address: "b@example.com"}}, "hi", ""); err != ErrQueueClosed {
+		t.Fatal("mail was accepted after the queue was destroyed")
+	}
+}
+
+func TestExtension_DeadLetter(t *testing.T) {
+	sender := &flakySender{failuresLeft: 100}
+	deadLettered := make(chan Job, 1)
+	onDeadLetter := func(job Job) {
+		deadLettered <- job
+	}
+
+	e := Extension{
+		Sender:         sender,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		OnDeadLetter:   &onDeadLetter,
+	}
+
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.SendMail(&nibbler.EmailAddress{Address: "a@example.com"}, "hi", []*nibbler.EmailAddress{{Address: "b@example.com"}}, "hi", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case job := <-deadLettered:
+		if job.Attempts != 3 || job.LastError != "mail server unavailable" {
+			t.Fatal("the dead-lettered job has the wrong attempt count or error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the job was never dead-lettered")
+	}
+
+	if dead, _ := e.GetDeadLetters(); len(dead) != 1 {
+		t.Fatal("the job is not in dead-letter storage")
+	}
+
+	e.Destroy(&nibbler.Application{})
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := FileStore{Directory: dir}
+	if err := store.Save(Job{ID: "1", Message: &nibbler.MailMessage{Subject: "first"}, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(Job{ID: "2", Message: &nibbler.MailMessage{Subject: "second"}, CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeadLetter(Job{ID: "1", Message: &nibbler.MailMessage{Subject: "first"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := store.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Message.Subject != "second" {
+		t.Fatal("the wrong jobs are pending")
+	}
+
+	dead, err := store.DeadLetters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].ID != "1" {
+		t.Fatal("the wrong jobs are dead-lettered")
+	}
+}
+
+func TestExtension_DestroyFlushesRetries(t *testing.T) {
+	sender := &flakySender{failuresLeft: 1}
+	e := Extension{
+		Sender:         sender,
+		InitialBackoff: time.Hour,
+	}
+
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.SendMail(&nibbler.EmailAddress{Address: "a@example.com"}, "hi", []*nibbler.EmailAddress{{Address: "b@example.com"}}, "hi", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the first attempt to fail, leaving the job waiting an hour for its retry
+	for i := 0; i < 100; i++ {
+		if pending, _ := e.Store.Pending(); len(pending) == 1 && pending[0].Attempts == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := e.Destroy(&nibbler.Application{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if sender.sent != 1 {
+		t.Fatal("the job waiting on a retry was not delivered at shutdown")
+	}
+
+	if pending, _ := e.Store.Pending(); len(pending) != 0 {
+		t.Fatal("a delivered job was left in the store")
+	}
+}
+
+func TestExtension_QueuesMail(t *testing.T) {
+	if !nibbler.IsQueueingMailSender(&Extension{}) {
+		t.Fatal("the queue is not a queueing mail sender")
+	}
+
+	if nibbler.IsQueueingMailSender(&flakySender{}) {
+		t.Fatal("a plain sender was taken for a queueing mail sender")
+	}
+}
+
+// stuckSender fails the first failuresLeft emails, then blocks on the rest until released
+type stuckSender struct {
+	failuresLeft int
+	stuck        chan struct{}
+	release      chan struct{}
+	mutex        sync.Mutex
+}
+
+func (f *stuckSender) SendMail(from *nibbler.EmailAddress, subject string, to []*nibbler.EmailAddress, plainTextContent string, htmlContent string) (*nibbler.MailSendResponse, error) {
+	f.mutex.Lock()
+	if f.failuresLeft > 0 {
+		f.failuresLeft--
+		f.mutex.Unlock()
+		return nil, errors.New("mail server unavailable")
+	}
+	f.mutex.Unlock()
+
+	f.stuck <- struct{}{}
+	<-f.release
+	return &nibbler.MailSendResponse{StatusCode: 200}, nil
+}
+
+// failedOnce counts the pending jobs that have had a (failed) attempt
+func failedOnce(store Store) int {
+	pending, _ := store.Pending()
+	count := 0
+	for _, job := range pending {
+		if job.Attempts == 1 {
+			count++
+		}
+	}
+	return count
+}
+
+func TestExtension_DestroyDoesNotHangOnStuckWorkers(t *testing.T) {
+	sender := &stuckSender{failuresLeft: 2, stuck: make(chan struct{}, 1), release: make(chan struct{})}
+	defer close(sender.release)
+
+	e := Extension{
+		Sender:          sender,
+		Workers:         1,
+		QueueSize:       1,
+		InitialBackoff:  time.Hour,
+		ShutdownTimeout: 50 * time.Millisecond,
+	}
+
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// two jobs fail once, and wait an hour for their retries
+	for i := 1; i <= 2; i++ {
+		if _, err := e.SendMail(&nibbler.EmailAddress{Address: "a@example.com"}, "hi", []*nibbler.EmailAddress{{Address: "b@example.com"}}, "hi", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 100 && failedOnce(e.Store) < i; j++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// the only worker gets stuck on a third, so only one waiting job fits in the queue at shutdown
+	if _, err := e.SendMail(&nibbler.EmailAddress{Address: "a@example.com"}, "hi", []*nibbler.EmailAddress{{Address: "b@example.com"}}, "hi", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-sender.stuck:
+	case <-time.After(time.Second):
+		t.Fatal("the worker never started sending")
+	}
+
+	destroyed := make(chan error, 1)
+	go func() {
+		destroyed <- e.Destroy(&nibbler.Application{})
+	}()
+
+	select {
+	case err := <-destroyed:
+		if err == nil {
+			t.Fatal("a shutdown that left mail behind reported no error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("shutdown hung on a stuck worker")
+	}
+
+	if pending, _ := e.Store.Pending(); len(pending) != 3 {
+		t.Fatal("undelivered jobs were not left in the store")
+	}
+}
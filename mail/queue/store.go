@@ -0,0 +1,188 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job is a single email waiting to be delivered (or, once in dead-letter storage, one that could not be)
+type Job struct {
+	ID            string               `json:"id"`
+	CreatedAt     time.Time            `json:"createdAt"`
+	Message       *nibbler.MailMessage `json:"message"`
+	Attempts      int                  `json:"attempts"`
+	LastError     string               `json:"lastError,omitempty"`
+	LastAttemptAt *time.Time           `json:"lastAttemptAt,omitempty"`
+}
+
+// Store persists jobs so that they survive restarts and so that failed jobs can be inspected.  Save is called when a
+// job is accepted and after every failed attempt, Delete when a job is delivered, and DeadLetter when a job has used
+// up all of its attempts (it should no longer be returned by Pending after that)
+type Store interface {
+	Save(job Job) error
+	Delete(id string) error
+	Pending() ([]Job, error)
+	DeadLetter(job Job) error
+	DeadLetters() ([]Job, error)
+}
+
+// MemoryStore keeps jobs in memory - pending jobs are lost on restart, but dead letters can still be inspected while
+// the app is running
+type MemoryStore struct {
+	pending map[string]Job
+	dead    map[string]Job
+	mutex   sync.Mutex
+}
+
+func (m *MemoryStore) Save(job Job) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.pending == nil {
+		m.pending = make(map[string]Job)
+	}
+	m.pending[job.ID] = job
+	return nil
+}
+
+func (m *MemoryStore) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.pending, id)
+	return nil
+}
+
+func (m *MemoryStore) Pending() ([]Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return sortedJobs(m.pending), nil
+}
+
+func (m *MemoryStore) DeadLetter(job Job) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.dead == nil {
+		m.dead = make(map[string]Job)
+	}
+	delete(m.pending, job.ID)
+	m.dead[job.ID] = job
+	return nil
+}
+
+func (m *MemoryStore) DeadLetters() ([]Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return sortedJobs(m.dead), nil
+}
+
+// FileStore keeps each job as a JSON file, in "pending" and "dead" subdirectories of Directory
+type FileStore struct {
+	Directory string
+}
+
+func (f *FileStore) Save(job Job) error {
+	return writeJobFile(filepath.Join(f.Directory, "pending"), job)
+}
+
+func (f *FileStore) Delete(id string) error {
+	if err := os.Remove(jobFilePath(filepath.Join(f.Directory, "pending"), id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *FileStore) Pending() ([]Job, error) {
+	return readJobFiles(filepath.Join(f.Directory, "pending"))
+}
+
+func (f *FileStore) DeadLetter(job Job) error {
+	if err := writeJobFile(filepath.Join(f.Directory, "dead"), job); err != nil {
+		return err
+	}
+	return f.Delete(job.ID)
+}
+
+func (f *FileStore) DeadLetters() ([]Job, error) {
+	return readJobFiles(filepath.Join(f.Directory, "dead"))
+}
+
+func jobFilePath(directory string, id string) string {
+	return filepath.Join(directory, id+".json")
+}
+
+// writeJobFile writes to a temp file and renames it, so a crash never leaves a partially-written job behind
+func writeJobFile(directory string, job Job) error {
+	if job.ID == "" || strings.ContainsAny(job.ID, `/\`) {
+		return errors.New("invalid mail job ID")
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return err
+	}
+
+	jobBytes, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	tempPath := jobFilePath(directory, job.ID) + ".tmp"
+	if err := ioutil.WriteFile(tempPath, jobBytes, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, jobFilePath(directory, job.ID))
+}
+
+func readJobFiles(directory string) ([]Job, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	jobs := make(map[string]Job)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		jobBytes, err := ioutil.ReadFile(filepath.Join(directory, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		job := Job{}
+		if err := json.Unmarshal(jobBytes, &job); err != nil {
+			return nil, err
+		}
+		jobs[job.ID] = job
+	}
+
+	return sortedJobs(jobs), nil
+}
+
+// sortedJobs returns the jobs oldest-first, so they are resumed in the order they were accepted
+func sortedJobs(jobs map[string]Job) []Job {
+	result := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		result = append(result, j)
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].CreatedAt.Before(result[b].CreatedAt)
+	})
+	return result
+}
@@ -0,0 +1,47 @@
+package smtp
+
+import (
+	"errors"
+	netsmtp "net/smtp"
+	"strings"
+)
+
+// loginAuth implements the (non-standard, but widely used) LOGIN mechanism.  Like net/smtp's PlainAuth, it refuses
+// to send credentials over an unencrypted connection to anything but localhost
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *netsmtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.Contains(prompt, "username"):
+		return []byte(a.username), nil
+	case strings.Contains(prompt, "password"):
+		return []byte(a.password), nil
+	}
+
+	return nil, errors.New("unexpected LOGIN prompt from smtp server: " + string(fromServer))
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
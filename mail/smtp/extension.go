@@ -0,0 +1,265 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail"
+	"net"
+	netsmtp "net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how the connection to the SMTP server is secured
+const (
+	SecurityStartTLS = "starttls" // upgrade a plain connection with STARTTLS (required, not opportunistic)
+	SecurityTLS      = "tls"      // implicit TLS from the start of the connection (usually port 465)
+	SecurityNone     = "none"     // no TLS at all - only suitable for local relays
+)
+
+// supported authentication mechanisms
+const (
+	AuthPlain = "plain"
+	AuthLogin = "login"
+)
+
+// Extension is a nibbler.MailSender (as well as a nibbler.AttachmentMailSender and nibbler.MessageSender) that
+// delivers mail to an SMTP server.  Any field that isn't set is read from configuration in Init (e.g. SMTP_HOST or
+// smtp.host in JSON)
+type Extension struct {
+	nibbler.NoOpExtension
+
+	Host          string
+	Port          int    // defaults to 465 with SecurityTLS, otherwise 587
+	Username      string // if blank, no authentication is attempted
+	Password      string
+	Security      string // defaults to SecurityStartTLS
+	AuthMechanism string // defaults to AuthPlain
+	LocalName     string // the name sent with HELO/EHLO, defaults to "localhost"
+	Timeout       time.Duration
+	TLSConfig     *tls.Config // defaults to verifying the certificate against Host
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if app.Config != nil && app.Config.Raw != nil {
+		raw := app.Config.Raw
+		if s.Host == "" {
+			s.Host = raw.Get("smtp", "host").String("")
+		}
+		if s.Port == 0 {
+			s.Port = raw.Get("smtp", "port").Int(0)
+		}
+		if s.Username == "" {
+			s.Username = raw.Get("smtp", "username").String("")
+		}
+		if s.Password == "" {
+			s.Password = raw.Get("smtp", "password").String("")
+		}
+		if s.Security == "" {
+			s.Security = raw.Get("smtp", "security").String("")
+		}
+		if s.AuthMechanism == "" {
+			s.AuthMechanism = raw.Get("smtp", "auth").String("")
+		}
+	}
+
+	if s.Host == "" {
+		return errors.New("smtp extension requires a host")
+	}
+
+	s.Security = strings.ToLower(s.Security)
+	if s.Security == "" {
+		s.Security = SecurityStartTLS
+	} else if s.Security != SecurityStartTLS && s.Security != SecurityTLS && s.Security != SecurityNone {
+		return errors.New("smtp extension was given unknown security mode " + s.Security)
+	}
+
+	s.AuthMechanism = strings.ToLower(s.AuthMechanism)
+	if s.AuthMechanism == "" {
+		s.AuthMechanism = AuthPlain
+	} else if s.AuthMechanism != AuthPlain && s.AuthMechanism != AuthLogin {
+		return errors.New("smtp extension was given unknown auth mechanism " + s.AuthMechanism)
+	}
+
+	if s.Port == 0 {
+		if s.Security == SecurityTLS {
+			s.Port = 465
+		} else {
+			s.Port = 587
+		}
+	}
+
+	if s.LocalName == "" {
+		s.LocalName = "localhost"
+	}
+
+	if s.Timeout == 0 {
+		s.Timeout = 30 * time.Second
+	}
+
+	if s.TLSConfig == nil {
+		s.TLSConfig = &tls.Config{ServerName: s.Host}
+	}
+
+	return nil
+}
+
+func (s *Extension) GetName() string {
+	return "smtp"
+}
+
+func (s *Extension) SendMail(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMailWithAttachments(from, subject, to, plainTextContent, htmlContent, nil)
+}
+
+func (s *Extension) SendMailWithAttachments(
+	from *nibbler.EmailAddress,
+	subject string,
+	to []*nibbler.EmailAddress,
+	plainTextContent string,
+	htmlContent string,
+	attachments []*nibbler.MailAttachment,
+) (*nibbler.MailSendResponse, error) {
+	return s.SendMessage(context.Background(), &nibbler.MailMessage{
+		From:             from,
+		Subject:          subject,
+		To:               to,
+		PlainTextContent: plainTextContent,
+		HtmlContent:      htmlContent,
+		Attachments:      attachments,
+	})
+}
+
+// SendMessage delivers the message to all of its recipients (including bcc) in a single SMTP transaction
+func (s *Extension) SendMessage(ctx context.Context, message *nibbler.MailMessage) (*nibbler.MailSendResponse, error) {
+	content, err := mail.Compose(message)
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []string
+	for _, r := range message.Recipients() {
+		recipients = append(recipients, r.Address)
+	}
+
+	if err := s.deliver(ctx, message.From.Address, recipients, content); err != nil {
+		return nil, err
+	}
+
+	return &nibbler.MailSendResponse{StatusCode: 250}, nil
+}
+
+// deliver runs a single SMTP transaction for the message
+func (s *Extension) deliver(ctx context.Context, from string, recipients []string, message []byte) error {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if s.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("smtp server does not support authentication")
+		}
+
+		if err := client.Auth(s.auth()); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+
+	for _, r := range recipients {
+		if err := client.Rcpt(r); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// connect dials the server and secures the connection (according to Security)
+func (s *Extension) connect(ctx context.Context) (*netsmtp.Client, error) {
+	address := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	dialer := &net.Dialer{Timeout: s.Timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.Security == SecurityTLS {
+		conn = tls.Client(conn, s.TLSConfig)
+	}
+
+	// bound the whole transaction, not just the dial (and respect any earlier deadline on the context)
+	deadline := time.Now().Add(s.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	client, err := netsmtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := client.Hello(s.LocalName); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if s.Security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, errors.New("smtp server does not support STARTTLS")
+		}
+
+		if err := client.StartTLS(s.TLSConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (s *Extension) auth() netsmtp.Auth {
+	if s.AuthMechanism == AuthLogin {
+		return &loginAuth{username: s.Username, password: s.Password, host: s.Host}
+	}
+	return netsmtp.PlainAuth("", s.Username, s.Password, s.Host)
+}
@@ -0,0 +1,123 @@
+package smtp
+
+import (
+	"bufio"
+	"github.com/markdicksonjr/nibbler"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestImplements(t *testing.T) {
+	e := Extension{}
+	var base nibbler.Extension = &e
+	var sender nibbler.AttachmentMailSender = &e
+	if base == nil || sender == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+func TestExtension_InitRequiresHost(t *testing.T) {
+	e := Extension{}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err == nil {
+		t.Fatal("init succeeded without a host")
+	}
+}
+
+// serveOnce plays the part of a very simple SMTP server for one transaction, sending the commands it received on the
+// returned channel once the client quits
+func serveOnce(t *testing.T, listener net.Listener) chan []string {
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		write := func(line string) {
+			conn.Write([]byte(line + "\r\n"))
+		}
+
+		var commands []string
+		write("220 localhost ESMTP")
+		inData := false
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				received <- commands
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+
+			if inData {
+				if line == "." {
+					inData = false
+					write("250 queued")
+				} else {
+					commands = append(commands, "DATA: "+line)
+				}
+				continue
+			}
+
+			commands = append(commands, line)
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				write("250 localhost")
+			case line == "DATA":
+				inData = true
+				write("354 go ahead")
+			case line == "QUIT":
+				write("221 bye")
+				received <- commands
+				return
+			default:
+				write("250 ok")
+			}
+		}
+	}()
+	return received
+}
+
+func TestExtension_SendMail(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := serveOnce(t, listener)
+
+	e := Extension{
+		Host:     "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Security: SecurityNone,
+	}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.SendMail(
+		&nibbler.EmailAddress{Address: "support@example.com"},
+		"Hello",
+		[]*nibbler.EmailAddress{{Address: "bob@example.com"}, {Address: "sue@example.com"}},
+		"plain body",
+		"",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := strings.Join(<-received, "\n")
+	for _, expected := range []string{
+		"MAIL FROM:<support@example.com>",
+		"RCPT TO:<bob@example.com>",
+		"RCPT TO:<sue@example.com>",
+		"DATA: Subject: Hello",
+		"DATA: plain body",
+	} {
+		if !strings.Contains(commands, expected) {
+			t.Fatal("the smtp server did not receive " + expected)
+		}
+	}
+}
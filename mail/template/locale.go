@@ -0,0 +1,97 @@
+package template
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NormalizeLocale lower-cases a locale and uses "-" as its separator, so "en_US" and "en-us" are treated the same
+func NormalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// ParseAcceptLanguage returns the locales in an Accept-Language header value, most preferred first.  Wildcards and
+// locales with a quality of zero are dropped
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale  string
+		quality float64
+	}
+
+	var list []weighted
+	for _, part := range strings.Split(header, ",") {
+		pieces := strings.Split(strings.TrimSpace(part), ";")
+		locale := NormalizeLocale(pieces[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, p := range pieces[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(p, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			list = append(list, weighted{locale: locale, quality: quality})
+		}
+	}
+
+	sort.SliceStable(list, func(a, b int) bool {
+		return list[a].quality > list[b].quality
+	})
+
+	var result []string
+	for _, w := range list {
+		result = append(result, w.locale)
+	}
+	return result
+}
+
+// LocalesForRequest returns the preferred locales for an email triggered by a request - the user's locale (if known)
+// comes first, followed by whatever the request's Accept-Language header asks for
+func LocalesForRequest(r *http.Request, userLocale string) []string {
+	var result []string
+	if userLocale != "" {
+		result = append(result, NormalizeLocale(userLocale))
+	}
+
+	if r != nil {
+		result = append(result, ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+	}
+	return result
+}
+
+// candidateLocales expands the requested locales into the order in which variants are tried: each locale followed by
+// its base language, then the default locale, then the variant with no locale
+func candidateLocales(locales []string, defaultLocale string) []string {
+	seen := make(map[string]bool)
+	var result []string
+
+	add := func(locale string) {
+		if !seen[locale] {
+			seen[locale] = true
+			result = append(result, locale)
+		}
+	}
+
+	for _, l := range append(locales, defaultLocale) {
+		l = NormalizeLocale(l)
+		if l == "" {
+			continue
+		}
+		add(l)
+		if i := strings.Index(l, "-"); i > 0 {
+			add(l[:i])
+		}
+	}
+
+	add("")
+	return result
+}
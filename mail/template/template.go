@@ -0,0 +1,226 @@
+package template
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+const subjectSuffix = ".subject.txt"
+const textSuffix = ".txt"
+const htmlSuffix = ".html"
+
+//go:embed defaults
+var defaultFiles embed.FS
+
+// Data is what is made available to every email template.  User should be a "safe" user (see user.GetSafeUser), as
+// anything on it can end up in an email
+type Data struct {
+	User   *nibbler.User
+	Name   string
+	Link   string
+	Values map[string]interface{}
+}
+
+// Rendered is the result of rendering a template, ready to be handed to a nibbler.MailSender
+type Rendered struct {
+	Subject          string
+	PlainTextContent string
+	HtmlContent      string
+}
+
+// Set is a collection of email templates, keyed by name and locale.  Files are named "<name>.subject.txt",
+// "<name>.txt" and "<name>.html" for the default variant, and "<name>.<locale>.subject.txt" (etc) for a locale
+// variant, e.g. "password-reset.fr.subject.txt".  Each variant needs a subject and at least one body
+type Set struct {
+	DefaultLocale string
+	Fallback      *Set // consulted when this set has no variant of a template at all (e.g. Default())
+
+	templates map[string]map[string]*variant
+}
+
+type variant struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// Default returns the built-in templates used by the local auth extension and group invitations
+func Default() *Set {
+	sub, err := fs.Sub(defaultFiles, "defaults")
+	if err != nil {
+		panic(err)
+	}
+
+	set, err := Load(sub)
+	if err != nil {
+		panic(err)
+	}
+	return set
+}
+
+// LoadDirectory loads every template file in the given directory
+func LoadDirectory(path string) (*Set, error) {
+	return Load(os.DirFS(path))
+}
+
+// Load parses every template file at the root of the provided file system (which can be an embed.FS)
+func Load(fsys fs.FS) (*Set, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	set := &Set{
+		templates: make(map[string]map[string]*variant),
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		name, locale, kind := parseFileName(e.Name())
+		if name == "" {
+			continue
+		}
+
+		content, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		v := set.getOrCreateVariant(name, locale)
+		switch kind {
+		case subjectSuffix:
+			v.subject, err = texttemplate.New(e.Name()).Parse(string(content))
+		case textSuffix:
+			v.text, err = texttemplate.New(e.Name()).Parse(string(content))
+		case htmlSuffix:
+			v.html, err = htmltemplate.New(e.Name()).Parse(string(content))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// validate that each variant can actually produce an email
+	for name, locales := range set.templates {
+		for locale, v := range locales {
+			if v.subject == nil {
+				return nil, errors.New("email template " + name + " (locale \"" + locale + "\") has no subject")
+			}
+			if v.text == nil && v.html == nil {
+				return nil, errors.New("email template " + name + " (locale \"" + locale + "\") has no body")
+			}
+		}
+	}
+
+	return set, nil
+}
+
+// Has states whether this set (or its fallback) has any variant of the named template
+func (s *Set) Has(name string) bool {
+	if _, ok := s.templates[name]; ok {
+		return true
+	}
+	return s.Fallback != nil && s.Fallback.Has(name)
+}
+
+// Render renders the named template in the first of the given locales that has a variant, trying the base language
+// of each locale (e.g. "fr" for "fr-CA"), then DefaultLocale, then the variant with no locale
+func (s *Set) Render(name string, locales []string, data Data) (*Rendered, error) {
+	variants, ok := s.templates[name]
+	if !ok {
+		if s.Fallback != nil {
+			return s.Fallback.Render(name, locales, data)
+		}
+		return nil, errors.New("email template " + name + " was not found")
+	}
+
+	v := s.pickVariant(variants, candidateLocales(locales, s.DefaultLocale))
+	if v == nil {
+		return nil, errors.New("email template " + name + " has no variant for the requested locales")
+	}
+
+	return v.render(data)
+}
+
+func (s *Set) pickVariant(variants map[string]*variant, candidates []string) *variant {
+	for _, c := range candidates {
+		if v, ok := variants[c]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *Set) getOrCreateVariant(name, locale string) *variant {
+	locales, ok := s.templates[name]
+	if !ok {
+		locales = make(map[string]*variant)
+		s.templates[name] = locales
+	}
+
+	v, ok := locales[locale]
+	if !ok {
+		v = &variant{}
+		locales[locale] = v
+	}
+	return v
+}
+
+func (v *variant) render(data Data) (*Rendered, error) {
+	result := Rendered{}
+
+	buf := bytes.Buffer{}
+	if err := v.subject.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	result.Subject = strings.TrimSpace(buf.String())
+
+	if v.text != nil {
+		buf.Reset()
+		if err := v.text.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		result.PlainTextContent = buf.String()
+	}
+
+	if v.html != nil {
+		buf.Reset()
+		if err := v.html.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		result.HtmlContent = buf.String()
+	}
+
+	return &result, nil
+}
+
+// parseFileName splits something like "password-reset.fr-ca.subject.txt" into its name, locale and kind (suffix)
+func parseFileName(fileName string) (name string, locale string, kind string) {
+	for _, suffix := range []string{subjectSuffix, htmlSuffix, textSuffix} {
+		if strings.HasSuffix(fileName, suffix) {
+			kind = suffix
+			break
+		}
+	}
+
+	if kind == "" {
+		return "", "", ""
+	}
+
+	base := strings.TrimSuffix(fileName, kind)
+	if i := strings.Index(base, "."); i >= 0 {
+		return base[:i], NormalizeLocale(base[i+1:]), kind
+	}
+	return base, "", kind
+}
@@ -0,0 +1,71 @@
+package template
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestDefault(t *testing.T) {
+	set := Default()
+	if !set.Has("password-reset") || !set.Has("email-verification") {
+		t.Fatal("default templates are missing")
+	}
+
+	result, err := set.Render("password-reset", nil, Data{Link: "https://example.com/?token=a&b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Subject != "Password Reset" {
+		t.Fatal("unexpected subject " + result.Subject)
+	}
+
+	if result.PlainTextContent != "Please go to https://example.com/?token=a&b to reset your password\n" {
+		t.Fatal("unexpected plain text content " + result.PlainTextContent)
+	}
+
+	if result.HtmlContent != "Please go to <a href=\"https://example.com/?token=a&amp;b\">https://example.com/?token=a&amp;b</a> to reset your password\n" {
+		t.Fatal("unexpected html content " + result.HtmlContent)
+	}
+}
+
+func TestSet_RenderLocale(t *testing.T) {
+	set, err := Load(fstest.MapFS{
+		"welcome.subject.txt":    {Data: []byte("Welcome")},
+		"welcome.txt":            {Data: []byte("Hi {{.Name}}")},
+		"welcome.fr.subject.txt": {Data: []byte("Bienvenue")},
+		"welcome.fr.txt":         {Data: []byte("Salut {{.Name}}")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Fallback = Default()
+
+	result, err := set.Render("welcome", ParseAcceptLanguage("de;q=0.5, fr-CA, en;q=0.8"), Data{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Subject != "Bienvenue" || result.PlainTextContent != "Salut Bob" {
+		t.Fatal("the french variant was not chosen for fr-CA")
+	}
+
+	result, err = set.Render("welcome", []string{"de"}, Data{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Subject != "Welcome" {
+		t.Fatal("the default variant was not chosen for an unknown locale")
+	}
+
+	if _, err := set.Render("email-verification", []string{"fr"}, Data{}); err != nil {
+		t.Fatal("the fallback set was not used for a missing template")
+	}
+}
+
+func TestLoad_MissingSubject(t *testing.T) {
+	if _, err := Load(fstest.MapFS{
+		"welcome.txt": {Data: []byte("Hi")},
+	}); err == nil {
+		t.Fatal("a template without a subject was loaded without error")
+	}
+}
@@ -0,0 +1,45 @@
+package nibbler
+
+import (
+	"context"
+	"testing"
+)
+
+type recordingMailSender struct {
+	sent [][]*EmailAddress
+}
+
+func (r *recordingMailSender) SendMail(from *EmailAddress, subject string, to []*EmailAddress, plainTextContent string, htmlContent string) (*MailSendResponse, error) {
+	r.sent = append(r.sent, to)
+	return &MailSendResponse{StatusCode: 200}, nil
+}
+
+func TestToMessageSender_Adapter(t *testing.T) {
+	sender := &recordingMailSender{}
+	_, err := ToMessageSender(sender).SendMessage(context.Background(), &MailMessage{
+		From: &EmailAddress{Address: "support@example.com"},
+		To:   []*EmailAddress{{Address: "bob@example.com"}},
+		Cc:   []*EmailAddress{{Address: "sue@example.com"}},
+		Bcc:  []*EmailAddress{{Address: "audit@example.com"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sender.sent) != 2 || len(sender.sent[0]) != 2 || sender.sent[1][0].Address != "audit@example.com" {
+		t.Fatal("the adapter did not send to cc recipients with to recipients, and bcc recipients separately")
+	}
+}
+
+func TestToMessageSender_AdapterUnsupported(t *testing.T) {
+	_, err := ToMessageSender(&recordingMailSender{}).SendMessage(context.Background(), &MailMessage{
+		From:        &EmailAddress{Address: "support@example.com"},
+		To:          []*EmailAddress{{Address: "bob@example.com"}},
+		Attachments: []*MailAttachment{{Filename: "a.txt"}},
+	})
+
+	if err != ErrMailFeatureNotSupported {
+		t.Fatal("attachments were accepted by a sender that can't send them")
+	}
+}
@@ -50,6 +50,8 @@ type User struct {
 	PasswordResetExpiration   *time.Time `json:"passwordResetExpiration,omitempty"`
 	EmailValidationToken      *string    `json:"emailValidationToken,omitempty"`
 	EmailValidationExpiration *time.Time `json:"emailValidationExpiration,omitempty"`
+	LoginToken                *string    `json:"loginToken,omitempty"`
+	LoginTokenExpiration      *time.Time `json:"loginTokenExpiration,omitempty"`
 	EmploymentStartDate       *time.Time `json:"employmentStartDate,omitempty"`
 	EmploymentEndDate         *time.Time `json:"employmentEndDate,omitempty"`
 	ContractStartDate         *time.Time `json:"contractStartDate,omitempty"`
@@ -71,6 +73,7 @@ type Group struct {
 	DeletedAt  *time.Time       `json:"deletedAt,omitempty" sql:"index"`
 	Name       string           `json:"name"`
 	Type       string           `json:"type"`
+	ParentID   *string          `json:"parentId,omitempty" sql:"index"` // e.g. the department a team is in
 	Context    *string          `json:"data,omitempty"`
 	Privileges []GroupPrivilege `json:"privileges"`
 }
@@ -95,6 +98,40 @@ type GroupPrivilege struct {
 	Action     string     `json:"action"`                            // e.g. read/write/admin/etc
 }
 
+// GroupRole is a named set of actions that members with that role can perform on the group (and groups below it)
+type GroupRole struct {
+	ID        string     `json:"id" bson:"_id" gorm:"primary_key"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" sql:"index"`
+	GroupID   string     `json:"groupId" sql:"index"` // blank for a role available in every group
+	Name      string     `json:"name"`
+	Actions   string     `json:"actions"` // space-separated
+}
+
+// GroupInvitation invites someone (by email, whether or not they have registered) to join a group with a role.  The
+// token emailed to them is signed, rather than stored
+type GroupInvitation struct {
+	ID         string     `json:"id" bson:"_id" gorm:"primary_key"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	DeletedAt  *time.Time `json:"deletedAt,omitempty" sql:"index"`
+	GroupID    string     `json:"groupId" sql:"index"`
+	Email      string     `json:"email" sql:"index"`
+	Role       string     `json:"role"`
+	InviterID  string     `json:"inviterId"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	AcceptedAt *time.Time `json:"acceptedAt,omitempty"`
+	AcceptedBy *string    `json:"acceptedBy,omitempty"` // the ID of the user who accepted
+	DeclinedAt *time.Time `json:"declinedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// IsPending states whether the invitation can still be accepted or declined
+func (i GroupInvitation) IsPending() bool {
+	return i.AcceptedAt == nil && i.DeclinedAt == nil && i.RevokedAt == nil && i.DeletedAt == nil && time.Now().Before(i.ExpiresAt)
+}
+
 // common interfaces extensions can use if needed
 
 type SearchParameters struct {
@@ -40,6 +40,11 @@ func Write204(w http.ResponseWriter, content string) {
 	w.Write(nil)
 }
 
+// Write400Json is some syntactic sugar to allow for a quick way to write JSON responses with a StatusBadRequest code
+func Write400Json(w http.ResponseWriter, message string) {
+	WriteStructToJson(w, map[string]string{"result": message}, http.StatusBadRequest)
+}
+
 // Write401Json
 func Write401Json(w http.ResponseWriter) {
 	WriteJson(w, `{"result": "not authorized"}`, http.StatusUnauthorized)
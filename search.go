@@ -0,0 +1,131 @@
+package nibbler
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// the page sizes used when SearchParameterOptions doesn't give them
+const DefaultSearchSize = 20
+const DefaultMaxSearchSize = 100
+
+// SearchQuery is the Query of SearchParameters parsed from a request (see ParseSearchParameters).  Persistence
+// extensions decide which fields Text is matched against
+type SearchQuery struct {
+	Text    string            `json:"text,omitempty"`    // from the "q" param
+	Filters map[string]string `json:"filters,omitempty"` // exact matches, by field
+}
+
+// SearchParameterOptions limit what ParseSearchParameters accepts
+type SearchParameterOptions struct {
+	DefaultSize         int      // the size when none is given (DefaultSearchSize if 0)
+	MaxSize             int      // larger sizes are rejected (DefaultMaxSearchSize if 0)
+	DefaultIncludeTotal bool     // whether the total is included when includeTotal isn't given
+	SortFields          []string // the fields that can be sorted by (none, if empty)
+	FilterFields        []string // the params that are taken as filters (e.g. "type" for ?type=team)
+}
+
+// ParseSearchParameters maps query string values to SearchParameters:
+//
+// - q: free text, as the Text of a SearchQuery (the Query is always a *SearchQuery)
+// - offset: a non-negative number of results to skip
+// - size: the number of results, from 1 to MaxSize
+// - sort: comma-separated fields, descending if prefixed with "-" (e.g. "name,-createdAt")
+// - includeTotal: "true" or "false" (DefaultIncludeTotal when not given)
+// - any of FilterFields, as exact-match filters
+//
+// Other params are ignored.  Errors describe the invalid param, so they're suitable for a 400 response
+func ParseSearchParameters(values url.Values, options SearchParameterOptions) (*SearchParameters, error) {
+	if options.DefaultSize <= 0 {
+		options.DefaultSize = DefaultSearchSize
+	}
+
+	if options.MaxSize <= 0 {
+		options.MaxSize = DefaultMaxSearchSize
+	}
+
+	query := &SearchQuery{Text: strings.TrimSpace(values.Get("q"))}
+	params := &SearchParameters{Query: query}
+
+	offset := 0
+	if raw := values.Get("offset"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 0 {
+			return nil, errors.New("offset must be a non-negative number")
+		}
+		offset = value
+	}
+	params.Offset = &offset
+
+	size := options.DefaultSize
+	if raw := values.Get("size"); raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil || value < 1 {
+			return nil, errors.New("size must be a positive number")
+		}
+
+		if value > options.MaxSize {
+			return nil, errors.New("size cannot be more than " + strconv.Itoa(options.MaxSize))
+		}
+		size = value
+	}
+
+	if size > options.MaxSize {
+		size = options.MaxSize
+	}
+	params.Size = &size
+
+	params.IncludeTotal = options.DefaultIncludeTotal
+	if raw := values.Get("includeTotal"); raw != "" {
+		includeTotal, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.New("includeTotal must be true or false")
+		}
+		params.IncludeTotal = includeTotal
+	}
+
+	if raw := values.Get("sort"); raw != "" {
+		for _, field := range strings.Split(raw, ",") {
+			field = strings.TrimSpace(field)
+			ascending := !strings.HasPrefix(field, "-")
+			field = strings.TrimPrefix(field, "-")
+
+			if !containsString(options.SortFields, field) {
+				return nil, errors.New("cannot sort by \"" + field + "\"")
+			}
+
+			params.SortBy = append(params.SortBy, SortByFieldParameters{Field: field, IsAscending: ascending})
+		}
+	}
+
+	for _, field := range options.FilterFields {
+		if value, ok := values[field]; ok {
+			if query.Filters == nil {
+				query.Filters = make(map[string]string)
+			}
+			query.Filters[field] = value[0]
+		}
+	}
+
+	return params, nil
+}
+
+// GetSearchQuery returns the query of the parameters if it's a *SearchQuery (e.g. from ParseSearchParameters), or an
+// empty query otherwise
+func (p SearchParameters) GetSearchQuery() SearchQuery {
+	if query, ok := p.Query.(*SearchQuery); ok && query != nil {
+		return *query
+	}
+	return SearchQuery{}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package nibbler
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseSearchParameters(t *testing.T) {
+	values, _ := url.ParseQuery("q=+editors+&offset=10&size=5&sort=name,-createdAt&includeTotal=true&type=team&other=x")
+	params, err := ParseSearchParameters(values, SearchParameterOptions{
+		SortFields:   []string{"name", "createdAt"},
+		FilterFields: []string{"type", "parentId"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := params.GetSearchQuery()
+	if query.Text != "editors" || len(query.Filters) != 1 || query.Filters["type"] != "team" {
+		t.Fatal("the query was not parsed")
+	}
+
+	if *params.Offset != 10 || *params.Size != 5 || !params.IncludeTotal {
+		t.Fatal("the paging was not parsed")
+	}
+
+	if len(params.SortBy) != 2 || params.SortBy[0] != (SortByFieldParameters{Field: "name", IsAscending: true}) ||
+		params.SortBy[1] != (SortByFieldParameters{Field: "createdAt", IsAscending: false}) {
+		t.Fatal("the sort was not parsed")
+	}
+}
+
+func TestParseSearchParameters_Defaults(t *testing.T) {
+	params, err := ParseSearchParameters(url.Values{}, SearchParameterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *params.Offset != 0 || *params.Size != DefaultSearchSize || params.IncludeTotal || params.SortBy != nil {
+		t.Fatal("the defaults were not used")
+	}
+
+	if params.GetSearchQuery().Text != "" || params.GetSearchQuery().Filters != nil {
+		t.Fatal("an empty query was not returned")
+	}
+
+	// a default size above the maximum is capped
+	params, _ = ParseSearchParameters(url.Values{}, SearchParameterOptions{DefaultSize: 50, MaxSize: 10})
+	if *params.Size != 10 {
+		t.Fatal("the default size was not capped")
+	}
+
+	// the total can be included by default, and still be left out
+	params, _ = ParseSearchParameters(url.Values{}, SearchParameterOptions{DefaultIncludeTotal: true})
+	if !params.IncludeTotal {
+		t.Fatal("the total was not included by default")
+	}
+
+	values, _ := url.ParseQuery("includeTotal=false")
+	params, _ = ParseSearchParameters(values, SearchParameterOptions{DefaultIncludeTotal: true})
+	if params.IncludeTotal {
+		t.Fatal("the total was included when includeTotal was false")
+	}
+}
+
+func TestParseSearchParameters_Invalid(t *testing.T) {
+	for _, raw := range []string{
+		"offset=-1",
+		"offset=abc",
+		"size=0",
+		"size=101",
+		"includeTotal=maybe",
+		"sort=password",
+		"sort=name,",
+	} {
+		values, _ := url.ParseQuery(raw)
+		if _, err := ParseSearchParameters(values, SearchParameterOptions{SortFields: []string{"name"}}); err == nil {
+			t.Fatal("invalid search parameters were accepted: " + raw)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+)
+
+// ListUserSessionsHandler lists the active sessions for the user in the userId path param
+func (s *Extension) ListUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.userSessionStore()
+	if !ok {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	sessionList, err := store.ListUserSessions(mux.Vars(r)["userId"])
+	if err != nil {
+		s.Logger.Error("while listing user sessions, error = " + err.Error())
+		nibbler.Write500Json(w, "failed to list sessions")
+		return
+	}
+
+	nibbler.WriteStructToJson(w, map[string]interface{}{"sessions": sessionList}, http.StatusOK)
+}
+
+// RevokeUserSessionsHandler logs the user in the userId path param out of every session
+func (s *Extension) RevokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.InvalidateUserSessions(mux.Vars(r)["userId"]); err != nil {
+		s.Logger.Error("while revoking user sessions, error = " + err.Error())
+		nibbler.Write500Json(w, "failed to revoke sessions")
+		return
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
+
+// RevokeSessionHandler deletes the session with the ID in the sessionId path param
+func (s *Extension) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.userSessionStore()
+	if !ok {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if err := store.RevokeSession(mux.Vars(r)["sessionId"]); err != nil {
+		s.Logger.Error("while revoking session, error = " + err.Error())
+		nibbler.Write500Json(w, "failed to revoke session")
+		return
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
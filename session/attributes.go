@@ -0,0 +1,182 @@
+package session
+
+import (
+	"context"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"sync"
+)
+
+// SetAttributes sets several values in the session, with a single save
+func (s *Extension) SetAttributes(w http.ResponseWriter, r *http.Request, values map[string]interface{}) error {
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	return s.saveSession(w, r, session)
+}
+
+// DeleteAttribute removes a value from the session
+func (s *Extension) DeleteAttribute(w http.ResponseWriter, r *http.Request, key string) error {
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := session.Values[key]; !ok {
+		return nil
+	}
+
+	delete(session.Values, key)
+	return s.saveSession(w, r, session)
+}
+
+// Clear removes every value from the session (including the caller), but keeps the session itself.  To end the
+// session, use InvalidateSession
+func (s *Extension) Clear(w http.ResponseWriter, r *http.Request) error {
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return err
+	}
+
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+
+	if err := s.saveSession(w, r, session); err != nil {
+		return err
+	}
+
+	setCallerInContext(r, nil)
+	return nil
+}
+
+// GetAttributeAs returns the session value for the key as a T.  ok is false if there is no value, or it isn't a T
+func GetAttributeAs[T any](s *Extension, r *http.Request, key string) (value T, ok bool, err error) {
+	raw, err := s.GetAttribute(r, key)
+	if err != nil || raw == nil {
+		return value, false, err
+	}
+
+	value, ok = raw.(T)
+	return value, ok, nil
+}
+
+// AddFlash adds a one-shot value under the key, which is removed from the session when read with Flashes (e.g. a
+// message to show after a redirect)
+func (s *Extension) AddFlash(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return err
+	}
+
+	session.AddFlash(value, key)
+	return s.saveSession(w, r, session)
+}
+
+// Flashes returns (and removes) the flash values under the key
+func (s *Extension) Flashes(w http.ResponseWriter, r *http.Request, key string) ([]interface{}, error) {
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return nil, err
+	}
+
+	flashes := session.Flashes(key)
+	if len(flashes) == 0 {
+		return nil, nil
+	}
+
+	return flashes, s.saveSession(w, r, session)
+}
+
+type deferredSaveContextKey struct{}
+
+// deferredSave holds a modified session until the response is about to be written
+type deferredSave struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	session *sessions.Session
+	flushed bool
+	mutex   sync.Mutex
+}
+
+// flush saves the session, if it was modified
+func (d *deferredSave) flush() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.flushed {
+		return nil
+	}
+	d.flushed = true
+
+	if d.session == nil {
+		return nil
+	}
+	return d.session.Save(d.r, d.w)
+}
+
+// deferredSaveWriter saves the session before the status and headers are written
+type deferredSaveWriter struct {
+	http.ResponseWriter
+	save func()
+}
+
+func (d *deferredSaveWriter) WriteHeader(statusCode int) {
+	d.save()
+	d.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (d *deferredSaveWriter) Write(b []byte) (int, error) {
+	d.save()
+	return d.ResponseWriter.Write(b)
+}
+
+func (d *deferredSaveWriter) Flush() {
+	d.save()
+	if flusher, ok := d.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// DeferredSaveMiddleware makes changes to the session during the request save it once, just before the response is
+// written (or when the handler returns without writing anything).  PostInit adds it to the app's router if DeferSave
+// is set
+func (s *Extension) DeferredSaveMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// create the session registry first, so that it's shared by the requests derived from this one
+		sessions.GetRegistry(r)
+
+		pending := &deferredSave{w: w}
+		r = r.WithContext(context.WithValue(r.Context(), deferredSaveContextKey{}, pending))
+
+		save := func() {
+			if err := pending.flush(); err != nil {
+				s.Logger.Error("while saving session, error = " + err.Error())
+			}
+		}
+
+		next.ServeHTTP(&deferredSaveWriter{ResponseWriter: w, save: save}, r)
+		save()
+	})
+}
+
+// saveSession saves the session now, or marks it to be saved later for requests through DeferredSaveMiddleware
+func (s *Extension) saveSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	if pending, ok := r.Context().Value(deferredSaveContextKey{}).(*deferredSave); ok {
+		pending.mutex.Lock()
+		if !pending.flushed {
+			pending.session = session
+			pending.r = r
+			pending.mutex.Unlock()
+			return nil
+		}
+		pending.mutex.Unlock()
+	}
+
+	return session.Save(r, w)
+}
@@ -0,0 +1,123 @@
+package session
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// savingStore counts how many times a session is saved
+type savingStore struct {
+	MockStore
+	saves int
+}
+
+func (c *savingStore) Save(r *http.Request, w http.ResponseWriter, s *sessions.Session) error {
+	c.saves++
+	return nil
+}
+
+func newAttributeTestExtension(t *testing.T) (*Extension, *savingStore) {
+	store := &savingStore{}
+	store.Session = sessions.NewSession(store, "test")
+	e := &Extension{StoreConnector: &MockStoreConnector{Store: store}}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+	return e, store
+}
+
+func TestExtension_Attributes(t *testing.T) {
+	e, store := newAttributeTestExtension(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := e.SetAttributes(w, r, map[string]interface{}{"count": 3, "name": "cart"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.saves != 1 {
+		t.Fatal("setting several attributes did not save exactly once")
+	}
+
+	if count, ok, err := GetAttributeAs[int](e, r, "count"); err != nil || !ok || count != 3 {
+		t.Fatal("the typed getter did not return the value")
+	}
+
+	if _, ok, _ := GetAttributeAs[string](e, r, "count"); ok {
+		t.Fatal("the typed getter returned a value of the wrong type")
+	}
+
+	if err := e.DeleteAttribute(w, r, "count"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := GetAttributeAs[int](e, r, "count"); ok {
+		t.Fatal("the attribute was not deleted")
+	}
+
+	if err := e.Clear(w, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.Session.Values) != 0 {
+		t.Fatal("the session was not cleared")
+	}
+}
+
+func TestExtension_Flashes(t *testing.T) {
+	e, _ := newAttributeTestExtension(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	if err := e.AddFlash(w, r, "message", "saved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if flashes, err := e.Flashes(w, r, "message"); err != nil || len(flashes) != 1 || flashes[0] != "saved" {
+		t.Fatal("the flash was not returned")
+	}
+
+	if flashes, _ := e.Flashes(w, r, "message"); len(flashes) != 0 {
+		t.Fatal("the flash was returned twice")
+	}
+}
+
+func TestExtension_DeferredSave(t *testing.T) {
+	e, store := newAttributeTestExtension(t)
+
+	e.DeferredSaveMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range []string{"a", "b", "c"} {
+			if err := e.SetAttribute(w, r, key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if store.saves != 0 {
+			t.Fatal("the session was saved before the response was written")
+		}
+
+		nibbler.Write200Json(w, `{"result": "ok"}`)
+
+		if store.saves != 1 {
+			t.Fatal("the session was not saved when the response was written")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if store.saves != 1 {
+		t.Fatal("the session was saved more than once")
+	}
+
+	// a handler that writes nothing still gets the session saved
+	e.DeferredSaveMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.SetAttribute(w, r, "d", "d"); err != nil {
+			t.Fatal(err)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if store.saves != 2 {
+		t.Fatal("the session was not saved when the handler returned")
+	}
+}
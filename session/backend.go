@@ -0,0 +1,166 @@
+package session
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// memoryBackend keeps records in a map
+type memoryBackend struct {
+	records map[string]*record
+	mutex   sync.RWMutex
+}
+
+func (m *memoryBackend) load(id string) (*record, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	rec, ok := m.records[id]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+
+	result := *rec
+	return &result, nil
+}
+
+func (m *memoryBackend) save(r *record) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	saved := *r
+	m.records[r.Info.ID] = &saved
+	return nil
+}
+
+func (m *memoryBackend) delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.records[id]; !ok {
+		return errSessionNotFound
+	}
+
+	delete(m.records, id)
+	return nil
+}
+
+func (m *memoryBackend) list() ([]SessionInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var infos []SessionInfo
+	for _, r := range m.records {
+		infos = append(infos, r.Info)
+	}
+	return infos, nil
+}
+
+const sessionFileSuffix = ".session"
+
+// fileBackend keeps each record in a gob-encoded file named for the session ID
+type fileBackend struct {
+	directory string
+	mutex     sync.RWMutex
+}
+
+func newFileBackend(directory string) (*fileBackend, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &fileBackend{directory: directory}, nil
+}
+
+func (f *fileBackend) load(id string) (*record, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.read(f.path(id))
+}
+
+func (f *fileBackend) save(r *record) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// write to a temporary file first, so a crash can't leave a partial session behind
+	temp, err := ioutil.TempFile(f.directory, "tmp-")
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(temp).Encode(r); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), f.path(r.Info.ID))
+}
+
+func (f *fileBackend) delete(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := os.Remove(f.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return errSessionNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *fileBackend) list() ([]SessionInfo, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	entries, err := ioutil.ReadDir(f.directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []SessionInfo
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), sessionFileSuffix) {
+			continue
+		}
+
+		// skip files that were removed since listing, or that can't be read (which can't be loaded as sessions either)
+		rec, err := f.read(filepath.Join(f.directory, e.Name()))
+		if err != nil {
+			continue
+		}
+		infos = append(infos, rec.Info)
+	}
+	return infos, nil
+}
+
+func (f *fileBackend) read(path string) (*record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errSessionNotFound
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	rec := record{}
+	if err := gob.NewDecoder(file).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// path is only ever given IDs from generateSessionID or a verified cookie, but the ID is cleaned anyway
+func (f *fileBackend) path(id string) string {
+	return filepath.Join(f.directory, filepath.Base(id)+sessionFileSuffix)
+}
@@ -0,0 +1,155 @@
+package session
+
+import (
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/micro/go-micro/config"
+	"net/http"
+	"time"
+)
+
+const defaultMaxAge = 86400 * 30
+
+// the store types that can be chosen with session.store in config
+const (
+	StoreTypeCookie = "cookie"
+	StoreTypeMemory = "memory"
+	StoreTypeFile   = "file"
+)
+
+// CookieStoreConnector creates a gorilla cookie store - all session values are kept in the (signed, and optionally
+// encrypted) cookie.  Sessions can't be listed, so user-wide revocation relies on the extension's RevocationStore
+type CookieStoreConnector struct {
+	KeyPairs      [][]byte // an authentication key, then an optional encryption key (repeat the pair to rotate keys)
+	MaxAgeSeconds int      // defaults to 30 days
+	Secure        bool     // only send the cookie over HTTPS
+}
+
+func (c *CookieStoreConnector) Connect() (error, sessions.Store) {
+	if len(c.KeyPairs) == 0 || len(c.KeyPairs[0]) == 0 {
+		return errors.New("cookie store connector requires an authentication key"), nil
+	}
+
+	store := sessions.NewCookieStore(c.KeyPairs...)
+	applyOptions(store.Options, c.MaxAge(), c.Secure)
+	store.MaxAge(c.MaxAge())
+	return nil, store
+}
+
+func (c *CookieStoreConnector) MaxAge() int {
+	return maxAgeOrDefault(c.MaxAgeSeconds)
+}
+
+// MemoryStoreConnector creates a ServerStore that keeps sessions in memory
+type MemoryStoreConnector struct {
+	KeyPairs      [][]byte      // for signing (and optionally encrypting) the session ID in the cookie
+	MaxAgeSeconds int           // defaults to 30 days
+	Secure        bool          // only send the cookie over HTTPS
+	SweepInterval time.Duration // how often expired sessions are deleted, defaults to 10 minutes
+}
+
+func (m *MemoryStoreConnector) Connect() (error, sessions.Store) {
+	if len(m.KeyPairs) == 0 || len(m.KeyPairs[0]) == 0 {
+		return errors.New("memory store connector requires an authentication key"), nil
+	}
+
+	store := NewMemoryStore(m.KeyPairs...)
+	applyOptions(store.Options, m.MaxAge(), m.Secure)
+	store.StartSweeping(sweepIntervalOrDefault(m.SweepInterval), nil)
+	return nil, store
+}
+
+func (m *MemoryStoreConnector) MaxAge() int {
+	return maxAgeOrDefault(m.MaxAgeSeconds)
+}
+
+// FileStoreConnector creates a ServerStore that keeps each session in a file, so sessions survive a restart
+type FileStoreConnector struct {
+	Directory     string        // defaults to ./sessions
+	KeyPairs      [][]byte      // for signing (and optionally encrypting) the session ID in the cookie
+	MaxAgeSeconds int           // defaults to 30 days
+	Secure        bool          // only send the cookie over HTTPS
+	SweepInterval time.Duration // how often expired sessions are deleted, defaults to 10 minutes
+}
+
+func (f *FileStoreConnector) Connect() (error, sessions.Store) {
+	if len(f.KeyPairs) == 0 || len(f.KeyPairs[0]) == 0 {
+		return errors.New("file store connector requires an authentication key"), nil
+	}
+
+	directory := f.Directory
+	if directory == "" {
+		directory = "./sessions"
+	}
+
+	store, err := NewFileStore(directory, f.KeyPairs...)
+	if err != nil {
+		return err, nil
+	}
+
+	applyOptions(store.Options, f.MaxAge(), f.Secure)
+	store.StartSweeping(sweepIntervalOrDefault(f.SweepInterval), nil)
+	return nil, store
+}
+
+func (f *FileStoreConnector) MaxAge() int {
+	return maxAgeOrDefault(f.MaxAgeSeconds)
+}
+
+// connectorFromConfig creates a connector from session.* config (e.g. SESSION_AUTHENTICATION_KEY), or returns nil if
+// no authentication key is configured
+func connectorFromConfig(raw config.Config) (StoreConnector, error) {
+	authenticationKey := raw.Get("session", "authentication", "key").String("")
+	if authenticationKey == "" {
+		return nil, nil
+	}
+
+	keyPairs := [][]byte{[]byte(authenticationKey)}
+	if encryptionKey := raw.Get("session", "encryption", "key").String(""); encryptionKey != "" {
+		if l := len(encryptionKey); l != 16 && l != 24 && l != 32 {
+			return nil, errors.New("session encryption key must be 16, 24 or 32 bytes long")
+		}
+		keyPairs = append(keyPairs, []byte(encryptionKey))
+	}
+
+	maxAge := raw.Get("session", "max", "age").Int(0)
+	secure := raw.Get("session", "secure").Bool(false)
+
+	switch storeType := raw.Get("session", "store").String(StoreTypeCookie); storeType {
+	case StoreTypeCookie:
+		return &CookieStoreConnector{KeyPairs: keyPairs, MaxAgeSeconds: maxAge, Secure: secure}, nil
+	case StoreTypeMemory:
+		return &MemoryStoreConnector{KeyPairs: keyPairs, MaxAgeSeconds: maxAge, Secure: secure}, nil
+	case StoreTypeFile:
+		return &FileStoreConnector{
+			Directory:     raw.Get("session", "directory").String(""),
+			KeyPairs:      keyPairs,
+			MaxAgeSeconds: maxAge,
+			Secure:        secure,
+		}, nil
+	default:
+		return nil, errors.New("unknown session store type " + storeType)
+	}
+}
+
+func applyOptions(options *sessions.Options, maxAge int, secure bool) {
+	options.Path = "/"
+	options.MaxAge = maxAge
+	options.HttpOnly = true
+	options.Secure = secure
+	options.SameSite = http.SameSiteLaxMode
+}
+
+func maxAgeOrDefault(maxAge int) int {
+	if maxAge <= 0 {
+		return defaultMaxAge
+	}
+	return maxAge
+}
+
+func sweepIntervalOrDefault(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 10 * time.Minute
+	}
+	return interval
+}
@@ -0,0 +1,96 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/sessions"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"sync"
+)
+
+// ErrNoCallerContext is returned by CallerFromContext for a context that didn't come through CallerMiddleware
+var ErrNoCallerContext = errors.New("the caller is not available from this context")
+
+type callerContextKey struct{}
+
+// callerEntry memoizes the caller for a request - it's resolved the first time it's asked for, and kept up to date by
+// SetCaller and InvalidateSession
+type callerEntry struct {
+	resolve func() (*nibbler.User, error)
+	once    sync.Once
+	mutex   sync.Mutex
+	caller  *nibbler.User
+	err     error
+}
+
+func (c *callerEntry) get() (*nibbler.User, error) {
+	c.once.Do(func() {
+		caller, err := c.resolve()
+		c.set(caller, err)
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.caller == nil {
+		return nil, c.err
+	}
+
+	// hand out copies, so a handler changing the caller doesn't change the cached value
+	caller := *c.caller
+	return &caller, c.err
+}
+
+func (c *callerEntry) set(caller *nibbler.User, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.caller = nil
+	if caller != nil {
+		copied := *caller
+		c.caller = &copied
+	}
+	c.err = err
+}
+
+// CallerMiddleware makes the caller available from the request's context, so it is only loaded from the session (at
+// most) once per request, however many times GetCaller or CallerFromContext is called.  The extension adds it to the
+// app's router in PostInit
+func (s *Extension) CallerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(callerContextKey{}).(*callerEntry); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// create the session registry first, so that it's shared by the requests derived from this one
+		sessions.GetRegistry(r)
+
+		entry := &callerEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), callerContextKey{}, entry))
+		entry.resolve = func() (*nibbler.User, error) {
+			return s.loadCaller(r)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CallerFromContext returns the caller for a request context that came through CallerMiddleware, or nil if nobody is
+// logged in
+func CallerFromContext(ctx context.Context) (*nibbler.User, error) {
+	entry, ok := ctx.Value(callerContextKey{}).(*callerEntry)
+	if !ok {
+		return nil, ErrNoCallerContext
+	}
+	return entry.get()
+}
+
+// setCallerInContext updates the memoized caller (if there is one) after the session changes
+func setCallerInContext(r *http.Request, caller *nibbler.User) {
+	if entry, ok := r.Context().Value(callerContextKey{}).(*callerEntry); ok {
+		entry.once.Do(func() {})
+		entry.set(caller, nil)
+	}
+}
@@ -0,0 +1,71 @@
+package session
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingStore counts how many times the session is fetched
+type countingStore struct {
+	MockStore
+	gets int
+}
+
+func (c *countingStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	c.gets++
+	return c.MockStore.Get(r, name)
+}
+
+func TestExtension_CallerMiddleware(t *testing.T) {
+	store := &countingStore{}
+	store.Session = sessions.NewSession(store, "test")
+	e := Extension{StoreConnector: &MockStoreConnector{Store: store}}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.SetCaller(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), &nibbler.User{ID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	store.gets = 0
+
+	e.CallerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			if caller, err := e.GetCaller(r); err != nil || caller == nil || caller.ID != "bob" {
+				t.Fatal("the caller was not returned")
+			}
+		}
+
+		if caller, err := CallerFromContext(r.Context()); err != nil || caller == nil || caller.ID != "bob" {
+			t.Fatal("the caller was not available from the context")
+		}
+
+		if store.gets != 1 {
+			t.Fatal("the caller was loaded from the session more than once")
+		}
+
+		// changes to the session are reflected in the context
+		if err := e.SetCaller(w, r, &nibbler.User{ID: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if caller, _ := CallerFromContext(r.Context()); caller == nil || caller.ID != "alice" {
+			t.Fatal("the context was not updated by SetCaller")
+		}
+
+		if err := e.InvalidateSession(w, r); err != nil {
+			t.Fatal(err)
+		}
+
+		if caller, _ := CallerFromContext(r.Context()); caller != nil {
+			t.Fatal("the context was not updated by InvalidateSession")
+		}
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if _, err := CallerFromContext(httptest.NewRequest("GET", "/", nil).Context()); err != ErrNoCallerContext {
+		t.Fatal("a context without the middleware did not give ErrNoCallerContext")
+	}
+}
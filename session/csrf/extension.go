@@ -0,0 +1,215 @@
+package csrf
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"net/http"
+	"strings"
+)
+
+// how the expected token is kept
+const (
+	ModeSynchronizer = "synchronizer"  // in the session (the default)
+	ModeDoubleSubmit = "double-submit" // in a cookie that the client's script reads and echoes back
+)
+
+// HeaderName and FormField are where the token is read from on unsafe requests (the header takes precedence)
+const HeaderName = "X-CSRF-Token"
+const FormField = "csrf_token"
+
+const sessionAttribute = "csrfToken"
+
+var ErrInvalidToken = errors.New("invalid csrf token")
+
+// Extension protects cookie-authenticated endpoints from cross-site request forgery.  Unsafe requests (anything but
+// GET, HEAD, OPTIONS and TRACE) must echo the token from the token endpoint (GET /api/csrf) in the X-CSRF-Token
+// header or csrf_token form field
+type Extension struct {
+	nibbler.NoOpExtension
+
+	SessionExtension *session.Extension // required for ModeSynchronizer
+	Mode             string             // defaults to ModeSynchronizer
+	CookieName       string             // for ModeDoubleSubmit, defaults to "csrf_token"
+	Secure           bool               // for ModeDoubleSubmit, only send the cookie over HTTPS
+
+	// requests that skip the check - paths are exact, or prefixes if they end with "*" (e.g. "/api/webhook/*")
+	ExemptPaths []string
+	Exempt      func(r *http.Request) bool
+
+	// requests with an Authorization header aren't authenticated by a cookie, so they're exempt unless this is set
+	CheckAuthorizedRequests bool
+
+	DisableDefaultRoutes bool
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.Mode == "" {
+		s.Mode = ModeSynchronizer
+	}
+
+	if s.Mode != ModeSynchronizer && s.Mode != ModeDoubleSubmit {
+		return errors.New("csrf extension was given unknown mode " + s.Mode)
+	}
+
+	if s.Mode == ModeSynchronizer && s.SessionExtension == nil {
+		return errors.New("csrf extension requires a session extension in synchronizer mode")
+	}
+
+	if s.CookieName == "" {
+		s.CookieName = "csrf_token"
+	}
+
+	return nil
+}
+
+// PostInit enforces the token on every route of the app's router, and adds the token endpoint
+func (s *Extension) PostInit(app *nibbler.Application) error {
+	if app.Router == nil {
+		return nil
+	}
+
+	app.Router.Use(s.Middleware)
+
+	if !s.DisableDefaultRoutes {
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/csrf", s.TokenHandler).Methods("GET")
+	}
+	return nil
+}
+
+func (s *Extension) GetName() string {
+	return "csrf"
+}
+
+// TokenHandler responds with the token for the caller, creating one if needed
+func (s *Extension) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := s.Token(w, r)
+	if err != nil {
+		s.Logger.Error("while issuing csrf token, error = " + err.Error())
+		nibbler.Write500Json(w, "failed to issue token")
+		return
+	}
+
+	nibbler.Write200Json(w, `{"token": "`+token+`"}`)
+}
+
+// Token returns the token for the request (e.g. for a server-rendered form), creating one if needed
+func (s *Extension) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if token, err := s.expectedToken(r); err != nil || token != "" {
+		return token, err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	if s.Mode == ModeDoubleSubmit {
+		http.SetCookie(w, &http.Cookie{
+			Name:     s.CookieName,
+			Value:    token,
+			Path:     "/",
+			Secure:   s.Secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+		return token, nil
+	}
+
+	return token, s.SessionExtension.SetAttribute(w, r, sessionAttribute, token)
+}
+
+// Verify checks the token on the request, regardless of method or exemptions
+func (s *Extension) Verify(r *http.Request) error {
+	expected, err := s.expectedToken(r)
+	if err != nil {
+		return err
+	}
+
+	provided := r.Header.Get(HeaderName)
+	if provided == "" {
+		provided = r.PostFormValue(FormField)
+	}
+
+	if expected == "" || provided == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(provided)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// Middleware rejects unsafe requests that don't carry a valid token with a 403
+func (s *Extension) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.requiresToken(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := s.Verify(r); err != nil {
+			if err != ErrInvalidToken {
+				s.Logger.Error("while verifying csrf token, error = " + err.Error())
+			}
+			s.Logger.Debug("rejected request to " + r.URL.Path + " with missing or invalid csrf token")
+			nibbler.WriteJson(w, `{"result": "invalid csrf token"}`, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Protect wraps a single route, for apps that don't enforce the token on the whole router
+func (s *Extension) Protect(routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return s.Middleware(http.HandlerFunc(routerFunc)).ServeHTTP
+}
+
+func (s *Extension) requiresToken(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+
+	if !s.CheckAuthorizedRequests && r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	for _, p := range s.ExemptPaths {
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(r.URL.Path, strings.TrimSuffix(p, "*")) {
+			return false
+		}
+
+		if p == r.URL.Path {
+			return false
+		}
+	}
+
+	return s.Exempt == nil || !s.Exempt(r)
+}
+
+// expectedToken returns the token issued to the client, or an empty string if none has been
+func (s *Extension) expectedToken(r *http.Request) (string, error) {
+	if s.Mode == ModeDoubleSubmit {
+		cookie, err := r.Cookie(s.CookieName)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+
+	token, _, err := session.GetAttributeAs[string](s.SessionExtension, r, sessionAttribute)
+	return token, err
+}
+
+func generateToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
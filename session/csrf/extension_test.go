@@ -0,0 +1,169 @@
+package csrf
+
+import (
+	"encoding/json"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestImplements(t *testing.T) {
+	e := Extension{}
+	var base nibbler.Extension = &e
+	if base == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+func TestExtension_InitNeedsSessionExtension(t *testing.T) {
+	e := Extension{}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err == nil {
+		t.Fatal("synchronizer mode was allowed without a session extension")
+	}
+
+	e = Extension{Mode: ModeDoubleSubmit}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestExtension builds a csrf extension (on a mock session store, for synchronizer mode)
+func newTestExtension(t *testing.T, configure func(e *Extension)) *Extension {
+	app := &nibbler.Application{Logger: nibbler.SilentLogger{}}
+
+	sessionExtension := session.NewMockExtension()
+	if err := sessionExtension.Init(app); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Extension{SessionExtension: sessionExtension}
+	configure(e)
+	if err := e.Init(app); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func issueToken(t *testing.T, e *Extension) (string, *httptest.ResponseRecorder) {
+	res := httptest.NewRecorder()
+	e.TokenHandler(res, httptest.NewRequest("GET", "/api/csrf", nil))
+	if res.Code != http.StatusOK {
+		t.Fatal("the token was not issued")
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body.Token == "" {
+		t.Fatal("the token endpoint responded without a token")
+	}
+	return body.Token, res
+}
+
+// serve runs the request through the middleware, returning whether the protected handler was reached
+func serve(e *Extension, req *http.Request) (bool, *httptest.ResponseRecorder) {
+	reached := false
+	res := httptest.NewRecorder()
+	e.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})).ServeHTTP(res, req)
+	return reached, res
+}
+
+func TestExtension_Synchronizer(t *testing.T) {
+	e := newTestExtension(t, func(e *Extension) {})
+
+	if reached, res := serve(e, httptest.NewRequest("POST", "/api/logout", nil)); reached || res.Code != http.StatusForbidden {
+		t.Fatal("a request without a token was allowed")
+	}
+
+	token, _ := issueToken(t, e)
+	if again, _ := issueToken(t, e); again != token {
+		t.Fatal("the token changed within a session")
+	}
+
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set(HeaderName, "not-"+token)
+	if reached, _ := serve(e, req); reached {
+		t.Fatal("a request with the wrong token was allowed")
+	}
+
+	req = httptest.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set(HeaderName, token)
+	if reached, _ := serve(e, req); !reached {
+		t.Fatal("a request with the token in the header was rejected")
+	}
+
+	req = httptest.NewRequest("POST", "/api/password", strings.NewReader(url.Values{FormField: {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if reached, _ := serve(e, req); !reached {
+		t.Fatal("a request with the token in the form was rejected")
+	}
+
+	if reached, _ := serve(e, httptest.NewRequest("GET", "/api/user", nil)); !reached {
+		t.Fatal("a safe request was rejected")
+	}
+}
+
+func TestExtension_DoubleSubmit(t *testing.T) {
+	e := newTestExtension(t, func(e *Extension) {
+		e.Mode = ModeDoubleSubmit
+	})
+
+	token, res := issueToken(t, e)
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != token || cookies[0].HttpOnly {
+		t.Fatal("the token was not set in a script-readable cookie")
+	}
+
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set(HeaderName, token)
+	if reached, _ := serve(e, req); reached {
+		t.Fatal("a request without the cookie was allowed")
+	}
+
+	req.AddCookie(cookies[0])
+	if reached, _ := serve(e, req); !reached {
+		t.Fatal("a request with a matching cookie and header was rejected")
+	}
+}
+
+func TestExtension_Exemptions(t *testing.T) {
+	e := newTestExtension(t, func(e *Extension) {
+		e.ExemptPaths = []string{"/api/webhook/*", "/api/ping"}
+		e.Exempt = func(r *http.Request) bool {
+			return r.Header.Get("X-Internal") == "true"
+		}
+	})
+
+	for _, path := range []string{"/api/webhook/stripe", "/api/ping"} {
+		if reached, _ := serve(e, httptest.NewRequest("POST", path, nil)); !reached {
+			t.Fatal("a request to exempt path " + path + " was rejected")
+		}
+	}
+
+	if reached, _ := serve(e, httptest.NewRequest("POST", "/api/ping/other", nil)); reached {
+		t.Fatal("an exact exempt path matched as a prefix")
+	}
+
+	req := httptest.NewRequest("POST", "/api/user", nil)
+	req.Header.Set("X-Internal", "true")
+	if reached, _ := serve(e, req); !reached {
+		t.Fatal("a request exempted by the Exempt func was rejected")
+	}
+
+	req = httptest.NewRequest("POST", "/api/user", nil)
+	req.Header.Set("Authorization", "Bearer abc")
+	if reached, _ := serve(e, req); !reached {
+		t.Fatal("a request with an Authorization header was rejected")
+	}
+
+	e.CheckAuthorizedRequests = true
+	if reached, _ := serve(e, req); reached {
+		t.Fatal("a request with an Authorization header was allowed with CheckAuthorizedRequests")
+	}
+}
@@ -7,11 +7,18 @@ import (
 	"github.com/gorilla/sessions"
 	"github.com/markdicksonjr/nibbler"
 	"github.com/markdicksonjr/nibbler/user"
+	"io"
 	"net/http"
+	"time"
 )
 
 var requiresConnectorError = "session extension requires connector"
 
+// the session attributes managed by this extension
+const callerAttribute = "user"
+const authTimeAttribute = "authTime"       // when the caller was put into the session, in unix nanoseconds
+const userVersionAttribute = "userVersion" // the caller's UpdatedAt (unix nanoseconds) when put into the session
+
 type StoreConnector interface {
 	Connect() (error, sessions.Store) // TODO: reverse param order
 	MaxAge() int
@@ -19,9 +26,26 @@ type StoreConnector interface {
 
 type Extension struct {
 	nibbler.NoOpExtension
-	SessionName    string
-	StoreConnector StoreConnector  // creates cookie store if not provided
-	store          *sessions.Store // created by this extension
+	SessionName     string
+	StoreConnector  StoreConnector  // created from session.* config if not provided (see README)
+	RevocationStore RevocationStore // for InvalidateUserSessions, defaults to a MemoryRevocationStore
+
+	// rather than a snapshot of the caller, keep only the caller's ID in the session, and load the caller with
+	// UserLoader (caching users for UserCacheTTL, which defaults to 10 seconds).  Deleted or deactivated users are
+	// logged out, and changes to users are seen without logging in again
+	StoreUserIDOnly bool
+	UserLoader      UserLoader
+	UserCacheTTL    time.Duration
+
+	// save the session (at most) once per request, just before the response is written, rather than on every change.
+	// This applies to requests through DeferredSaveMiddleware, which PostInit adds to the app's router
+	DeferSave bool
+
+	// if provided, guards the admin routes for listing and revoking a user's sessions (which need a UserSessionStore)
+	AdminEnforcer func(routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request)
+
+	store     *sessions.Store // created by this extension
+	userCache *userCache
 }
 
 func (s *Extension) Init(app *nibbler.Application) error {
@@ -32,11 +56,32 @@ func (s *Extension) Init(app *nibbler.Application) error {
 		s.Logger = app.Logger
 	}
 
-	// if a store connector is provided, use it
+	// if a store connector isn't provided, try to create one from config
+	if s.StoreConnector == nil && app.Config != nil && app.Config.Raw != nil {
+		connector, err := connectorFromConfig(app.Config.Raw)
+		if err != nil {
+			return err
+		}
+		s.StoreConnector = connector
+	}
+
 	if s.StoreConnector == nil {
 		return errors.New(requiresConnectorError)
 	}
 
+	if s.RevocationStore == nil {
+		s.RevocationStore = &MemoryRevocationStore{}
+	}
+
+	if s.StoreUserIDOnly && s.UserLoader == nil {
+		return errors.New("session extension requires a user loader to store only user IDs")
+	}
+
+	if s.UserCacheTTL <= 0 {
+		s.UserCacheTTL = 10 * time.Second
+	}
+	s.userCache = &userCache{ttl: s.UserCacheTTL}
+
 	errConnect, store := s.StoreConnector.Connect()
 
 	// save the store to the extension
@@ -44,6 +89,43 @@ func (s *Extension) Init(app *nibbler.Application) error {
 	return errConnect
 }
 
+func (s *Extension) PostInit(app *nibbler.Application) error {
+	if app.Router == nil {
+		return nil
+	}
+
+	app.Router.Use(s.CallerMiddleware)
+
+	if s.DeferSave {
+		app.Router.Use(s.DeferredSaveMiddleware)
+	}
+
+	if s.AdminEnforcer == nil {
+		return nil
+	}
+
+	if _, ok := s.userSessionStore(); !ok {
+		return errors.New("session admin routes require a store that can list user sessions")
+	}
+
+	app.Router.HandleFunc(app.Config.ApiPrefix+"/session/user/{userId}", s.AdminEnforcer(s.ListUserSessionsHandler)).Methods("GET")
+	app.Router.HandleFunc(app.Config.ApiPrefix+"/session/user/{userId}", s.AdminEnforcer(s.RevokeUserSessionsHandler)).Methods("DELETE")
+	app.Router.HandleFunc(app.Config.ApiPrefix+"/session/{sessionId}", s.AdminEnforcer(s.RevokeSessionHandler)).Methods("DELETE")
+	return nil
+}
+
+// Destroy stops any background work (e.g. expiry sweeping) done by the store
+func (s *Extension) Destroy(app *nibbler.Application) error {
+	if s.store == nil {
+		return nil
+	}
+
+	if closer, ok := (*s.store).(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func (s *Extension) GetName() string {
 	return "session"
 }
@@ -60,59 +142,252 @@ func (s *Extension) GetAttribute(r *http.Request, attribute string) (interface{}
 	return sessionAttribute, nil
 }
 
-// TODO: SetAttributes to set multiple attributes in one save
+// SetAttribute sets a single value in the session (use SetAttributes to set several with one save)
 func (s *Extension) SetAttribute(w http.ResponseWriter, r *http.Request, key string, value interface{}) error {
+	return s.SetAttributes(w, r, map[string]interface{}{key: value})
+}
+
+// GetCaller returns the user in the session, or nil if there isn't one (or if the user's sessions were invalidated
+// after this one was started).  For requests through CallerMiddleware, the caller is only loaded once
+func (s *Extension) GetCaller(r *http.Request) (*nibbler.User, error) {
+	if caller, err := CallerFromContext(r.Context()); err != ErrNoCallerContext {
+		return caller, err
+	}
+	return s.loadCaller(r)
+}
+
+// loadCaller reads the caller from the session (or, in StoreUserIDOnly mode, loads the user with the ID in the session)
+func (s *Extension) loadCaller(r *http.Request) (*nibbler.User, error) {
 	session, err := (*s.store).Get(r, s.SessionName)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	session.Values[key] = value
-	return session.Save(r, w)
-}
+	if s.StoreUserIDOnly {
+		return s.loadCallerById(session)
+	}
 
-func (s *Extension) GetCaller(r *http.Request) (*nibbler.User, error) {
-	sessionUser, err := s.GetAttribute(r, "user")
+	sessionUser := session.Values[callerAttribute]
 
+	if sessionUser == nil {
+		return nil, nil
+	}
+
+	caller, err := user.FromJson(sessionUser.(string))
 	if err != nil {
 		return nil, err
 	}
 
-	if sessionUser == nil {
+	revoked, err := s.isRevoked(caller.ID, session.Values[authTimeAttribute])
+	if err != nil || revoked {
+		return nil, err
+	}
+
+	return caller, nil
+}
+
+// loadCallerById loads the caller for StoreUserIDOnly mode
+func (s *Extension) loadCallerById(session *sessions.Session) (*nibbler.User, error) {
+	userID, _ := session.Values[UserIDAttribute].(string)
+	if userID == "" {
 		return nil, nil
 	}
 
-	return user.FromJson(sessionUser.(string))
+	revoked, err := s.isRevoked(userID, session.Values[authTimeAttribute])
+	if err != nil || revoked {
+		return nil, err
+	}
+
+	version := time.Time{}
+	if v, ok := session.Values[userVersionAttribute].(int64); ok {
+		version = time.Unix(0, v)
+	}
+
+	return s.loadUser(userID, version)
 }
 
-// SetCaller puts the user into the session as the current user
+// SetCaller puts the user into the session as the current user.  As this marks a change in privilege (e.g. a login),
+// the session is given a new ID.  A nil user ends the session entirely (see InvalidateSession)
 func (s *Extension) SetCaller(w http.ResponseWriter, r *http.Request, userValue *nibbler.User) error {
 
 	if userValue == nil {
-		return s.SetAttribute(w, r, "user", nil)
+		return s.InvalidateSession(w, r)
 	}
 
 	// wipe values for stringification TODO: use user.GetSafeString?
 	password := userValue.Password
 	resetToken := userValue.PasswordResetToken
 	resetExpiration := userValue.PasswordResetExpiration
+	loginToken := userValue.LoginToken
+	loginTokenExpiration := userValue.LoginTokenExpiration
 	userValue.Password = nil
 	userValue.PasswordResetToken = nil
 	userValue.PasswordResetExpiration = nil
+	userValue.LoginToken = nil
+	userValue.LoginTokenExpiration = nil
 
 	userJson, err := user.ToJson(userValue)
 
-	// restore password and reset token
+	// restore password and tokens
 	userValue.Password = password
 	userValue.PasswordResetToken = resetToken
 	userValue.PasswordResetExpiration = resetExpiration
+	userValue.LoginToken = loginToken
+	userValue.LoginTokenExpiration = loginTokenExpiration
+
+	if err != nil {
+		return err
+	}
+
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return err
+	}
+
+	if err := s.expireSessionID(w, r, session); err != nil {
+		return err
+	}
+
+	// a new caller starts a new session, but updating the same caller (e.g. a flag change) keeps the original auth time
+	sameCaller := false
+	if previousID, _ := session.Values[UserIDAttribute].(string); previousID == userValue.ID {
+		revoked, err := s.isRevoked(userValue.ID, session.Values[authTimeAttribute])
+		if err != nil {
+			return err
+		}
+		sameCaller = !revoked
+	}
+
+	if !sameCaller {
+		session.Values[authTimeAttribute] = time.Now().UnixNano()
+	}
+
+	if s.StoreUserIDOnly {
+		delete(session.Values, callerAttribute)
+		session.Values[userVersionAttribute] = userValue.UpdatedAt.UnixNano()
+		s.RefreshCachedUser(userValue.ID)
+	} else {
+		session.Values[callerAttribute] = userJson
+	}
+
+	session.Values[UserIDAttribute] = userValue.ID
+	if err := s.saveSession(w, r, session); err != nil {
+		return err
+	}
+
+	// the copy in the context loses the password and tokens too, as it would coming from the session
+	cached := *userValue
+	cached.Password = nil
+	cached.PasswordResetToken = nil
+	cached.PasswordResetExpiration = nil
+	cached.LoginToken = nil
+	cached.LoginTokenExpiration = nil
+	setCallerInContext(r, &cached)
+	return nil
+}
 
+// RegenerateSession gives the session a new ID, keeping its values, so that an ID obtained before a change in
+// privilege can't be used after it.  SetCaller does this automatically - call it directly for other privilege changes
+func (s *Extension) RegenerateSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := (*s.store).Get(r, s.SessionName)
 	if err != nil {
 		return err
 	}
 
-	return s.SetAttribute(w, r, "user", userJson)
+	if err := s.expireSessionID(w, r, session); err != nil {
+		return err
+	}
+
+	return s.saveSession(w, r, session)
+}
+
+// InvalidateSession clears every value in the session and expires it (deleting any server-side data for it)
+func (s *Extension) InvalidateSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := (*s.store).Get(r, s.SessionName)
+	if err != nil {
+		return err
+	}
+
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+
+	options := sessions.Options{}
+	if session.Options != nil {
+		options = *session.Options
+	}
+	options.MaxAge = -1
+	session.Options = &options
+
+	if err := s.saveSession(w, r, session); err != nil {
+		return err
+	}
+
+	setCallerInContext(r, nil)
+	return nil
+}
+
+// InvalidateUserSessions logs the user out of every session started before now (e.g. after a password reset).  With a
+// UserSessionStore, the sessions are deleted as well
+func (s *Extension) InvalidateUserSessions(userID string) error {
+	if store, ok := s.userSessionStore(); ok {
+		if err := store.RevokeUserSessions(userID); err != nil {
+			return err
+		}
+	}
+
+	return s.RevocationStore.RevokeUserSessions(userID, time.Now())
+}
+
+// userSessionStore returns the store as a UserSessionStore, if it is one
+func (s *Extension) userSessionStore() (UserSessionStore, bool) {
+	if s.store == nil {
+		return nil, false
+	}
+
+	store, ok := (*s.store).(UserSessionStore)
+	return store, ok
+}
+
+// expireSessionID deletes the data stored under the session's current ID (for server-side stores) and clears the ID,
+// so that the next save assigns a new one.  Cookie stores have no ID, so there's nothing to do for them
+func (s *Extension) expireSessionID(w http.ResponseWriter, r *http.Request, session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+
+	expired := *session
+	expired.Values = map[interface{}]interface{}{}
+	options := sessions.Options{}
+	if session.Options != nil {
+		options = *session.Options
+	}
+	options.MaxAge = -1
+	expired.Options = &options
+
+	if err := expired.Save(r, w); err != nil {
+		return err
+	}
+
+	session.ID = ""
+	session.IsNew = true
+	return nil
+}
+
+// isRevoked states whether the user's sessions were invalidated after the session's auth time
+func (s *Extension) isRevoked(userID string, authTime interface{}) (bool, error) {
+	if s.RevocationStore == nil {
+		return false, nil
+	}
+
+	revokedAt, err := s.RevocationStore.GetRevocationTime(userID)
+	if err != nil || revokedAt == nil {
+		return false, err
+	}
+
+	startedAt, ok := authTime.(int64)
+	return !ok || startedAt <= revokedAt.UnixNano(), nil
 }
 
 func (s *Extension) EnforceLoggedIn(routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
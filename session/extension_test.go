@@ -7,6 +7,7 @@ import (
 	"github.com/markdicksonjr/nibbler"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 )
 
@@ -119,3 +120,127 @@ func TestExtension_EnforceLogin_GetCallerFailPropagates(t *testing.T) {
 
 	// TODO: validate status code, and error
 }
+
+type filesystemStoreConnector struct {
+	directory string
+}
+
+func (f *filesystemStoreConnector) Connect() (error, sessions.Store) {
+	return nil, sessions.NewFilesystemStore(f.directory, []byte("0123456789abcdef0123456789abcdef"))
+}
+
+func (f *filesystemStoreConnector) MaxAge() int {
+	return 3600
+}
+
+// sendWithCookies runs the handler with the cookies from the previous response (if any), returning the new response
+func sendWithCookies(handler http.HandlerFunc, previous *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	if previous != nil {
+		for _, c := range previous.Result().Cookies() {
+			if c.MaxAge >= 0 {
+				req.AddCookie(c)
+			}
+		}
+	}
+
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+func countFiles(t *testing.T, directory string) int {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestExtension_SetCallerRegeneratesSession(t *testing.T) {
+	directory := t.TempDir()
+	e := Extension{
+		SessionName:    "test",
+		StoreConnector: &filesystemStoreConnector{directory: directory},
+	}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an anonymous session is started
+	anonymous := sendWithCookies(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.SetAttribute(w, r, "cart", "3 items"); err != nil {
+			t.Fatal(err)
+		}
+	}, nil)
+
+	// then the user logs in
+	loggedIn := sendWithCookies(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.SetCaller(w, r, &nibbler.User{ID: "bob"}); err != nil {
+			t.Fatal(err)
+		}
+	}, anonymous)
+
+	anonymousCookie := anonymous.Result().Cookies()[0].Value
+	loggedInCookie := loggedIn.Result().Cookies()[len(loggedIn.Result().Cookies())-1].Value
+	if anonymousCookie == loggedInCookie {
+		t.Fatal("the session was not regenerated on login")
+	}
+
+	if countFiles(t, directory) != 1 {
+		t.Fatal("the data for the old session ID was not deleted")
+	}
+
+	// the values carry over to the new session
+	sendWithCookies(func(w http.ResponseWriter, r *http.Request) {
+		if cart, _ := e.GetAttribute(r, "cart"); cart != "3 items" {
+			t.Fatal("the session values were lost when the session was regenerated")
+		}
+
+		if caller, _ := e.GetCaller(r); caller == nil || caller.ID != "bob" {
+			t.Fatal("the caller was not in the regenerated session")
+		}
+	}, loggedIn)
+
+	// logging out removes the session altogether
+	sendWithCookies(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.SetCaller(w, r, nil); err != nil {
+			t.Fatal(err)
+		}
+	}, loggedIn)
+
+	if countFiles(t, directory) != 0 {
+		t.Fatal("the session was not deleted on logout")
+	}
+}
+
+func TestExtension_InvalidateUserSessions(t *testing.T) {
+	store := &MockStore{}
+	store.Session = sessions.NewSession(store, "test")
+	e := Extension{StoreConnector: &MockStoreConnector{Store: store}}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := e.SetCaller(httptest.NewRecorder(), req, &nibbler.User{ID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.InvalidateUserSessions("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if caller, err := e.GetCaller(req); err != nil || caller != nil {
+		t.Fatal("the caller was still logged in after their sessions were invalidated")
+	}
+
+	// logging in again works
+	if err := e.SetCaller(httptest.NewRecorder(), req, &nibbler.User{ID: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if caller, err := e.GetCaller(req); err != nil || caller == nil {
+		t.Fatal("a session started after invalidation was rejected")
+	}
+}
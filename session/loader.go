@@ -0,0 +1,93 @@
+package session
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
+	"sync"
+	"time"
+)
+
+// UserLoader loads users for StoreUserIDOnly mode - user.Extension implements it
+type UserLoader interface {
+	GetUserById(id string) (*nibbler.User, error)
+}
+
+// userCache holds recently-loaded users for StoreUserIDOnly mode
+type userCache struct {
+	ttl     time.Duration
+	entries map[string]cachedUser
+	mutex   sync.Mutex
+}
+
+type cachedUser struct {
+	user     nibbler.User
+	loadedAt time.Time
+}
+
+// get returns the cached user if it was loaded within the TTL, and is at least as new as the given version
+func (c *userCache) get(id string, version time.Time) *nibbler.User {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[id]
+	if !ok || time.Since(entry.loadedAt) > c.ttl || entry.user.UpdatedAt.Before(version) {
+		return nil
+	}
+
+	result := entry.user
+	return &result
+}
+
+func (c *userCache) set(u *nibbler.User) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]cachedUser)
+	}
+
+	// drop expired entries now and then, so users who have gone away don't stay cached
+	if len(c.entries) >= 1000 {
+		for id, entry := range c.entries {
+			if time.Since(entry.loadedAt) > c.ttl {
+				delete(c.entries, id)
+			}
+		}
+	}
+
+	c.entries[u.ID] = cachedUser{user: *u, loadedAt: time.Now()}
+}
+
+func (c *userCache) remove(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, id)
+}
+
+// loadUser returns the (safe) user with the given ID, from the cache if possible.  Deleted and deactivated users are
+// treated as missing
+func (s *Extension) loadUser(id string, version time.Time) (*nibbler.User, error) {
+	if cached := s.userCache.get(id, version); cached != nil {
+		return cached, nil
+	}
+
+	loaded, err := s.UserLoader.GetUserById(id)
+	if err != nil || loaded == nil {
+		return nil, err
+	}
+
+	if !user.IsUserActive(*loaded) {
+		s.Logger.Debug("rejecting session for deleted or deactivated user " + id)
+		return nil, nil
+	}
+
+	safeUser := user.GetSafeUser(*loaded)
+	s.userCache.set(&safeUser)
+	return &safeUser, nil
+}
+
+// RefreshCachedUser drops the user from the cache used in StoreUserIDOnly mode, so that changes to the user are seen
+// by this instance on the next request rather than after UserCacheTTL
+func (s *Extension) RefreshCachedUser(userID string) {
+	s.userCache.remove(userID)
+}
@@ -0,0 +1,84 @@
+package session
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExtension_StoreUserIDOnly(t *testing.T) {
+	app := &nibbler.Application{Logger: nibbler.SilentLogger{}}
+	userExtension := &user.Extension{PersistenceExtension: &user.MockPersistenceExtension{}}
+	if err := userExtension.Init(app); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "Bob"
+	bob, err := userExtension.Create(&nibbler.User{FirstName: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &MockStore{}
+	store.Session = sessions.NewSession(store, "test")
+	e := Extension{
+		StoreConnector:  &MockStoreConnector{Store: store},
+		StoreUserIDOnly: true,
+		UserLoader:      userExtension,
+		UserCacheTTL:    time.Hour,
+	}
+	if err := e.Init(app); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := e.SetCaller(httptest.NewRecorder(), req, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.Session.Values[callerAttribute]; ok {
+		t.Fatal("a snapshot of the user was put into the session")
+	}
+
+	if caller, err := e.GetCaller(req); err != nil || caller == nil || *caller.FirstName != "Bob" {
+		t.Fatal("the caller was not loaded")
+	}
+
+	// changes are seen once the cached user is dropped (or expires)
+	newName := "Robert"
+	bob.FirstName = &newName
+	if err := userExtension.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if caller, _ := e.GetCaller(req); *caller.FirstName != "Bob" {
+		t.Fatal("the user was not cached")
+	}
+
+	e.RefreshCachedUser(bob.ID)
+	if caller, _ := e.GetCaller(req); *caller.FirstName != "Robert" {
+		t.Fatal("the change to the user was not seen")
+	}
+
+	// deactivated users are logged out
+	isActive := false
+	bob.IsActive = &isActive
+	if err := userExtension.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+	e.RefreshCachedUser(bob.ID)
+
+	if caller, err := e.GetCaller(req); err != nil || caller != nil {
+		t.Fatal("a deactivated user was still logged in")
+	}
+}
+
+func TestExtension_StoreUserIDOnlyNeedsLoader(t *testing.T) {
+	e := Extension{StoreConnector: &MockStoreConnector{Store: &MockStore{}}, StoreUserIDOnly: true}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err == nil {
+		t.Fatal("init succeeded without a user loader")
+	}
+}
@@ -40,3 +40,11 @@ type MockStoreFailedGet struct {
 func (m *MockStoreFailedGet) Get(r *http.Request, name string) (*sessions.Session, error) {
 	return m.Session, m.ErrOnGet
 }
+
+// NewMockExtension returns a (not yet initialized) session extension on a MockStore, for tests.  Every request shares
+// the store's single session, so a caller set in one request is the caller of the next
+func NewMockExtension() *Extension {
+	store := &MockStore{}
+	store.Session = sessions.NewSession(store, "test")
+	return &Extension{StoreConnector: &MockStoreConnector{Store: store}}
+}
@@ -0,0 +1,42 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationStore records when all of a user's sessions were invalidated.  Sessions for the user that were started
+// (i.e. logged into) before that time are treated as logged out.  Use a shared implementation if the app runs on more
+// than one instance
+type RevocationStore interface {
+	RevokeUserSessions(userID string, at time.Time) error
+	GetRevocationTime(userID string) (*time.Time, error)
+}
+
+// MemoryRevocationStore is a RevocationStore for a single instance.  Revocations don't survive a restart
+type MemoryRevocationStore struct {
+	revocations map[string]time.Time
+	mutex       sync.RWMutex
+}
+
+func (m *MemoryRevocationStore) RevokeUserSessions(userID string, at time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.revocations == nil {
+		m.revocations = make(map[string]time.Time)
+	}
+	m.revocations[userID] = at
+	return nil
+}
+
+func (m *MemoryRevocationStore) GetRevocationTime(userID string) (*time.Time, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	at, ok := m.revocations[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &at, nil
+}
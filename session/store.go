@@ -0,0 +1,359 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserIDAttribute is the session attribute holding the caller's ID (set by SetCaller), which server-side stores use to
+// index sessions by user
+const UserIDAttribute = "userId"
+
+var errSessionNotFound = errors.New("session not found")
+
+// UserSessionStore is implemented by stores that can find and revoke a user's sessions (i.e. server-side stores)
+type UserSessionStore interface {
+	sessions.Store
+	ListUserSessions(userID string) ([]SessionInfo, error)
+	RevokeSession(sessionID string) error
+	RevokeUserSessions(userID string) error
+}
+
+// SessionInfo describes a session held by a server-side store
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// record is what a ServerStore keeps for each session
+type record struct {
+	Info SessionInfo
+	Data []byte // the gob-encoded session values
+}
+
+// backend persists the records for a ServerStore
+type backend interface {
+	load(id string) (*record, error) // returns errSessionNotFound if there's no record
+	save(r *record) error
+	delete(id string) error
+	list() ([]SessionInfo, error)
+}
+
+// ServerStore is a sessions.Store (and UserSessionStore) that keeps session values on the server, with only the signed
+// session ID in the cookie.  Expired sessions are swept on an interval, and sessions are indexed by the caller's ID
+type ServerStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	backend      backend
+	userIndex    map[string]map[string]bool // user ID to session IDs
+	sessionUsers map[string]string          // session ID to user ID
+	mutex        sync.Mutex
+	stop         chan struct{}
+}
+
+// NewMemoryStore creates a ServerStore that keeps sessions in memory (so they don't survive a restart, and aren't
+// shared between instances).  keyPairs are as for sessions.NewCookieStore, but only the session ID is encoded with them
+func NewMemoryStore(keyPairs ...[]byte) *ServerStore {
+	store, _ := newServerStore(&memoryBackend{records: make(map[string]*record)}, keyPairs...)
+	return store
+}
+
+// NewFileStore creates a ServerStore that keeps each session in a file in the directory (which is created if needed)
+func NewFileStore(directory string, keyPairs ...[]byte) (*ServerStore, error) {
+	fb, err := newFileBackend(directory)
+	if err != nil {
+		return nil, err
+	}
+	return newServerStore(fb, keyPairs...)
+}
+
+func newServerStore(b backend, keyPairs ...[]byte) (*ServerStore, error) {
+	store := &ServerStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   86400 * 30,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		backend:      b,
+		userIndex:    make(map[string]map[string]bool),
+		sessionUsers: make(map[string]string),
+	}
+
+	// build the index from any sessions that are already stored
+	infos, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info := range infos {
+		store.index(info.UserID, info.ID)
+	}
+
+	return store, nil
+}
+
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session for the request's cookie, or a new session if there's no cookie (or its session has expired
+// or been revoked).  An error is returned if the cookie can't be decoded
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.Codecs...); err != nil {
+		session.ID = ""
+		return session, err
+	}
+
+	rec, err := s.backend.load(session.ID)
+	if err == errSessionNotFound || (err == nil && rec.Info.ExpiresAt.Before(time.Now())) {
+		session.ID = ""
+		return session, nil
+	}
+
+	if err != nil {
+		return session, err
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(rec.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+
+	session.IsNew = false
+	return session, nil
+}
+
+// Save stores the session and writes its cookie.  A negative MaxAge deletes the session
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.RevokeSession(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	info := SessionInfo{
+		ID:        session.ID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+	}
+	info.UserID, _ = session.Values[UserIDAttribute].(string)
+
+	if info.ID == "" {
+		id, err := generateSessionID()
+		if err != nil {
+			return err
+		}
+		info.ID = id
+	} else if existing, err := s.backend.load(info.ID); err == nil {
+		info.CreatedAt = existing.Info.CreatedAt
+	}
+
+	data := bytes.Buffer{}
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	err := s.backend.save(&record{Info: info, Data: data.Bytes()})
+	if err == nil {
+		s.unindex(info.ID)
+		s.index(info.UserID, info.ID)
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), info.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	session.ID = info.ID
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// ListUserSessions lists the user's sessions that haven't expired
+func (s *ServerStore) ListUserSessions(userID string) ([]SessionInfo, error) {
+	s.mutex.Lock()
+	var ids []string
+	for id := range s.userIndex[userID] {
+		ids = append(ids, id)
+	}
+	s.mutex.Unlock()
+
+	now := time.Now()
+	result := []SessionInfo{}
+	for _, id := range ids {
+		rec, err := s.backend.load(id)
+		if err == errSessionNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if rec.Info.ExpiresAt.After(now) {
+			result = append(result, rec.Info)
+		}
+	}
+
+	return result, nil
+}
+
+// RevokeSession deletes the session, logging out whoever is using it
+func (s *ServerStore) RevokeSession(sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.backend.delete(sessionID); err != nil && err != errSessionNotFound {
+		return err
+	}
+
+	s.unindex(sessionID)
+	return nil
+}
+
+// RevokeUserSessions deletes all of the user's sessions
+func (s *ServerStore) RevokeUserSessions(userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id := range s.userIndex[userID] {
+		if err := s.backend.delete(id); err != nil && err != errSessionNotFound {
+			return err
+		}
+		s.unindex(id)
+	}
+	return nil
+}
+
+// Sweep deletes expired sessions, returning how many were deleted
+func (s *ServerStore) Sweep() (int, error) {
+	infos, err := s.backend.list()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	count := 0
+	for _, info := range infos {
+		if info.ExpiresAt.After(now) {
+			continue
+		}
+
+		if err := s.RevokeSession(info.ID); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// StartSweeping runs Sweep on the interval until Close is called
+func (s *ServerStore) StartSweeping(interval time.Duration, onError func(err error)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := s.Sweep(); err != nil && onError != nil {
+					onError(err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops sweeping
+func (s *ServerStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	return nil
+}
+
+// index and unindex must be called with the mutex held
+func (s *ServerStore) index(userID string, sessionID string) {
+	if userID == "" {
+		return
+	}
+
+	if s.userIndex[userID] == nil {
+		s.userIndex[userID] = make(map[string]bool)
+	}
+	s.userIndex[userID][sessionID] = true
+	s.sessionUsers[sessionID] = userID
+}
+
+func (s *ServerStore) unindex(sessionID string) {
+	userID, ok := s.sessionUsers[sessionID]
+	if !ok {
+		return
+	}
+
+	delete(s.sessionUsers, sessionID)
+	delete(s.userIndex[userID], sessionID)
+	if len(s.userIndex[userID]) == 0 {
+		delete(s.userIndex, userID)
+	}
+}
+
+// generateSessionID returns a random ID that is safe to use as a file name
+func generateSessionID() (string, error) {
+	idBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimRight(base32.StdEncoding.EncodeToString(idBytes), "=")), nil
+}
@@ -0,0 +1,158 @@
+package session
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"github.com/micro/go-micro/config/source"
+	"github.com/micro/go-micro/config/source/memory"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// newTestExtension initializes a session extension around the store
+func newTestExtension(t *testing.T, store *ServerStore) *Extension {
+	e := &Extension{
+		SessionName:    "test",
+		StoreConnector: &MockStoreConnector{Store: store},
+	}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// logIn puts the user into a new session, returning the response (with its cookie)
+func logIn(t *testing.T, e *Extension, userID string) *httptest.ResponseRecorder {
+	return sendWithCookies(func(w http.ResponseWriter, r *http.Request) {
+		if err := e.SetCaller(w, r, &nibbler.User{ID: userID}); err != nil {
+			t.Fatal(err)
+		}
+	}, nil)
+}
+
+// callerFor returns the caller for a request with the response's cookie
+func callerFor(t *testing.T, e *Extension, previous *httptest.ResponseRecorder) *nibbler.User {
+	var caller *nibbler.User
+	sendWithCookies(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if caller, err = e.GetCaller(r); err != nil {
+			t.Fatal(err)
+		}
+	}, previous)
+	return caller
+}
+
+func TestServerStore_UserSessions(t *testing.T) {
+	store := NewMemoryStore(testKey)
+	e := newTestExtension(t, store)
+
+	first := logIn(t, e, "bob")
+	second := logIn(t, e, "bob")
+	other := logIn(t, e, "alice")
+
+	if caller := callerFor(t, e, first); caller == nil || caller.ID != "bob" {
+		t.Fatal("the session was not loaded from the store")
+	}
+
+	bobSessions, err := store.ListUserSessions("bob")
+	if err != nil || len(bobSessions) != 2 {
+		t.Fatal("the user's sessions were not listed")
+	}
+
+	// revoke a single session
+	if err := store.RevokeSession(bobSessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if bobSessions, _ = store.ListUserSessions("bob"); len(bobSessions) != 1 {
+		t.Fatal("the session was not revoked")
+	}
+
+	// revoke the rest of the user's sessions
+	if err := e.InvalidateUserSessions("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	if callerFor(t, e, first) != nil || callerFor(t, e, second) != nil {
+		t.Fatal("a revoked session was still logged in")
+	}
+
+	if caller := callerFor(t, e, other); caller == nil || caller.ID != "alice" {
+		t.Fatal("another user's session was revoked")
+	}
+}
+
+func TestServerStore_Sweep(t *testing.T) {
+	store := NewMemoryStore(testKey)
+	store.Options.MaxAge = 1
+	e := newTestExtension(t, store)
+
+	res := logIn(t, e, "bob")
+	if count, _ := store.Sweep(); count != 0 {
+		t.Fatal("a live session was swept")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if callerFor(t, e, res) != nil {
+		t.Fatal("an expired session was loaded")
+	}
+
+	if count, _ := store.Sweep(); count != 1 {
+		t.Fatal("the expired session was not swept")
+	}
+
+	if sessionList, _ := store.ListUserSessions("bob"); len(sessionList) != 0 {
+		t.Fatal("the swept session is still indexed")
+	}
+}
+
+func TestFileStore_SurvivesRestart(t *testing.T) {
+	directory := t.TempDir()
+	store, err := NewFileStore(directory, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := logIn(t, newTestExtension(t, store), "bob")
+
+	// a new store over the same directory picks up the session, and its index
+	restarted, err := NewFileStore(directory, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestExtension(t, restarted)
+
+	if caller := callerFor(t, e, res); caller == nil || caller.ID != "bob" {
+		t.Fatal("the session did not survive a restart")
+	}
+
+	if sessionList, _ := restarted.ListUserSessions("bob"); len(sessionList) != 1 {
+		t.Fatal("the user index was not rebuilt")
+	}
+}
+
+func TestExtension_InitFromConfig(t *testing.T) {
+	conf, err := nibbler.GetConfigurationFromSources([]source.Source{
+		memory.NewSource(memory.WithJSON([]byte(`{"session": {"authentication": {"key": "a-key"}, "store": "memory"}}`))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := Extension{}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}, Config: &nibbler.Configuration{Raw: conf}}); err != nil {
+		t.Fatal(err)
+	}
+	defer e.Destroy(nil)
+
+	if _, ok := e.StoreConnector.(*MemoryStoreConnector); !ok {
+		t.Fatal("the connector was not created from config")
+	}
+
+	if _, ok := e.userSessionStore(); !ok {
+		t.Fatal("the memory store was not used")
+	}
+}
@@ -0,0 +1,328 @@
+package admin
+
+import (
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"github.com/markdicksonjr/nibbler/user/auth/jwt"
+	"github.com/markdicksonjr/nibbler/user/auth/local"
+	"github.com/markdicksonjr/nibbler/user/group"
+	"strings"
+	"time"
+)
+
+// the (resource-agnostic) actions required by the admin routes - grant them globally, e.g. with an admin role
+const ListUsersAction = "list-users"
+const GetUserAction = "get-user"
+const CreateUserAction = "create-user"
+const UpdateUserAction = "update-user"
+const UpdateUserIdentityAction = "update-user-identity" // also required to change a user's email or username
+const DeactivateUserAction = "deactivate-user"
+const ReactivateUserAction = "reactivate-user"
+const ResetUserPasswordAction = "reset-user-password"
+const VerifyUserEmailAction = "verify-user-email"
+
+// ErrUserNotFound is returned when there's no (non-deleted) user with the given ID
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserTaken is returned when another user already has the email or username
+var ErrUserTaken = errors.New("the email or username is already in use")
+
+// Profile is the user fields administrators can set.  Nil fields are left as they are, and an empty string clears a
+// field (other than the email and username)
+type Profile struct {
+	Email           *string `json:"email,omitempty"`
+	Username        *string `json:"username,omitempty"`
+	FirstName       *string `json:"firstName,omitempty"`
+	MiddleName      *string `json:"middleName,omitempty"`
+	LastName        *string `json:"lastName,omitempty"`
+	Title           *string `json:"title,omitempty"`
+	PhoneWork       *string `json:"phoneWork,omitempty"`
+	PhoneMobile     *string `json:"phoneMobile,omitempty"`
+	CompanyID       *string `json:"companyId,omitempty"`
+	EmployeeID      *string `json:"employeeId,omitempty"`
+	SupervisorID    *string `json:"supervisorId,omitempty"`
+	ReferenceID     *string `json:"referenceId,omitempty"`
+	PrimaryLocation *string `json:"primaryLocation,omitempty"`
+}
+
+// Extension provides routes for administrators to manage users (see README).  Each route is protected by the group
+// extension's EnforceHasPrivilege, and only ever responds with safe versions of users
+type Extension struct {
+	nibbler.NoOpExtension
+
+	UserExtension    *user.Extension
+	GroupExtension   *nibbler_user_group.Extension // authorizes the routes
+	SessionExtension *session.Extension            // optional - logs out users who are deactivated or have their password reset
+	CallerResolver   nibbler.CallerResolver        // identifies the administrator, defaults to SessionExtension
+
+	// optional - revokes the tokens of users who are deactivated or have their password reset (it needs a
+	// RevocationStore).  Not needed if its RevocationStore is the session extension's
+	JWTExtension *jwt.Extension
+
+	// optional - emails invitations to created users, and forced password resets (password reset must be enabled)
+	AuthExtension *local.Extension
+
+	DisableDefaultRoutes bool
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.UserExtension == nil {
+		return errors.New(s.GetName() + " requires a user extension but none was provided")
+	}
+
+	if s.GroupExtension == nil {
+		return errors.New(s.GetName() + " requires a group extension but none was provided")
+	}
+
+	if s.SessionExtension == nil && s.CallerResolver == nil {
+		return errors.New(s.GetName() + " requires a session extension or caller resolver but none was provided")
+	}
+
+	if s.JWTExtension != nil && s.JWTExtension.RevocationStore == nil {
+		return errors.New(s.GetName() + " was given a jwt extension that can't revoke tokens - it needs a RevocationStore")
+	}
+	return nil
+}
+
+// PostInit adds the default routes, unless they're disabled
+func (s *Extension) PostInit(app *nibbler.Application) error {
+	if app.Router == nil || s.DisableDefaultRoutes {
+		return nil
+	}
+
+	prefix := app.Config.ApiPrefix + "/admin/user"
+	app.Router.HandleFunc(prefix, s.GroupExtension.EnforceHasPrivilege(ListUsersAction, s.UserExtension.SearchUsersRequestHandler)).Methods("GET")
+	app.Router.HandleFunc(prefix, s.GroupExtension.EnforceHasPrivilege(CreateUserAction, s.CreateUserRequestHandler)).Methods("PUT")
+	app.Router.HandleFunc(prefix+"/{userId}", s.GroupExtension.EnforceHasPrivilege(GetUserAction, s.GetUserRequestHandler)).Methods("GET")
+	app.Router.HandleFunc(prefix+"/{userId}", s.GroupExtension.EnforceHasPrivilege(UpdateUserAction, s.UpdateUserRequestHandler)).Methods("PATCH")
+	app.Router.HandleFunc(prefix+"/{userId}/deactivate", s.GroupExtension.EnforceHasPrivilege(DeactivateUserAction, s.DeactivateUserRequestHandler)).Methods("POST")
+	app.Router.HandleFunc(prefix+"/{userId}/reactivate", s.GroupExtension.EnforceHasPrivilege(ReactivateUserAction, s.ReactivateUserRequestHandler)).Methods("POST")
+	app.Router.HandleFunc(prefix+"/{userId}/password-reset", s.GroupExtension.EnforceHasPrivilege(ResetUserPasswordAction, s.ResetUserPasswordRequestHandler)).Methods("POST")
+	app.Router.HandleFunc(prefix+"/{userId}/verify-email", s.GroupExtension.EnforceHasPrivilege(VerifyUserEmailAction, s.VerifyUserEmailRequestHandler)).Methods("POST")
+	return nil
+}
+
+func (s *Extension) GetName() string {
+	return "user-admin"
+}
+
+// callerResolver returns the CallerResolver, or the session extension if none was provided
+func (s *Extension) callerResolver() nibbler.CallerResolver {
+	return nibbler.ResolverOrDefault(s.CallerResolver, s.SessionExtension)
+}
+
+// getUser returns the (non-deleted) user with the ID, or ErrUserNotFound
+func (s *Extension) getUser(userId string) (*nibbler.User, error) {
+	userValue, err := s.UserExtension.GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if userValue == nil || userValue.DeletedAt != nil {
+		return nil, ErrUserNotFound
+	}
+	return userValue, nil
+}
+
+// CreateUser creates an (active) user with the profile, which needs an email or a username.  The user has no password,
+// so they need to be invited (see InviteUser) or to reset their password before they can log in
+func (s *Extension) CreateUser(profile Profile, createdBy *nibbler.User) (*nibbler.User, error) {
+	isActive := true
+	userValue := &nibbler.User{IsActive: &isActive}
+	if createdBy != nil {
+		userValue.CreatedByUserID = &createdBy.ID
+	}
+
+	if err := s.applyProfile(userValue, profile); err != nil {
+		return nil, err
+	}
+
+	if userValue.Email == nil && userValue.Username == nil {
+		return nil, errors.New("an email or username is required")
+	}
+	return s.UserExtension.Create(userValue)
+}
+
+// UpdateUserProfile sets the profile fields of the user.  Changing the email marks it unverified, and invalidates any
+// password reset or login link sent to the old address
+func (s *Extension) UpdateUserProfile(userId string, profile Profile) (*nibbler.User, error) {
+	userValue, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.applyProfile(userValue, profile); err != nil {
+		return nil, err
+	}
+
+	if err := s.UserExtension.Update(userValue); err != nil {
+		return nil, err
+	}
+	return userValue, nil
+}
+
+// ResetUserPassword clears the user's password, so it can no longer be used to log in, and logs them out everywhere
+// (if there's a session extension).  They'll need to reset their password (e.g. with SendPasswordResetEmail)
+func (s *Extension) ResetUserPassword(userId string) (*nibbler.User, error) {
+	userValue, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	userValue.Password = nil
+	if err := s.UserExtension.UpdatePassword(userValue); err != nil {
+		return nil, err
+	}
+	return userValue, s.invalidateSessions(userValue.ID)
+}
+
+// DeactivateUser marks the user inactive, so they can no longer log in, and logs them out everywhere (if there's a
+// session extension)
+func (s *Extension) DeactivateUser(userId string) (*nibbler.User, error) {
+	userValue, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	isActive := false
+	now := time.Now()
+	userValue.IsActive = &isActive
+	if userValue.DeactivatedAt == nil {
+		userValue.DeactivatedAt = &now
+	}
+
+	if err := s.UserExtension.Update(userValue); err != nil {
+		return nil, err
+	}
+	return userValue, s.invalidateSessions(userValue.ID)
+}
+
+// ReactivateUser undoes DeactivateUser
+func (s *Extension) ReactivateUser(userId string) (*nibbler.User, error) {
+	userValue, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	isActive := true
+	userValue.IsActive = &isActive
+	userValue.DeactivatedAt = nil
+
+	if err := s.UserExtension.Update(userValue); err != nil {
+		return nil, err
+	}
+	return userValue, nil
+}
+
+// VerifyUserEmail marks the user's email verified, as if they had followed the verification link
+func (s *Extension) VerifyUserEmail(userId string) (*nibbler.User, error) {
+	userValue, err := s.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if userValue.Email == nil {
+		return nil, errors.New("the user has no email")
+	}
+
+	isTrue := true
+	userValue.IsEmailValidated = &isTrue
+	userValue.EmailValidationToken = nil
+	userValue.EmailValidationExpiration = nil
+
+	if err := s.UserExtension.Update(userValue); err != nil {
+		return nil, err
+	}
+	return userValue, nil
+}
+
+// applyProfile sets the profile's (non-nil) fields on the user, checking that the email and username aren't taken
+func (s *Extension) applyProfile(userValue *nibbler.User, profile Profile) error {
+	if profile.Email != nil {
+		email := strings.TrimSpace(*profile.Email)
+		if email == "" {
+			return errors.New("email cannot be blank")
+		}
+
+		if userValue.Email == nil || *userValue.Email != email {
+			if existing, err := s.UserExtension.GetUserByEmail(email); err != nil {
+				return err
+			} else if existing != nil && existing.ID != userValue.ID {
+				return ErrUserTaken
+			}
+
+			// links sent to the old address must not work once it's no longer the user's
+			isFalse := false
+			userValue.Email = &email
+			userValue.IsEmailValidated = &isFalse
+			userValue.PasswordResetToken = nil
+			userValue.PasswordResetExpiration = nil
+			userValue.LoginToken = nil
+			userValue.LoginTokenExpiration = nil
+		}
+	}
+
+	if profile.Username != nil {
+		username := strings.TrimSpace(*profile.Username)
+		if username == "" {
+			return errors.New("username cannot be blank")
+		}
+
+		if existing, err := s.UserExtension.GetUserByUsername(username); err != nil {
+			return err
+		} else if existing != nil && existing.ID != userValue.ID {
+			return ErrUserTaken
+		}
+		userValue.Username = &username
+	}
+
+	for _, field := range []struct {
+		value  *string
+		target **string
+	}{
+		{profile.FirstName, &userValue.FirstName},
+		{profile.MiddleName, &userValue.MiddleName},
+		{profile.LastName, &userValue.LastName},
+		{profile.Title, &userValue.Title},
+		{profile.PhoneWork, &userValue.PhoneWork},
+		{profile.PhoneMobile, &userValue.PhoneMobile},
+		{profile.CompanyID, &userValue.CompanyID},
+		{profile.EmployeeID, &userValue.EmployeeID},
+		{profile.SupervisorID, &userValue.SupervisorID},
+		{profile.ReferenceID, &userValue.ReferenceID},
+		{profile.PrimaryLocation, &userValue.PrimaryLocation},
+	} {
+		if field.value == nil {
+			continue
+		}
+
+		if *field.value == "" {
+			*field.target = nil
+		} else {
+			value := *field.value
+			*field.target = &value
+		}
+	}
+	return nil
+}
+
+// invalidateSessions logs the user out everywhere - their sessions (if there's a session extension) and their tokens
+// (if there's a jwt extension)
+func (s *Extension) invalidateSessions(userId string) error {
+	if s.SessionExtension != nil {
+		if err := s.SessionExtension.InvalidateUserSessions(userId); err != nil {
+			return err
+		}
+	}
+
+	if s.JWTExtension != nil {
+		return s.JWTExtension.RevokeUserTokens(userId)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/memory"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"github.com/markdicksonjr/nibbler/user/auth/jwt"
+	"github.com/markdicksonjr/nibbler/user/auth/local"
+	"github.com/markdicksonjr/nibbler/user/group"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImplements(t *testing.T) {
+	e := Extension{}
+	var base nibbler.Extension = &e
+	if base == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+type testApp struct {
+	extension *Extension
+	router    *mux.Router
+	sender    *memory.Sender
+	jwt       *jwt.Extension // with its own RevocationStore, not the session extension's
+	admin     *nibbler.User  // with every admin privilege
+	member    *nibbler.User  // with no privileges
+}
+
+func newTestApp(t *testing.T) *testApp {
+	app := &nibbler.Application{
+		Config: &nibbler.Configuration{ApiPrefix: "/api"},
+		Logger: nibbler.SilentLogger{},
+		Router: mux.NewRouter(),
+	}
+
+	userExtension := &user.Extension{PersistenceExtension: &user.MockPersistenceExtension{}}
+	callerResolver := user.HeaderCallerResolver{UserExtension: userExtension}
+
+	sessionExtension := session.NewMockExtension()
+
+	groupExtension := &nibbler_user_group.Extension{
+		PersistenceExtension: &nibbler_user_group.MockPersistenceExtension{},
+		CallerResolver:       callerResolver,
+		UserExtension:        userExtension,
+		DisableDefaultRoutes: true,
+	}
+
+	sender := &memory.Sender{}
+	authExtension := &local.Extension{
+		SessionExtension:       sessionExtension,
+		UserExtension:          userExtension,
+		Sender:                 sender,
+		TokenHashKey:           []byte("test-key"),
+		PasswordResetEnabled:   true,
+		PasswordResetFromName:  "Admin",
+		PasswordResetFromEmail: "admin@example.com",
+		PasswordResetRedirect:  "https://example.com/reset",
+	}
+
+	jwtExtension := &jwt.Extension{
+		UserExtension:        userExtension,
+		SigningKey:           []byte("a-test-signing-key-of-at-least-32-bytes"),
+		RevocationStore:      &session.MemoryRevocationStore{},
+		DisableDefaultRoutes: true,
+	}
+
+	e := &Extension{
+		UserExtension:    userExtension,
+		GroupExtension:   groupExtension,
+		SessionExtension: sessionExtension,
+		CallerResolver:   callerResolver,
+		JWTExtension:     jwtExtension,
+		AuthExtension:    authExtension,
+	}
+
+	for _, x := range []nibbler.Extension{userExtension, sessionExtension, groupExtension, authExtension, jwtExtension, e} {
+		if err := x.Init(app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, x := range []nibbler.Extension{groupExtension, e} {
+		if err := x.PostInit(app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	admins, err := groupExtension.CreateGroup("admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{ListUsersAction, GetUserAction, CreateUserAction, UpdateUserAction,
+		UpdateUserIdentityAction, DeactivateUserAction, ReactivateUserAction, ResetUserPasswordAction, VerifyUserEmailAction} {
+		if err := groupExtension.AddPrivilegeToGroups([]string{admins.ID}, "", action); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	adminEmail := "admin@example.com"
+	admin, err := userExtension.Create(&nibbler.User{Email: &adminEmail, CurrentGroupID: &admins.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memberEmail := "member@example.com"
+	member, err := userExtension.Create(&nibbler.User{Email: &memberEmail})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testApp{extension: e, router: app.Router, sender: sender, jwt: jwtExtension, admin: admin, member: member}
+}
+
+func (a *testApp) send(caller *nibbler.User, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if caller != nil {
+		req.Header.Set(user.CallerIDHeader, caller.ID)
+	}
+
+	res := httptest.NewRecorder()
+	a.router.ServeHTTP(res, req)
+	return res
+}
+
+// sendForUser sends the request as the admin, expecting a 200 with a user
+func (a *testApp) sendForUser(t *testing.T, method string, path string, body string) map[string]interface{} {
+	res := a.send(a.admin, method, path, body)
+	if res.Code != http.StatusOK {
+		t.Fatal("got " + res.Body.String() + " from " + method + " " + path)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestExtension_RoutesRequirePrivileges(t *testing.T) {
+	a := newTestApp(t)
+
+	if res := a.send(nil, "GET", "/api/admin/user", ""); res.Code != http.StatusUnauthorized {
+		t.Fatal("an anonymous caller was not rejected")
+	}
+
+	for _, path := range []string{"/api/admin/user", "/api/admin/user/" + a.admin.ID} {
+		if res := a.send(a.member, "GET", path, ""); res.Code != http.StatusNotFound {
+			t.Fatal("a member without privileges could use " + path)
+		}
+	}
+
+	if res := a.send(a.member, "POST", "/api/admin/user/"+a.admin.ID+"/deactivate", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a member without privileges deactivated a user")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/admin/user?q=member", ""); res.Code != http.StatusOK ||
+		!strings.Contains(res.Body.String(), "member@example.com") || strings.Contains(res.Body.String(), "admin@example.com") {
+		t.Fatal("the admin could not search users")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/admin/user/nobody", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a missing user was not a 404")
+	}
+}
+
+func TestExtension_CreateAndUpdateUser(t *testing.T) {
+	a := newTestApp(t)
+
+	created := a.sendForUser(t, "PUT", "/api/admin/user", `{"email": "new@example.com", "firstName": "New", "invite": true}`)
+	if created["email"] != "new@example.com" || created["isActive"] != true || created["createdByUserId"] != a.admin.ID {
+		t.Fatal("the user was not created from the body")
+	}
+
+	if _, ok := created["passwordResetToken"]; ok {
+		t.Fatal("the created user was not made safe")
+	}
+
+	for i := 0; i < 100 && len(a.sender.Messages()) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(a.sender.Messages()) != 1 || a.sender.Last().To[0].Address != "new@example.com" ||
+		!strings.Contains(a.sender.Last().PlainTextContent, "https://example.com/reset?token=") {
+		t.Fatal("the created user was not invited")
+	}
+
+	if res := a.send(a.admin, "PUT", "/api/admin/user", `{"email": "member@example.com"}`); res.Code != http.StatusBadRequest {
+		t.Fatal("a user was created with a taken email")
+	}
+
+	if res := a.send(a.admin, "PUT", "/api/admin/user", `{"firstName": "Nobody"}`); res.Code != http.StatusInternalServerError {
+		t.Fatal("a user was created without an email or username")
+	}
+
+	id := created["id"].(string)
+	verified := a.sendForUser(t, "POST", "/api/admin/user/"+id+"/verify-email", "")
+	if verified["isEmailValidated"] != true {
+		t.Fatal("the email was not verified")
+	}
+
+	updated := a.sendForUser(t, "PATCH", "/api/admin/user/"+id, `{"email": "renamed@example.com", "firstName": "", "lastName": "Person"}`)
+	if updated["email"] != "renamed@example.com" || updated["lastName"] != "Person" || updated["firstName"] != nil {
+		t.Fatal("the profile was not updated")
+	}
+
+	if updated["isEmailValidated"] != false {
+		t.Fatal("changing the email did not mark it unverified")
+	}
+
+	if res := a.send(a.admin, "PATCH", "/api/admin/user/"+id, `{"email": "admin@example.com"}`); res.Code != http.StatusBadRequest {
+		t.Fatal("a user was given a taken email")
+	}
+
+	if res := a.send(a.admin, "PATCH", "/api/admin/user/"+id, `{"password": "secret"}`); res.Code != http.StatusOK {
+		t.Fatal("an update with an unknown field failed")
+	} else if loaded, _ := a.extension.UserExtension.GetUserById(id); loaded.Password != nil {
+		t.Fatal("the password was set through the profile")
+	}
+}
+
+func TestExtension_DeactivateAndReactivateUser(t *testing.T) {
+	a := newTestApp(t)
+
+	if res := a.send(a.admin, "POST", "/api/admin/user/"+a.admin.ID+"/deactivate", ""); res.Code != http.StatusBadRequest {
+		t.Fatal("the admin deactivated themselves")
+	}
+
+	tokens, err := a.jwt.IssueTokens(a.member)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deactivated := a.sendForUser(t, "POST", "/api/admin/user/"+a.member.ID+"/deactivate", "")
+	if deactivated["isActive"] != false || deactivated["deactivatedAt"] == nil {
+		t.Fatal("the user was not deactivated")
+	}
+
+	if _, err := a.jwt.Verify(tokens.AccessToken, jwt.TokenTypeAccess); err != jwt.ErrInvalidToken {
+		t.Fatal("the deactivated user's token was not revoked")
+	}
+
+	if loaded, _ := a.extension.UserExtension.GetUserById(a.member.ID); user.IsUserActive(*loaded) {
+		t.Fatal("the deactivation was not saved")
+	}
+
+	reactivated := a.sendForUser(t, "POST", "/api/admin/user/"+a.member.ID+"/reactivate", "")
+	if reactivated["isActive"] != true || reactivated["deactivatedAt"] != nil {
+		t.Fatal("the user was not reactivated")
+	}
+}
+
+func TestExtension_ResetUserPassword(t *testing.T) {
+	a := newTestApp(t)
+
+	password := "a-hash"
+	a.member.Password = &password
+	if err := a.extension.UserExtension.UpdatePassword(a.member); err != nil {
+		t.Fatal(err)
+	}
+
+	a.sendForUser(t, "POST", "/api/admin/user/"+a.member.ID+"/password-reset", "")
+
+	for i := 0; i < 100 && len(a.sender.Messages()) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(a.sender.Messages()) != 1 || a.sender.Last().To[0].Address != "member@example.com" {
+		t.Fatal("no password reset email was sent")
+	}
+
+	loaded, _ := a.extension.UserExtension.GetUserById(a.member.ID)
+	if loaded.Password != nil {
+		t.Fatal("the password was not cleared")
+	}
+
+	if loaded.PasswordResetToken == nil {
+		t.Fatal("no password reset token was stored")
+	}
+
+	if revokedAt, _ := a.extension.SessionExtension.RevocationStore.GetRevocationTime(a.member.ID); revokedAt == nil {
+		t.Fatal("the user was not logged out")
+	}
+
+	a.extension.AuthExtension.PasswordResetEnabled = false
+	if res := a.send(a.admin, "POST", "/api/admin/user/"+a.member.ID+"/password-reset", ""); res.Code != http.StatusBadRequest {
+		t.Fatal("a password reset was sent while password reset is disabled")
+	}
+}
+
+func TestExtension_UpdateUserIdentity(t *testing.T) {
+	a := newTestApp(t)
+
+	// an administrator who can update profiles, but not emails or usernames
+	editors, err := a.extension.GroupExtension.CreateGroup("editors")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.extension.GroupExtension.AddPrivilegeToGroups([]string{editors.ID}, "", UpdateUserAction); err != nil {
+		t.Fatal(err)
+	}
+
+	editorEmail := "editor@example.com"
+	editor, err := a.extension.UserExtension.Create(&nibbler.User{Email: &editorEmail, CurrentGroupID: &editors.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(editor, "PATCH", "/api/admin/user/"+a.member.ID, `{"email": "taken-over@example.com"}`); res.Code != http.StatusNotFound {
+		t.Fatal("an email was changed without the identity privilege")
+	}
+
+	if res := a.send(editor, "PATCH", "/api/admin/user/"+a.member.ID, `{"username": "taken-over"}`); res.Code != http.StatusNotFound {
+		t.Fatal("a username was changed without the identity privilege")
+	}
+
+	if res := a.send(editor, "PATCH", "/api/admin/user/"+a.member.ID, `{"firstName": "Renamed"}`); res.Code != http.StatusOK {
+		t.Fatal("the profile could not be updated: " + res.Body.String())
+	}
+
+	// links sent to the old address stop working when the email changes
+	token := "a-token-hash"
+	expiration := time.Now().Add(time.Hour)
+	a.member.PasswordResetToken = &token
+	a.member.PasswordResetExpiration = &expiration
+	a.member.LoginToken = &token
+	a.member.LoginTokenExpiration = &expiration
+	if err := a.extension.UserExtension.Update(a.member); err != nil {
+		t.Fatal(err)
+	}
+
+	a.sendForUser(t, "PATCH", "/api/admin/user/"+a.member.ID, `{"email": "moved@example.com"}`)
+
+	if loaded, _ := a.extension.UserExtension.GetUserById(a.member.ID); loaded.PasswordResetToken != nil ||
+		loaded.PasswordResetExpiration != nil || loaded.LoginToken != nil || loaded.LoginTokenExpiration != nil {
+		t.Fatal("tokens sent to the old email survived the change")
+	}
+}
@@ -0,0 +1,182 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+)
+
+// GetUserRequestHandler responds with the user with the "userId" path param
+func (s *Extension) GetUserRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userValue, err := s.getUser(mux.Vars(r)["userId"])
+	s.writeUser(w, userValue, err)
+}
+
+// CreateUserRequestHandler creates a user from the JSON body (a Profile).  With invite=true (in the body or query
+// string), the user is emailed a link to choose their password
+func (s *Extension) CreateUserRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Profile
+		Invite bool `json:"invite"`
+	}
+
+	if r.Body == nil {
+		nibbler.Write500Json(w, "no body provided")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		nibbler.Write400Json(w, err.Error())
+		return
+	}
+
+	invite := body.Invite || r.URL.Query().Get("invite") == "true"
+	if invite && (s.AuthExtension == nil || !s.AuthExtension.PasswordResetEnabled) {
+		nibbler.Write400Json(w, "invitations are not available")
+		return
+	}
+
+	if invite && body.Email == nil {
+		nibbler.Write400Json(w, "an email is required to invite the user")
+		return
+	}
+
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	userValue, err := s.CreateUser(body.Profile, caller)
+	if err != nil {
+		s.writeUser(w, nil, err)
+		return
+	}
+
+	if invite {
+		if err := s.AuthExtension.SendAccountInvitationEmail(r, userValue); err != nil {
+			s.Logger.Error("while inviting created user " + userValue.ID + ", error = " + err.Error())
+			nibbler.Write500Json(w, "the user was created, but could not be invited")
+			return
+		}
+	}
+
+	s.writeUser(w, userValue, nil)
+}
+
+// UpdateUserRequestHandler sets the profile fields in the JSON body (a Profile) on the user with the "userId" path param.
+// Changing the email or username also requires UpdateUserIdentityAction, as it changes how the user logs in (and where
+// their password reset emails go)
+func (s *Extension) UpdateUserRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var profile Profile
+
+	if r.Body == nil {
+		nibbler.Write500Json(w, "no body provided")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		nibbler.Write400Json(w, err.Error())
+		return
+	}
+
+	if profile.Email != nil || profile.Username != nil {
+		if has, err := s.GroupExtension.CallerHasPrivilege(r, UpdateUserIdentityAction); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		} else if !has {
+			nibbler.Write404Json(w)
+			return
+		}
+	}
+
+	userValue, err := s.UpdateUserProfile(mux.Vars(r)["userId"], profile)
+	s.writeUser(w, userValue, err)
+}
+
+// DeactivateUserRequestHandler deactivates the user with the "userId" path param.  Administrators can't deactivate
+// themselves
+func (s *Extension) DeactivateUserRequestHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	userId := mux.Vars(r)["userId"]
+	if caller != nil && caller.ID == userId {
+		nibbler.Write400Json(w, "you cannot deactivate yourself")
+		return
+	}
+
+	userValue, err := s.DeactivateUser(userId)
+	s.writeUser(w, userValue, err)
+}
+
+// ReactivateUserRequestHandler reactivates the user with the "userId" path param
+func (s *Extension) ReactivateUserRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userValue, err := s.ReactivateUser(mux.Vars(r)["userId"])
+	s.writeUser(w, userValue, err)
+}
+
+// ResetUserPasswordRequestHandler clears the password of the user with the "userId" path param, logs them out
+// everywhere, and emails them a link to choose a new password
+func (s *Extension) ResetUserPasswordRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if s.AuthExtension == nil || !s.AuthExtension.PasswordResetEnabled {
+		nibbler.Write400Json(w, "password reset is not available")
+		return
+	}
+
+	userValue, err := s.getUser(mux.Vars(r)["userId"])
+	if err != nil {
+		s.writeUser(w, nil, err)
+		return
+	}
+
+	if userValue.Email == nil {
+		nibbler.Write400Json(w, "the user has no email")
+		return
+	}
+
+	if userValue, err = s.ResetUserPassword(userValue.ID); err != nil {
+		s.writeUser(w, nil, err)
+		return
+	}
+
+	if err := s.AuthExtension.SendPasswordResetEmail(r, userValue); err != nil {
+		s.Logger.Error("while emailing user " + userValue.ID + " after a password reset, error = " + err.Error())
+		nibbler.Write500Json(w, "the password was reset, but the user could not be emailed")
+		return
+	}
+
+	s.writeUser(w, userValue, nil)
+}
+
+// VerifyUserEmailRequestHandler marks the email of the user with the "userId" path param verified
+func (s *Extension) VerifyUserEmailRequestHandler(w http.ResponseWriter, r *http.Request) {
+	userValue, err := s.VerifyUserEmail(mux.Vars(r)["userId"])
+	s.writeUser(w, userValue, err)
+}
+
+// writeUser responds with the safe version of the user, or the error (a 404 for ErrUserNotFound, and a 400 for
+// ErrUserTaken)
+func (s *Extension) writeUser(w http.ResponseWriter, userValue *nibbler.User, err error) {
+	if err == ErrUserNotFound {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if err == ErrUserTaken {
+		nibbler.Write400Json(w, err.Error())
+		return
+	}
+
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, user.GetSafeUser(*userValue), http.StatusOK)
+}
@@ -0,0 +1,235 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPrefix starts every key, so keys are recognizable (e.g. by secret scanners) and told apart from other bearer tokens
+const KeyPrefix = "nbk_"
+
+// lastUsedInterval limits how often a key's LastUsedAt is written
+const lastUsedInterval = time.Minute
+
+// APIKey is a key a user has created to call APIs as themselves, without a session.  Only a hash of the key is stored
+type APIKey struct {
+	ID         string     `json:"id" bson:"_id" gorm:"primary_key"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	UserID     string     `json:"userId" gorm:"index"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // the start of the key, so the user can tell their keys apart
+	Hash       string     `json:"-" gorm:"unique"`
+	Scopes     string     `json:"scopes"` // space-separated, see nibbler.ScopedCallerResolver
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+}
+
+// ScopeList returns the key's scopes
+func (k APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// IsUsable states whether the key has neither been revoked nor expired
+func (k APIKey) IsUsable(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+type PersistenceExtension interface {
+	CreateAPIKey(key APIKey) error
+	GetAPIKeyByHash(hash string) (*APIKey, error)
+	GetAPIKeysForUser(userId string) ([]APIKey, error)
+	UpdateAPIKey(key APIKey) error
+}
+
+// Extension authenticates "Authorization: Bearer" requests made with API keys, and provides routes for logged-in users
+// to manage their keys.  It implements nibbler.ScopedCallerResolver, so the group extension restricts key-authenticated
+// requests to the key's scopes
+type Extension struct {
+	nibbler.NoOpExtension
+
+	PersistenceExtension PersistenceExtension
+	UserExtension        *user.Extension
+	SessionExtension     *session.Extension
+	CallerResolver       nibbler.CallerResolver // identifies who is managing keys, defaults to SessionExtension
+
+	DefaultExpirationDays *int // for keys created without an expiry - nil means they don't expire
+	MaxExpirationDays     *int // if set, keys can't be created without an expiry, or with a later one
+
+	DisableDefaultRoutes bool
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.PersistenceExtension == nil {
+		return errors.New(s.GetName() + " requires a persistence extension but none was provided")
+	}
+
+	if s.UserExtension == nil {
+		return errors.New(s.GetName() + " requires a user extension but none was provided")
+	}
+
+	if s.SessionExtension == nil && s.CallerResolver == nil {
+		return errors.New(s.GetName() + " requires a session extension or caller resolver but none was provided")
+	}
+	return nil
+}
+
+// PostInit adds the middleware that authenticates each request's key once, and the default routes
+func (s *Extension) PostInit(app *nibbler.Application) error {
+	if app.Router == nil {
+		return nil
+	}
+
+	app.Router.Use(s.Middleware)
+
+	if !s.DisableDefaultRoutes {
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/user/api-key", s.enforceManager(s.ListKeysHandler)).Methods("GET")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/user/api-key", s.enforceManager(s.CreateKeyHandler)).Methods("POST")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/user/api-key/{keyId}", s.enforceManager(s.UpdateKeyHandler)).Methods("PATCH")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/user/api-key/{keyId}", s.enforceManager(s.RevokeKeyHandler)).Methods("DELETE")
+	}
+	return nil
+}
+
+func (s *Extension) GetName() string {
+	return "api-key"
+}
+
+// GetModels provides all relevant models for stuff like SQLExtension initialization
+func GetModels() []interface{} {
+	return []interface{}{APIKey{}}
+}
+
+// authenticated is the outcome of authenticating a request's key
+type authenticated struct {
+	key    *APIKey
+	caller *nibbler.User
+	err    error
+}
+
+type authenticatedContextKey struct{}
+
+type authenticatedEntry struct {
+	once   sync.Once
+	result authenticated
+}
+
+// Middleware authenticates the request's key (if any) once, for every GetCaller and GetCallerScopes on the request
+func (s *Extension) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(authenticatedContextKey{}).(*authenticatedEntry); !ok {
+			r = r.WithContext(context.WithValue(r.Context(), authenticatedContextKey{}, &authenticatedEntry{}))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetCaller returns the owner of the request's API key (as the session extension would), or nil if the request has no
+// valid key.  Requests with other bearer tokens are left to other resolvers
+func (s *Extension) GetCaller(r *http.Request) (*nibbler.User, error) {
+	result := s.authenticate(r)
+	return result.caller, result.err
+}
+
+// GetCallerScopes returns the scopes of the request's API key - requests without a key aren't restricted
+func (s *Extension) GetCallerScopes(r *http.Request) ([]string, bool, error) {
+	result := s.authenticate(r)
+	if result.err != nil || result.key == nil {
+		return nil, false, result.err
+	}
+	return result.key.ScopeList(), true, nil
+}
+
+func (s *Extension) authenticate(r *http.Request) authenticated {
+	entry, ok := r.Context().Value(authenticatedContextKey{}).(*authenticatedEntry)
+	if !ok {
+		return s.authenticateKey(r)
+	}
+
+	entry.once.Do(func() {
+		entry.result = s.authenticateKey(r)
+	})
+
+	result := entry.result
+	if result.caller != nil {
+		caller := *result.caller
+		result.caller = &caller
+	}
+	return result
+}
+
+func (s *Extension) authenticateKey(r *http.Request) authenticated {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return authenticated{}
+	}
+
+	token := strings.TrimSpace(authorization[7:])
+	if !strings.HasPrefix(token, KeyPrefix) {
+		return authenticated{}
+	}
+
+	key, err := s.PersistenceExtension.GetAPIKeyByHash(hashKey(token))
+	if err != nil {
+		return authenticated{err: err}
+	}
+
+	now := time.Now()
+	if key == nil || !key.IsUsable(now) {
+		s.Logger.Debug("rejected unknown, revoked or expired api key")
+		return authenticated{}
+	}
+
+	u, err := s.UserExtension.GetUserById(key.UserID)
+	if err != nil {
+		return authenticated{err: err}
+	}
+
+	if u == nil || !user.IsUserActive(*u) {
+		return authenticated{}
+	}
+
+	// record use, but not on every request
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= lastUsedInterval {
+		key.LastUsedAt = &now
+		if err := s.PersistenceExtension.UpdateAPIKey(*key); err != nil {
+			s.Logger.Error("while recording api key use, error = " + err.Error())
+		}
+	}
+
+	safeUser := user.GetSafeUser(*u)
+	return authenticated{key: key, caller: &safeUser}
+}
+
+// generateKey returns a new key, and the prefix that's stored with its hash
+func generateKey() (string, string, error) {
+	keyBytes := make([]byte, 32)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return "", "", err
+	}
+
+	key := KeyPrefix + base64.RawURLEncoding.EncodeToString(keyBytes)
+	return key, key[:len(KeyPrefix)+8], nil
+}
+
+// hashKey hashes a key for storage - keys are long and random, so they don't need a slow or keyed hash
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,276 @@
+package apikey
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"github.com/markdicksonjr/nibbler/user/group"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImplements(t *testing.T) {
+	var base nibbler.Extension = &Extension{}
+	var resolver nibbler.ScopedCallerResolver = &Extension{}
+	if base == nil || resolver == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+// newTestExtension builds an api key extension on in-memory persistence and a mock session store, with a single user
+// (bob) already logged in to the session
+func newTestExtension(t *testing.T, configure func(e *Extension)) (*Extension, *nibbler.User) {
+	mock, err := user.NewMockApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := mock.CreateUser("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionExtension := session.NewMockExtension()
+	if err := sessionExtension.Init(mock.App); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sessionExtension.SetCaller(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), bob); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Extension{
+		PersistenceExtension: &MockPersistenceExtension{},
+		UserExtension:        mock.UserExtension,
+		SessionExtension:     sessionExtension,
+	}
+	configure(e)
+	if err := e.Init(mock.App); err != nil {
+		t.Fatal(err)
+	}
+	return e, bob
+}
+
+// serve runs the request through the router (for path params) and the middleware
+func serve(e *Extension, method string, path string, body string, key string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.Use(e.Middleware)
+	router.HandleFunc("/api/user/api-key", e.enforceManager(e.ListKeysHandler)).Methods("GET")
+	router.HandleFunc("/api/user/api-key", e.enforceManager(e.CreateKeyHandler)).Methods("POST")
+	router.HandleFunc("/api/user/api-key/{keyId}", e.enforceManager(e.UpdateKeyHandler)).Methods("PATCH")
+	router.HandleFunc("/api/user/api-key/{keyId}", e.enforceManager(e.RevokeKeyHandler)).Methods("DELETE")
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	return res
+}
+
+func createKey(t *testing.T, e *Extension, body string) (string, APIKey) {
+	res := serve(e, "POST", "/api/user/api-key", body, "")
+	if res.Code != http.StatusOK {
+		t.Fatal("the key was not created: " + res.Body.String())
+	}
+
+	var created struct {
+		Key    string `json:"key"`
+		APIKey APIKey `json:"apiKey"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created.Key, created.APIKey
+}
+
+func callerFor(t *testing.T, e *Extension, key string) *nibbler.User {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	caller, err := e.GetCaller(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caller
+}
+
+func TestExtension_KeyLifecycle(t *testing.T) {
+	e, bob := newTestExtension(t, func(e *Extension) {})
+
+	key, record := createKey(t, e, `{"name": "ci", "scopes": "list-groups delete-group:group-a"}`)
+	if !strings.HasPrefix(key, KeyPrefix) || !strings.HasPrefix(key, record.Prefix) || record.UserID != bob.ID {
+		t.Fatal("the created key was not as expected")
+	}
+
+	stored, _ := e.PersistenceExtension.GetAPIKeysForUser(bob.ID)
+	if len(stored) != 1 || stored[0].Hash == key || strings.Contains(stored[0].Hash, key) {
+		t.Fatal("the key was not stored hashed")
+	}
+
+	// the key authenticates as its owner, restricted to its scopes
+	caller := callerFor(t, e, key)
+	if caller == nil || caller.ID != bob.ID || caller.Password != nil {
+		t.Fatal("the key did not authenticate as its owner")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	scopes, restricted, err := e.GetCallerScopes(req)
+	if err != nil || !restricted || len(scopes) != 2 || scopes[1] != "delete-group:group-a" {
+		t.Fatal("the key's scopes were not returned")
+	}
+
+	if stored, _ := e.PersistenceExtension.GetAPIKeysForUser(bob.ID); stored[0].LastUsedAt == nil {
+		t.Fatal("the key's use was not recorded")
+	}
+
+	// rename it
+	res := serve(e, "PATCH", "/api/user/api-key/"+record.ID, `{"name": "deploys"}`, "")
+	if res.Code != http.StatusOK {
+		t.Fatal("the key was not renamed")
+	}
+
+	res = serve(e, "GET", "/api/user/api-key", "", "")
+	if !strings.Contains(res.Body.String(), `"name":"deploys"`) || strings.Contains(res.Body.String(), key) {
+		t.Fatal("the key list was not as expected")
+	}
+
+	// keys can't manage keys
+	if res := serve(e, "POST", "/api/user/api-key", `{"name": "another"}`, key); res.Code == http.StatusOK {
+		t.Fatal("a key was used to create another key")
+	}
+
+	// revoke it
+	if res := serve(e, "DELETE", "/api/user/api-key/"+record.ID, "", ""); res.Code != http.StatusOK {
+		t.Fatal("the key was not revoked")
+	}
+
+	if callerFor(t, e, key) != nil {
+		t.Fatal("a revoked key was accepted")
+	}
+}
+
+func TestExtension_KeyExpiry(t *testing.T) {
+	maxDays := 30
+	e, bob := newTestExtension(t, func(e *Extension) {
+		e.MaxExpirationDays = &maxDays
+	})
+
+	if res := serve(e, "POST", "/api/user/api-key", `{"name": "forever"}`, ""); res.Code != http.StatusBadRequest {
+		t.Fatal("a key was created without an expiry despite the maximum")
+	}
+
+	if res := serve(e, "POST", "/api/user/api-key", `{"name": "long", "expiresInDays": 365}`, ""); res.Code != http.StatusBadRequest {
+		t.Fatal("a key was created with an expiry beyond the maximum")
+	}
+
+	_, record := createKey(t, e, `{"name": "short", "expiresInDays": 7}`)
+	if record.ExpiresAt == nil {
+		t.Fatal("the key was created without an expiry")
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	key, _, err := e.CreateKey(bob.ID, "expired", nil, &expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if callerFor(t, e, key) != nil {
+		t.Fatal("an expired key was accepted")
+	}
+}
+
+func TestExtension_IgnoresOtherBearerTokens(t *testing.T) {
+	e, _ := newTestExtension(t, func(e *Extension) {})
+
+	if callerFor(t, e, "eyJhbGciOiJIUzI1NiJ9.e30.sig") != nil || callerFor(t, e, KeyPrefix+"unknown") != nil {
+		t.Fatal("an unknown token was accepted")
+	}
+}
+
+func TestExtension_ScopesRestrictGroupRoutes(t *testing.T) {
+	e, bob := newTestExtension(t, func(e *Extension) {})
+
+	app := &nibbler.Application{
+		Config: &nibbler.Configuration{ApiPrefix: "/api"},
+		Logger: nibbler.SilentLogger{},
+		Router: mux.NewRouter(),
+	}
+	app.Router.Use(e.Middleware)
+
+	groupExtension := &nibbler_user_group.Extension{
+		PersistenceExtension: &nibbler_user_group.MockPersistenceExtension{},
+		CallerResolver:       e,
+		UserExtension:        e.UserExtension,
+	}
+	if err := groupExtension.Init(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := groupExtension.PostInit(app); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob has every privilege the routes below need
+	team, err := groupExtension.CreateGroup("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{nibbler_user_group.ListGroupsAction, nibbler_user_group.GetGroupAction, nibbler_user_group.DeleteGroupAction} {
+		if err := groupExtension.AddPrivilegeToGroups([]string{team.ID}, "", action); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := groupExtension.SetGroupMembership(team.ID, bob.ID, nibbler_user_group.MemberRole); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := groupExtension.SetCurrentGroup(bob.ID, team.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(method string, path string, key string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader("groupId="+team.ID))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+key)
+		res := httptest.NewRecorder()
+		app.Router.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	key, _, err := e.CreateKey(bob.ID, "ci", []string{"list-groups", "get-group:" + team.ID}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if send("GET", "/api/group", key) != http.StatusOK || send("GET", "/api/group/"+team.ID, key) != http.StatusOK {
+		t.Fatal("the key was denied a route its scopes allow")
+	}
+
+	// the privilege alone isn't enough, without a scope
+	if send("DELETE", "/api/group/"+team.ID, key) != http.StatusNotFound {
+		t.Fatal("the key deleted a group without a scope for it")
+	}
+
+	// routes that only need a caller still need a scope, so the key can't act for its user
+	if send("GET", "/api/group/composite", key) != http.StatusNotFound || send("POST", "/api/group/current", key) != http.StatusNotFound {
+		t.Fatal("the key used a caller route without a scope for it")
+	}
+
+	unrestricted, _, err := e.CreateKey(bob.ID, "admin", []string{"*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if send("GET", "/api/group/composite", unrestricted) != http.StatusOK {
+		t.Fatal("an unrestricted key was denied a caller route")
+	}
+}
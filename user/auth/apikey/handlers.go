@@ -0,0 +1,204 @@
+package apikey
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// callerResolver returns the CallerResolver, or the session extension if none was provided
+func (s *Extension) callerResolver() nibbler.CallerResolver {
+	return nibbler.ResolverOrDefault(s.CallerResolver, s.SessionExtension)
+}
+
+// enforceManager requires a caller, who didn't authenticate with an API key (keys can't be used to create more keys)
+func (s *Extension) enforceManager(routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return nibbler.EnforceCaller(s.callerResolver(), func(w http.ResponseWriter, r *http.Request) {
+		if result := s.authenticate(r); result.key != nil {
+			nibbler.WriteJson(w, `{"result": "api keys cannot be managed with an api key"}`, http.StatusForbidden)
+			return
+		}
+		routerFunc(w, r)
+	})
+}
+
+// keyRequest is the body for creating or updating a key - scopes are space-separated
+type keyRequest struct {
+	Name          *string `json:"name"`
+	Scopes        *string `json:"scopes"`
+	ExpiresInDays *int    `json:"expiresInDays"`
+}
+
+// CreateKey creates a key for the user, returning the key itself (which can't be retrieved later) and its record
+func (s *Extension) CreateKey(userId string, name string, scopes []string, expiresAt *time.Time) (string, *APIKey, error) {
+	plaintext, prefix, err := generateKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	key := APIKey{
+		ID:        uuid.New().String(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		UserID:    userId,
+		Name:      name,
+		Prefix:    prefix,
+		Hash:      hashKey(plaintext),
+		Scopes:    strings.Join(scopes, " "),
+		ExpiresAt: expiresAt,
+	}
+
+	if err := s.PersistenceExtension.CreateAPIKey(key); err != nil {
+		return "", nil, err
+	}
+	return plaintext, &key, nil
+}
+
+// ListKeysHandler lists the caller's keys (including revoked and expired ones)
+func (s *Extension) ListKeysHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	keys, err := s.PersistenceExtension.GetAPIKeysForUser(caller.ID)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	nibbler.WriteStructToJson(w, map[string]interface{}{"apiKeys": keys}, http.StatusOK)
+}
+
+// CreateKeyHandler creates a key for the caller from a JSON body with a name, scopes and (optionally) expiresInDays.
+// The response has the key, which is only ever shown this once
+func (s *Extension) CreateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	var body keyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		nibbler.WriteJson(w, `{"result": "invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if body.Name == nil || strings.TrimSpace(*body.Name) == "" {
+		nibbler.WriteJson(w, `{"result": "name is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	expiresInDays := s.DefaultExpirationDays
+	if body.ExpiresInDays != nil {
+		expiresInDays = body.ExpiresInDays
+	}
+
+	if expiresInDays != nil && *expiresInDays <= 0 {
+		nibbler.WriteJson(w, `{"result": "expiresInDays must be positive"}`, http.StatusBadRequest)
+		return
+	}
+
+	if s.MaxExpirationDays != nil && (expiresInDays == nil || *expiresInDays > *s.MaxExpirationDays) {
+		nibbler.WriteJson(w, `{"result": "expiresInDays exceeds the maximum"}`, http.StatusBadRequest)
+		return
+	}
+
+	var expiresAt *time.Time
+	if expiresInDays != nil {
+		at := time.Now().AddDate(0, 0, *expiresInDays)
+		expiresAt = &at
+	}
+
+	var scopes []string
+	if body.Scopes != nil {
+		scopes = strings.Fields(*body.Scopes)
+	}
+
+	plaintext, key, err := s.CreateKey(caller.ID, strings.TrimSpace(*body.Name), scopes, expiresAt)
+	if err != nil {
+		s.Logger.Error("while creating api key, error = " + err.Error())
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, map[string]interface{}{"key": plaintext, "apiKey": key}, http.StatusOK)
+}
+
+// UpdateKeyHandler renames or re-scopes the caller's key with the keyId path param, from a JSON body with a name and/or scopes
+func (s *Extension) UpdateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var body keyRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		nibbler.WriteJson(w, `{"result": "invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if body.Name != nil && strings.TrimSpace(*body.Name) == "" {
+		nibbler.WriteJson(w, `{"result": "name cannot be blank"}`, http.StatusBadRequest)
+		return
+	}
+
+	s.updateCallerKey(w, r, func(key *APIKey) {
+		if body.Name != nil {
+			key.Name = strings.TrimSpace(*body.Name)
+		}
+
+		if body.Scopes != nil {
+			key.Scopes = strings.Join(strings.Fields(*body.Scopes), " ")
+		}
+	})
+}
+
+// RevokeKeyHandler revokes the caller's key with the keyId path param
+func (s *Extension) RevokeKeyHandler(w http.ResponseWriter, r *http.Request) {
+	s.updateCallerKey(w, r, func(key *APIKey) {
+		if key.RevokedAt == nil {
+			now := time.Now()
+			key.RevokedAt = &now
+		}
+	})
+}
+
+// updateCallerKey applies the update to the caller's key with the keyId path param, responding with the updated key
+// (or a 404 if the caller has no such key)
+func (s *Extension) updateCallerKey(w http.ResponseWriter, r *http.Request, update func(key *APIKey)) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	keys, err := s.PersistenceExtension.GetAPIKeysForUser(caller.ID)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	for _, key := range keys {
+		if key.ID != mux.Vars(r)["keyId"] {
+			continue
+		}
+
+		update(&key)
+		key.UpdatedAt = time.Now()
+		if err := s.PersistenceExtension.UpdateAPIKey(key); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		}
+
+		nibbler.WriteStructToJson(w, key, http.StatusOK)
+		return
+	}
+
+	nibbler.Write404Json(w)
+}
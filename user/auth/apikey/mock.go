@@ -0,0 +1,70 @@
+package apikey
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// MockPersistenceExtension is an in-memory PersistenceExtension, for tests and prototyping
+type MockPersistenceExtension struct {
+	keys  map[string]APIKey
+	mutex sync.RWMutex
+}
+
+func (m *MockPersistenceExtension) CreateAPIKey(key APIKey) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.keys == nil {
+		m.keys = make(map[string]APIKey)
+	}
+
+	if _, ok := m.keys[key.ID]; ok {
+		return errors.New("an api key with ID " + key.ID + " already exists")
+	}
+
+	m.keys[key.ID] = key
+	return nil
+}
+
+func (m *MockPersistenceExtension) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, key := range m.keys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockPersistenceExtension) GetAPIKeysForUser(userId string) ([]APIKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var keys []APIKey
+	for _, key := range m.keys {
+		if key.UserID == userId {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(a, b int) bool {
+		return keys[a].CreatedAt.Before(keys[b].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (m *MockPersistenceExtension) UpdateAPIKey(key APIKey) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.keys[key.ID]; !ok {
+		return errors.New("no api key with ID " + key.ID + " exists")
+	}
+
+	m.keys[key.ID] = key
+	return nil
+}
@@ -0,0 +1,355 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Extension authenticates requests with bearer tokens (JWTs) instead of a session cookie.  It implements
+// nibbler.CallerResolver, so it can stand in for (or be combined with) the session extension in the group and message
+// extensions.  Tokens are issued by the local auth extension's login when it's given this extension
+type Extension struct {
+	nibbler.NoOpExtension
+
+	UserExtension *user.Extension // loads the user when tokens are refreshed
+
+	// the key tokens are signed with - a []byte secret (HS256), *rsa.PrivateKey (RS256) or ed25519.PrivateKey (EdDSA).
+	// If not provided, it's read from config: jwt.hmac.key, or a PEM-encoded private key in the file at jwt.key.file
+	SigningKey crypto.PrivateKey
+	KeyID      string // put in each token's header, to pick the verification key (jwt.key.id in config)
+
+	// public keys (by key ID) to verify tokens with, reloaded when the file changes - without it, tokens are verified
+	// with the signing key (jwt.jwks.file in config)
+	JWKSFile          string
+	JWKSCheckInterval time.Duration // defaults to 1 minute
+
+	Issuer          string // if set, put in tokens and required of them
+	Audience        string // if set, put in tokens and required of them
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// if set (e.g. to the session extension's store), tokens issued before a user's revocation time are rejected
+	RevocationStore session.RevocationStore
+
+	// records used refresh tokens, so each can only be used once - defaults to a MemoryRefreshTokenStore
+	RefreshTokenStore RefreshTokenStore
+
+	DisableDefaultRoutes bool
+
+	keys *keySet
+}
+
+// Tokens is the response to a login or refresh
+type Tokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int    `json:"expiresIn"` // seconds until the access token expires
+}
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.UserExtension == nil {
+		return errors.New("jwt extension requires a user extension")
+	}
+
+	if app.Config != nil && app.Config.Raw != nil {
+		if s.SigningKey == nil {
+			if secret := app.Config.Raw.Get("jwt", "hmac", "key").String(""); secret != "" {
+				s.SigningKey = []byte(secret)
+			} else if keyFile := app.Config.Raw.Get("jwt", "key", "file").String(""); keyFile != "" {
+				key, err := loadPrivateKey(keyFile)
+				if err != nil {
+					return err
+				}
+				s.SigningKey = key
+			}
+		}
+
+		if s.KeyID == "" {
+			s.KeyID = app.Config.Raw.Get("jwt", "key", "id").String("")
+		}
+
+		if s.JWKSFile == "" {
+			s.JWKSFile = app.Config.Raw.Get("jwt", "jwks", "file").String("")
+		}
+	}
+
+	if s.SigningKey == nil {
+		return errors.New("jwt extension requires a signing key")
+	}
+
+	if _, err := algorithmForKey(s.SigningKey); err != nil {
+		return err
+	}
+
+	if secret, ok := s.SigningKey.([]byte); ok && len(secret) < 32 {
+		return errors.New("jwt extension requires an hmac key of at least 32 bytes")
+	}
+
+	if s.AccessTokenTTL == 0 {
+		s.AccessTokenTTL = 15 * time.Minute
+	}
+
+	if s.RefreshTokenTTL == 0 {
+		s.RefreshTokenTTL = 30 * 24 * time.Hour
+	}
+
+	if s.RefreshTokenStore == nil {
+		s.RefreshTokenStore = &MemoryRefreshTokenStore{}
+	}
+
+	if s.JWKSCheckInterval == 0 {
+		s.JWKSCheckInterval = time.Minute
+	}
+
+	if s.JWKSFile != "" {
+		keys, err := newKeySet(s.JWKSFile, s.JWKSCheckInterval)
+		if err != nil {
+			return err
+		}
+		s.keys = keys
+	}
+	return nil
+}
+
+func (s *Extension) PostInit(app *nibbler.Application) error {
+	if !s.DisableDefaultRoutes && app.Router != nil {
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/token/refresh", s.RefreshHandler).Methods("POST")
+	}
+	return nil
+}
+
+func (s *Extension) GetName() string {
+	return "jwt"
+}
+
+// IssueTokens creates an access token (carrying the safe user) and a refresh token for the user
+func (s *Extension) IssueTokens(u *nibbler.User) (*Tokens, error) {
+	now := time.Now()
+	safeUser := user.GetSafeUser(*u)
+
+	accessToken, err := s.issue(u.ID, TokenTypeAccess, &safeUser, now, s.AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := s.issue(u.ID, TokenTypeRefresh, nil, now, s.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+func (s *Extension) issue(userID string, tokenType string, u *nibbler.User, now time.Time, ttl time.Duration) (string, error) {
+	id, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	return sign(Claims{
+		Subject:   userID,
+		Issuer:    s.Issuer,
+		Audience:  s.Audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		ID:        id,
+		Type:      tokenType,
+		User:      u,
+	}, s.SigningKey, s.KeyID)
+}
+
+// Verify returns the claims of a valid, unexpired and unrevoked token of the given type
+func (s *Extension) Verify(token string, tokenType string) (*Claims, error) {
+	claims, err := verify(token, s.verificationKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Type != tokenType || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if (s.Issuer != "" && claims.Issuer != s.Issuer) || (s.Audience != "" && claims.Audience != s.Audience) {
+		return nil, ErrInvalidToken
+	}
+
+	if s.RevocationStore != nil {
+		revokedAt, err := s.RevocationStore.GetRevocationTime(claims.Subject)
+		if err != nil {
+			return nil, err
+		}
+
+		// iat only has second precision, so tokens issued in the same second as the revocation are rejected too
+		if revokedAt != nil && claims.IssuedAt <= revokedAt.Unix() {
+			return nil, ErrInvalidToken
+		}
+	}
+
+	return claims, nil
+}
+
+// RevokeUserTokens rejects the user's tokens issued up to now (e.g. when they're deactivated) - it needs a
+// RevocationStore.  If the store is shared with the session extension, InvalidateUserSessions does the same
+func (s *Extension) RevokeUserTokens(userID string) error {
+	if s.RevocationStore == nil {
+		return ErrNoRevocationStore
+	}
+	return s.RevocationStore.RevokeUserSessions(userID, time.Now())
+}
+
+// verificationKey returns the key from the JWKS file, falling back to the signing key when the key ID matches it
+func (s *Extension) verificationKey(keyID string) (crypto.PublicKey, error) {
+	if s.keys != nil {
+		key, err := s.keys.get(keyID)
+		if err != nil || key != nil {
+			return key, err
+		}
+	}
+
+	if keyID == s.KeyID {
+		return publicKey(s.SigningKey), nil
+	}
+	return nil, nil
+}
+
+// GetCaller returns the user from the request's bearer access token, or nil if there's no valid token
+func (s *Extension) GetCaller(r *http.Request) (*nibbler.User, error) {
+	token := BearerToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	claims, err := s.Verify(token, TokenTypeAccess)
+	if err == ErrInvalidToken || err == ErrExpiredToken {
+		s.Logger.Debug("rejected bearer token, error = " + err.Error())
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.User == nil {
+		return &nibbler.User{ID: claims.Subject}, nil
+	}
+
+	caller := *claims.User
+	caller.ID = claims.Subject
+	return &caller, nil
+}
+
+// EnforceLoggedIn will return a 401 if the request has no valid bearer token, and pass through to routerFunc otherwise
+func (s *Extension) EnforceLoggedIn(routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return nibbler.EnforceCaller(s, routerFunc)
+}
+
+// Refresh issues new tokens for a valid refresh token, as long as the user still exists and is active.  Refresh tokens
+// are rotated - each can only be used once, and a reused one (which suggests it was stolen) is rejected, and revokes
+// the user's tokens if there's a RevocationStore
+func (s *Extension) Refresh(refreshToken string) (*Tokens, error) {
+	claims, err := s.Verify(refreshToken, TokenTypeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	reused, err := s.RefreshTokenStore.MarkUsed(claims.ID, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	if reused {
+		s.Logger.Warn("refresh token " + claims.ID + " was reused for user " + claims.Subject)
+		if s.RevocationStore != nil {
+			if err := s.RevocationStore.RevokeUserSessions(claims.Subject, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		return nil, ErrInvalidToken
+	}
+
+	u, err := s.UserExtension.GetUserById(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if u == nil || !user.IsUserActive(*u) {
+		return nil, ErrInvalidToken
+	}
+
+	return s.IssueTokens(u)
+}
+
+// RefreshHandler exchanges a refresh token (the "refreshToken" form value or JSON field) for new tokens
+func (s *Extension) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	refreshToken := r.FormValue("refreshToken")
+
+	if refreshToken == "" && r.Body != nil {
+		var body struct {
+			RefreshToken string `json:"refreshToken"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err == nil {
+			refreshToken = body.RefreshToken
+		}
+	}
+
+	tokens, err := s.Refresh(refreshToken)
+	if err == ErrInvalidToken || err == ErrExpiredToken {
+		nibbler.WriteJson(w, `{"result": "invalid token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if err != nil {
+		s.Logger.Error("while refreshing tokens, error = " + err.Error())
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, tokens, http.StatusOK)
+}
+
+// BearerToken returns the token from the request's "Authorization: Bearer" header, or an empty string
+func BearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(authorization[7:])
+}
+
+// loadPrivateKey reads a PEM-encoded (PKCS #8, or PKCS #1 for RSA) private key
+func loadPrivateKey(path string) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data was found in jwt key file " + path)
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
@@ -0,0 +1,326 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var hmacKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestImplements(t *testing.T) {
+	var base nibbler.Extension = &Extension{}
+	var resolver nibbler.CallerResolver = &Extension{}
+	if base == nil || resolver == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+// newTestExtension builds a jwt extension on in-memory user persistence, with a single user (bob) already created
+func newTestExtension(t *testing.T, configure func(e *Extension)) (*Extension, *user.Extension, *nibbler.User) {
+	mock, err := user.NewMockApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := mock.CreateUser("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Extension{UserExtension: mock.UserExtension, SigningKey: hmacKey}
+	configure(e)
+	if err := e.Init(mock.App); err != nil {
+		t.Fatal(err)
+	}
+	return e, mock.UserExtension, bob
+}
+
+func callerFor(t *testing.T, e *Extension, accessToken string) *nibbler.User {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	caller, err := e.GetCaller(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caller
+}
+
+func TestExtension_InitChecksKey(t *testing.T) {
+	app := &nibbler.Application{Logger: nibbler.SilentLogger{}}
+	userExtension := &user.Extension{PersistenceExtension: &user.MockPersistenceExtension{}}
+
+	if err := (&Extension{UserExtension: userExtension}).Init(app); err == nil {
+		t.Fatal("the extension initialized without a signing key")
+	}
+
+	if err := (&Extension{UserExtension: userExtension, SigningKey: []byte("short")}).Init(app); err == nil {
+		t.Fatal("the extension initialized with a short hmac key")
+	}
+}
+
+func TestExtension_Algorithms(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []interface{}{hmacKey, rsaKey, edKey} {
+		e, _, _ := newTestExtension(t, func(e *Extension) {
+			e.SigningKey = key
+		})
+
+		tokens, err := e.IssueTokens(&nibbler.User{ID: "bob"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if caller := callerFor(t, e, tokens.AccessToken); caller == nil || caller.ID != "bob" {
+			t.Fatal("the caller was not resolved from the access token")
+		}
+
+		if caller := callerFor(t, e, tokens.RefreshToken); caller != nil {
+			t.Fatal("a refresh token was accepted as an access token")
+		}
+
+		if caller := callerFor(t, e, tokens.AccessToken[:len(tokens.AccessToken)-4]+"AAAA"); caller != nil {
+			t.Fatal("a token with a bad signature was accepted")
+		}
+	}
+}
+
+func TestExtension_RejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, _, _ := newTestExtension(t, func(e *Extension) {
+		e.SigningKey = rsaKey
+	})
+
+	// a token signed with HS256, using the (public) key as the secret
+	forged, err := sign(Claims{Subject: "bob", Type: TokenTypeAccess, ExpiresAt: time.Now().Add(time.Hour).Unix()}, []byte(rsaKey.PublicKey.N.Bytes()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if caller := callerFor(t, e, forged); caller != nil {
+		t.Fatal("a token signed with the wrong algorithm was accepted")
+	}
+}
+
+func TestExtension_Expiry(t *testing.T) {
+	e, _, _ := newTestExtension(t, func(e *Extension) {
+		e.AccessTokenTTL = -time.Second
+	})
+
+	tokens, err := e.IssueTokens(&nibbler.User{ID: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if caller := callerFor(t, e, tokens.AccessToken); caller != nil {
+		t.Fatal("an expired token was accepted")
+	}
+}
+
+func TestExtension_JWKSRotation(t *testing.T) {
+	oldPublic, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newPublic, newKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeKeys := func(keys map[string]ed25519.PublicKey) {
+		var jwks []map[string]string
+		for id, key := range keys {
+			jwks = append(jwks, map[string]string{"kty": "OKP", "crv": "Ed25519", "kid": id, "x": encoding.EncodeToString(key)})
+		}
+
+		data, _ := json.Marshal(map[string]interface{}{"keys": jwks})
+		if err := ioutil.WriteFile(jwksFile, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys(map[string]ed25519.PublicKey{"old": oldPublic})
+
+	e, _, _ := newTestExtension(t, func(e *Extension) {
+		e.SigningKey = oldKey
+		e.KeyID = "old"
+		e.JWKSFile = jwksFile
+		e.JWKSCheckInterval = -1
+	})
+
+	oldTokens, _ := e.IssueTokens(&nibbler.User{ID: "bob"})
+
+	// publish the new key alongside the old, and switch to signing with it
+	writeKeys(map[string]ed25519.PublicKey{"old": oldPublic, "new": newPublic})
+	e.SigningKey = newKey
+	e.KeyID = "new"
+	newTokens, _ := e.IssueTokens(&nibbler.User{ID: "bob"})
+
+	if callerFor(t, e, oldTokens.AccessToken) == nil || callerFor(t, e, newTokens.AccessToken) == nil {
+		t.Fatal("tokens were rejected during key rotation")
+	}
+
+	// retire the old key (pushing the mod time forward, in case the filesystem's resolution is coarse)
+	writeKeys(map[string]ed25519.PublicKey{"new": newPublic})
+	e.keys.modTime = time.Time{}
+
+	if callerFor(t, e, oldTokens.AccessToken) != nil {
+		t.Fatal("a token signed with a retired key was accepted")
+	}
+
+	if callerFor(t, e, newTokens.AccessToken) == nil {
+		t.Fatal("a token signed with the current key was rejected")
+	}
+}
+
+func TestParseKeySet_RSA(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "rsa",
+		"n":   encoding.EncodeToString(rsaKey.N.Bytes()),
+		"e":   encoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}}})
+
+	keys, err := parseKeySet(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if public, ok := keys["rsa"].(*rsa.PublicKey); !ok || !public.Equal(&rsaKey.PublicKey) {
+		t.Fatal("the rsa key was not read from the key set")
+	}
+}
+
+func TestExtension_Refresh(t *testing.T) {
+	revocations := &session.MemoryRevocationStore{}
+	e, userExtension, bob := newTestExtension(t, func(e *Extension) {
+		e.RevocationStore = revocations
+	})
+
+	tokens, err := e.IssueTokens(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/token/refresh", strings.NewReader(url.Values{"refreshToken": {refreshToken}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		e.RefreshHandler(res, req)
+		return res
+	}
+
+	res := refresh(tokens.RefreshToken)
+	if res.Code != http.StatusOK {
+		t.Fatal("the refresh token was rejected")
+	}
+
+	var refreshed Tokens
+	if err := json.Unmarshal(res.Body.Bytes(), &refreshed); err != nil {
+		t.Fatal(err)
+	}
+
+	if caller := callerFor(t, e, refreshed.AccessToken); caller == nil || caller.Email == nil || *caller.Email != "bob@example.com" {
+		t.Fatal("the refreshed access token did not carry the user")
+	}
+
+	if refresh(tokens.AccessToken).Code != http.StatusUnauthorized {
+		t.Fatal("an access token was accepted as a refresh token")
+	}
+
+	// deactivated users can't refresh
+	inactive := false
+	bob.IsActive = &inactive
+	if err := userExtension.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if refresh(refreshed.RefreshToken).Code != http.StatusUnauthorized {
+		t.Fatal("a deactivated user refreshed their tokens")
+	}
+
+	// revoking the user's sessions revokes their tokens
+	if err := revocations.RevokeUserSessions(bob.ID, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if callerFor(t, e, refreshed.AccessToken) != nil {
+		t.Fatal("a revoked access token was accepted")
+	}
+}
+
+func TestExtension_RefreshTokenReuse(t *testing.T) {
+	revocations := &session.MemoryRevocationStore{}
+	e, _, bob := newTestExtension(t, func(e *Extension) {
+		e.RevocationStore = revocations
+	})
+
+	tokens, err := e.IssueTokens(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := e.Refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Refresh(tokens.RefreshToken); err != ErrInvalidToken {
+		t.Fatal("a used refresh token was accepted again")
+	}
+
+	// reuse suggests the token was stolen, so every token the user had is revoked, including the rotated ones
+	if _, err := e.Refresh(rotated.RefreshToken); err != ErrInvalidToken {
+		t.Fatal("the rotated refresh token still worked after reuse was detected")
+	}
+
+	if callerFor(t, e, rotated.AccessToken) != nil {
+		t.Fatal("the rotated access token still worked after reuse was detected")
+	}
+}
+
+func TestMemoryRefreshTokenStore(t *testing.T) {
+	store := &MemoryRefreshTokenStore{}
+
+	if used, _ := store.MarkUsed("a", time.Now().Add(time.Hour)); used {
+		t.Fatal("a new token was reported as used")
+	}
+
+	if used, _ := store.MarkUsed("a", time.Now().Add(time.Hour)); !used {
+		t.Fatal("a used token was not reported as used")
+	}
+
+	// expired tokens are forgotten
+	store.MarkUsed("b", time.Now().Add(-time.Hour))
+	store.lastPrune = time.Time{}
+	store.MarkUsed("c", time.Now().Add(time.Hour))
+	if _, ok := store.used["b"]; ok {
+		t.Fatal("an expired token was not pruned")
+	}
+}
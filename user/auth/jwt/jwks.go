@@ -0,0 +1,150 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonWebKey is the subset of RFC 7517 fields needed for the supported algorithms
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	K       string `json:"k"`
+}
+
+// keySet holds the verification keys from a JWKS file, and reloads the file (at most once per checkInterval) when it
+// changes - so keys can be rotated by adding the new public key to the file, switching the signing key, and removing
+// the old key once the tokens it signed have expired
+type keySet struct {
+	path          string
+	checkInterval time.Duration
+
+	keys      map[string]crypto.PublicKey
+	modTime   time.Time
+	checkedAt time.Time
+	mutex     sync.Mutex
+}
+
+func newKeySet(path string, checkInterval time.Duration) (*keySet, error) {
+	k := &keySet{path: path, checkInterval: checkInterval}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k, k.reload()
+}
+
+// get returns the key with the given ID, or nil if the file has no such key
+func (k *keySet) get(keyID string) (crypto.PublicKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if time.Since(k.checkedAt) >= k.checkInterval {
+		if err := k.reload(); err != nil {
+			return nil, err
+		}
+	}
+
+	return k.keys[keyID], nil
+}
+
+// reload reads the file if it has changed since it was last read - the caller must hold the mutex
+func (k *keySet) reload() error {
+	k.checkedAt = time.Now()
+
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+
+	if k.keys != nil && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseKeySet(data)
+	if err != nil {
+		return err
+	}
+
+	k.keys = keys
+	k.modTime = info.ModTime()
+	return nil
+}
+
+// parseKeySet reads the keys from a JWKS document, by key ID
+func parseKeySet(data []byte) (map[string]crypto.PublicKey, error) {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range document.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, errors.New("while reading key \"" + jwk.KeyID + "\" from jwks, error = " + err.Error())
+		}
+		keys[jwk.KeyID] = key
+	}
+	return keys, nil
+}
+
+func (j jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch j.KeyType {
+	case "RSA":
+		n, err := encoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := encoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "OKP":
+		if j.Curve != "Ed25519" {
+			return nil, errors.New("unsupported curve " + j.Curve)
+		}
+
+		x, err := encoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("ed25519 key has the wrong size")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		k, err := encoding.DecodeString(j.K)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	return nil, errors.New("unsupported key type " + j.KeyType)
+}
@@ -0,0 +1,48 @@
+package jwt
+
+import (
+	"sync"
+	"time"
+)
+
+// RefreshTokenStore records which refresh tokens (by ID) have been used, so each can only be used once.  Use a shared
+// implementation if the app runs on more than one instance
+type RefreshTokenStore interface {
+
+	// MarkUsed records the token as used (until it expires), returning whether it had already been used
+	MarkUsed(tokenID string, expiresAt time.Time) (bool, error)
+}
+
+// MemoryRefreshTokenStore is a RefreshTokenStore for a single instance.  Used tokens are forgotten on restart (and
+// once they expire)
+type MemoryRefreshTokenStore struct {
+	used      map[string]time.Time
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func (m *MemoryRefreshTokenStore) MarkUsed(tokenID string, expiresAt time.Time) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	if m.used == nil {
+		m.used = make(map[string]time.Time)
+	}
+
+	// expired tokens are rejected anyway, so there's no need to remember them
+	if now.Sub(m.lastPrune) > time.Minute {
+		for id, expiry := range m.used {
+			if expiry.Before(now) {
+				delete(m.used, id)
+			}
+		}
+		m.lastPrune = now
+	}
+
+	if _, ok := m.used[tokenID]; ok {
+		return true, nil
+	}
+	m.used[tokenID] = expiresAt
+	return false, nil
+}
@@ -0,0 +1,193 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"strings"
+	"time"
+)
+
+// the supported signing algorithms
+const (
+	AlgorithmHS256 = "HS256" // HMAC-SHA256, with a shared secret ([]byte)
+	AlgorithmRS256 = "RS256" // RSA PKCS#1 v1.5 with SHA-256 (*rsa.PrivateKey to sign, *rsa.PublicKey to verify)
+	AlgorithmEdDSA = "EdDSA" // Ed25519 (ed25519.PrivateKey to sign, ed25519.PublicKey to verify)
+)
+
+// the kinds of token issued, kept in the "typ" claim so that one can't be used as the other
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+var ErrExpiredToken = errors.New("token has expired")
+var ErrNoRevocationStore = errors.New("tokens can't be revoked without a revocation store")
+
+// Claims are the contents of an issued token.  Access tokens carry the (safe) user, so the caller can be resolved
+// without loading them
+type Claims struct {
+	Subject   string        `json:"sub"`
+	Issuer    string        `json:"iss,omitempty"`
+	Audience  string        `json:"aud,omitempty"`
+	IssuedAt  int64         `json:"iat"`
+	ExpiresAt int64         `json:"exp"`
+	ID        string        `json:"jti"`
+	Type      string        `json:"typ"`
+	User      *nibbler.User `json:"user,omitempty"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// sign produces a compact JWT for the claims, with the key's algorithm
+func sign(claims Claims, key crypto.PrivateKey, keyID string) (string, error) {
+	algorithm, err := algorithmForKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	headerBytes, err := json.Marshal(header{Algorithm: algorithm, Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+
+	claimsBytes, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(headerBytes) + "." + encoding.EncodeToString(claimsBytes)
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signingInput))
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// verify checks the token's signature with the key returned for its key ID, and that it hasn't expired.  The
+// algorithm must match the key's type, so that (for example) an RSA public key can't be used as an HMAC secret
+func verify(token string, keyFor func(keyID string) (crypto.PublicKey, error), now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerBytes, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(headerBytes, &h); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := keyFor(h.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, ErrInvalidToken
+	}
+
+	if algorithm, err := algorithmForKey(key); err != nil || algorithm != h.Algorithm {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	valid := false
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signingInput)
+		valid = hmac.Equal(signature, mac.Sum(nil))
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signingInput)
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, signingInput, signature)
+	}
+
+	if !valid {
+		return nil, ErrInvalidToken
+	}
+
+	claimsBytes, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(claimsBytes, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// algorithmForKey returns the algorithm used with a (private or public) key
+func algorithmForKey(key interface{}) (string, error) {
+	switch key.(type) {
+	case []byte:
+		return AlgorithmHS256, nil
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return AlgorithmRS256, nil
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return AlgorithmEdDSA, nil
+	}
+	return "", errors.New("unsupported key type for jwt")
+}
+
+// publicKey returns the key that verifies signatures made with the signing key
+func publicKey(key crypto.PrivateKey) crypto.PublicKey {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
+	}
+	return key
+}
+
+func generateTokenID() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(idBytes), nil
+}
@@ -0,0 +1,61 @@
+package local
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"time"
+)
+
+// the types of AuthEvent
+const (
+	AuthEventLoginSucceeded        = "login-succeeded"
+	AuthEventLoginFailed           = "login-failed"
+	AuthEventRegistrationSucceeded = "registration-succeeded"
+	AuthEventRegistrationDuplicate = "registration-duplicate"
+)
+
+// the reasons given with failed AuthEvents
+const (
+	ReasonUserNotFound     = "user not found"
+	ReasonNoPassword       = "user has no password"
+	ReasonInvalidPassword  = "invalid password"
+	ReasonEmailNotVerified = "email not verified"
+	ReasonUserDeactivated  = "user deactivated"
+	ReasonEmailTaken       = "email already registered"
+	ReasonUsernameTaken    = "username already registered"
+)
+
+// AuthEvent describes a login or registration attempt, with the detail that (in HardenedMode) isn't given to the
+// client.  UserID is only set if a user was found
+type AuthEvent struct {
+	Type     string
+	Reason   string
+	Email    string
+	Username string
+	UserID   string
+	Time     time.Time
+}
+
+// recordAuthEvent logs the event, and passes it to OnAuthEvent if provided
+func (s *Extension) recordAuthEvent(eventType string, reason string, email string, username string, userValue *nibbler.User) {
+	event := AuthEvent{
+		Type:     eventType,
+		Reason:   reason,
+		Email:    email,
+		Username: username,
+		Time:     time.Now(),
+	}
+
+	if userValue != nil {
+		event.UserID = userValue.ID
+	}
+
+	message := "auth event " + eventType + " for email \"" + email + "\", username \"" + username + "\""
+	if reason != "" {
+		message += ", reason = " + reason
+	}
+	s.app.Logger.Debug(message)
+
+	if s.OnAuthEvent != nil {
+		(*s.OnAuthEvent)(event)
+	}
+}
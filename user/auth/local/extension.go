@@ -1,10 +1,13 @@
 package local
 
 import (
+	"crypto/rand"
 	"errors"
 	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/template"
 	"github.com/markdicksonjr/nibbler/session"
 	"github.com/markdicksonjr/nibbler/user"
+	"github.com/markdicksonjr/nibbler/user/auth/jwt"
 	"net/http"
 )
 
@@ -13,9 +16,16 @@ type Extension struct {
 
 	SessionExtension *session.Extension
 	UserExtension    *user.Extension
+	JwtExtension     *jwt.Extension // optional - if provided, logins also respond with bearer tokens (see README)
 
 	// for emailing
-	Sender nibbler.MailSender
+	Sender         nibbler.MailSender
+	EmailTemplates *template.Set               // defaults to template.Default()
+	UserLocale     func(u nibbler.User) string // optional, the locale to prefer (ahead of Accept-Language) when emailing a user
+
+	// for tokens sent by email (password reset, email verification and magic links), which are only stored as hashes
+	TokenHashKey         []byte // the HMAC key for token hashes - read from token.hash.key in config if not provided
+	AllowPlaintextTokens bool   // accept tokens stored before hashing was introduced (see MigrateUserTokens)
 
 	// for password reset
 	PasswordResetEnabled             bool
@@ -35,11 +45,24 @@ type Extension struct {
 	EmailVerificationFromName            string
 	EmailVerificationFromEmail           string
 
+	// for not revealing which emails are registered (see README) - registration emails the account owner (using the
+	// email verification from name and address) instead of telling the client that the email is taken
+	HardenedMode      bool
+	AccountExistsLink string // a link (e.g. to sign in or reset a password) for the account exists email
+
+	// for passwordless (magic link) login
+	MagicLinkEnabled                bool
+	MagicLinkFromName               string
+	MagicLinkFromEmail              string
+	MagicLinkRedirect               string // a UI or other service to handle the redirect from email (will have ?token=X or &token=X appended)
+	MagicLinkTokenExpirationMinutes *int
+
 	// callbacks (for extending default behavior)
 	OnLoginSuccessful             *func(loggedInUser nibbler.User, sessionMaxAgeMinutes int)
 	OnLogoutSuccessful            *func(loggedOutUser nibbler.User)
 	OnRegistrationSuccessful      *func(registeredUser nibbler.User)
 	OnEmailVerificationSuccessful *func(registeredUser nibbler.User)
+	OnAuthEvent                   *func(event AuthEvent) // for auditing login and registration attempts
 
 	app *nibbler.Application
 }
@@ -57,6 +80,24 @@ func (s *Extension) Init(app *nibbler.Application) error {
 		return errors.New("user extension was not provided to user local auth extension")
 	}
 
+	// if no token hash key was provided, read it from config, or fall back to a random one
+	if len(s.TokenHashKey) == 0 && app.Config != nil && app.Config.Raw != nil {
+		s.TokenHashKey = []byte(app.Config.Raw.Get("token", "hash", "key").String(""))
+	}
+
+	if len(s.TokenHashKey) == 0 {
+		s.TokenHashKey = make([]byte, 32)
+		if _, err := rand.Read(s.TokenHashKey); err != nil {
+			return err
+		}
+		app.Logger.Warn("no token hash key was provided to user local auth extension, so emailed tokens will not survive a restart")
+	}
+
+	// if no email templates were provided, use the built-in ones
+	if s.EmailTemplates == nil {
+		s.EmailTemplates = template.Default()
+	}
+
 	// if password reset is enabled, check prerequisites
 	if s.PasswordResetEnabled {
 		if s.Sender == nil {
@@ -70,6 +111,10 @@ func (s *Extension) Init(app *nibbler.Application) error {
 		if s.PasswordResetFromEmail == "" {
 			return errors.New("password reset from address was not provided to user local auth extension, but features using it are enabled")
 		}
+
+		if !s.EmailTemplates.Has(PasswordResetTemplate) {
+			return errors.New("email templates provided to user local auth extension have no " + PasswordResetTemplate + " template")
+		}
 	}
 
 	// if registration is enabled, check prerequisites
@@ -85,6 +130,48 @@ func (s *Extension) Init(app *nibbler.Application) error {
 		if s.EmailVerificationFromEmail == "" {
 			return errors.New("email verification from address was not provided to user local auth extension, but features using it are enabled")
 		}
+
+		if !s.EmailTemplates.Has(EmailVerificationTemplate) {
+			return errors.New("email templates provided to user local auth extension have no " + EmailVerificationTemplate + " template")
+		}
+	}
+
+	// if registration is hardened, check prerequisites
+	if s.HardenedMode && s.RegistrationEnabled {
+		if s.Sender == nil {
+			return errors.New("sender extension was not provided to user local auth extension, but features using it are enabled")
+		}
+
+		if s.EmailVerificationFromName == "" || s.EmailVerificationFromEmail == "" {
+			return errors.New("hardened registration requires the email verification from name and address for user local auth extension")
+		}
+
+		if !s.EmailTemplates.Has(AccountExistsTemplate) {
+			return errors.New("email templates provided to user local auth extension have no " + AccountExistsTemplate + " template")
+		}
+	}
+
+	// if passwordless login is enabled, check prerequisites
+	if s.MagicLinkEnabled {
+		if s.Sender == nil {
+			return errors.New("sender extension was not provided to user local auth extension, but features using it are enabled")
+		}
+
+		if s.MagicLinkFromName == "" {
+			return errors.New("magic link from name was not provided to user local auth extension, but features using it are enabled")
+		}
+
+		if s.MagicLinkFromEmail == "" {
+			return errors.New("magic link from address was not provided to user local auth extension, but features using it are enabled")
+		}
+
+		if !s.EmailTemplates.Has(MagicLinkTemplate) {
+			return errors.New("email templates provided to user local auth extension have no " + MagicLinkTemplate + " template")
+		}
+
+		if !s.UserExtension.SupportsLoginTokens() {
+			return errors.New("magic link login is enabled, but the user persistence extension does not support login tokens")
+		}
 	}
 
 	return nil
@@ -93,10 +180,15 @@ func (s *Extension) Init(app *nibbler.Application) error {
 func (s *Extension) PostInit(app *nibbler.Application) error {
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/user", s.GetCurrentUserHandler).Methods("GET")
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/login", s.LoginFormHandler).Methods("POST")
-	app.Router.HandleFunc(app.Config.ApiPrefix + "/logout", s.LogoutHandler).Methods("POST", "GET")
+	app.Router.HandleFunc(app.Config.ApiPrefix + "/logout", s.LogoutHandler).Methods("POST")
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/password/reset-token", s.ResetPasswordTokenHandler).Methods("POST")
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/password", s.ResetPasswordHandler).Methods("POST")
 
+	if s.MagicLinkEnabled {
+		app.Router.HandleFunc(app.Config.ApiPrefix + "/login/magic-link", s.MagicLinkTokenHandler).Methods("POST")
+		app.Router.HandleFunc(app.Config.ApiPrefix + "/login/magic-link/verify", s.MagicLinkLoginHandler).Methods("POST")
+	}
+
 	if s.RegistrationEnabled {
 		app.Router.HandleFunc(app.Config.ApiPrefix + "/register", s.RegisterFormHandler).Methods("POST")
 
@@ -2,7 +2,15 @@ package local
 
 import (
 	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/memory"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestImplements(t *testing.T) {
@@ -13,3 +21,65 @@ func TestImplements(t *testing.T) {
 	}
 }
 
+// newTestExtension builds a local auth extension on in-memory persistence, a mock session store and a capturing mail
+// sender, with a single user (bob@example.com, password bob-password) already registered.  configure is called before Init
+func newTestExtension(t *testing.T, configure func(e *Extension)) (*Extension, *memory.Sender) {
+	mock, err := user.NewMockApp()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionExtension := session.NewMockExtension()
+	if err := sessionExtension.Init(mock.App); err != nil {
+		t.Fatal(err)
+	}
+
+	email := "bob@example.com"
+	password, err := GeneratePasswordHash("bob-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mock.UserExtension.Create(&nibbler.User{Email: &email, Password: &password}); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &memory.Sender{}
+	e := &Extension{
+		SessionExtension: sessionExtension,
+		UserExtension:    mock.UserExtension,
+		Sender:           sender,
+		TokenHashKey:     []byte("test-key"),
+	}
+	configure(e)
+
+	if err := e.Init(mock.App); err != nil {
+		t.Fatal(err)
+	}
+
+	return e, sender
+}
+
+func postForm(handler http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	handler(res, req)
+	return res
+}
+
+// waitForMail waits for the (asynchronously-sent) email to reach the sender
+func waitForMail(t *testing.T, sender *memory.Sender, count int) *memory.Message {
+	for i := 0; i < 100 && len(sender.Messages()) < count; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if len(sender.Messages()) < count {
+		t.Fatal("no email was sent")
+	}
+	return sender.Last()
+}
+
+// tokenFromMail pulls the token out of the link in the email
+func tokenFromMail(message *memory.Message) string {
+	return strings.Fields(strings.SplitN(message.PlainTextContent, "?token=", 2)[1])[0]
+}
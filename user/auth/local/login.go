@@ -47,8 +47,19 @@ func (s *Extension) LoginFormHandler(w http.ResponseWriter, r *http.Request) {
 
 	userValue, err := s.Login(email, username, password)
 
+	// in hardened mode, every rejected login gets the same response
+	if err == ErrInvalidCredentials {
+		nibbler.WriteJson(w, `{"result": "invalid credentials"}`, http.StatusUnauthorized)
+		return
+	}
+
 	// if an error happened during login
 	if err != nil {
+		if s.HardenedMode {
+			nibbler.Write500Json(w, "please try again")
+			return
+		}
+
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
@@ -59,8 +70,14 @@ func (s *Extension) LoginFormHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.completeLogin(w, r, userValue)
+}
+
+// completeLogin puts the (authenticated) user into the session and writes the login response
+func (s *Extension) completeLogin(w http.ResponseWriter, r *http.Request, userValue *nibbler.User) {
+
 	// set the caller in the session
-	if err = s.SessionExtension.SetCaller(w, r, userValue); err != nil {
+	if err := s.SessionExtension.SetCaller(w, r, userValue); err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
@@ -73,36 +90,58 @@ func (s *Extension) LoginFormHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// issue bearer tokens for clients that don't keep cookies
+	tokensJson := ""
+	if s.JwtExtension != nil {
+		tokens, err := s.JwtExtension.IssueTokens(userValue)
+		if err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		}
+
+		tokensBytes, err := json.Marshal(tokens)
+		if err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		}
+		tokensJson = `, "tokens": ` + string(tokensBytes)
+	}
+
 	if s.OnLoginSuccessful != nil {
 		(*s.OnLoginSuccessful)(safeUser, s.SessionExtension.StoreConnector.MaxAge())
 	}
 
 	nibbler.Write200Json(w, `{"user": `+jsonString+
-		`, "sessionAgeSeconds":`+strconv.Itoa(s.SessionExtension.StoreConnector.MaxAge())+`}`)
+		`, "sessionAgeSeconds":`+strconv.Itoa(s.SessionExtension.StoreConnector.MaxAge())+tokensJson+`}`)
 }
 
+// LogoutHandler ends the caller's session entirely (clearing all of its values, not just the caller)
 func (s *Extension) LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	err := s.SessionExtension.SetCaller(w, r, nil)
 
+	// grab the caller before the session is gone, for the callback
+	sessionUser, err := s.SessionExtension.GetCaller(r)
 	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
 
-	if s.OnLogoutSuccessful != nil {
-		sessionUser, err := s.SessionExtension.GetCaller(r)
-
-		if err != nil {
-			nibbler.Write500Json(w, err.Error())
-			return
-		}
+	if err := s.SessionExtension.InvalidateSession(w, r); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
 
+	if s.OnLogoutSuccessful != nil && sessionUser != nil {
 		(*s.OnLogoutSuccessful)(*sessionUser)
 	}
 
 	nibbler.Write200Json(w, `{"result": "ok"}`)
 }
 
+// ErrInvalidCredentials is returned by Login in HardenedMode for any rejected login, whatever the reason
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Login returns the user with the given email (or username) and password.  Outside of HardenedMode, a nil user and
+// nil error means the user wasn't found.  In HardenedMode, every rejected login returns ErrInvalidCredentials
 func (s *Extension) Login(email string, username string, password string) (*nibbler.User, error) {
 	var u *nibbler.User
 	var err error
@@ -122,25 +161,63 @@ func (s *Extension) Login(email string, username string, password string) (*nibb
 	}
 
 	if u == nil || u.Password == nil {
+		reason := ReasonUserNotFound
+		if u != nil {
+			reason = ReasonNoPassword
+		}
+		s.recordAuthEvent(AuthEventLoginFailed, reason, email, username, u)
+
+		if s.HardenedMode {
+
+			// compare against a dummy hash, so that the response takes as long as it would for a real user
+			comparePassword(password, getDummyPasswordHash())
+			return nil, ErrInvalidCredentials
+		}
 		return nil, nil
 	}
 
-	validPassword, err := ValidatePassword(password, *u.Password)
-	if err != nil {
-		s.app.Logger.Error("while validating password in login flow, error = " + err.Error())
-		return nil, err
+	if s.HardenedMode {
+		if !comparePassword(password, *u.Password) {
+			s.recordAuthEvent(AuthEventLoginFailed, ReasonInvalidPassword, email, username, u)
+			return nil, ErrInvalidCredentials
+		}
+	} else {
+		validPassword, err := ValidatePassword(password, *u.Password)
+		if err != nil {
+			s.app.Logger.Error("while validating password in login flow, error = " + err.Error())
+			s.recordAuthEvent(AuthEventLoginFailed, ReasonInvalidPassword, email, username, u)
+			return nil, err
+		}
+
+		if !validPassword {
+			s.app.Logger.Trace("invalid password for email \"" + email + "\", username \"" + username + "\"")
+			s.recordAuthEvent(AuthEventLoginFailed, ReasonInvalidPassword, email, username, u)
+			return nil, errors.New("invalid password")
+		}
 	}
 
-	if !validPassword {
-		s.app.Logger.Trace("invalid password for email \"" + email + "\", username \"" + username + "\"")
-		return nil, errors.New("invalid password")
+	// deactivated users can't log in, even with the right password
+	if !user.IsUserActive(*u) {
+		s.app.Logger.Debug("login blocked for deactivated user " + u.ID)
+		s.recordAuthEvent(AuthEventLoginFailed, ReasonUserDeactivated, email, username, u)
+
+		if s.HardenedMode {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, errors.New("user deactivated")
 	}
 
 	// if we need email verification but it hasn't been done yet, fail
 	if s.EmailVerificationEnabled && s.EmailVerificationRequired && (u.IsEmailValidated == nil || !*u.IsEmailValidated) {
 		s.app.Logger.Debug("login blocked for email " + email + " because it was not verified")
+		s.recordAuthEvent(AuthEventLoginFailed, ReasonEmailNotVerified, email, username, u)
+
+		if s.HardenedMode {
+			return nil, ErrInvalidCredentials
+		}
 		return nil, errors.New("email not verified")
 	}
 
+	s.recordAuthEvent(AuthEventLoginSucceeded, "", email, username, u)
 	return u, nil
 }
@@ -0,0 +1,130 @@
+package local
+
+import (
+	"encoding/json"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user/auth/jwt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestExtension_LoginHardened(t *testing.T) {
+	var events []AuthEvent
+	onAuthEvent := func(event AuthEvent) {
+		events = append(events, event)
+	}
+
+	e, _ := newTestExtension(t, func(e *Extension) {
+		e.HardenedMode = true
+		e.OnAuthEvent = &onAuthEvent
+	})
+
+	wrongPassword := postForm(e.LoginFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"not-bob-password"}})
+	shortPassword := postForm(e.LoginFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"short"}})
+	unknownUser := postForm(e.LoginFormHandler, url.Values{"email": {"nobody@example.com"}, "password": {"bob-password"}})
+
+	for _, res := range []*http.Response{shortPassword.Result(), unknownUser.Result()} {
+		if res.StatusCode != wrongPassword.Code || res.StatusCode != http.StatusUnauthorized {
+			t.Fatal("rejected logins got different responses")
+		}
+	}
+
+	if shortPassword.Body.String() != wrongPassword.Body.String() || unknownUser.Body.String() != wrongPassword.Body.String() {
+		t.Fatal("rejected logins got different responses")
+	}
+
+	// the detail is still available to the app
+	if len(events) != 3 || events[0].Reason != ReasonInvalidPassword || events[2].Reason != ReasonUserNotFound {
+		t.Fatal("the expected auth events were not recorded")
+	}
+
+	if res := postForm(e.LoginFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"bob-password"}}); res.Code != http.StatusOK {
+		t.Fatal("a valid login was rejected")
+	}
+
+	if events[3].Type != AuthEventLoginSucceeded || events[3].UserID == "" {
+		t.Fatal("the successful login was not recorded")
+	}
+}
+
+func TestExtension_Logout(t *testing.T) {
+	var loggedOut *nibbler.User
+	onLogout := func(u nibbler.User) {
+		loggedOut = &u
+	}
+
+	e, _ := newTestExtension(t, func(e *Extension) {
+		e.OnLogoutSuccessful = &onLogout
+	})
+
+	if res := postForm(e.LoginFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"bob-password"}}); res.Code != http.StatusOK {
+		t.Fatal("login failed")
+	}
+
+	if res := postForm(e.LogoutHandler, url.Values{}); res.Code != http.StatusOK {
+		t.Fatal("logout failed")
+	}
+
+	if loggedOut == nil || loggedOut.Email == nil || *loggedOut.Email != "bob@example.com" {
+		t.Fatal("the logout callback did not get the logged out user")
+	}
+
+	if caller, _ := e.SessionExtension.GetCaller(httptest.NewRequest("GET", "/", nil)); caller != nil {
+		t.Fatal("the caller was still in the session after logout")
+	}
+}
+
+func TestExtension_LoginIssuesTokens(t *testing.T) {
+	e, _ := newTestExtension(t, func(e *Extension) {
+		e.JwtExtension = &jwt.Extension{UserExtension: e.UserExtension, SigningKey: []byte("0123456789abcdef0123456789abcdef")}
+		if err := e.JwtExtension.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	res := postForm(e.LoginFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"bob-password"}})
+	if res.Code != http.StatusOK {
+		t.Fatal("login failed")
+	}
+
+	var body struct {
+		Tokens jwt.Tokens `json:"tokens"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body.Tokens.AccessToken == "" || body.Tokens.RefreshToken == "" {
+		t.Fatal("the login response did not include tokens")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+body.Tokens.AccessToken)
+	if caller, err := e.JwtExtension.GetCaller(req); err != nil || caller == nil || *caller.Email != "bob@example.com" {
+		t.Fatal("the access token did not identify the user")
+	}
+}
+
+func TestExtension_LoginDeactivated(t *testing.T) {
+	var events []AuthEvent
+	onAuthEvent := func(event AuthEvent) {
+		events = append(events, event)
+	}
+
+	e, _ := newTestExtension(t, func(e *Extension) {
+		e.OnAuthEvent = &onAuthEvent
+	})
+
+	bob, _ := e.UserExtension.GetUserByEmail("bob@example.com")
+	isActive := false
+	bob.IsActive = &isActive
+	if err := e.UserExtension.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := postForm(e.LoginFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"bob-password"}}); res.Code == http.StatusOK {
+		t.Fatal("a deactivated user logged in")
+	}
+
+	if len(events) != 1 || events[0].Reason != ReasonUserDeactivated {
+		t.Fatal("the deactivated login was not recorded")
+	}
+}
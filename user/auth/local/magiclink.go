@@ -0,0 +1,175 @@
+package local
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MagicLinkTokenHandler emails a single-use sign-in link to the user with the given email or username.  Like the
+// password reset token flow, it responds the same way whether or not the user exists
+func (s *Extension) MagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.MagicLinkEnabled {
+		s.app.Logger.Warn("magic link requested while feature disabled")
+		nibbler.Write404Json(w)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	username := strings.TrimSpace(r.FormValue("username"))
+
+	var userValue *nibbler.User
+	var err error
+
+	if email != "" {
+		userValue, err = s.UserExtension.GetUserByEmail(email)
+	} else if username != "" {
+		userValue, err = s.UserExtension.GetUserByUsername(username)
+	} else {
+		s.app.Logger.Error("while requesting magic link, received invalid parameters, request url = " + r.URL.String())
+		nibbler.Write500Json(w, "incorrect parameters")
+		return
+	}
+
+	if err != nil {
+		s.app.Logger.Error("while requesting magic link, error = " + err.Error())
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	// user not found (or can't be emailed), but we want to respond with OK to not give away too much info
+	if userValue == nil {
+		s.app.Logger.Warn("user not found in magic link flow for email \"" + email + "\", username \"" + username + "\"")
+		nibbler.Write200Json(w, `{"result": "ok"}`)
+		return
+	}
+
+	if userValue.Email == nil {
+		s.app.Logger.Warn("user had no email on record during magic link request for user " + userValue.ID)
+		nibbler.Write200Json(w, `{"result": "ok"}`)
+		return
+	}
+
+	// compute token expiration time (defaults to 15 minutes)
+	expirationMinutes := 15
+	if s.MagicLinkTokenExpirationMinutes != nil {
+		expirationMinutes = *s.MagicLinkTokenExpirationMinutes
+	}
+
+	// generate the token, storing only its hash
+	token, err := generateToken()
+	if err != nil {
+		s.app.Logger.Error("while generating magic link token, error = " + err.Error())
+		nibbler.Write500Json(w, "failed to generate token")
+		return
+	}
+
+	tokenHash := s.hashToken(token)
+	expiration := time.Now().Add(time.Duration(expirationMinutes) * time.Minute)
+	userValue.LoginToken = &tokenHash
+	userValue.LoginTokenExpiration = &expiration
+
+	if err := s.UserExtension.Update(userValue); err != nil {
+		s.app.Logger.Error("in magic link flow, failed to update user record: " + err.Error())
+		nibbler.Write500Json(w, "failed to update user record")
+		return
+	}
+
+	// send the email with the sign-in link
+	if err := s.sendTemplatedMail(
+		r,
+		MagicLinkTemplate,
+		&nibbler.EmailAddress{
+			Name:    s.MagicLinkFromName,
+			Address: s.MagicLinkFromEmail,
+		},
+		userValue,
+		user.AppendTokenToLink(s.MagicLinkRedirect, token),
+	); err != nil {
+		s.app.Logger.Error("while preparing email in magic link flow, error = " + err.Error())
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
+
+// MagicLinkLoginHandler logs in the user with the given magic link token.  The token can only be used once
+func (s *Extension) MagicLinkLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.MagicLinkEnabled {
+		s.app.Logger.Warn("magic link login requested while feature disabled")
+		nibbler.Write404Json(w)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		s.app.Logger.Warn("got magic link login request with no token")
+		nibbler.Write500Json(w, "a token form parameter is required")
+		return
+	}
+
+	userValue, err := s.getUserByLoginToken(token)
+	if err != nil {
+		s.app.Logger.Error("while logging in with magic link, error = " + err.Error())
+		nibbler.Write500Json(w, "please try again")
+		return
+	}
+
+	if userValue == nil {
+		s.app.Logger.Warn("while logging in with magic link, user not found for token")
+		nibbler.Write500Json(w, "please try again")
+		return
+	}
+
+	if !user.IsUserActive(*userValue) {
+		s.app.Logger.Warn("magic link login blocked for deactivated user " + userValue.ID)
+		nibbler.Write500Json(w, "please try again")
+		return
+	}
+
+	// the token is single-use, so clear it before doing anything else - if another request got there first, it's used
+	if cleared, err := s.UserExtension.ClearLoginToken(userValue.ID, *userValue.LoginToken); err != nil {
+		s.app.Logger.Error("while clearing magic link token, error = " + err.Error())
+		nibbler.Write500Json(w, "please try again")
+		return
+	} else if !cleared {
+		s.app.Logger.Warn("magic link token for user " + userValue.ID + " was already used")
+		nibbler.Write500Json(w, "please try again")
+		return
+	}
+	userValue.LoginToken = nil
+	userValue.LoginTokenExpiration = nil
+
+	// following the link proves the user controls the email address
+	if s.EmailVerificationEnabled && (userValue.IsEmailValidated == nil || !*userValue.IsEmailValidated) {
+		isTrue := true
+		userValue.IsEmailValidated = &isTrue
+		userValue.EmailValidationToken = nil
+		userValue.EmailValidationExpiration = nil
+	}
+
+	if err := s.UserExtension.Update(userValue); err != nil {
+		s.app.Logger.Error("in magic link login, failed to update user record: " + err.Error())
+		nibbler.Write500Json(w, "failed to update user record")
+		return
+	}
+
+	s.completeLogin(w, r, userValue)
+}
+
+func (s *Extension) getUserByLoginToken(token string) (*nibbler.User, error) {
+	userValue, err := s.getUserByToken(token, s.UserExtension.GetUserByLoginToken, func(u *nibbler.User) *string {
+		return u.LoginToken
+	})
+
+	if err != nil || userValue == nil {
+		return nil, err
+	}
+
+	if userValue.LoginTokenExpiration == nil || !(*userValue.LoginTokenExpiration).After(time.Now()) {
+		return nil, nil
+	}
+
+	return userValue, nil
+}
@@ -0,0 +1,102 @@
+package local
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func enableMagicLinks(e *Extension) {
+	e.MagicLinkEnabled = true
+	e.MagicLinkFromName = "Support"
+	e.MagicLinkFromEmail = "support@example.com"
+	e.MagicLinkRedirect = "https://example.com/sign-in"
+}
+
+func TestExtension_MagicLink(t *testing.T) {
+	e, sender := newTestExtension(t, enableMagicLinks)
+
+	res := postForm(e.MagicLinkTokenHandler, url.Values{"email": {"bob@example.com"}})
+	if res.Code != http.StatusOK {
+		t.Fatal("magic link request failed")
+	}
+
+	message := waitForMail(t, sender, 1)
+	if message.Subject != "Sign In Link" || message.To[0].Address != "bob@example.com" {
+		t.Fatal("the wrong email was sent")
+	}
+
+	token := tokenFromMail(message)
+
+	// the token itself should never be stored
+	stored, _ := e.UserExtension.GetUserByEmail("bob@example.com")
+	if stored.LoginToken == nil || *stored.LoginToken == token {
+		t.Fatal("the login token was not stored hashed")
+	}
+
+	if res := postForm(e.MagicLinkLoginHandler, url.Values{"token": {token}}); res.Code != http.StatusOK {
+		t.Fatal("magic link login failed")
+	}
+
+	caller, err := e.SessionExtension.GetCaller(httptest.NewRequest("GET", "/", nil))
+	if err != nil || caller == nil || caller.ID != stored.ID {
+		t.Fatal("the user was not put into the session")
+	}
+
+	// the token is single-use
+	if res := postForm(e.MagicLinkLoginHandler, url.Values{"token": {token}}); res.Code == http.StatusOK {
+		t.Fatal("a magic link token was used twice")
+	}
+}
+
+func TestExtension_MagicLinkConcurrentUse(t *testing.T) {
+	e, sender := newTestExtension(t, enableMagicLinks)
+
+	if res := postForm(e.MagicLinkTokenHandler, url.Values{"email": {"bob@example.com"}}); res.Code != http.StatusOK {
+		t.Fatal("magic link request failed")
+	}
+	token := tokenFromMail(waitForMail(t, sender, 1))
+
+	// however the requests interleave, only one can log in with the token
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postForm(e.MagicLinkLoginHandler, url.Values{"token": {token}}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	logins := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			logins++
+		}
+	}
+
+	if logins != 1 {
+		t.Fatal("a magic link token was used " + strconv.Itoa(logins) + " times")
+	}
+}
+
+func TestExtension_MagicLinkUnknownUser(t *testing.T) {
+	e, sender := newTestExtension(t, enableMagicLinks)
+
+	known := postForm(e.MagicLinkTokenHandler, url.Values{"email": {"bob@example.com"}})
+	unknown := postForm(e.MagicLinkTokenHandler, url.Values{"email": {"nobody@example.com"}})
+
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Fatal("the response for an unknown user differs from the response for a known user")
+	}
+
+	waitForMail(t, sender, 1)
+	if len(sender.SentTo("nobody@example.com")) != 0 {
+		t.Fatal("an email was sent for an unknown user")
+	}
+}
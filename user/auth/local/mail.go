@@ -0,0 +1,68 @@
+package local
+
+import (
+	"context"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/template"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+)
+
+// the names of the templates (in EmailTemplates) used for each email this extension sends
+const PasswordResetTemplate = "password-reset"
+const EmailVerificationTemplate = "email-verification"
+const MagicLinkTemplate = "magic-link"
+const AccountExistsTemplate = "account-exists"
+const AccountInvitationTemplate = "account-invitation"
+
+// sendTemplatedMail renders the named template for the given user and link, then sends it to the user's email address.
+// A queueing Sender (see mail/queue) is handed the email before returning, and errors accepting it are returned.  Other
+// senders are sent to in the background, and failures are only logged
+func (s *Extension) sendTemplatedMail(
+	r *http.Request,
+	templateName string,
+	from *nibbler.EmailAddress,
+	userValue *nibbler.User,
+	link string,
+) error {
+	name := user.GetFullName(*userValue)
+
+	// pick the locale, preferring the user's over the request's
+	userLocale := ""
+	if s.UserLocale != nil {
+		userLocale = s.UserLocale(*userValue)
+	}
+
+	// templates only ever see the safe version of the user
+	safeUser := user.GetSafeUser(*userValue)
+	rendered, err := s.EmailTemplates.Render(templateName, template.LocalesForRequest(r, userLocale), template.Data{
+		User: &safeUser,
+		Name: name,
+		Link: link,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	message := &nibbler.MailMessage{
+		From:             from,
+		To:               []*nibbler.EmailAddress{{Address: *userValue.Email, Name: name}},
+		Subject:          rendered.Subject,
+		PlainTextContent: rendered.PlainTextContent,
+		HtmlContent:      rendered.HtmlContent,
+	}
+
+	if nibbler.IsQueueingMailSender(s.Sender) {
+		_, err := nibbler.ToMessageSender(s.Sender).SendMessage(r.Context(), message)
+		return err
+	}
+
+	go func() {
+		if _, err := nibbler.ToMessageSender(s.Sender).SendMessage(context.Background(), message); err != nil {
+			s.app.Logger.Error("while sending " + templateName + " email, error = " + err.Error())
+		}
+	}()
+
+	return nil
+}
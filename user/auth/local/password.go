@@ -1,8 +1,9 @@
 package local
 
 import (
-	"github.com/google/uuid"
+	"errors"
 	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
 	"net/http"
 	"strings"
 	"time"
@@ -55,65 +56,91 @@ func (s *Extension) ResetPasswordTokenHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// compute password expiration time (defaults to 1 day)
-	expirationDays := 1
-	if s.PasswordResetTokenExpirationDays != nil {
-		expirationDays = *s.PasswordResetTokenExpirationDays
+	token, err := s.createPasswordResetToken(userValue)
+	if err != nil {
+		s.app.Logger.Error("in request password reset token flow, error = " + err.Error())
+		nibbler.Write500Json(w, "failed to update user record")
+		return
 	}
 
-	// generate reset token with expiration
-	uuidInstance := uuid.New().String()
-	expiration := time.Now().AddDate(0, 0, expirationDays)
-	userValue.PasswordResetToken = &uuidInstance
-	userValue.PasswordResetExpiration = &expiration
+	// failures to send are only logged, as responding differently for known accounts would reveal which exist
+	if err := s.sendPasswordResetLink(r, userValue, PasswordResetTemplate, token); err != nil {
+		s.app.Logger.Error("while sending email in password reset flow, error = " + err.Error())
+	}
 
-	errUpdate := s.UserExtension.Update(userValue)
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
 
-	if errUpdate != nil {
-		s.app.Logger.Error("in request password reset token flow, failed to update user record: " + errUpdate.Error())
-		nibbler.Write500Json(w, "failed to update user record")
-		return
+// SendPasswordResetEmail emails the user a link to reset their password (e.g. when an administrator forces a reset).
+// Password reset must be enabled, and the user must have an email.  Unlike the public route, failures to send the email
+// (e.g. to a full mail queue) are returned
+func (s *Extension) SendPasswordResetEmail(r *http.Request, userValue *nibbler.User) error {
+	return s.sendPasswordResetToken(r, userValue, PasswordResetTemplate)
+}
+
+// SendAccountInvitationEmail emails a user (e.g. one created by an administrator) a link to choose their password, with
+// the AccountInvitationTemplate.  The link is a password reset link, so password reset must be enabled.  Failures to
+// send the email are returned
+func (s *Extension) SendAccountInvitationEmail(r *http.Request, userValue *nibbler.User) error {
+	return s.sendPasswordResetToken(r, userValue, AccountInvitationTemplate)
+}
+
+// sendPasswordResetToken creates a password reset token for the user, and emails them a link with it, rendered from the
+// named template
+func (s *Extension) sendPasswordResetToken(r *http.Request, userValue *nibbler.User, templateName string) error {
+	token, err := s.createPasswordResetToken(userValue)
+	if err != nil {
+		return err
+	}
+	return s.sendPasswordResetLink(r, userValue, templateName, token)
+}
+
+// createPasswordResetToken stores a new password reset token (only its hash) for the user, and returns the token
+func (s *Extension) createPasswordResetToken(userValue *nibbler.User) (string, error) {
+	if !s.PasswordResetEnabled {
+		return "", errors.New("password reset is not enabled")
 	}
 
-	name := ""
-	if userValue.FirstName != nil && userValue.LastName != nil {
-		name = *userValue.FirstName + " " + *userValue.LastName
+	if userValue.Email == nil || *userValue.Email == "" {
+		return "", errors.New("no email on record")
 	}
 
-	go func() {
+	// compute password expiration time (defaults to 1 day)
+	expirationDays := 1
+	if s.PasswordResetTokenExpirationDays != nil {
+		expirationDays = *s.PasswordResetTokenExpirationDays
+	}
 
-		// generate the link for the email
-		var link = s.PasswordResetRedirect
-		useAmpersand := strings.Contains(s.PasswordResetRedirect, "?")
-		if useAmpersand {
-			link += "&token=" + *userValue.PasswordResetToken
-		} else {
-			link += "?token=" + *userValue.PasswordResetToken
-		}
+	// generate reset token with expiration, storing only its hash
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
 
-		// build the recipient list
-		emailVal := *userValue.Email
-		var toList []*nibbler.EmailAddress
-		toList = append(toList, &nibbler.EmailAddress{Address: emailVal, Name: name})
-
-		// send the email
-		_, err = s.Sender.SendMail(
-			&nibbler.EmailAddress{
-				Name:    s.PasswordResetFromName,
-				Address: s.PasswordResetFromEmail,
-			},
-			"Password Reset", // TODO: make configurable
-			toList,
-			"Please go to "+link+" to reset your password",
-			"Please go to <a href=\""+link+"\">"+link+"</a> to reset your password",
-		)
-
-		if err != nil {
-			s.app.Logger.Error("while sending email in password reset flow, error = " + err.Error())
-		}
-	}()
+	tokenHash := s.hashToken(token)
+	expiration := time.Now().AddDate(0, 0, expirationDays)
+	userValue.PasswordResetToken = &tokenHash
+	userValue.PasswordResetExpiration = &expiration
 
-	nibbler.Write200Json(w, `{"result": "ok"}`)
+	if err := s.UserExtension.Update(userValue); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// sendPasswordResetLink emails the user a link to reset their password with the token, rendered from the named
+// template (see sendTemplatedMail for which errors are returned)
+func (s *Extension) sendPasswordResetLink(r *http.Request, userValue *nibbler.User, templateName string, token string) error {
+	return s.sendTemplatedMail(
+		r,
+		templateName,
+		&nibbler.EmailAddress{
+			Name:    s.PasswordResetFromName,
+			Address: s.PasswordResetFromEmail,
+		},
+		userValue,
+		user.AppendTokenToLink(s.PasswordResetRedirect, token),
+	)
 }
 
 func (s *Extension) ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,23 +171,31 @@ func (s *Extension) ResetPasswordHandler(w http.ResponseWriter, r *http.Request)
 
 	// TODO: check password complexity...  make configurable...
 
-	*userValue.Password, err = GeneratePasswordHash(password)
+	// the user may not have had a password yet (e.g. if they only used magic links), so don't write through the pointer
+	passwordHash, err := GeneratePasswordHash(password)
 	if err != nil {
 		s.app.Logger.Error("while generating password reset hash, error = " + err.Error())
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
+	userValue.Password = &passwordHash
 
 	(*userValue).PasswordResetToken = nil
 	(*userValue).PasswordResetExpiration = nil
 
-	// TODO: ensure extension sets above props to null, as well
 	if err = s.UserExtension.UpdatePassword(userValue); err != nil {
 		s.app.Logger.Error("while updating user record in password reset, error = " + err.Error())
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
 
+	// anyone who was logged in as the user (possibly with the old password) is logged out
+	if err = s.SessionExtension.InvalidateUserSessions(userValue.ID); err != nil {
+		s.app.Logger.Error("while invalidating sessions in password reset, error = " + err.Error())
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
 	nibbler.Write200Json(w, `{"result": "ok"}`)
 }
 
@@ -169,7 +204,9 @@ func (s *Extension) getUserByPasswordResetTokenAndValidate(token string) (*nibbl
 		return nil, nil
 	}
 
-	userValue, err := s.UserExtension.GetUserByPasswordResetToken(token)
+	userValue, err := s.getUserByToken(token, s.UserExtension.GetUserByPasswordResetToken, func(u *nibbler.User) *string {
+		return u.PasswordResetToken
+	})
 
 	if err != nil || userValue == nil {
 		return nil, nil
@@ -0,0 +1,149 @@
+package local
+
+import (
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/queue"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func enablePasswordReset(e *Extension) {
+	e.PasswordResetEnabled = true
+	e.PasswordResetFromName = "Support"
+	e.PasswordResetFromEmail = "support@example.com"
+	e.PasswordResetRedirect = "https://example.com/reset"
+}
+
+func TestExtension_ResetPassword(t *testing.T) {
+	e, sender := newTestExtension(t, enablePasswordReset)
+
+	if res := postForm(e.ResetPasswordTokenHandler, url.Values{"email": {"bob@example.com"}}); res.Code != http.StatusOK {
+		t.Fatal("password reset token request failed")
+	}
+
+	token := tokenFromMail(waitForMail(t, sender, 1))
+
+	stored, _ := e.UserExtension.GetUserByEmail("bob@example.com")
+	if stored.PasswordResetToken == nil || *stored.PasswordResetToken == token {
+		t.Fatal("the password reset token was not stored hashed")
+	}
+
+	// the stored value must not work as a token
+	if res := postForm(e.ResetPasswordHandler, url.Values{"token": {*stored.PasswordResetToken}, "password": {"new-password"}}); res.Code == http.StatusOK {
+		t.Fatal("the stored hash was accepted as a token")
+	}
+
+	if res := postForm(e.ResetPasswordHandler, url.Values{"token": {token}, "password": {"new-password"}}); res.Code != http.StatusOK {
+		t.Fatal("password reset failed")
+	}
+
+	stored, _ = e.UserExtension.GetUserByEmail("bob@example.com")
+	if ok, _ := ValidatePassword("new-password", *stored.Password); !ok {
+		t.Fatal("the password was not changed")
+	}
+
+	// the token is single-use
+	if res := postForm(e.ResetPasswordHandler, url.Values{"token": {token}, "password": {"other-password"}}); res.Code == http.StatusOK {
+		t.Fatal("a password reset token was used twice")
+	}
+}
+
+func TestExtension_PasswordChangeInvalidatesTokens(t *testing.T) {
+	e, sender := newTestExtension(t, enablePasswordReset)
+
+	postForm(e.ResetPasswordTokenHandler, url.Values{"email": {"bob@example.com"}})
+	token := tokenFromMail(waitForMail(t, sender, 1))
+
+	// change the password some other way
+	stored, _ := e.UserExtension.GetUserByEmail("bob@example.com")
+	password, _ := GeneratePasswordHash("changed-password")
+	stored.Password = &password
+	if err := e.UserExtension.UpdatePassword(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := postForm(e.ResetPasswordHandler, url.Values{"token": {token}, "password": {"new-password"}}); res.Code == http.StatusOK {
+		t.Fatal("a password reset token outlived a password change")
+	}
+}
+
+func TestExtension_PlaintextTokens(t *testing.T) {
+	e, _ := newTestExtension(t, enablePasswordReset)
+
+	// simulate a token stored before hashing was introduced
+	stored, _ := e.UserExtension.GetUserByEmail("bob@example.com")
+	legacyToken := "0b7c3f1e-58b5-4c6a-9d3e-2f4d1c7a8e90"
+	expiration := time.Now().Add(time.Hour)
+	stored.PasswordResetToken = &legacyToken
+	stored.PasswordResetExpiration = &expiration
+	if err := e.UserExtension.Update(stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, _ := e.getUserByPasswordResetTokenAndValidate(legacyToken); u != nil {
+		t.Fatal("a plaintext token was accepted without AllowPlaintextTokens")
+	}
+
+	e.AllowPlaintextTokens = true
+	if u, _ := e.getUserByPasswordResetTokenAndValidate(legacyToken); u == nil {
+		t.Fatal("a plaintext token was rejected with AllowPlaintextTokens")
+	}
+
+	// after migration, the same token works without AllowPlaintextTokens
+	e.AllowPlaintextTokens = false
+	if changed, err := e.MigrateUserTokens(stored); err != nil || !changed {
+		t.Fatal("the plaintext token was not migrated")
+	}
+
+	if changed, _ := e.MigrateUserTokens(stored); changed {
+		t.Fatal("an already-hashed token was migrated again")
+	}
+
+	if u, _ := e.getUserByPasswordResetTokenAndValidate(legacyToken); u == nil {
+		t.Fatal("a migrated token was rejected")
+	}
+}
+
+type unavailableSender struct{}
+
+func (u unavailableSender) SendMail(from *nibbler.EmailAddress, subject string, to []*nibbler.EmailAddress, plainTextContent string, htmlContent string) (*nibbler.MailSendResponse, error) {
+	return nil, errors.New("mail server unavailable")
+}
+
+func TestExtension_ResetPasswordQueuesMail(t *testing.T) {
+	mailQueue := &queue.Extension{Sender: unavailableSender{}, InitialBackoff: time.Hour}
+	if err := mailQueue.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, _ := newTestExtension(t, func(e *Extension) {
+		enablePasswordReset(e)
+		e.Sender = mailQueue
+	})
+
+	// the email is queued before the response, so it's retried rather than lost
+	if res := postForm(e.ResetPasswordTokenHandler, url.Values{"email": {"bob@example.com"}}); res.Code != http.StatusOK {
+		t.Fatal("password reset token request failed")
+	}
+
+	if pending, _ := mailQueue.Store.Pending(); len(pending) != 1 {
+		t.Fatal("the email was not queued during the request")
+	}
+
+	// an email the queue won't accept is only logged - a different response would reveal that the account exists
+	mailQueue.Destroy(&nibbler.Application{})
+
+	if res := postForm(e.ResetPasswordTokenHandler, url.Values{"email": {"bob@example.com"}}); res.Code != http.StatusOK {
+		t.Fatal("a rejected email changed the response")
+	}
+
+	// administrators sending a reset are told, though
+	bob, _ := e.UserExtension.GetUserByEmail("bob@example.com")
+	if err := e.SendPasswordResetEmail(httptest.NewRequest("POST", "/", nil), bob); err == nil {
+		t.Fatal("a rejected email was not reported to an administrator")
+	}
+}
@@ -2,7 +2,6 @@ package local
 
 import (
 	"encoding/json"
-	"github.com/google/uuid"
 	"github.com/markdicksonjr/nibbler"
 	"github.com/markdicksonjr/nibbler/user"
 	"io/ioutil"
@@ -76,8 +75,14 @@ func (s *Extension) RegisterFormHandler(w http.ResponseWriter, r *http.Request)
 		}
 
 		// if the user is found
-		// TODO: improve error message, but don't let the user know the email is in the system, if possible
 		if u != nil {
+			s.recordAuthEvent(AuthEventRegistrationDuplicate, ReasonEmailTaken, email, username, u)
+
+			if s.HardenedMode {
+				s.respondToDuplicateRegistration(w, r, u, password)
+				return
+			}
+
 			nibbler.Write500Json(w, "please try again")
 			return
 		}
@@ -90,8 +95,15 @@ func (s *Extension) RegisterFormHandler(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		// TODO: improve error message, but don't let the user know the email is in the system, if possible
+		// usernames are chosen by the user, so it can't be hidden that one is taken
 		if u != nil {
+			s.recordAuthEvent(AuthEventRegistrationDuplicate, ReasonUsernameTaken, email, username, u)
+
+			if s.HardenedMode {
+				nibbler.Write500Json(w, "username is not available")
+				return
+			}
+
 			nibbler.Write500Json(w, "please try again")
 			return
 		}
@@ -108,6 +120,7 @@ func (s *Extension) RegisterFormHandler(w http.ResponseWriter, r *http.Request)
 		userValue.Username = &username
 	}
 
+	var token string
 	if s.EmailVerificationEnabled {
 
 		// compute verification token expiration time (defaults to 1 day)
@@ -116,10 +129,15 @@ func (s *Extension) RegisterFormHandler(w http.ResponseWriter, r *http.Request)
 			expirationDays = *s.EmailVerificationTokenExpirationDays
 		}
 
-		// generate verification token with expiration
-		uuidInstance := uuid.New().String()
+		// generate verification token with expiration, storing only its hash
+		if token, err = generateToken(); err != nil {
+			nibbler.Write500Json(w, "failed to generate token")
+			return
+		}
+
+		tokenHash := s.hashToken(token)
 		expiration := time.Now().AddDate(0, 0, expirationDays)
-		userValue.EmailValidationToken = &uuidInstance
+		userValue.EmailValidationToken = &tokenHash
 		userValue.EmailValidationExpiration = &expiration
 	}
 
@@ -154,52 +172,61 @@ func (s *Extension) RegisterFormHandler(w http.ResponseWriter, r *http.Request)
 	if s.EmailVerificationEnabled {
 
 		// send email to verify the email for the account
-		go func() {
-
-			// generate the link for the email
-			var link = s.EmailVerificationRedirect
-			useAmpersand := strings.Contains(s.EmailVerificationRedirect, "?")
-			if useAmpersand {
-				link += "&token=" + *userValue.EmailValidationToken
-			} else {
-				link += "?token=" + *userValue.EmailValidationToken
-			}
-
-			name := ""
-			if userValue.FirstName != nil && userValue.LastName != nil {
-				name = *userValue.FirstName + " " + *userValue.LastName
-			}
-
-			// build the recipient list
-			emailVal := *userValue.Email
-			var toList []*nibbler.EmailAddress
-			toList = append(toList, &nibbler.EmailAddress{Address: emailVal, Name: name})
-
-			// send the email
-			_, err = s.Sender.SendMail(
-				&nibbler.EmailAddress{
-					Name:    s.EmailVerificationFromName,
-					Address: s.EmailVerificationFromEmail,
-				},
-				"EmailAddress Verification", // TODO: make configurable
-				toList,
-				"Please go to "+link+" to verify your email",                          // TODO: configurable, with template param for link
-				"Please go to <a href=\""+link+"\">"+link+"</a> to verify your email", // TODO: configurable, with template param for link
-			)
-
-			if err != nil {
-				s.app.Logger.Error("while sending email verification, " + err.Error())
-			}
-		}()
+		if err := s.sendTemplatedMail(
+			r,
+			EmailVerificationTemplate,
+			&nibbler.EmailAddress{
+				Name:    s.EmailVerificationFromName,
+				Address: s.EmailVerificationFromEmail,
+			},
+			&userValue,
+			user.AppendTokenToLink(s.EmailVerificationRedirect, token),
+		); err != nil {
+			s.app.Logger.Error("while preparing email verification, " + err.Error())
+		}
 	}
 
+	s.recordAuthEvent(AuthEventRegistrationSucceeded, "", email, username, u)
+
 	if s.OnRegistrationSuccessful != nil {
 		(*s.OnRegistrationSuccessful)(safeUser)
 	}
 
+	// in hardened mode, the response can't differ from the one for an email that's already registered
+	if s.HardenedMode {
+		nibbler.Write200Json(w, `{"result": "ok"}`)
+		return
+	}
+
 	nibbler.Write200Json(w, `{"user": `+jsonString+`}`)
 }
 
+// respondToDuplicateRegistration is used in HardenedMode when the email is already registered.  Rather than telling
+// the client, the account owner is emailed, and the client gets the same response (after about the same amount of
+// work) as a successful registration
+func (s *Extension) respondToDuplicateRegistration(w http.ResponseWriter, r *http.Request, existing *nibbler.User, password string) {
+
+	// hash the password anyway, as a successful registration would
+	if _, err := GeneratePasswordHash(password); err != nil {
+		s.app.Logger.Error("while hashing password for duplicate registration, error = " + err.Error())
+	}
+
+	if err := s.sendTemplatedMail(
+		r,
+		AccountExistsTemplate,
+		&nibbler.EmailAddress{
+			Name:    s.EmailVerificationFromName,
+			Address: s.EmailVerificationFromEmail,
+		},
+		existing,
+		s.AccountExistsLink,
+	); err != nil {
+		s.app.Logger.Error("while preparing account exists email, error = " + err.Error())
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
+
 func (s *Extension) EmailTokenVerifyHandler(w http.ResponseWriter, r *http.Request) {
 
 	// the endpoint is only available if verification is enabled
@@ -280,7 +307,9 @@ func (s *Extension) getUserByEmailValidationToken(token string) (*nibbler.User,
 		return nil, nil
 	}
 
-	userValue, err := s.UserExtension.GetUserByEmailVerificationToken(token)
+	userValue, err := s.getUserByToken(token, s.UserExtension.GetUserByEmailVerificationToken, func(u *nibbler.User) *string {
+		return u.EmailValidationToken
+	})
 
 	if err != nil || userValue == nil {
 		return nil, nil
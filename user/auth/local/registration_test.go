@@ -0,0 +1,36 @@
+package local
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func enableHardenedRegistration(e *Extension) {
+	e.HardenedMode = true
+	e.RegistrationEnabled = true
+	e.EmailVerificationFromName = "Support"
+	e.EmailVerificationFromEmail = "support@example.com"
+	e.AccountExistsLink = "https://example.com/sign-in"
+}
+
+func TestExtension_RegisterHardened(t *testing.T) {
+	e, sender := newTestExtension(t, enableHardenedRegistration)
+
+	registered := postForm(e.RegisterFormHandler, url.Values{"email": {"alice@example.com"}, "password": {"alice-password"}})
+	duplicate := postForm(e.RegisterFormHandler, url.Values{"email": {"bob@example.com"}, "password": {"other-password"}})
+
+	if registered.Code != http.StatusOK || duplicate.Code != registered.Code || duplicate.Body.String() != registered.Body.String() {
+		t.Fatal("registering an existing email got a different response than registering a new one")
+	}
+
+	if u, _ := e.UserExtension.GetUserByEmail("alice@example.com"); u == nil {
+		t.Fatal("the new user was not created")
+	}
+
+	// the owner of the existing account is told instead
+	message := waitForMail(t, sender, 1)
+	if message.To[0].Address != "bob@example.com" || message.Subject != "Account Already Exists" {
+		t.Fatal("the account exists email was not sent")
+	}
+}
@@ -1,10 +1,22 @@
 package local
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"github.com/markdicksonjr/nibbler"
 	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"sync"
 )
 
+// hashedTokenPrefix marks a stored token as a hash, to tell it apart from a (legacy) plaintext token
+const hashedTokenPrefix = "h1:"
+
 // http://codahale.com/how-to-safely-store-a-password/
 
 func GeneratePasswordHash(password string) (string, error) {
@@ -23,3 +35,110 @@ func ValidatePassword(password string, hashedPassword string) (bool, error) {
 
 	return true, nil
 }
+
+var dummyPasswordHash string
+var dummyPasswordHashOnce sync.Once
+
+// getDummyPasswordHash returns a hash (of a random password) to compare against when there's no real one, so that
+// a login for a user that doesn't exist takes as long as one for a user that does
+func getDummyPasswordHash() string {
+	dummyPasswordHashOnce.Do(func() {
+		password, err := generateToken()
+		if err != nil {
+			password = "dummy-password"
+		}
+		dummyPasswordHash, _ = GeneratePasswordHash(password)
+	})
+	return dummyPasswordHash
+}
+
+// comparePassword is ValidatePassword without the early return for short passwords - the (slow) comparison always
+// runs, so the time taken doesn't reveal why a password was rejected
+func comparePassword(password string, hashedPassword string) bool {
+	matches := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+	return matches && len(password) >= 8
+}
+
+// generateToken returns a URL-safe token made from 32 crypto-random bytes
+func generateToken() (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
+
+// hashToken returns what is stored for a token - a keyed hash, so that the stored value can't be used as a token, and
+// can't be brute-forced without TokenHashKey
+func (s *Extension) hashToken(token string) string {
+	mac := hmac.New(sha256.New, s.TokenHashKey)
+	mac.Write([]byte(token))
+	return hashedTokenPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenMatches compares the token with the stored value in constant time.  Plaintext stored values only match if
+// AllowPlaintextTokens is set
+func (s *Extension) tokenMatches(token string, stored *string) bool {
+	if stored == nil || token == "" {
+		return false
+	}
+
+	if isHashedToken(*stored) {
+		return hmac.Equal([]byte(s.hashToken(token)), []byte(*stored))
+	}
+
+	return s.AllowPlaintextTokens && subtle.ConstantTimeCompare([]byte(token), []byte(*stored)) == 1
+}
+
+// getUserByToken looks up the user for the token (by its hash, then by the token itself if AllowPlaintextTokens is
+// set), confirming the match with tokenMatches rather than trusting the persistence extension's comparison
+func (s *Extension) getUserByToken(
+	token string,
+	lookup func(token string) (*nibbler.User, error),
+	storedToken func(u *nibbler.User) *string,
+) (*nibbler.User, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	userValue, err := lookup(s.hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if userValue == nil && s.AllowPlaintextTokens && !isHashedToken(token) {
+		if userValue, err = lookup(token); err != nil {
+			return nil, err
+		}
+	}
+
+	if userValue == nil || !s.tokenMatches(token, storedToken(userValue)) {
+		return nil, nil
+	}
+
+	return userValue, nil
+}
+
+// MigrateUserTokens replaces any plaintext tokens stored for the user with their hashes, and saves the user if
+// anything changed.  Run it over existing users once TokenHashKey is configured - outstanding links keep working, as
+// the token in the link hashes to the new stored value.  It returns whether the user was changed
+func (s *Extension) MigrateUserTokens(userValue *nibbler.User) (bool, error) {
+	changed := false
+	for _, token := range []**string{&userValue.PasswordResetToken, &userValue.EmailValidationToken, &userValue.LoginToken} {
+		if *token != nil && **token != "" && !isHashedToken(**token) {
+			hash := s.hashToken(**token)
+			*token = &hash
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, s.UserExtension.Update(userValue)
+}
+
+func isHashedToken(value string) bool {
+	return strings.HasPrefix(value, hashedTokenPrefix)
+}
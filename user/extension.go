@@ -4,9 +4,11 @@ import (
 	"errors"
 	"github.com/google/uuid"
 	"github.com/markdicksonjr/nibbler"
+	"net/http"
 )
 
 const noExtensionErrorMessage = "no persistence extension was provided to user extension"
+const noLoginTokenSupportErrorMessage = "the persistence extension provided to user extension does not support login tokens"
 
 type PersistenceExtension interface {
 	nibbler.Extension
@@ -18,7 +20,18 @@ type PersistenceExtension interface {
 	GetUserByUsername(username string) (*nibbler.User, error)
 	SearchUsers(query nibbler.SearchParameters) (*nibbler.SearchResults, error)
 	Update(user *nibbler.User) error
-	UpdatePassword(user *nibbler.User) error
+	UpdatePassword(user *nibbler.User) error // only needs to save the password - Extension.UpdatePassword saves the rest
+}
+
+// LoginTokenPersistenceExtension is implemented by persistence extensions that can look up users by login token (for
+// passwordless login).  It is optional, as not every app needs passwordless login
+type LoginTokenPersistenceExtension interface {
+	GetUserByLoginToken(token string) (*nibbler.User, error)
+
+	// ClearLoginToken clears the user's login token and its expiration, only if the stored token is still the given one,
+	// and states whether it was.  The check and the clear must be atomic (e.g. a conditional update), so that
+	// concurrent requests can't both use a token
+	ClearLoginToken(userId string, token string) (bool, error)
 }
 
 type Extension struct {
@@ -32,6 +45,10 @@ type Extension struct {
 	OnAfterUserUpdate      func(user *nibbler.User)
 	OnBeforePasswordUpdate func(user *nibbler.User)
 	OnAfterPasswordUpdate  func(user *nibbler.User)
+
+	// protects the user search route (GET {ApiPrefix}/user/search), which is only added if this is provided - e.g. a
+	// group extension's EnforceHasPrivilege, with an action like "search-users"
+	SearchRouteGuard func(routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request)
 }
 
 func (s *Extension) Init(app *nibbler.Application) error {
@@ -43,6 +60,9 @@ func (s *Extension) Init(app *nibbler.Application) error {
 }
 
 func (s *Extension) PostInit(app *nibbler.Application) error {
+	if s.SearchRouteGuard != nil && app.Router != nil {
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/user/search", s.SearchRouteGuard(s.SearchUsersRequestHandler)).Methods("GET")
+	}
 	return nil
 }
 
@@ -82,6 +102,34 @@ func (s *Extension) GetUserByEmailVerificationToken(token string) (*nibbler.User
 	return nil, errors.New(noExtensionErrorMessage)
 }
 
+func (s *Extension) GetUserByLoginToken(token string) (*nibbler.User, error) {
+	if s.PersistenceExtension != nil {
+		if p, ok := s.PersistenceExtension.(LoginTokenPersistenceExtension); ok {
+			return p.GetUserByLoginToken(token)
+		}
+		return nil, errors.New(noLoginTokenSupportErrorMessage)
+	}
+	return nil, errors.New(noExtensionErrorMessage)
+}
+
+// ClearLoginToken clears the user's login token if it is still the given (stored) token, and states whether it was -
+// only one request can clear a token, so it can be used to make tokens single-use
+func (s *Extension) ClearLoginToken(userId string, token string) (bool, error) {
+	if s.PersistenceExtension != nil {
+		if p, ok := s.PersistenceExtension.(LoginTokenPersistenceExtension); ok {
+			return p.ClearLoginToken(userId, token)
+		}
+		return false, errors.New(noLoginTokenSupportErrorMessage)
+	}
+	return false, errors.New(noExtensionErrorMessage)
+}
+
+// SupportsLoginTokens states whether the persistence extension can look up users by login token
+func (s *Extension) SupportsLoginTokens() bool {
+	_, ok := s.PersistenceExtension.(LoginTokenPersistenceExtension)
+	return ok
+}
+
 func (s *Extension) GetUserByUsername(username string) (*nibbler.User, error) {
 	if s.PersistenceExtension != nil {
 		return s.PersistenceExtension.GetUserByUsername(username)
@@ -146,8 +194,14 @@ func (s *Extension) Update(user *nibbler.User) error {
 	return errors.New(noExtensionErrorMessage)
 }
 
+// UpdatePassword saves the user's password.  Any outstanding password reset or login token is invalidated, as a
+// token issued before the change shouldn't outlive it
 func (s *Extension) UpdatePassword(user *nibbler.User) error {
 	if s.PersistenceExtension != nil {
+		user.PasswordResetToken = nil
+		user.PasswordResetExpiration = nil
+		user.LoginToken = nil
+		user.LoginTokenExpiration = nil
 
 		// call the OnBeforePasswordUpdate callback if provided
 		if s.OnBeforePasswordUpdate != nil {
@@ -159,6 +213,12 @@ func (s *Extension) UpdatePassword(user *nibbler.User) error {
 			return err
 		}
 
+		// persistence extensions only promise to save the password, so save the cleared tokens as well (through Update,
+		// so that the user update callbacks see the change)
+		if err := s.Update(user); err != nil {
+			return err
+		}
+
 		// call the OnAfterUserUpdate callback if provided
 		if s.OnAfterPasswordUpdate != nil {
 			s.OnAfterPasswordUpdate(user)
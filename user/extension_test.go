@@ -3,6 +3,7 @@ package user
 import (
 	"github.com/markdicksonjr/nibbler"
 	"testing"
+	"time"
 )
 
 func TestImplements(t *testing.T) {
@@ -21,3 +22,81 @@ func TestExtension_Init(t *testing.T) {
 		t.Fatal("the error given by an init was not the expected value of " + noExtensionErrorMessage + " but was " + err.Error())
 	}
 }
+
+// passwordOnlyPersistenceExtension only saves the password in UpdatePassword, as the interface allows
+type passwordOnlyPersistenceExtension struct {
+	MockPersistenceExtension
+}
+
+func (p *passwordOnlyPersistenceExtension) UpdatePassword(user *nibbler.User) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	existing := p.users[user.ID]
+	existing.Password = user.Password
+	p.users[user.ID] = existing
+	return nil
+}
+
+func TestExtension_UpdatePasswordClearsTokens(t *testing.T) {
+	e := Extension{PersistenceExtension: &passwordOnlyPersistenceExtension{}}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	token := "token"
+	expiration := time.Now().Add(time.Hour)
+	created, err := e.Create(&nibbler.User{
+		PasswordResetToken:      &token,
+		PasswordResetExpiration: &expiration,
+		LoginToken:              &token,
+		LoginTokenExpiration:    &expiration,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password := "new-password-hash"
+	created.Password = &password
+	if err := e.UpdatePassword(created); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := e.GetUserById(created.ID)
+	if stored.Password == nil || *stored.Password != password {
+		t.Fatal("the password was not saved")
+	}
+
+	if stored.PasswordResetToken != nil || stored.PasswordResetExpiration != nil || stored.LoginToken != nil || stored.LoginTokenExpiration != nil {
+		t.Fatal("the tokens outlived the password change")
+	}
+}
+
+func TestExtension_UpdatePasswordCallsUpdateCallbacks(t *testing.T) {
+	updated := 0
+	e := Extension{
+		PersistenceExtension: &MockPersistenceExtension{},
+		OnAfterUserUpdate: func(user *nibbler.User) {
+			updated++
+		},
+	}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := e.Create(&nibbler.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	password := "new-password-hash"
+	created.Password = &password
+	if err := e.UpdatePassword(created); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. audit logging and cached users rely on seeing every change to a user
+	if updated != 1 {
+		t.Fatal("the user update callbacks did not see the password change's token clearing")
+	}
+}
@@ -2,11 +2,15 @@ package nibbler_user_group
 
 import (
 	"encoding/json"
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/markdicksonjr/nibbler"
 	"net/http"
 )
 
+// ErrNotGroupMember is returned when a user's current group is set to a group they aren't a member of
+var ErrNotGroupMember = errors.New("the user is not a member of the group")
+
 // UserComposite is a summary of group memberships and the state of the "current" group and role for the user
 type UserComposite struct {
 	CurrentGroup       *nibbler.Group  `json:"currentGroup"`
@@ -23,7 +27,7 @@ func (s *Extension) GetUserCompositeRequestHandler(w http.ResponseWriter, r *htt
 
 	// if no ID was provided, assume the route did not have ID in the path, and the user wants to ask about the caller
 	if id == "" {
-		caller, err := s.SessionExtension.GetCaller(r)
+		caller, err := s.callerResolver().GetCaller(r)
 		if err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
@@ -73,8 +77,8 @@ func (s *Extension) GetUserComposite(userId string) (*UserComposite, error) {
 		return nil, nil
 	}
 
-	// load the group memberships for the user
-	memberships, err := s.GetGroupMembershipsForUser(userId)
+	// load the group memberships for the user (including inherited ones, if enabled)
+	memberships, err := s.GetEffectiveMemberships(userId)
 	if err != nil {
 		return nil, err
 	}
@@ -94,16 +98,21 @@ func (s *Extension) GetUserComposite(userId string) (*UserComposite, error) {
 		}
 
 		composite.Groups = groups
+	}
 
-		// set the current group in the composite model we're returning
-		// TODO: check results of GetGroups above to avoid doing this load
-		if u.CurrentGroupID != nil {
-			g, err := s.GetGroups([]string{*u.CurrentGroupID}, true)
-			if err != nil {
-				return nil, err
+	// set the current group in the composite model we're returning (groups that were deleted aren't loaded)
+	if u.CurrentGroupID != nil {
+		for i, g := range composite.Groups {
+			if g.ID == *u.CurrentGroupID {
+				composite.CurrentGroup = &composite.Groups[i]
 			}
-			if len(g) > 0 { // TODO: log when empty?  bogus/deleted group ID is current.  Maybe wipe the current group from user?
-				composite.CurrentGroup = &g[0]
+		}
+
+		// the current group was deleted, or the user was removed from it, so clear it from the user
+		if composite.CurrentGroup == nil {
+			u.CurrentGroupID = nil
+			if err := s.UserExtension.Update(u); err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -114,18 +123,97 @@ func (s *Extension) GetUserComposite(userId string) (*UserComposite, error) {
 	}
 
 	// load the role for the current group
-	var currentGroupMembership *nibbler.GroupMembership
 	for _, c := range memberships {
 		if c.GroupID == composite.CurrentGroup.ID {
-			m := c
-			currentGroupMembership = &m
+			composite.RoleInCurrentGroup = c.Role
 		}
 	}
+	return &composite, nil
+}
 
-	if currentGroupMembership == nil {
-		return &composite, nil
+// SetCurrentGroup changes the user's current group (which decides their privileges, unless all memberships are
+// evaluated), or clears it for a blank groupId.  It returns ErrNotGroupMember if the user isn't a member of the group
+// (including through a group above it, with InheritMemberships), or the group doesn't exist
+func (s *Extension) SetCurrentGroup(userId string, groupId string) (*nibbler.User, error) {
+	u, err := s.UserExtension.GetUserById(userId)
+	if err != nil {
+		return nil, err
 	}
 
-	composite.RoleInCurrentGroup = (currentGroupMembership).Role
-	return &composite, nil
+	if u == nil {
+		return nil, errors.New("no user with ID " + userId + " exists")
+	}
+
+	if groupId == "" {
+		u.CurrentGroupID = nil
+		return u, s.UserExtension.Update(u)
+	}
+
+	group, err := s.GetGroup(groupId, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if group == nil {
+		return nil, ErrNotGroupMember
+	}
+
+	memberships, err := s.GetEffectiveMemberships(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, membership := range memberships {
+		if membership.GroupID == groupId {
+			u.CurrentGroupID = &groupId
+			return u, s.UserExtension.Update(u)
+		}
+	}
+	return nil, ErrNotGroupMember
+}
+
+// SetCurrentGroupRequestHandler changes the caller's current group to the one with the "groupId" form value (or clears
+// it, if blank), responding with the caller's new composite.  If there's a session extension and the caller is the
+// user in the session, the session is refreshed
+func (s *Extension) SetCurrentGroupRequestHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if caller == nil {
+		nibbler.Write401Json(w)
+		return
+	}
+
+	u, err := s.SetCurrentGroup(caller.ID, r.FormValue("groupId"))
+	if err == ErrNotGroupMember {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	// only a caller who is in the session is refreshed there - callers authenticated another way (e.g. with an API key
+	// or bearer token) must not be handed a session cookie
+	if s.SessionExtension != nil {
+		if sessionCaller, err := s.SessionExtension.GetCaller(r); err == nil && sessionCaller != nil && sessionCaller.ID == u.ID {
+			if err := s.SessionExtension.SetCaller(w, r, u); err != nil {
+				nibbler.Write500Json(w, err.Error())
+				return
+			}
+		}
+	}
+
+	composite, err := s.GetUserComposite(u.ID)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, composite, http.StatusOK)
 }
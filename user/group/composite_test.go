@@ -0,0 +1,151 @@
+package nibbler_user_group
+
+import (
+	"encoding/json"
+	"github.com/gorilla/sessions"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/session"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtension_SetCurrentGroupRoute(t *testing.T) {
+	sessionExtension := session.NewMockExtension()
+	if err := sessionExtension.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAppWith(t, func(e *Extension) {
+		e.SessionExtension = sessionExtension
+	})
+	editors, _ := a.extension.CreateGroup("editors")
+
+	// the member is logged in (the mock store has a single session)
+	if err := sessionExtension.SetCaller(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), a.member); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.member, "POST", "/api/group/current?groupId="+editors.ID, ""); res.Code != http.StatusNotFound {
+		t.Fatal("the current group was set to a group the user is not a member of")
+	}
+
+	if _, err := a.extension.SetGroupMembership(editors.ID, a.member.ID, MemberRole); err != nil {
+		t.Fatal(err)
+	}
+
+	res := a.send(a.member, "POST", "/api/group/current?groupId="+editors.ID, "")
+	if res.Code != http.StatusOK {
+		t.Fatal("the current group was not set: " + res.Body.String())
+	}
+
+	var composite UserComposite
+	if err := json.Unmarshal(res.Body.Bytes(), &composite); err != nil {
+		t.Fatal(err)
+	}
+
+	if composite.CurrentGroup == nil || composite.CurrentGroup.ID != editors.ID || composite.RoleInCurrentGroup != MemberRole {
+		t.Fatal("the new composite was not returned")
+	}
+
+	if u, _ := a.extension.UserExtension.GetUserById(a.member.ID); u.CurrentGroupID == nil || *u.CurrentGroupID != editors.ID {
+		t.Fatal("the current group was not saved")
+	}
+
+	if caller, _ := sessionExtension.GetCaller(httptest.NewRequest("GET", "/", nil)); caller == nil || caller.CurrentGroupID == nil || *caller.CurrentGroupID != editors.ID {
+		t.Fatal("the caller in the session was not refreshed")
+	}
+
+	// a blank group clears it
+	if res := a.send(a.member, "POST", "/api/group/current", ""); res.Code != http.StatusOK {
+		t.Fatal("the current group was not cleared")
+	}
+
+	if u, _ := a.extension.UserExtension.GetUserById(a.member.ID); u.CurrentGroupID != nil {
+		t.Fatal("the cleared current group was not saved")
+	}
+}
+
+// cookieStoreConnector connects to a cookie store, which (unlike the mock store) writes cookies on save
+type cookieStoreConnector struct{}
+
+func (c cookieStoreConnector) Connect() (error, sessions.Store) {
+	return nil, sessions.NewCookieStore([]byte("test-session-key"))
+}
+
+func (c cookieStoreConnector) MaxAge() int {
+	return 3600
+}
+
+func TestExtension_SetCurrentGroupWithoutSession(t *testing.T) {
+	sessionExtension := &session.Extension{StoreConnector: cookieStoreConnector{}, SessionName: "test"}
+	if err := sessionExtension.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestAppWith(t, func(e *Extension) {
+		e.SessionExtension = sessionExtension
+	})
+	editors, _ := a.extension.CreateGroup("editors")
+	if _, err := a.extension.SetGroupMembership(editors.ID, a.member.ID, MemberRole); err != nil {
+		t.Fatal(err)
+	}
+
+	// the member is identified by a header (like an API key or bearer token), not a session
+	res := a.send(a.member, "POST", "/api/group/current?groupId="+editors.ID, "")
+	if res.Code != http.StatusOK {
+		t.Fatal("the current group was not set: " + res.Body.String())
+	}
+
+	if res.Header().Get("Set-Cookie") != "" {
+		t.Fatal("a session cookie was issued to a caller without a session")
+	}
+
+	// a caller with a session has it refreshed
+	login := httptest.NewRecorder()
+	if err := sessionExtension.SetCaller(login, httptest.NewRequest("GET", "/", nil), a.member); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/group/current", nil)
+	req.Header.Set(user.CallerIDHeader, a.member.ID)
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	res = httptest.NewRecorder()
+	a.router.ServeHTTP(res, req)
+	if res.Code != http.StatusOK || res.Header().Get("Set-Cookie") == "" {
+		t.Fatal("the session of a caller with one was not refreshed")
+	}
+}
+
+func TestExtension_CompositeClearsStaleCurrentGroup(t *testing.T) {
+	a := newTestApp(t)
+	editors, _ := a.extension.CreateGroup("editors")
+	if _, err := a.extension.SetGroupMembership(editors.ID, a.member.ID, MemberRole); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.extension.SetCurrentGroup(a.member.ID, editors.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if composite, err := a.extension.GetUserComposite(a.member.ID); err != nil || composite.CurrentGroup == nil {
+		t.Fatal("the current group was not in the composite")
+	}
+
+	if err := a.extension.PersistenceExtension.DeleteGroup(editors.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	composite, err := a.extension.GetUserComposite(a.member.ID)
+	if err != nil || composite.CurrentGroup != nil || composite.RoleInCurrentGroup != "" {
+		t.Fatal("a deleted current group was in the composite")
+	}
+
+	if u, _ := a.extension.UserExtension.GetUserById(a.member.ID); u.CurrentGroupID != nil {
+		t.Fatal("the deleted current group was not cleared from the user")
+	}
+}
@@ -0,0 +1,267 @@
+package nibbler_user_group
+
+import (
+	"container/list"
+	"github.com/markdicksonjr/nibbler"
+	"sync"
+	"time"
+)
+
+// the default maximum number of cached decisions (and, separately, users)
+const defaultDecisionCacheSize = 10000
+
+// DecisionCacheStats counts the decision cache's activity since the extension was initialized
+type DecisionCacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`     // entries dropped to stay within the size limit
+	Invalidations uint64 `json:"invalidations"` // entries dropped as privileges, memberships, roles or users changed
+	Size          int    `json:"size"`
+}
+
+// HitRate is the fraction of lookups answered from the cache (0 when there have been none)
+func (s DecisionCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// decisionKey identifies a privilege decision - the group is the user's current group, as that decides which
+// privileges they have (unless all memberships are evaluated)
+type decisionKey struct {
+	userId   string
+	groupId  string
+	resource string
+	action   string
+}
+
+type cacheEntry struct {
+	key     interface{}
+	value   interface{}
+	expires time.Time
+}
+
+// decisionCache holds privilege decisions (and the users they were made for), least-recently-used first out once
+// there are more than size of either
+type decisionCache struct {
+	ttl   time.Duration
+	size  int
+	mutex sync.Mutex
+	stats DecisionCacheStats
+
+	decisions     map[interface{}]*list.Element
+	decisionOrder *list.List
+	users         map[interface{}]*list.Element
+	userOrder     *list.List
+}
+
+func newDecisionCache(ttl time.Duration, size int) *decisionCache {
+	if size <= 0 {
+		size = defaultDecisionCacheSize
+	}
+
+	return &decisionCache{
+		ttl:           ttl,
+		size:          size,
+		decisions:     make(map[interface{}]*list.Element),
+		decisionOrder: list.New(),
+		users:         make(map[interface{}]*list.Element),
+		userOrder:     list.New(),
+	}
+}
+
+func (c *decisionCache) getDecision(key decisionKey) (Decision, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, ok := c.get(c.decisions, c.decisionOrder, key)
+	if ok {
+		c.stats.Hits++
+		return value.(Decision), true
+	}
+
+	c.stats.Misses++
+	return Decision{}, false
+}
+
+func (c *decisionCache) putDecision(key decisionKey, decision Decision) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.put(c.decisions, c.decisionOrder, key, decision)
+}
+
+func (c *decisionCache) getUser(id string) (*nibbler.User, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	value, ok := c.get(c.users, c.userOrder, id)
+	if !ok {
+		return nil, false
+	}
+
+	// hand out copies, so callers can't change the cached user
+	userCopy := value.(nibbler.User)
+	return &userCopy, true
+}
+
+func (c *decisionCache) putUser(user *nibbler.User) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.put(c.users, c.userOrder, user.ID, *user)
+}
+
+// invalidateUser drops the user, and every decision made for them
+func (c *decisionCache) invalidateUser(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.users[id]; ok {
+		c.remove(c.users, c.userOrder, element)
+		c.stats.Invalidations++
+	}
+
+	for key, element := range c.decisions {
+		if key.(decisionKey).userId == id {
+			c.remove(c.decisions, c.decisionOrder, element)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+// invalidateDecisions drops every decision (keeping the users)
+func (c *decisionCache) invalidateDecisions() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stats.Invalidations += uint64(len(c.decisions))
+	c.decisions = make(map[interface{}]*list.Element)
+	c.decisionOrder.Init()
+}
+
+func (c *decisionCache) getStats() DecisionCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Size = len(c.decisions)
+	return stats
+}
+
+// get returns an unexpired value, marking it as recently used - the caller must hold the lock
+func (c *decisionCache) get(entries map[interface{}]*list.Element, order *list.List, key interface{}) (interface{}, bool) {
+	element, ok := entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(entries, order, element)
+		return nil, false
+	}
+
+	order.MoveToFront(element)
+	return entry.value, true
+}
+
+// put adds or replaces a value, evicting the least-recently-used entry if there are too many - the caller must hold
+// the lock
+func (c *decisionCache) put(entries map[interface{}]*list.Element, order *list.List, key interface{}, value interface{}) {
+	if element, ok := entries[key]; ok {
+		c.remove(entries, order, element)
+	}
+
+	entries[key] = order.PushFront(&cacheEntry{key: key, value: value, expires: time.Now().Add(c.ttl)})
+	for len(entries) > c.size {
+		c.remove(entries, order, order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *decisionCache) remove(entries map[interface{}]*list.Element, order *list.List, element *list.Element) {
+	delete(entries, element.Value.(*cacheEntry).key)
+	order.Remove(element)
+}
+
+// DecisionCacheStats returns the decision cache's counters (all zero if DecisionCacheTTL isn't set)
+func (s *Extension) DecisionCacheStats() DecisionCacheStats {
+	if s.decisionCache == nil {
+		return DecisionCacheStats{}
+	}
+	return s.decisionCache.getStats()
+}
+
+// InvalidateDecisions drops every cached decision.  Changes made through the extension invalidate the decisions they
+// affect, so this is only needed after changing privileges, memberships, roles or groups through the persistence
+// extension directly
+func (s *Extension) InvalidateDecisions() {
+	if s.decisionCache != nil {
+		s.decisionCache.invalidateDecisions()
+	}
+}
+
+// InvalidateUserDecisions drops the cached user, and the decisions made for them
+func (s *Extension) InvalidateUserDecisions(userId string) {
+	if s.decisionCache != nil {
+		s.decisionCache.invalidateUser(userId)
+	}
+}
+
+// getUser loads the user, from the cache if it's enabled
+func (s *Extension) getUser(id string) (*nibbler.User, error) {
+	if s.decisionCache == nil {
+		return s.UserExtension.GetUserById(id)
+	}
+
+	if cached, ok := s.decisionCache.getUser(id); ok {
+		return cached, nil
+	}
+
+	userFromDb, err := s.UserExtension.GetUserById(id)
+	if err == nil && userFromDb != nil {
+		s.decisionCache.putUser(userFromDb)
+	}
+	return userFromDb, err
+}
+
+// cachedPrivilegeDecision returns the privilege (and role) decision for the user, from the cache if it's enabled
+func (s *Extension) cachedPrivilegeDecision(userFromDb *nibbler.User, action string, resource string) (Decision, error) {
+	if s.decisionCache == nil {
+		return s.privilegeDecision(userFromDb, action, resource)
+	}
+
+	key := decisionKey{userId: userFromDb.ID, resource: resource, action: action}
+	if userFromDb.CurrentGroupID != nil && s.PrivilegeEvaluation == EvaluateCurrentGroup {
+		key.groupId = *userFromDb.CurrentGroupID
+	}
+
+	if decision, ok := s.decisionCache.getDecision(key); ok {
+		return decision, nil
+	}
+
+	decision, err := s.privilegeDecision(userFromDb, action, resource)
+	if err == nil {
+		s.decisionCache.putDecision(key, decision)
+	}
+	return decision, err
+}
+
+// initDecisionCache creates the cache (if DecisionCacheTTL is set), and has user updates invalidate it
+func (s *Extension) initDecisionCache() {
+	if s.DecisionCacheTTL <= 0 {
+		return
+	}
+
+	s.decisionCache = newDecisionCache(s.DecisionCacheTTL, s.DecisionCacheSize)
+
+	if s.UserExtension != nil {
+		onAfterUserUpdate := s.UserExtension.OnAfterUserUpdate
+		s.UserExtension.OnAfterUserUpdate = func(user *nibbler.User) {
+			s.InvalidateUserDecisions(user.ID)
+			if onAfterUserUpdate != nil {
+				onAfterUserUpdate(user)
+			}
+		}
+	}
+}
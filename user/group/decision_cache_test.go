@@ -0,0 +1,111 @@
+package nibbler_user_group
+
+import (
+	"testing"
+	"time"
+)
+
+// newCachingTestApp is newTestApp, with the decision cache enabled
+func newCachingTestApp(t *testing.T, ttl time.Duration, size int) *testApp {
+	a := newTestApp(t)
+	a.extension.DecisionCacheTTL = ttl
+	a.extension.DecisionCacheSize = size
+	a.extension.initDecisionCache()
+	return a
+}
+
+func TestExtension_DecisionCacheHits(t *testing.T) {
+	a := newCachingTestApp(t, time.Minute, 0)
+
+	for i := 0; i < 4; i++ {
+		if has, err := a.extension.HasPrivilege(a.admin.ID, ListGroupsAction); err != nil || !has {
+			t.Fatal("the privilege was not granted")
+		}
+	}
+
+	stats := a.extension.DecisionCacheStats()
+	if stats.Hits != 3 || stats.Misses != 1 || stats.Size != 1 || stats.HitRate() != 0.75 {
+		t.Fatal("the decisions were not cached")
+	}
+}
+
+func TestExtension_DecisionCacheInvalidation(t *testing.T) {
+	a := newCachingTestApp(t, time.Minute, 0)
+	editors, _ := a.extension.CreateGroup("editors")
+
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "edit"); has {
+		t.Fatal("the privilege was granted before it existed")
+	}
+
+	// changing the user's current group invalidates their decisions
+	setCurrentGroup(t, a.extension, a.member, editors.ID)
+	if err := a.extension.AddPrivilegeToGroups([]string{editors.ID}, "", "edit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "edit"); !has {
+		t.Fatal("a stale decision was used after a privilege was added")
+	}
+
+	privileges, _ := a.extension.PersistenceExtension.GetPrivilegesForAction(editors.ID, nil, "edit")
+	if err := a.extension.DeletePrivilege(privileges[0].ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "edit"); has {
+		t.Fatal("a stale decision was used after a privilege was deleted")
+	}
+
+	// memberships (and so roles) invalidate the member's decisions
+	if has, _ := a.extension.HasPrivilegeOnResource(a.member.ID, editors.ID, GetGroupAction); has {
+		t.Fatal("a role was used before the membership existed")
+	}
+
+	if _, err := a.extension.SetGroupMembership(editors.ID, a.member.ID, ViewerRole); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := a.extension.HasPrivilegeOnResource(a.member.ID, editors.ID, GetGroupAction); !has {
+		t.Fatal("a stale decision was used after a membership was added")
+	}
+
+	if err := a.extension.RemoveGroupMember(editors.ID, a.member.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, _ := a.extension.HasPrivilegeOnResource(a.member.ID, editors.ID, GetGroupAction); has {
+		t.Fatal("a stale decision was used after a membership was removed")
+	}
+
+	if a.extension.DecisionCacheStats().Invalidations == 0 {
+		t.Fatal("the invalidations were not counted")
+	}
+}
+
+func TestExtension_DecisionCacheLimits(t *testing.T) {
+	a := newCachingTestApp(t, time.Minute, 2)
+
+	for _, action := range []string{"a", "b", "c"} {
+		a.extension.HasPrivilege(a.admin.ID, action)
+	}
+
+	if stats := a.extension.DecisionCacheStats(); stats.Size != 2 || stats.Evictions != 1 {
+		t.Fatal("the cache grew past its size")
+	}
+
+	// the least-recently used decision was evicted
+	a.extension.HasPrivilege(a.admin.ID, "a")
+	if stats := a.extension.DecisionCacheStats(); stats.Hits != 0 {
+		t.Fatal("the oldest decision was not the one evicted")
+	}
+
+	// and decisions expire
+	a = newCachingTestApp(t, time.Millisecond, 0)
+	a.extension.HasPrivilege(a.admin.ID, "a")
+	time.Sleep(5 * time.Millisecond)
+	a.extension.HasPrivilege(a.admin.ID, "a")
+
+	if stats := a.extension.DecisionCacheStats(); stats.Hits != 0 || stats.Misses != 2 {
+		t.Fatal("an expired decision was used")
+	}
+}
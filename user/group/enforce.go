@@ -5,12 +5,14 @@ import (
 	"net/http"
 )
 
-// EnforceHasPrivilege will use HasPrivilege to produce a result for the caller - it will return a 500 if something
-// went wrong, a 401 if no user is authenticated, a 404 if there is no access.  It will pass through to the routerFunc
-// if the caller has access
+// EnforceHasPrivilege will use Authorize (for the resource-agnostic action) to produce a result for the caller - it
+// will return a 500 if something went wrong, a 401 if no user is authenticated, a 404 if there is no access.  It will
+// pass through to the routerFunc if the caller has access.  The caller comes from the request context when the session
+// extension's CallerMiddleware is in use, so it isn't loaded from the session again.  Callers restricted to some
+// privileges (e.g. by an API key's scopes) also need a scope that allows the action
 func (s *Extension) EnforceHasPrivilege(action string, routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		caller, err := s.SessionExtension.GetCaller(r)
+		caller, err := s.callerResolver().GetCaller(r)
 		if err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
@@ -21,7 +23,15 @@ func (s *Extension) EnforceHasPrivilege(action string, routerFunc func(http.Resp
 			return
 		}
 
-		if has, err := s.HasPrivilege(caller.ID, action); err != nil {
+		if allowed, err := s.scopesAllow(r, nil, action); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		} else if !allowed {
+			nibbler.Write404Json(w)
+			return
+		}
+
+		if has, err := s.authorize(r, caller, action, ""); err != nil {
 			nibbler.Write500Json(w, err.Error())
 		} else if !has {
 			nibbler.Write404Json(w)
@@ -31,12 +41,27 @@ func (s *Extension) EnforceHasPrivilege(action string, routerFunc func(http.Resp
 	}
 }
 
-// EnforceHasPrivilegeOnResource will use HasPrivilegeOnResource to produce a result for the caller - it will return
-// a 500 if something went wrong, a 401 if no user is authenticated, a 404 if there is no access.  It will pass through
-// to the routerFunc if the caller has access
+// CallerHasPrivilege states whether the caller has the resource-agnostic action, as EnforceHasPrivilege decides it (no
+// caller has no privileges).  It's for handlers that need a further privilege for some requests
+func (s *Extension) CallerHasPrivilege(r *http.Request, action string) (bool, error) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil || caller == nil {
+		return false, err
+	}
+
+	if allowed, err := s.scopesAllow(r, nil, action); err != nil || !allowed {
+		return false, err
+	}
+	return s.authorize(r, caller, action, "")
+}
+
+// EnforceHasPrivilegeOnResource will use Authorize (for the action on the resource) to produce a result for the
+// caller - it will return a 500 if something went wrong, a 401 if no user is authenticated, a 404 if there is no
+// access.  It will pass through to the routerFunc if the caller has access.  Callers restricted to some privileges
+// (e.g. by an API key's scopes) also need a scope that allows the action on the resource
 func (s *Extension) EnforceHasPrivilegeOnResource(action string, getResourceIdFn func(r *http.Request) (string, error), routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		caller, err := s.SessionExtension.GetCaller(r)
+		caller, err := s.callerResolver().GetCaller(r)
 		if err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
@@ -58,21 +83,52 @@ func (s *Extension) EnforceHasPrivilegeOnResource(action string, getResourceIdFn
 			return
 		}
 
-		// if the user does not have the privilege on the target resource, fall back to the "global" version of that privilege
-		if has, err := s.HasPrivilegeOnResource(caller.ID, targetGroup, action); err != nil {
+		if has, err := s.callerHasPrivilegeOnResource(r, caller, targetGroup, action); err != nil {
 			nibbler.Write500Json(w, err.Error())
 		} else if !has {
+			nibbler.Write404Json(w)
+		} else {
+			routerFunc(w, r)
+		}
+	}
+}
 
-			// this is the check against the global privilege for this action (e.g. admins, etc)
-			if has, err := s.HasPrivilege(caller.ID, action); err != nil {
-				nibbler.Write500Json(w, err.Error())
-			} else if !has {
-				nibbler.Write404Json(w)
-			} else {
-				routerFunc(w, r)
-			}
+// enforceCallerScope requires a caller (like nibbler.EnforceCaller), and that their scopes (if restricted, e.g. by an
+// API key) allow the action - it will return a 404 if they don't.  It guards the routes any caller can use for
+// themselves, so that a scoped key can't act for its user beyond its scopes
+func (s *Extension) enforceCallerScope(action string, routerFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return nibbler.EnforceCaller(s.callerResolver(), func(w http.ResponseWriter, r *http.Request) {
+		if allowed, err := s.scopesAllow(r, nil, action); err != nil {
+			nibbler.Write500Json(w, err.Error())
+		} else if !allowed {
+			nibbler.Write404Json(w)
 		} else {
 			routerFunc(w, r)
 		}
+	})
+}
+
+// callerHasPrivilegeOnResource checks the caller's scopes, then authorizes the action on the resource (which falls
+// back to the "global" version of the privilege, e.g. for admins)
+func (s *Extension) callerHasPrivilegeOnResource(r *http.Request, caller *nibbler.User, resourceId string, action string) (bool, error) {
+	if allowed, err := s.scopesAllow(r, &resourceId, action); err != nil || !allowed {
+		return false, err
+	}
+	return s.authorize(r, caller, action, resourceId)
+}
+
+// authorize runs Authorize for the caller, with the attributes of the request
+func (s *Extension) authorize(r *http.Request, caller *nibbler.User, action string, resourceId string) (bool, error) {
+	ctx := WithRequestAttributes(r.Context(), RequestAttributesFromRequest(r))
+	decision, err := s.Authorize(ctx, caller, action, resourceId)
+	return decision.Allowed, err
+}
+
+// scopesAllow states whether the caller's scopes (if the caller resolver restricts them) allow the action
+func (s *Extension) scopesAllow(r *http.Request, resourceId *string, action string) (bool, error) {
+	scopes, restricted, err := nibbler.CallerScopes(s.callerResolver(), r)
+	if err != nil || !restricted {
+		return err == nil, err
 	}
+	return nibbler.ScopesAllow(scopes, resourceId, action), nil
 }
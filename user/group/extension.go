@@ -1,11 +1,14 @@
 package nibbler_user_group
 
 import (
+	"errors"
 	"github.com/gorilla/mux"
 	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/template"
 	"github.com/markdicksonjr/nibbler/session"
 	"github.com/markdicksonjr/nibbler/user"
 	"net/http"
+	"time"
 )
 
 type PersistenceExtension interface {
@@ -14,7 +17,12 @@ type PersistenceExtension interface {
 	CommitTransaction() error
 	GetGroupMembershipsForUser(id string) ([]nibbler.GroupMembership, error)
 	SetGroupMembership(groupId string, userId string, role string) (nibbler.GroupMembership, error)
+	GetGroupMemberships(groupId string) ([]nibbler.GroupMembership, error)
+	DeleteGroupMembership(groupId string, userId string) error
+	GetGroupAncestors(groupId string) ([]nibbler.Group, error)   // nearest first, stopping if the parents loop
+	GetGroupDescendants(groupId string) ([]nibbler.Group, error) // every group below the group, visiting each once
 	CreateGroup(group nibbler.Group) error
+	UpdateGroup(group nibbler.Group) error
 	DeleteGroup(groupId string, hardDelete bool) error
 	SearchGroups(query nibbler.SearchParameters, includePrivileges bool) (*nibbler.SearchResults, error)
 	GetGroupsById(ids []string, includePrivileges bool) ([]nibbler.Group, error)
@@ -27,14 +35,77 @@ type Extension struct {
 	nibbler.NoOpExtension
 	PersistenceExtension PersistenceExtension
 	SessionExtension     *session.Extension
+	CallerResolver       nibbler.CallerResolver // identifies the caller, defaults to SessionExtension
 	UserExtension        *user.Extension
 	DisableDefaultRoutes bool
+	DisableDefaultRoles  bool // whether to skip creating the default global roles (owner, admin, member and viewer)
+
+	// note that roles only grant actions if the persistence extension implements RolePersistenceExtension - otherwise,
+	// membership roles are just labels
+
+	// whether members of a group are also members of the groups below it (e.g. a department's members belong to its
+	// teams) - privileges always inherit down the tree
+	InheritMemberships bool
+
+	// which groups' privileges a user has - EvaluateCurrentGroup (the default) or EvaluateAllMemberships
+	PrivilegeEvaluation string
+	EvaluatedRoles      []string // with EvaluateAllMemberships, only memberships with these roles count (if set)
+
+	// rules applied by Authorize before privileges and roles - a Deny policy overrides any privilege
+	Policies         []Policy
+	ExplainDecisions bool // whether to log (at debug level) each authorization decision, with the rule that decided it
+
+	// how long privilege decisions (and the users they're for) are cached - 0 (the default) disables the cache - and
+	// how many are cached (10000 by default)
+	DecisionCacheTTL  time.Duration
+	DecisionCacheSize int
+
+	// for inviting people to groups by email (see README) - the persistence extension must implement
+	// InvitationPersistenceExtension
+	InvitationsEnabled       bool
+	Sender                   nibbler.MailSender
+	EmailTemplates           *template.Set // defaults to template.Default()
+	InvitationKey            []byte        // the HMAC key for invitation tokens - read from group.invitation.key in config if not provided
+	InvitationFromName       string
+	InvitationFromEmail      string
+	InvitationRedirect       string // a UI to handle the link in the email (will have ?token=X or &token=X appended)
+	InvitationExpirationDays *int   // 7 by default
+
+	decisionCache *decisionCache
+}
+
+// privilege evaluation modes
+const (
+	EvaluateCurrentGroup   = "current-group"   // the user has the privileges of their current group
+	EvaluateAllMemberships = "all-memberships" // the user has the privileges of every group they're a member of
+)
+
+func (s *Extension) Init(app *nibbler.Application) error {
+	if err := s.NoOpExtension.Init(app); err != nil {
+		return err
+	}
+
+	if s.PrivilegeEvaluation == "" {
+		s.PrivilegeEvaluation = EvaluateCurrentGroup
+	}
+
+	if s.PrivilegeEvaluation != EvaluateCurrentGroup && s.PrivilegeEvaluation != EvaluateAllMemberships {
+		return errors.New(s.GetName() + " was given unknown privilege evaluation " + s.PrivilegeEvaluation)
+	}
+
+	s.initDecisionCache()
+	return s.initInvitations(app)
 }
 
 func (s *Extension) GetName() string {
 	return "user-group"
 }
 
+// callerResolver returns the CallerResolver, or the session extension if none was provided
+func (s *Extension) callerResolver() nibbler.CallerResolver {
+	return nibbler.ResolverOrDefault(s.CallerResolver, s.SessionExtension)
+}
+
 // GetParamValueFromRequest is a convenience function to extract the value of a named param for a request
 func GetParamValueFromRequest(paramName string) func(r *http.Request) (s string, err error) {
 	return func(r *http.Request) (s string, err error) {
@@ -42,17 +113,45 @@ func GetParamValueFromRequest(paramName string) func(r *http.Request) (s string,
 	}
 }
 
-// PostInit adds the default roues, if DisableDefaultRoutes is false
+// PostInit creates the default roles and adds the default routes, unless they're disabled
 func (s *Extension) PostInit(app *nibbler.Application) error {
+	if !s.DisableDefaultRoles && s.SupportsRoles() {
+		if err := s.createDefaultRoles(); err != nil {
+			return err
+		}
+	}
+
 	if !s.DisableDefaultRoutes {
-		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/composite", s.SessionExtension.EnforceLoggedIn(s.GetUserCompositeRequestHandler)).Methods("GET")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/composite", s.enforceCallerScope(GetUserCompositeAction, s.GetUserCompositeRequestHandler)).Methods("GET")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/current", s.enforceCallerScope(SetCurrentGroupAction, s.SetCurrentGroupRequestHandler)).Methods("POST")
 		app.Router.HandleFunc(app.Config.ApiPrefix+"/group", s.EnforceHasPrivilege(ListGroupsAction, s.QueryGroupsRequestHandler)).Methods("GET")
 		app.Router.HandleFunc(app.Config.ApiPrefix+"/group", s.EnforceHasPrivilege(CreateGroupAction, s.CreateGroupRequestHandler)).Methods("PUT")
-		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/:groupId/privilege", s.EnforceHasPrivilegeOnResource(DeleteGroupPrivilegeAction, GetParamValueFromRequest("groupId"), s.DeleteGroupPrivilegeRequestHandler)).Methods("DELETE")
-		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/:groupId/privilege", s.EnforceHasPrivilegeOnResource(CreateGroupPrivilegeAction, GetParamValueFromRequest("groupId"), s.CreateGroupPrivilegeRequestHandler)).Methods("PUT")
-		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/:groupId", s.EnforceHasPrivilegeOnResource(DeleteGroupAction, GetParamValueFromRequest("groupId"), s.DeleteGroupRequestHandler)).Methods("DELETE")
-		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/:groupId/membership", s.EnforceHasPrivilegeOnResource(CreateGroupMembershipAction, GetParamValueFromRequest("groupId"), s.CreateGroupMembershipRequestHandler)).Methods("PUT")
-		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/:groupId/membership", s.EnforceHasPrivilegeOnResource(RemoveMemberFromGroupAction, GetParamValueFromRequest("groupId"), s.CreateGroupMembershipRequestHandler)).Methods("DELETE")
+		if s.SupportsRoles() {
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/role", s.EnforceHasPrivilege(ListGroupRolesAction, s.ListGroupRolesRequestHandler)).Methods("GET")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/role", s.EnforceHasPrivilege(ManageGroupRolesAction, s.SetGroupRoleRequestHandler)).Methods("PUT")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/role/{roleId}", s.EnforceHasPrivilege(ManageGroupRolesAction, s.DeleteGroupRoleRequestHandler)).Methods("DELETE")
+		}
+		if s.InvitationsEnabled {
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/invitation/accept", s.enforceCallerScope(AcceptGroupInvitationAction, s.AcceptGroupInvitationRequestHandler)).Methods("POST")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/invitation/decline", s.DeclineGroupInvitationRequestHandler).Methods("POST")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/invitation", s.EnforceHasPrivilegeOnResource(ListGroupMembersAction, GetParamValueFromRequest("groupId"), s.ListGroupInvitationsRequestHandler)).Methods("GET")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/invitation", s.EnforceHasPrivilegeOnResource(CreateGroupMembershipAction, GetParamValueFromRequest("groupId"), s.CreateGroupInvitationRequestHandler)).Methods("PUT")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/invitation/{invitationId}", s.EnforceHasPrivilegeOnResource(CreateGroupMembershipAction, GetParamValueFromRequest("groupId"), s.RevokeGroupInvitationRequestHandler)).Methods("DELETE")
+		}
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}", s.EnforceHasPrivilegeOnResource(GetGroupAction, GetParamValueFromRequest("groupId"), s.GetGroupRequestHandler)).Methods("GET")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}", s.EnforceHasPrivilegeOnResource(UpdateGroupAction, GetParamValueFromRequest("groupId"), s.UpdateGroupRequestHandler)).Methods("PATCH")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}", s.EnforceHasPrivilegeOnResource(DeleteGroupAction, GetParamValueFromRequest("groupId"), s.DeleteGroupRequestHandler)).Methods("DELETE")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/privilege", s.EnforceHasPrivilegeOnResource(ListGroupPrivilegesAction, GetParamValueFromRequest("groupId"), s.ListGroupPrivilegesRequestHandler)).Methods("GET")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/privilege", s.EnforceHasPrivilegeOnResource(DeleteGroupPrivilegeAction, GetParamValueFromRequest("groupId"), s.DeleteGroupPrivilegeRequestHandler)).Methods("DELETE")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/privilege", s.EnforceHasPrivilegeOnResource(CreateGroupPrivilegeAction, GetParamValueFromRequest("groupId"), s.CreateGroupPrivilegeRequestHandler)).Methods("PUT")
+		if s.SupportsRoles() {
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/role", s.EnforceHasPrivilegeOnResource(ListGroupRolesAction, GetParamValueFromRequest("groupId"), s.ListGroupRolesRequestHandler)).Methods("GET")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/role", s.EnforceHasPrivilegeOnResource(ManageGroupRolesAction, GetParamValueFromRequest("groupId"), s.SetGroupRoleRequestHandler)).Methods("PUT")
+			app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/role/{roleId}", s.EnforceHasPrivilegeOnResource(ManageGroupRolesAction, GetParamValueFromRequest("groupId"), s.DeleteGroupRoleRequestHandler)).Methods("DELETE")
+		}
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/membership", s.EnforceHasPrivilegeOnResource(ListGroupMembersAction, GetParamValueFromRequest("groupId"), s.ListGroupMembershipsRequestHandler)).Methods("GET")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/membership", s.EnforceHasPrivilegeOnResource(CreateGroupMembershipAction, GetParamValueFromRequest("groupId"), s.CreateGroupMembershipRequestHandler)).Methods("PUT")
+		app.Router.HandleFunc(app.Config.ApiPrefix+"/group/{groupId}/membership/{memberId}", s.EnforceHasPrivilegeOnResource(RemoveMemberFromGroupAction, GetParamValueFromRequest("groupId"), s.RemoveGroupMembershipRequestHandler)).Methods("DELETE")
 	}
 	return nil
 }
@@ -64,6 +163,8 @@ func GetModels() []interface{} {
 	models = append(models, nibbler.GroupPrivilege{})
 	models = append(models, nibbler.User{})
 	models = append(models, nibbler.GroupMembership{})
+	models = append(models, nibbler.GroupRole{})
+	models = append(models, nibbler.GroupInvitation{})
 
 	return models
 }
@@ -0,0 +1,338 @@
+package nibbler_user_group
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestImplements(t *testing.T) {
+	e := Extension{}
+	var base nibbler.Extension = &e
+	var persistence PersistenceExtension = &MockPersistenceExtension{}
+	var roles RolePersistenceExtension = &MockPersistenceExtension{}
+	if base == nil || persistence == nil || roles == nil {
+		t.Fatal("base was nil")
+	}
+}
+
+type testApp struct {
+	extension *Extension
+	router    *mux.Router
+	admin     *nibbler.User // in the "admins" group, with every global privilege
+	member    *nibbler.User // with no privileges
+}
+
+func newTestApp(t *testing.T) *testApp {
+	return newTestAppWith(t, func(e *Extension) {})
+}
+
+// newTestAppWith is newTestApp, with configure called on the extension before Init
+func newTestAppWith(t *testing.T, configure func(e *Extension)) *testApp {
+	app := &nibbler.Application{
+		Config: &nibbler.Configuration{ApiPrefix: "/api"},
+		Logger: nibbler.SilentLogger{},
+		Router: mux.NewRouter(),
+	}
+
+	userExtension := &user.Extension{PersistenceExtension: &user.MockPersistenceExtension{}}
+	if err := userExtension.Init(app); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Extension{
+		PersistenceExtension: &MockPersistenceExtension{},
+		CallerResolver:       user.HeaderCallerResolver{UserExtension: userExtension},
+		UserExtension:        userExtension,
+	}
+	configure(e)
+
+	if err := e.Init(app); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PostInit(app); err != nil {
+		t.Fatal(err)
+	}
+
+	admins, err := e.CreateGroup("admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{ListGroupsAction, CreateGroupAction, GetGroupAction, UpdateGroupAction, DeleteGroupAction,
+		ListGroupMembersAction, CreateGroupMembershipAction, RemoveMemberFromGroupAction, ListGroupPrivilegesAction,
+		CreateGroupPrivilegeAction, DeleteGroupPrivilegeAction} {
+		if err := e.AddPrivilegeToGroups([]string{admins.ID}, "", action); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	admin, err := userExtension.Create(&nibbler.User{CurrentGroupID: &admins.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	member, err := userExtension.Create(&nibbler.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testApp{extension: e, router: app.Router, admin: admin, member: member}
+}
+
+func (a *testApp) send(caller *nibbler.User, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if caller != nil {
+		req.Header.Set(user.CallerIDHeader, caller.ID)
+	}
+
+	if strings.HasPrefix(body, "name=") {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res := httptest.NewRecorder()
+	a.router.ServeHTTP(res, req)
+	return res
+}
+
+func (a *testApp) createGroup(t *testing.T, name string) nibbler.Group {
+	res := a.send(a.admin, "PUT", "/api/group", url.Values{"name": {name}}.Encode())
+	if res.Code != http.StatusOK {
+		t.Fatal("the group was not created: " + res.Body.String())
+	}
+
+	var group nibbler.Group
+	if err := json.Unmarshal(res.Body.Bytes(), &group); err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func TestExtension_GroupRoutes(t *testing.T) {
+	a := newTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	if res := a.send(a.admin, "GET", "/api/group/"+group.ID, ""); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"name":"editors"`) {
+		t.Fatal("the group was not returned")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/missing", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a missing group was found")
+	}
+
+	if res := a.send(a.admin, "PATCH", "/api/group/"+group.ID, `{"name": "writers"}`); res.Code != http.StatusOK {
+		t.Fatal("the group was not renamed")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/"+group.ID, ""); !strings.Contains(res.Body.String(), `"name":"writers"`) {
+		t.Fatal("the rename was not saved")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group", ""); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"writers"`) {
+		t.Fatal("the group was not listed")
+	}
+}
+
+func TestExtension_MembershipRoutes(t *testing.T) {
+	a := newTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/membership", `{"memberId": "`+a.member.ID+`", "role": "member"}`); res.Code != http.StatusOK {
+		t.Fatal("the member was not added")
+	}
+
+	res := a.send(a.admin, "GET", "/api/group/"+group.ID+"/membership", "")
+	var memberships []nibbler.GroupMembership
+	if err := json.Unmarshal(res.Body.Bytes(), &memberships); err != nil {
+		t.Fatal(err)
+	}
+
+	// the creator is added as an admin
+	if len(memberships) != 2 || memberships[0].MemberID != a.admin.ID || memberships[1].Role != "member" {
+		t.Fatal("the memberships were not listed")
+	}
+
+	// removing a member clears their current group, if it was this one
+	member, _ := a.extension.UserExtension.GetUserById(a.member.ID)
+	member.CurrentGroupID = &group.ID
+	if err := a.extension.UserExtension.Update(member); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.admin, "DELETE", "/api/group/"+group.ID+"/membership/"+a.member.ID, ""); res.Code != http.StatusOK {
+		t.Fatal("the member was not removed")
+	}
+
+	if remaining, _ := a.extension.PersistenceExtension.GetGroupMemberships(group.ID); len(remaining) != 1 {
+		t.Fatal("the membership was not deleted")
+	}
+
+	if member, _ := a.extension.UserExtension.GetUserById(a.member.ID); member.CurrentGroupID != nil {
+		t.Fatal("the removed member's current group was not cleared")
+	}
+}
+
+func TestExtension_PrivilegeRoutes(t *testing.T) {
+	a := newTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	// the admin can only grant what they have
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/privilege", `{"resourceID": "documents", "action": "edit"}`); res.Code != http.StatusNotFound {
+		t.Fatal("a privilege the admin doesn't have was granted")
+	}
+
+	if err := a.extension.AddPrivilegeToGroups([]string{*a.admin.CurrentGroupID}, "documents", "edit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/privilege", `{"resourceID": "documents", "action": "edit"}`); res.Code != http.StatusOK {
+		t.Fatal("the privilege was not created")
+	}
+
+	res := a.send(a.admin, "GET", "/api/group/"+group.ID+"/privilege", "")
+	var privileges []nibbler.GroupPrivilege
+	if err := json.Unmarshal(res.Body.Bytes(), &privileges); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(privileges) != 1 || privileges[0].Action != "edit" || privileges[0].GroupID != group.ID {
+		t.Fatal("the privileges were not listed")
+	}
+
+	if res := a.send(a.admin, "DELETE", "/api/group/"+group.ID+"/privilege", `{"resourceID": "documents", "action": "edit"}`); res.Code != http.StatusOK {
+		t.Fatal("the privilege was not deleted")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/"+group.ID+"/privilege", ""); res.Body.String() != "[]" {
+		t.Fatal("the deleted privilege was still listed")
+	}
+}
+
+func TestExtension_CreateGroupPrivilegeRequiresTheAction(t *testing.T) {
+	a := newTestApp(t)
+	mine := a.createGroup(t, "mine")
+	other := a.createGroup(t, "other")
+
+	// the member can grant privileges on their own group, and nothing else
+	if err := a.extension.AddPrivilegeToGroups([]string{mine.ID}, mine.ID, CreateGroupPrivilegeAction); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.extension.SetGroupMembership(mine.ID, a.member.ID, MemberRole); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.extension.SetCurrentGroup(a.member.ID, mine.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"resourceID": "` + other.ID + `", "action": "` + HardDeleteGroupAction + `"}`
+	if res := a.send(a.member, "PUT", "/api/group/"+mine.ID+"/privilege", body); res.Code != http.StatusNotFound {
+		t.Fatal("a privilege on another group was granted by a caller without it")
+	}
+
+	if has, _ := a.extension.HasPrivilegeOnResource(a.member.ID, other.ID, HardDeleteGroupAction); has {
+		t.Fatal("the member gained a privilege they were not allowed to grant")
+	}
+
+	body = `{"resourceID": "` + mine.ID + `", "action": "` + CreateGroupPrivilegeAction + `"}`
+	if res := a.send(a.member, "PUT", "/api/group/"+mine.ID+"/privilege", body); res.Code != http.StatusOK {
+		t.Fatal("a privilege the caller has could not be granted")
+	}
+}
+
+func TestExtension_RoutesEnforcePrivileges(t *testing.T) {
+	a := newTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	if res := a.send(nil, "GET", "/api/group/"+group.ID, ""); res.Code != http.StatusUnauthorized {
+		t.Fatal("an anonymous caller was not rejected")
+	}
+
+	for _, route := range [][]string{
+		{"GET", "/api/group/" + group.ID, ""},
+		{"PATCH", "/api/group/" + group.ID, `{"name": "mine"}`},
+		{"DELETE", "/api/group/" + group.ID, ""},
+		{"GET", "/api/group/" + group.ID + "/membership", ""},
+		{"DELETE", "/api/group/" + group.ID + "/membership/" + a.admin.ID, ""},
+		{"GET", "/api/group/" + group.ID + "/privilege", ""},
+	} {
+		if res := a.send(a.member, route[0], route[1], route[2]); res.Code != http.StatusNotFound {
+			t.Fatal("a caller without the privilege could call " + route[0] + " " + route[1])
+		}
+	}
+}
+
+func TestExtension_DeleteGroup(t *testing.T) {
+	a := newTestApp(t)
+	soft := a.createGroup(t, "soft")
+	hard := a.createGroup(t, "hard")
+
+	if res := a.send(a.admin, "DELETE", "/api/group/"+soft.ID, ""); res.Code != http.StatusOK {
+		t.Fatal("the group was not deleted")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/"+soft.ID, ""); res.Code != http.StatusNotFound {
+		t.Fatal("a deleted group was found")
+	}
+
+	// hard deletes need their own privilege
+	if res := a.send(a.admin, "DELETE", "/api/group/"+hard.ID+"?hardDelete=true", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a group was hard deleted without the privilege")
+	}
+
+	if err := a.extension.AddPrivilegeToGroups([]string{*a.admin.CurrentGroupID}, hard.ID, HardDeleteGroupAction); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.admin, "DELETE", "/api/group/"+hard.ID+"?hardDelete=true", ""); res.Code != http.StatusOK {
+		t.Fatal("the group was not hard deleted")
+	}
+
+	if memberships, _ := a.extension.PersistenceExtension.GetGroupMemberships(hard.ID); len(memberships) != 0 {
+		t.Fatal("the hard deleted group's memberships were kept")
+	}
+}
+
+func TestExtension_QueryGroups(t *testing.T) {
+	a := newTestApp(t)
+	for _, name := range []string{"writers", "editors", "edit reviewers"} {
+		a.createGroup(t, name)
+	}
+
+	res := a.send(a.admin, "GET", "/api/group?q=EDIT&sort=-name&size=1&includeTotal=true", "")
+	if res.Code != http.StatusOK {
+		t.Fatal("the groups were not searched: " + res.Body.String())
+	}
+
+	var results struct {
+		Hits  []nibbler.Group `json:"hits"`
+		Total int             `json:"total"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.Total != 2 || len(results.Hits) != 1 || results.Hits[0].Name != "editors" {
+		t.Fatal("the search params were not applied")
+	}
+
+	// like before paging, the total is included by default
+	res = a.send(a.admin, "GET", "/api/group", "")
+	results.Total = 0
+	if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+
+	if results.Total != 4 || len(results.Hits) != 4 {
+		t.Fatal("every group and the total were not returned by default")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group?sort=secret", ""); res.Code != http.StatusBadRequest {
+		t.Fatal("an invalid sort was accepted")
+	}
+}
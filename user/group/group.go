@@ -17,24 +17,32 @@ func (s *Extension) CreateGroupRequestHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// get the current user from the session
-	caller, err := s.SessionExtension.GetCaller(r)
+	// get the current user (from the session, by default)
+	caller, err := s.callerResolver().GetCaller(r)
 	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
 
+	group := nibbler.Group{
+		ID:   uuid.New().String(),
+		Name: groupName,
+	}
+
+	// a group created below another inherits its privileges, so the caller needs to be allowed to create groups there
+	if parentId := r.FormValue("parentId"); parentId != "" {
+		if !s.checkNewParent(w, r, caller, group.ID, parentId, CreateGroupAction) {
+			return
+		}
+		group.ParentID = &parentId
+	}
+
 	ext, err := s.PersistenceExtension.StartTransaction()
 	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
 
-	group := nibbler.Group{
-		ID:   uuid.New().String(),
-		Name: groupName,
-	}
-
 	// create the group
 	err = ext.CreateGroup(group)
 	if err != nil {
@@ -43,9 +51,9 @@ func (s *Extension) CreateGroupRequestHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// add the user as a manager of the new group - this call will also change the current group for the current user
-	// to the new group, as well as create a score or any other model that's made once a user is added to a group
-	_, err = ext.SetGroupMembership(group.ID, caller.ID, "admin")
+	// add the user as the owner of the new group - their current group doesn't change (see SetCurrentGroup), but
+	// persistence extensions can create any other model that's made once a user is added to a group
+	_, err = ext.SetGroupMembership(group.ID, caller.ID, OwnerRole)
 	if err != nil {
 		ext.RollbackTransaction()
 		nibbler.Write500Json(w, err.Error())
@@ -58,6 +66,7 @@ func (s *Extension) CreateGroupRequestHandler(w http.ResponseWriter, r *http.Req
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
+	s.InvalidateUserDecisions(caller.ID)
 
 	// stringify the group in order to return it
 	groupJson, err := json.Marshal(&group)
@@ -69,29 +78,125 @@ func (s *Extension) CreateGroupRequestHandler(w http.ResponseWriter, r *http.Req
 	nibbler.Write200Json(w, string(groupJson))
 }
 
-// QueryGroupsRequestHandler lists groups - it does not yet support queries
+// GroupSearchOptions are the search params accepted by QueryGroupsRequestHandler (see nibbler.ParseSearchParameters).
+// Group listing used to return every group with its total, so the default page is large and includes the total
+var GroupSearchOptions = nibbler.SearchParameterOptions{
+	DefaultSize:         1000,
+	MaxSize:             1000,
+	DefaultIncludeTotal: true,
+	SortFields:          []string{"name", "type", "createdAt", "updatedAt"},
+	FilterFields:        []string{"type", "parentId"},
+}
+
+// QueryGroupsRequestHandler searches groups with the search params in the query string (q, offset, size, sort,
+// includeTotal, and the type and parentId filters - see GroupSearchOptions), including their privileges with the
+// includePrivs=true query param
 func (s *Extension) QueryGroupsRequestHandler(w http.ResponseWriter, r *http.Request) {
-	params := nibbler.SearchParameters{
-		Query:        nil,
-		Offset:       nil,
-		Size:         nil,
-		IncludeTotal: true,
+	params, err := nibbler.ParseSearchParameters(r.URL.Query(), GroupSearchOptions)
+	if err != nil {
+		nibbler.Write400Json(w, err.Error())
+		return
+	}
+
+	includePrivs := r.URL.Query().Get("includePrivs") == "true"
+
+	results, err := s.PersistenceExtension.SearchGroups(*params, includePrivs)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
 	}
 
-	// TODO: looks wrong - this should be a query param here
-	includePrivs := mux.Vars(r)["includePrivs"] == "true"
+	nibbler.WriteStructToJson(w, results, http.StatusOK)
+}
 
-	if g, err := s.PersistenceExtension.SearchGroups(params, includePrivs); err != nil {
+// GetGroupRequestHandler responds with the group with the "groupId" path param (including its privileges with the
+// includePrivs=true query param)
+func (s *Extension) GetGroupRequestHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := s.GetGroup(mux.Vars(r)["groupId"], r.URL.Query().Get("includePrivs") == "true")
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if group == nil {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	nibbler.WriteStructToJson(w, group, http.StatusOK)
+}
+
+// UpdateGroupRequestHandler updates the group with the "groupId" path param from a body with its new name, type, data
+// and/or parentId (blank for the top level) - fields left out of the body are not changed.  Moving the group below
+// another requires the update-group privilege on the new parent as well
+func (s *Extension) UpdateGroupRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var update struct {
+		Name     *string `json:"name"`
+		Type     *string `json:"type"`
+		Data     *string `json:"data"`
+		ParentID *string `json:"parentId"`
+	}
+
+	if r.Body == nil {
+		nibbler.Write500Json(w, "no body provided")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if update.Name != nil && *update.Name == "" {
+		nibbler.Write500Json(w, "group name is a required field")
+		return
+	}
+
+	group, err := s.GetGroup(mux.Vars(r)["groupId"], false)
+	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
-	} else {
-		r, err := json.Marshal(g)
+	}
+
+	if group == nil {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if update.Name != nil {
+		group.Name = *update.Name
+	}
+
+	if update.Type != nil {
+		group.Type = *update.Type
+	}
+
+	if update.Data != nil {
+		group.Context = update.Data
+	}
+
+	if update.ParentID != nil && *update.ParentID == "" {
+		group.ParentID = nil
+	} else if update.ParentID != nil && (group.ParentID == nil || *group.ParentID != *update.ParentID) {
+		caller, err := s.callerResolver().GetCaller(r)
 		if err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
 		}
-		nibbler.Write200Json(w, string(r))
+
+		if !s.checkNewParent(w, r, caller, group.ID, *update.ParentID, UpdateGroupAction) {
+			return
+		}
+		group.ParentID = update.ParentID
+	}
+
+	if err := s.PersistenceExtension.UpdateGroup(*group); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
 	}
+	s.InvalidateDecisions()
+
+	nibbler.WriteStructToJson(w, group, http.StatusOK)
 }
 
 func (s *Extension) CreateGroup(name string) (nibbler.Group, error) {
@@ -103,14 +208,75 @@ func (s *Extension) CreateGroup(name string) (nibbler.Group, error) {
 	return group, err
 }
 
+// DeleteGroupRequestHandler deletes the group with the "groupId" path param.  With the hardDelete=true query param,
+// the group is removed entirely rather than marked deleted, which also requires the hard-delete-group privilege
 func (s *Extension) DeleteGroupRequestHandler(w http.ResponseWriter, r *http.Request) {
-	// TODO: allow query param for hard delete
-	if err := s.PersistenceExtension.DeleteGroup(mux.Vars(r)["groupId"], false); err != nil {
+	groupId := mux.Vars(r)["groupId"]
+	hardDelete := r.URL.Query().Get("hardDelete") == "true"
+
+	if hardDelete {
+		caller, err := s.callerResolver().GetCaller(r)
+		if err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		}
+
+		if caller == nil {
+			nibbler.Write401Json(w)
+			return
+		}
+
+		if has, err := s.callerHasPrivilegeOnResource(r, caller, groupId, HardDeleteGroupAction); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		} else if !has {
+			nibbler.Write404Json(w)
+			return
+		}
+	}
+
+	if group, err := s.GetGroup(groupId, false); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	} else if group == nil {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if err := s.PersistenceExtension.DeleteGroup(groupId, hardDelete); err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
+	s.InvalidateDecisions()
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
+
+// checkNewParent validates a new parent for the group, and that the caller has the privilege for the action on it,
+// writing the error response (and returning false) if not
+func (s *Extension) checkNewParent(w http.ResponseWriter, r *http.Request, caller *nibbler.User, groupId string, parentId string, action string) bool {
+	if has, err := s.callerHasPrivilegeOnResource(r, caller, parentId, action); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return false
+	} else if !has {
+		nibbler.Write404Json(w)
+		return false
+	}
+
+	if err := s.checkParent(groupId, parentId); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return false
+	}
+	return true
+}
 
-	nibbler.Write200Json(w, "{\"result\":\"ok\"")
+// GetGroup returns the (non-deleted) group with the given ID, or nil if there is none
+func (s *Extension) GetGroup(groupId string, includePrivileges bool) (*nibbler.Group, error) {
+	groups, err := s.GetGroups([]string{groupId}, includePrivileges)
+	if err != nil || len(groups) == 0 {
+		return nil, err
+	}
+	return &groups[0], nil
 }
 
 func (s *Extension) GetGroups(groupIds []string, includePrivileges bool) ([]nibbler.Group, error) {
@@ -0,0 +1,120 @@
+package nibbler_user_group
+
+import (
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+)
+
+// ErrGroupCycle is returned when a group would become its own ancestor
+var ErrGroupCycle = errors.New("a group cannot be placed below itself or one of its descendants")
+
+// SetGroupParent moves the group below the parent (or to the top level, if parentId is nil or blank).  Members of the
+// group inherit the privileges of the groups above it
+func (s *Extension) SetGroupParent(groupId string, parentId *string) error {
+	group, err := s.GetGroup(groupId, false)
+	if err != nil {
+		return err
+	}
+
+	if group == nil {
+		return errors.New("no group with ID " + groupId + " exists")
+	}
+
+	if parentId != nil && *parentId == "" {
+		parentId = nil
+	}
+
+	if parentId != nil {
+		if err := s.checkParent(groupId, *parentId); err != nil {
+			return err
+		}
+	}
+
+	group.ParentID = parentId
+	if err := s.PersistenceExtension.UpdateGroup(*group); err != nil {
+		return err
+	}
+
+	// the privileges inherited by (and through) the group have changed
+	s.InvalidateDecisions()
+	return nil
+}
+
+// checkParent validates that the parent exists, and that the group isn't the parent or one of its ancestors
+func (s *Extension) checkParent(groupId string, parentId string) error {
+	parent, err := s.GetGroup(parentId, false)
+	if err != nil {
+		return err
+	}
+
+	if parent == nil {
+		return errors.New("no group with ID " + parentId + " exists")
+	}
+
+	if parentId == groupId {
+		return ErrGroupCycle
+	}
+
+	ancestors, err := s.PersistenceExtension.GetGroupAncestors(parentId)
+	if err != nil {
+		return err
+	}
+
+	for _, ancestor := range ancestors {
+		if ancestor.ID == groupId {
+			return ErrGroupCycle
+		}
+	}
+	return nil
+}
+
+// withAncestors returns the group ID followed by the IDs of the groups above it, nearest first.  For IDs that aren't
+// groups (e.g. other resources), it returns just the ID
+func (s *Extension) withAncestors(groupId string) ([]string, error) {
+	ancestors, err := s.PersistenceExtension.GetGroupAncestors(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{groupId}
+	for _, ancestor := range ancestors {
+		ids = append(ids, ancestor.ID)
+	}
+	return ids, nil
+}
+
+// GetEffectiveMemberships returns the user's memberships, along with (if InheritMemberships is set) memberships of the
+// groups below those, which carry the role of the membership they're inherited from and have no ID
+func (s *Extension) GetEffectiveMemberships(userId string) ([]nibbler.GroupMembership, error) {
+	memberships, err := s.GetGroupMembershipsForUser(userId)
+	if err != nil || !s.InheritMemberships {
+		return memberships, err
+	}
+
+	seen := make(map[string]bool)
+	for _, membership := range memberships {
+		seen[membership.GroupID] = true
+	}
+
+	effective := memberships
+	for _, membership := range memberships {
+		descendants, err := s.PersistenceExtension.GetGroupDescendants(membership.GroupID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, descendant := range descendants {
+			if seen[descendant.ID] {
+				continue
+			}
+			seen[descendant.ID] = true
+
+			effective = append(effective, nibbler.GroupMembership{
+				GroupID:  descendant.ID,
+				MemberID: userId,
+				Role:     membership.Role,
+			})
+		}
+	}
+	return effective, nil
+}
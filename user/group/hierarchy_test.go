@@ -0,0 +1,159 @@
+package nibbler_user_group
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// createTree creates organization -> department -> team
+func createTree(t *testing.T, e *Extension) (nibbler.Group, nibbler.Group, nibbler.Group) {
+	var groups []nibbler.Group
+	for _, name := range []string{"organization", "department", "team"} {
+		group, err := e.CreateGroup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(groups) > 0 {
+			if err := e.SetGroupParent(group.ID, &groups[len(groups)-1].ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups[0], groups[1], groups[2]
+}
+
+func setCurrentGroup(t *testing.T, e *Extension, u *nibbler.User, groupId string) {
+	u.CurrentGroupID = &groupId
+	if err := e.UserExtension.Update(u); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtension_PrivilegesInheritDown(t *testing.T) {
+	a := newTestApp(t)
+	organization, department, team := createTree(t, a.extension)
+	setCurrentGroup(t, a.extension, a.member, team.ID)
+
+	if err := a.extension.AddPrivilegeToGroups([]string{organization.ID}, "", "read-docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, err := a.extension.HasPrivilege(a.member.ID, "read-docs"); err != nil || !has {
+		t.Fatal("a privilege granted to an ancestor group was not inherited")
+	}
+
+	// but not up
+	if err := a.extension.AddPrivilegeToGroups([]string{team.ID}, "", "write-docs"); err != nil {
+		t.Fatal(err)
+	}
+
+	setCurrentGroup(t, a.extension, a.member, department.ID)
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "write-docs"); has {
+		t.Fatal("a privilege granted to a child group was inherited by its parent")
+	}
+}
+
+func TestExtension_PrivilegeOnAncestorResource(t *testing.T) {
+	a := newTestApp(t)
+	organization, _, team := createTree(t, a.extension)
+
+	auditors, _ := a.extension.CreateGroup("auditors")
+	setCurrentGroup(t, a.extension, a.member, auditors.ID)
+
+	if err := a.extension.AddPrivilegeToGroups([]string{auditors.ID}, organization.ID, "audit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if has, err := a.extension.HasPrivilegeOnResource(a.member.ID, team.ID, "audit"); err != nil || !has {
+		t.Fatal("a privilege on an ancestor resource did not match")
+	}
+
+	if has, _ := a.extension.HasPrivilegeOnResource(a.member.ID, auditors.ID, "audit"); has {
+		t.Fatal("a privilege matched an unrelated resource")
+	}
+}
+
+func TestExtension_GroupCycles(t *testing.T) {
+	a := newTestApp(t)
+	organization, department, team := createTree(t, a.extension)
+
+	if err := a.extension.SetGroupParent(organization.ID, &team.ID); err != ErrGroupCycle {
+		t.Fatal("a group was placed below its descendant")
+	}
+
+	if err := a.extension.SetGroupParent(team.ID, &team.ID); err != ErrGroupCycle {
+		t.Fatal("a group was placed below itself")
+	}
+
+	// even if persistence ends up with a loop, ancestry queries end
+	organization.ParentID = &team.ID
+	if err := a.extension.PersistenceExtension.UpdateGroup(organization); err != nil {
+		t.Fatal(err)
+	}
+
+	if ancestors, err := a.extension.PersistenceExtension.GetGroupAncestors(team.ID); err != nil || len(ancestors) != 2 {
+		t.Fatal("the ancestors of a group in a loop were not as expected")
+	}
+
+	if descendants, err := a.extension.PersistenceExtension.GetGroupDescendants(department.ID); err != nil || len(descendants) != 2 {
+		t.Fatal("the descendants of a group in a loop were not as expected")
+	}
+
+	setCurrentGroup(t, a.extension, a.member, team.ID)
+	if has, err := a.extension.HasPrivilege(a.member.ID, "anything"); err != nil || has {
+		t.Fatal("a privilege check in a loop did not end correctly")
+	}
+}
+
+func TestExtension_InheritMemberships(t *testing.T) {
+	a := newTestApp(t)
+	_, department, team := createTree(t, a.extension)
+
+	if _, err := a.extension.SetGroupMembership(department.ID, a.member.ID, "member"); err != nil {
+		t.Fatal(err)
+	}
+
+	if memberships, _ := a.extension.GetEffectiveMemberships(a.member.ID); len(memberships) != 1 {
+		t.Fatal("memberships were inherited without InheritMemberships")
+	}
+
+	a.extension.InheritMemberships = true
+	memberships, err := a.extension.GetEffectiveMemberships(a.member.ID)
+	if err != nil || len(memberships) != 2 || memberships[1].GroupID != team.ID || memberships[1].Role != "member" {
+		t.Fatal("the membership was not inherited by the child group")
+	}
+}
+
+func TestExtension_ParentRequiresPrivilege(t *testing.T) {
+	a := newTestApp(t)
+	organization, _, _ := createTree(t, a.extension)
+
+	// the member may update their own group, but has no privilege on the organization
+	own, _ := a.extension.CreateGroup("own")
+	setCurrentGroup(t, a.extension, a.member, own.ID)
+	if err := a.extension.AddPrivilegeToGroups([]string{own.ID}, own.ID, UpdateGroupAction); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.member, "PATCH", "/api/group/"+own.ID, `{"name": "renamed"}`); res.Code != http.StatusOK {
+		t.Fatal("the member could not update their own group")
+	}
+
+	if res := a.send(a.member, "PATCH", "/api/group/"+own.ID, `{"parentId": "`+organization.ID+`"}`); res.Code != http.StatusNotFound {
+		t.Fatal("a group was moved below a group the caller has no privilege on")
+	}
+
+	// the admin can
+	res := a.send(a.admin, "PUT", "/api/group", url.Values{"name": {"project"}, "parentId": {organization.ID}}.Encode())
+	if res.Code != http.StatusOK {
+		t.Fatal("a child group was not created: " + res.Body.String())
+	}
+
+	if res := a.send(a.admin, "PATCH", "/api/group/"+organization.ID, `{"parentId": "`+own.ID+`"}`); res.Code != http.StatusOK {
+		t.Fatal("the group was not moved")
+	}
+}
@@ -0,0 +1,412 @@
+package nibbler_user_group
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/template"
+	"github.com/markdicksonjr/nibbler/user"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InvitationTemplate is the name of the template (in EmailTemplates) used for invitation emails
+const InvitationTemplate = "group-invitation"
+
+// ErrInvalidInvitation is returned for invitation tokens that are malformed, not signed by this app, expired, or for
+// invitations that have been accepted, declined or revoked
+var ErrInvalidInvitation = errors.New("invalid or expired invitation")
+
+// InvitationPersistenceExtension is implemented by persistence extensions that can store invitations.  It is only
+// required when InvitationsEnabled is set
+type InvitationPersistenceExtension interface {
+	CreateGroupInvitation(invitation nibbler.GroupInvitation) error
+	GetGroupInvitation(id string) (*nibbler.GroupInvitation, error)
+	GetGroupInvitations(groupId string) ([]nibbler.GroupInvitation, error)
+	UpdateGroupInvitation(invitation nibbler.GroupInvitation) error
+}
+
+// initInvitations validates the invitation settings, and applies defaults
+func (s *Extension) initInvitations(app *nibbler.Application) error {
+	if !s.InvitationsEnabled {
+		return nil
+	}
+
+	if _, ok := s.PersistenceExtension.(InvitationPersistenceExtension); !ok {
+		return errors.New(s.GetName() + " has invitations enabled, but its persistence extension can't store them")
+	}
+
+	if s.Sender == nil {
+		return errors.New(s.GetName() + " has invitations enabled, but no mail sender was provided")
+	}
+
+	// if no key was provided, read it from config, or fall back to a random one
+	if len(s.InvitationKey) == 0 && app.Config != nil && app.Config.Raw != nil {
+		s.InvitationKey = []byte(app.Config.Raw.Get("group", "invitation", "key").String(""))
+	}
+
+	if len(s.InvitationKey) == 0 {
+		s.InvitationKey = make([]byte, 32)
+		if _, err := rand.Read(s.InvitationKey); err != nil {
+			return err
+		}
+		app.Logger.Warn("no invitation key was provided to " + s.GetName() + ", so invitations will not survive a restart")
+	}
+
+	if s.EmailTemplates == nil {
+		s.EmailTemplates = template.Default()
+	}
+
+	if s.InvitationExpirationDays == nil {
+		days := 7
+		s.InvitationExpirationDays = &days
+	}
+	return nil
+}
+
+func (s *Extension) invitations() InvitationPersistenceExtension {
+	return s.PersistenceExtension.(InvitationPersistenceExtension)
+}
+
+// Invite invites the email address to join the group with the role, and emails them a link (InvitationRedirect, with
+// the token appended) to accept or decline.  The email is handed to the Sender before returning - if that fails, the
+// invitation is revoked and the error is returned.  Otherwise, any invitation still pending for the address is revoked
+func (s *Extension) Invite(r *http.Request, group nibbler.Group, email string, role string, inviter *nibbler.User) (*nibbler.GroupInvitation, error) {
+	existing, err := s.invitations().GetGroupInvitations(group.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	invitation := nibbler.GroupInvitation{
+		ID:        uuid.New().String(),
+		GroupID:   group.ID,
+		Email:     email,
+		Role:      role,
+		InviterID: inviter.ID,
+		ExpiresAt: now.AddDate(0, 0, *s.InvitationExpirationDays),
+	}
+
+	if err := s.invitations().CreateGroupInvitation(invitation); err != nil {
+		return nil, err
+	}
+
+	if err := s.sendInvitation(r, group, invitation, inviter); err != nil {
+		invitation.RevokedAt = &now
+		if revokeErr := s.invitations().UpdateGroupInvitation(invitation); revokeErr != nil {
+			s.Logger.Error("while revoking unsent invitation " + invitation.ID + ", error = " + revokeErr.Error())
+		}
+		return nil, err
+	}
+
+	// only now the new invitation has been sent, so that a failed send doesn't leave the invitee with no working link
+	for _, previous := range existing {
+		if previous.IsPending() && strings.EqualFold(previous.Email, email) {
+			previous.RevokedAt = &now
+			if err := s.invitations().UpdateGroupInvitation(previous); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &invitation, nil
+}
+
+func (s *Extension) sendInvitation(r *http.Request, group nibbler.Group, invitation nibbler.GroupInvitation, inviter *nibbler.User) error {
+	data := template.Data{
+		Link: user.AppendTokenToLink(s.InvitationRedirect, s.invitationToken(invitation)),
+		Values: map[string]interface{}{
+			"group":   group.Name,
+			"role":    invitation.Role,
+			"inviter": user.GetFullName(*inviter),
+		},
+	}
+
+	// registered users are greeted by name - templates only ever see the safe version of the user
+	if invitee, err := s.UserExtension.GetUserByEmail(invitation.Email); err != nil {
+		return err
+	} else if invitee != nil {
+		safeUser := user.GetSafeUser(*invitee)
+		data.User = &safeUser
+		data.Name = user.GetFullName(*invitee)
+	}
+
+	rendered, err := s.EmailTemplates.Render(InvitationTemplate, template.LocalesForRequest(r, ""), data)
+	if err != nil {
+		return err
+	}
+
+	message := &nibbler.MailMessage{
+		From:             &nibbler.EmailAddress{Name: s.InvitationFromName, Address: s.InvitationFromEmail},
+		To:               []*nibbler.EmailAddress{{Address: invitation.Email, Name: data.Name}},
+		Subject:          rendered.Subject,
+		PlainTextContent: rendered.PlainTextContent,
+		HtmlContent:      rendered.HtmlContent,
+	}
+
+	// sent before responding, so the inviter hears about failures (a queueing Sender only has to accept it)
+	if _, err := nibbler.ToMessageSender(s.Sender).SendMessage(r.Context(), message); err != nil {
+		s.Logger.Error("while sending " + InvitationTemplate + " email, error = " + err.Error())
+		return err
+	}
+	return nil
+}
+
+// invitationToken returns "<invitation ID>.<expiry>.<signature>" - the signature (an HMAC of the rest) means the token
+// can't be forged or have its expiry changed, without storing it
+func (s *Extension) invitationToken(invitation nibbler.GroupInvitation) string {
+	payload := invitation.ID + "." + strconv.FormatInt(invitation.ExpiresAt.Unix(), 10)
+	return payload + "." + s.signInvitation(payload)
+}
+
+func (s *Extension) signInvitation(payload string) string {
+	mac := hmac.New(sha256.New, s.InvitationKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GetInvitationForToken verifies the token, and returns the (pending) invitation it is for
+func (s *Extension) GetInvitationForToken(token string) (*nibbler.GroupInvitation, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidInvitation
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(s.signInvitation(payload)), []byte(parts[2])) {
+		return nil, ErrInvalidInvitation
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return nil, ErrInvalidInvitation
+	}
+
+	invitation, err := s.invitations().GetGroupInvitation(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if invitation == nil || !invitation.IsPending() {
+		return nil, ErrInvalidInvitation
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation makes the user a member of the invitation's group, with its role.  Invitations can only be
+// accepted by a user with the invited email address.  Users who are already members keep their role (whether the
+// invitation's is higher or lower) - roles are changed through memberships, by someone allowed to grant them
+func (s *Extension) AcceptInvitation(token string, invitee *nibbler.User) (*nibbler.GroupMembership, error) {
+	invitation, err := s.GetInvitationForToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if invitee.Email == nil || !strings.EqualFold(*invitee.Email, invitation.Email) {
+		return nil, ErrInvalidInvitation
+	}
+
+	if group, err := s.GetGroup(invitation.GroupID, false); err != nil {
+		return nil, err
+	} else if group == nil {
+		return nil, ErrInvalidInvitation
+	}
+
+	membership, err := s.getGroupMembership(invitation.GroupID, invitee.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if membership == nil {
+		created, err := s.SetGroupMembership(invitation.GroupID, invitee.ID, invitation.Role)
+		if err != nil {
+			return nil, err
+		}
+		membership = &created
+	}
+
+	now := time.Now()
+	invitation.AcceptedAt = &now
+	invitation.AcceptedBy = &invitee.ID
+	return membership, s.invitations().UpdateGroupInvitation(*invitation)
+}
+
+// DeclineInvitation marks the invitation as declined - anyone with the token can decline it
+func (s *Extension) DeclineInvitation(token string) error {
+	invitation, err := s.GetInvitationForToken(token)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	invitation.DeclinedAt = &now
+	return s.invitations().UpdateGroupInvitation(*invitation)
+}
+
+// CreateGroupInvitationRequestHandler invites the email address in the body (with the role in the body, or "member")
+// to the group with the "groupId" path param.  Like memberships, callers can only invite with roles they could grant
+func (s *Extension) CreateGroupInvitationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	if r.Body == nil {
+		nibbler.Write500Json(w, "no body provided")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	email := strings.TrimSpace(body.Email)
+	if !strings.Contains(email, "@") {
+		nibbler.Write500Json(w, "a valid email is required")
+		return
+	}
+
+	if body.Role == "" {
+		body.Role = MemberRole
+	}
+
+	group, err := s.GetGroup(mux.Vars(r)["groupId"], false)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if group == nil {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if !s.checkGrantableRole(w, r, group.ID, body.Role) {
+		return
+	}
+
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if caller == nil {
+		nibbler.Write401Json(w)
+		return
+	}
+
+	invitation, err := s.Invite(r, *group, email, body.Role, caller)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, invitation, http.StatusOK)
+}
+
+// ListGroupInvitationsRequestHandler responds with the pending invitations of the group with the "groupId" path param
+func (s *Extension) ListGroupInvitationsRequestHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := s.invitations().GetGroupInvitations(mux.Vars(r)["groupId"])
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	pending := []nibbler.GroupInvitation{}
+	for _, invitation := range invitations {
+		if invitation.IsPending() {
+			pending = append(pending, invitation)
+		}
+	}
+
+	nibbler.WriteStructToJson(w, pending, http.StatusOK)
+}
+
+// RevokeGroupInvitationRequestHandler revokes the invitation with the "invitationId" path param, from the group with
+// the "groupId" path param
+func (s *Extension) RevokeGroupInvitationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	invitation, err := s.invitations().GetGroupInvitation(vars["invitationId"])
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if invitation == nil || invitation.GroupID != vars["groupId"] || !invitation.IsPending() {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	now := time.Now()
+	invitation.RevokedAt = &now
+	if err := s.invitations().UpdateGroupInvitation(*invitation); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
+
+// AcceptGroupInvitationRequestHandler accepts the invitation with the "token" form value for the caller, responding
+// with the new membership
+func (s *Extension) AcceptGroupInvitationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if caller == nil {
+		nibbler.Write401Json(w)
+		return
+	}
+
+	// load the caller, as the session's copy may not have their latest email
+	invitee, err := s.UserExtension.GetUserById(caller.ID)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if invitee == nil {
+		nibbler.Write401Json(w)
+		return
+	}
+
+	membership, err := s.AcceptInvitation(r.FormValue("token"), invitee)
+	if err == ErrInvalidInvitation {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, membership, http.StatusOK)
+}
+
+// DeclineGroupInvitationRequestHandler declines the invitation with the "token" form value - it doesn't require the
+// invitee to have an account
+func (s *Extension) DeclineGroupInvitationRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.DeclineInvitation(r.FormValue("token")); err == ErrInvalidInvitation {
+		nibbler.Write404Json(w)
+		return
+	} else if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
@@ -0,0 +1,208 @@
+package nibbler_user_group
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/mail/memory"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newInvitationTestApp(t *testing.T) (*testApp, *memory.Sender) {
+	sender := &memory.Sender{}
+	a := newTestAppWith(t, func(e *Extension) {
+		e.InvitationsEnabled = true
+		e.Sender = sender
+		e.InvitationKey = []byte("test-key")
+		e.InvitationRedirect = "https://example.com/invitation"
+		e.InvitationFromEmail = "groups@example.com"
+	})
+	return a, sender
+}
+
+// invitationToken pulls the token out of the link in the last invitation email
+func invitationToken(t *testing.T, sender *memory.Sender, count int) string {
+	if len(sender.Messages()) < count {
+		t.Fatal("no invitation was sent")
+	}
+	return strings.Fields(strings.SplitN(sender.Last().PlainTextContent, "?token=", 2)[1])[0]
+}
+
+func (a *testApp) invite(t *testing.T, groupId string, email string, role string) nibbler.GroupInvitation {
+	res := a.send(a.admin, "PUT", "/api/group/"+groupId+"/invitation", `{"email": "`+email+`", "role": "`+role+`"}`)
+	if res.Code != http.StatusOK {
+		t.Fatal("the invitation was not created: " + res.Body.String())
+	}
+
+	var invitation nibbler.GroupInvitation
+	if err := json.Unmarshal(res.Body.Bytes(), &invitation); err != nil {
+		t.Fatal(err)
+	}
+	return invitation
+}
+
+func TestExtension_InitChecksInvitations(t *testing.T) {
+	e := Extension{PersistenceExtension: &MockPersistenceExtension{}, InvitationsEnabled: true}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err == nil {
+		t.Fatal("invitations were enabled without a mail sender")
+	}
+}
+
+type unavailableSender struct{}
+
+func (u unavailableSender) SendMail(from *nibbler.EmailAddress, subject string, to []*nibbler.EmailAddress, plainTextContent string, htmlContent string) (*nibbler.MailSendResponse, error) {
+	return nil, errors.New("mail server unavailable")
+}
+
+func TestExtension_InviteReportsSendFailures(t *testing.T) {
+	a, _ := newInvitationTestApp(t)
+	group := a.createGroup(t, "editors")
+	sent := a.invite(t, group.ID, "new@example.com", MemberRole)
+	a.extension.Sender = unavailableSender{}
+
+	res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/invitation", `{"email": "new@example.com"}`)
+	if res.Code != http.StatusInternalServerError {
+		t.Fatal("an invitation that could not be sent was reported as sent")
+	}
+
+	// the invitation that was never sent isn't left pending, and the one that was sent still works
+	invitations, err := a.extension.invitations().GetGroupInvitations(group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invitation := range invitations {
+		if invitation.IsPending() != (invitation.ID == sent.ID) {
+			t.Fatal("a failed send changed which invitations are pending")
+		}
+	}
+}
+
+func TestExtension_AcceptInvitation(t *testing.T) {
+	a, sender := newInvitationTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	// invitees don't need an account yet
+	invitation := a.invite(t, group.ID, "carol@example.com", ViewerRole)
+	token := invitationToken(t, sender, 1)
+
+	if sender.Last().To[0].Address != "carol@example.com" || !strings.Contains(sender.Last().Subject, "editors") {
+		t.Fatal("the invitation email was wrong")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/"+group.ID+"/invitation", ""); !strings.Contains(res.Body.String(), invitation.ID) {
+		t.Fatal("the pending invitation was not listed")
+	}
+
+	email := "Carol@example.com"
+	carol, err := a.extension.UserExtension.Create(&nibbler.User{Email: &email})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the invited address can accept, and only with an untampered token
+	accept := func(caller *nibbler.User, token string) int {
+		return a.send(caller, "POST", "/api/group/invitation/accept?"+url.Values{"token": {token}}.Encode(), "").Code
+	}
+
+	if accept(a.member, token) != http.StatusNotFound {
+		t.Fatal("an invitation was accepted by someone else")
+	}
+
+	if accept(carol, token[:len(token)-2]+"xx") != http.StatusNotFound {
+		t.Fatal("a tampered token was accepted")
+	}
+
+	if accept(nil, token) != http.StatusUnauthorized {
+		t.Fatal("an invitation was accepted without logging in")
+	}
+
+	if accept(carol, token) != http.StatusOK {
+		t.Fatal("the invitation was not accepted")
+	}
+
+	memberships, _ := a.extension.GetGroupMembershipsForUser(carol.ID)
+	if len(memberships) != 1 || memberships[0].GroupID != group.ID || memberships[0].Role != ViewerRole {
+		t.Fatal("the membership was not created with the invited role")
+	}
+
+	if accept(carol, token) != http.StatusNotFound {
+		t.Fatal("an invitation was accepted twice")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/"+group.ID+"/invitation", ""); res.Body.String() != "[]" {
+		t.Fatal("an accepted invitation was listed as pending")
+	}
+}
+
+func TestExtension_AcceptInvitationKeepsExistingRole(t *testing.T) {
+	a, sender := newInvitationTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	email := "dave@example.com"
+	dave, err := a.extension.UserExtension.Create(&nibbler.User{Email: &email})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.extension.SetGroupMembership(group.ID, dave.ID, OwnerRole); err != nil {
+		t.Fatal(err)
+	}
+
+	// an owner accepting an invitation with a lower role isn't demoted
+	a.invite(t, group.ID, email, ViewerRole)
+	token := invitationToken(t, sender, 1)
+	if res := a.send(dave, "POST", "/api/group/invitation/accept?"+url.Values{"token": {token}}.Encode(), ""); res.Code != http.StatusOK {
+		t.Fatal("the invitation was not accepted: " + res.Body.String())
+	}
+
+	memberships, _ := a.extension.GetGroupMembershipsForUser(dave.ID)
+	if len(memberships) != 1 || memberships[0].Role != OwnerRole {
+		t.Fatal("accepting an invitation changed an existing member's role")
+	}
+}
+
+func TestExtension_DeclineAndRevokeInvitations(t *testing.T) {
+	a, sender := newInvitationTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	a.invite(t, group.ID, "dave@example.com", MemberRole)
+	first := invitationToken(t, sender, 1)
+
+	// inviting the address again revokes the first invitation
+	second := a.invite(t, group.ID, "dave@example.com", MemberRole)
+	token := invitationToken(t, sender, 2)
+
+	decline := func(token string) int {
+		return a.send(nil, "POST", "/api/group/invitation/decline?"+url.Values{"token": {token}}.Encode(), "").Code
+	}
+
+	if decline(first) != http.StatusNotFound {
+		t.Fatal("a replaced invitation could still be used")
+	}
+
+	if decline(token) != http.StatusOK || decline(token) != http.StatusNotFound {
+		t.Fatal("the invitation was not declined exactly once")
+	}
+
+	third := a.invite(t, group.ID, "erin@example.com", MemberRole)
+	if res := a.send(a.admin, "DELETE", "/api/group/"+group.ID+"/invitation/"+second.ID, ""); res.Code != http.StatusNotFound {
+		t.Fatal("a declined invitation was revoked")
+	}
+
+	if res := a.send(a.admin, "DELETE", "/api/group/"+group.ID+"/invitation/"+third.ID, ""); res.Code != http.StatusOK {
+		t.Fatal("the invitation was not revoked")
+	}
+
+	if decline(invitationToken(t, sender, 3)) != http.StatusNotFound {
+		t.Fatal("a revoked invitation could still be used")
+	}
+
+	// callers can't invite with roles they couldn't grant
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/invitation", `{"email": "frank@example.com", "role": "superuser"}`); res.Code == http.StatusOK {
+		t.Fatal("an invitation was created with an unknown role")
+	}
+}
@@ -7,11 +7,16 @@ import (
 	"github.com/markdicksonjr/nibbler"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 // SetGroupMembership upserts the group membership record for a given user and group
 func (s *Extension) SetGroupMembership(groupId, userId string, role string) (nibbler.GroupMembership, error) {
-	return s.PersistenceExtension.SetGroupMembership(groupId, userId, role)
+	membership, err := s.PersistenceExtension.SetGroupMembership(groupId, userId, role)
+	if err == nil {
+		s.InvalidateUserDecisions(userId)
+	}
+	return membership, err
 }
 
 // GetGroupMembershipsForUser lists the groups to which the user (with the provided ID) belongs
@@ -19,6 +24,21 @@ func (s *Extension) GetGroupMembershipsForUser(userId string) ([]nibbler.GroupMe
 	return s.PersistenceExtension.GetGroupMembershipsForUser(userId)
 }
 
+// getGroupMembership returns the user's own membership of the group, or nil if they aren't a member
+func (s *Extension) getGroupMembership(groupId, userId string) (*nibbler.GroupMembership, error) {
+	memberships, err := s.GetGroupMembershipsForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, membership := range memberships {
+		if membership.GroupID == groupId {
+			return &membership, nil
+		}
+	}
+	return nil, nil
+}
+
 // CreateGroupMembershipRequestHandler will handle an http request with path param "groupId", and a membership request body
 func (s *Extension) CreateGroupMembershipRequestHandler(w http.ResponseWriter, r *http.Request) {
 	membership, err := getMembershipFromBody(r)
@@ -28,15 +48,18 @@ func (s *Extension) CreateGroupMembershipRequestHandler(w http.ResponseWriter, r
 	}
 
 	if membership.MemberID == "" {
-		nibbler.Write500Json(w, "{\"error\":\"no member ID provided\"")
+		nibbler.Write500Json(w, "no member ID provided")
 		return
 	}
 
 	membership.GroupID = mux.Vars(r)["groupId"]
 
-	// role is optional
+	// role is optional, but must be defined for the group, and the caller can't hand out a role with actions they lack
+	if membership.Role != "" && !s.checkGrantableRole(w, r, membership.GroupID, membership.Role) {
+		return
+	}
 
-	result, err := s.PersistenceExtension.SetGroupMembership(membership.GroupID, membership.MemberID, membership.Role)
+	result, err := s.SetGroupMembership(membership.GroupID, membership.MemberID, membership.Role)
 	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
@@ -51,6 +74,79 @@ func (s *Extension) CreateGroupMembershipRequestHandler(w http.ResponseWriter, r
 	nibbler.Write200Json(w, string(resultJson))
 }
 
+// checkGrantableRole validates that the role is defined for the group, and that the caller has every action it
+// includes on the group, writing a response and returning false if not.  Without role support, roles are just labels,
+// so any role can be given
+func (s *Extension) checkGrantableRole(w http.ResponseWriter, r *http.Request, groupId string, name string) bool {
+	if !s.SupportsRoles() {
+		return true
+	}
+
+	role, err := s.GetRole(groupId, name)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return false
+	}
+
+	if role == nil {
+		nibbler.Write500Json(w, "unknown role "+name)
+		return false
+	}
+
+	if has, err := s.callerHasActions(r, groupId, strings.Fields(role.Actions)); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return false
+	} else if !has {
+		nibbler.Write404Json(w)
+		return false
+	}
+	return true
+}
+
+// RemoveGroupMember removes the user from the group, clearing their current group if it was this one
+func (s *Extension) RemoveGroupMember(groupId, userId string) error {
+	if err := s.PersistenceExtension.DeleteGroupMembership(groupId, userId); err != nil {
+		return err
+	}
+	s.InvalidateUserDecisions(userId)
+
+	u, err := s.UserExtension.GetUserById(userId)
+	if err != nil || u == nil || u.CurrentGroupID == nil || *u.CurrentGroupID != groupId {
+		return err
+	}
+
+	u.CurrentGroupID = nil
+	return s.UserExtension.Update(u)
+}
+
+// ListGroupMembershipsRequestHandler responds with the memberships of the group with the "groupId" path param
+func (s *Extension) ListGroupMembershipsRequestHandler(w http.ResponseWriter, r *http.Request) {
+	memberships, err := s.PersistenceExtension.GetGroupMemberships(mux.Vars(r)["groupId"])
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if memberships == nil {
+		memberships = []nibbler.GroupMembership{}
+	}
+
+	nibbler.WriteStructToJson(w, memberships, http.StatusOK)
+}
+
+// RemoveGroupMembershipRequestHandler removes the member with the "memberId" path param from the group with the
+// "groupId" path param
+func (s *Extension) RemoveGroupMembershipRequestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := s.RemoveGroupMember(vars["groupId"], vars["memberId"]); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.Write200Json(w, `{"result": "ok"}`)
+}
+
 // getMembershipFromBody parses the request body into a GroupMembership struct
 func getMembershipFromBody(r *http.Request) (*nibbler.GroupMembership, error) {
 	if r.Body == nil {
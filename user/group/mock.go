@@ -0,0 +1,534 @@
+package nibbler_user_group
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/markdicksonjr/nibbler"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockPersistenceExtension is an in-memory PersistenceExtension (and RolePersistenceExtension and
+// InvitationPersistenceExtension), for tests and prototyping.  Transactions are not isolated (changes are applied immediately, and rollback does nothing)
+type MockPersistenceExtension struct {
+	nibbler.NoOpExtension
+
+	groups      map[string]nibbler.Group
+	memberships map[string]nibbler.GroupMembership
+	privileges  map[string]nibbler.GroupPrivilege
+	roles       map[string]nibbler.GroupRole
+	invitations map[string]nibbler.GroupInvitation
+	mutex       sync.RWMutex
+}
+
+func (m *MockPersistenceExtension) StartTransaction() (PersistenceExtension, error) {
+	return m, nil
+}
+
+func (m *MockPersistenceExtension) RollbackTransaction() error {
+	return nil
+}
+
+func (m *MockPersistenceExtension) CommitTransaction() error {
+	return nil
+}
+
+func (m *MockPersistenceExtension) GetGroupMembershipsForUser(id string) ([]nibbler.GroupMembership, error) {
+	return m.findMemberships(func(membership nibbler.GroupMembership) bool {
+		return membership.MemberID == id
+	}), nil
+}
+
+func (m *MockPersistenceExtension) GetGroupMemberships(groupId string) ([]nibbler.GroupMembership, error) {
+	return m.findMemberships(func(membership nibbler.GroupMembership) bool {
+		return membership.GroupID == groupId
+	}), nil
+}
+
+func (m *MockPersistenceExtension) SetGroupMembership(groupId string, userId string, role string) (nibbler.GroupMembership, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.allocate()
+
+	now := time.Now()
+	for id, membership := range m.memberships {
+		if membership.GroupID == groupId && membership.MemberID == userId && membership.DeletedAt == nil {
+			membership.Role = role
+			membership.UpdatedAt = now
+			m.memberships[id] = membership
+			return membership, nil
+		}
+	}
+
+	membership := nibbler.GroupMembership{
+		ID:        uuid.New().String(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		GroupID:   groupId,
+		MemberID:  userId,
+		Role:      role,
+	}
+	m.memberships[membership.ID] = membership
+	return membership, nil
+}
+
+func (m *MockPersistenceExtension) DeleteGroupMembership(groupId string, userId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, membership := range m.memberships {
+		if membership.GroupID == groupId && membership.MemberID == userId {
+			delete(m.memberships, id)
+		}
+	}
+	return nil
+}
+
+func (m *MockPersistenceExtension) GetGroupAncestors(groupId string) ([]nibbler.Group, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var ancestors []nibbler.Group
+	visited := map[string]bool{groupId: true}
+
+	group, ok := m.groups[groupId]
+	for ok && group.ParentID != nil && !visited[*group.ParentID] {
+		visited[*group.ParentID] = true
+
+		// a deleted group cuts the tree
+		group, ok = m.groups[*group.ParentID]
+		if !ok || group.DeletedAt != nil {
+			break
+		}
+		ancestors = append(ancestors, group)
+	}
+	return ancestors, nil
+}
+
+func (m *MockPersistenceExtension) GetGroupDescendants(groupId string) ([]nibbler.Group, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var descendants []nibbler.Group
+	visited := map[string]bool{groupId: true}
+	for queue := []string{groupId}; len(queue) > 0; queue = queue[1:] {
+		for id, group := range m.groups {
+			if group.ParentID != nil && *group.ParentID == queue[0] && group.DeletedAt == nil && !visited[id] {
+				visited[id] = true
+				descendants = append(descendants, group)
+				queue = append(queue, id)
+			}
+		}
+	}
+
+	sortByCreation(descendants, func(i int) (time.Time, string) {
+		return descendants[i].CreatedAt, descendants[i].ID
+	})
+	return descendants, nil
+}
+
+func (m *MockPersistenceExtension) CreateGroup(group nibbler.Group) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.allocate()
+
+	if _, ok := m.groups[group.ID]; ok {
+		return errors.New("a group with ID " + group.ID + " already exists")
+	}
+
+	now := time.Now()
+	group.CreatedAt = now
+	group.UpdatedAt = now
+	group.Privileges = nil
+	m.groups[group.ID] = group
+	return nil
+}
+
+func (m *MockPersistenceExtension) UpdateGroup(group nibbler.Group) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	existing, ok := m.groups[group.ID]
+	if !ok || existing.DeletedAt != nil {
+		return errors.New("no group with ID " + group.ID + " exists")
+	}
+
+	existing.Name = group.Name
+	existing.Type = group.Type
+	existing.ParentID = group.ParentID
+	existing.Context = group.Context
+	existing.UpdatedAt = time.Now()
+	m.groups[group.ID] = existing
+	return nil
+}
+
+func (m *MockPersistenceExtension) DeleteGroup(groupId string, hardDelete bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	group, ok := m.groups[groupId]
+	if !ok {
+		return errors.New("no group with ID " + groupId + " exists")
+	}
+
+	if !hardDelete {
+		now := time.Now()
+		group.DeletedAt = &now
+		m.groups[groupId] = group
+		return nil
+	}
+
+	// a hard delete takes the group's memberships, privileges and roles with it
+	delete(m.groups, groupId)
+	for id, membership := range m.memberships {
+		if membership.GroupID == groupId {
+			delete(m.memberships, id)
+		}
+	}
+
+	for id, privilege := range m.privileges {
+		if privilege.GroupID == groupId || privilege.ResourceID == groupId {
+			delete(m.privileges, id)
+		}
+	}
+
+	for id, role := range m.roles {
+		if role.GroupID == groupId {
+			delete(m.roles, id)
+		}
+	}
+
+	// and its children move up to the top level
+	for id, child := range m.groups {
+		if child.ParentID != nil && *child.ParentID == groupId {
+			child.ParentID = nil
+			m.groups[id] = child
+		}
+	}
+	return nil
+}
+
+// SearchGroups matches the query's text against group names (ignoring case), and supports the "type" and "parentId"
+// filters, sorting by name, type, createdAt and updatedAt, and paging
+func (m *MockPersistenceExtension) SearchGroups(query nibbler.SearchParameters, includePrivileges bool) (*nibbler.SearchResults, error) {
+	search := query.GetSearchQuery()
+
+	m.mutex.RLock()
+	var ids []string
+	for id, group := range m.groups {
+		parentId := ""
+		if group.ParentID != nil {
+			parentId = *group.ParentID
+		}
+
+		if group.DeletedAt != nil || !strings.Contains(strings.ToLower(group.Name), strings.ToLower(search.Text)) {
+			continue
+		}
+
+		if value, ok := search.Filters["type"]; ok && group.Type != value {
+			continue
+		}
+
+		if value, ok := search.Filters["parentId"]; ok && parentId != value {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	m.mutex.RUnlock()
+
+	groups, err := m.GetGroupsById(ids, includePrivileges)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(query.SortBy) - 1; i >= 0; i-- {
+		sortBy := query.SortBy[i]
+		sort.SliceStable(groups, func(a, b int) bool {
+			first, second := groups[a], groups[b]
+			if !sortBy.IsAscending {
+				first, second = second, first
+			}
+
+			switch sortBy.Field {
+			case "name":
+				return first.Name < second.Name
+			case "type":
+				return first.Type < second.Type
+			case "updatedAt":
+				return first.UpdatedAt.Before(second.UpdatedAt)
+			default:
+				return first.CreatedAt.Before(second.CreatedAt)
+			}
+		})
+	}
+
+	total := len(groups)
+	offset := 0
+	if query.Offset != nil && *query.Offset < total {
+		offset = *query.Offset
+	} else if query.Offset != nil {
+		offset = total
+	}
+
+	end := total
+	if query.Size != nil && offset+*query.Size < end {
+		end = offset + *query.Size
+	}
+
+	results := nibbler.SearchResults{Hits: groups[offset:end], Offset: &offset}
+	if query.IncludeTotal {
+		results.Total = &total
+	}
+	return &results, nil
+}
+
+func (m *MockPersistenceExtension) GetGroupsById(ids []string, includePrivileges bool) ([]nibbler.Group, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var groups []nibbler.Group
+	for _, id := range ids {
+		group, ok := m.groups[id]
+		if !ok || group.DeletedAt != nil {
+			continue
+		}
+
+		if includePrivileges {
+			group.Privileges = []nibbler.GroupPrivilege{}
+			for _, privilege := range m.privileges {
+				if privilege.GroupID == id && privilege.DeletedAt == nil {
+					group.Privileges = append(group.Privileges, privilege)
+				}
+			}
+			sortByCreation(group.Privileges, func(i int) (time.Time, string) {
+				return group.Privileges[i].CreatedAt, group.Privileges[i].ID
+			})
+		}
+		groups = append(groups, group)
+	}
+
+	sortByCreation(groups, func(i int) (time.Time, string) {
+		return groups[i].CreatedAt, groups[i].ID
+	})
+	return groups, nil
+}
+
+func (m *MockPersistenceExtension) AddPrivilegeToGroups(groupIdList []string, resourceId string, action string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.allocate()
+
+	now := time.Now()
+	for _, groupId := range groupIdList {
+		privilege := nibbler.GroupPrivilege{
+			ID:         uuid.New().String(),
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			GroupID:    groupId,
+			ResourceID: resourceId,
+			Action:     action,
+		}
+		m.privileges[privilege.ID] = privilege
+	}
+	return nil
+}
+
+// GetPrivilegesForAction returns the group's privileges for the action - on the resource, or resource-agnostic ones
+// (with a blank ResourceID) if resourceId is nil
+func (m *MockPersistenceExtension) GetPrivilegesForAction(groupId string, resourceId *string, action string) ([]nibbler.GroupPrivilege, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	target := ""
+	if resourceId != nil {
+		target = *resourceId
+	}
+
+	var privileges []nibbler.GroupPrivilege
+	for _, privilege := range m.privileges {
+		if privilege.GroupID == groupId && privilege.Action == action && privilege.ResourceID == target && privilege.DeletedAt == nil {
+			privileges = append(privileges, privilege)
+		}
+	}
+	return privileges, nil
+}
+
+func (m *MockPersistenceExtension) DeletePrivilege(id string, hardDelete bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	privilege, ok := m.privileges[id]
+	if !ok {
+		return errors.New("no privilege with ID " + id + " exists")
+	}
+
+	if hardDelete {
+		delete(m.privileges, id)
+		return nil
+	}
+
+	now := time.Now()
+	privilege.DeletedAt = &now
+	m.privileges[id] = privilege
+	return nil
+}
+
+func (m *MockPersistenceExtension) GetGroupRoles(groupId string) ([]nibbler.GroupRole, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var roles []nibbler.GroupRole
+	for _, role := range m.roles {
+		if role.GroupID == groupId && role.DeletedAt == nil {
+			roles = append(roles, role)
+		}
+	}
+
+	sortByCreation(roles, func(i int) (time.Time, string) {
+		return roles[i].CreatedAt, roles[i].ID
+	})
+	return roles, nil
+}
+
+func (m *MockPersistenceExtension) CreateGroupRole(role nibbler.GroupRole) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.allocate()
+
+	if _, ok := m.roles[role.ID]; ok {
+		return errors.New("a role with ID " + role.ID + " already exists")
+	}
+
+	now := time.Now()
+	role.CreatedAt = now
+	role.UpdatedAt = now
+	m.roles[role.ID] = role
+	return nil
+}
+
+func (m *MockPersistenceExtension) UpdateGroupRole(role nibbler.GroupRole) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	existing, ok := m.roles[role.ID]
+	if !ok || existing.DeletedAt != nil {
+		return errors.New("no role with ID " + role.ID + " exists")
+	}
+
+	existing.Name = role.Name
+	existing.Actions = role.Actions
+	existing.UpdatedAt = time.Now()
+	m.roles[role.ID] = existing
+	return nil
+}
+
+func (m *MockPersistenceExtension) DeleteGroupRole(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.roles[id]; !ok {
+		return errors.New("no role with ID " + id + " exists")
+	}
+
+	delete(m.roles, id)
+	return nil
+}
+
+func (m *MockPersistenceExtension) CreateGroupInvitation(invitation nibbler.GroupInvitation) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.allocate()
+
+	if _, ok := m.invitations[invitation.ID]; ok {
+		return errors.New("an invitation with ID " + invitation.ID + " already exists")
+	}
+
+	now := time.Now()
+	invitation.CreatedAt = now
+	invitation.UpdatedAt = now
+	m.invitations[invitation.ID] = invitation
+	return nil
+}
+
+func (m *MockPersistenceExtension) GetGroupInvitation(id string) (*nibbler.GroupInvitation, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	invitation, ok := m.invitations[id]
+	if !ok || invitation.DeletedAt != nil {
+		return nil, nil
+	}
+	return &invitation, nil
+}
+
+func (m *MockPersistenceExtension) GetGroupInvitations(groupId string) ([]nibbler.GroupInvitation, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var invitations []nibbler.GroupInvitation
+	for _, invitation := range m.invitations {
+		if invitation.GroupID == groupId && invitation.DeletedAt == nil {
+			invitations = append(invitations, invitation)
+		}
+	}
+
+	sortByCreation(invitations, func(i int) (time.Time, string) {
+		return invitations[i].CreatedAt, invitations[i].ID
+	})
+	return invitations, nil
+}
+
+func (m *MockPersistenceExtension) UpdateGroupInvitation(invitation nibbler.GroupInvitation) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.invitations[invitation.ID]; !ok {
+		return errors.New("no invitation with ID " + invitation.ID + " exists")
+	}
+
+	invitation.UpdatedAt = time.Now()
+	m.invitations[invitation.ID] = invitation
+	return nil
+}
+
+// allocate creates the maps on first use - the caller must hold the write lock
+func (m *MockPersistenceExtension) allocate() {
+	if m.groups == nil {
+		m.groups = make(map[string]nibbler.Group)
+		m.memberships = make(map[string]nibbler.GroupMembership)
+		m.privileges = make(map[string]nibbler.GroupPrivilege)
+		m.roles = make(map[string]nibbler.GroupRole)
+		m.invitations = make(map[string]nibbler.GroupInvitation)
+	}
+}
+
+func (m *MockPersistenceExtension) findMemberships(matches func(membership nibbler.GroupMembership) bool) []nibbler.GroupMembership {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var memberships []nibbler.GroupMembership
+	for _, membership := range m.memberships {
+		if membership.DeletedAt == nil && matches(membership) {
+			memberships = append(memberships, membership)
+		}
+	}
+
+	sortByCreation(memberships, func(i int) (time.Time, string) {
+		return memberships[i].CreatedAt, memberships[i].ID
+	})
+	return memberships
+}
+
+// sortByCreation orders a slice by creation time (then ID), as map order is random
+func sortByCreation(slice interface{}, key func(i int) (time.Time, string)) {
+	sort.SliceStable(slice, func(a, b int) bool {
+		aTime, aID := key(a)
+		bTime, bID := key(b)
+		if aTime.Equal(bTime) {
+			return aID < bID
+		}
+		return aTime.Before(bTime)
+	})
+}
@@ -0,0 +1,348 @@
+package nibbler_user_group
+
+import (
+	"context"
+	"github.com/markdicksonjr/nibbler"
+	"github.com/markdicksonjr/nibbler/user"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Effect is what a policy does to the requests it applies to
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// Policy allows (or denies) subjects some actions on some resources, when all of its conditions hold.  Subjects,
+// actions and resources are patterns - "*" matches anything, a trailing "*" matches by prefix (e.g. "document:*"), and
+// anything else must match exactly.  An empty list matches everything.  The resource-agnostic resource is "", which
+// only "*" (or an empty list) matches
+type Policy struct {
+	Name       string      // identifies the policy in decisions
+	Effect     Effect      // Allow or Deny
+	Subjects   []string    // "user:<id>", "group:<id>" (the subject's privilege groups) or "role:<name>" (any membership)
+	Actions    []string    // e.g. "read-document" or "document:*"
+	Resources  []string    // e.g. a resource ID, or "document:*"
+	Conditions []Condition // every condition must hold for the policy to apply
+}
+
+// Condition states whether a policy applies to the request
+type Condition func(ctx context.Context, request *AuthorizationRequest) (bool, error)
+
+// AuthorizationRequest is what a policy is evaluated against
+type AuthorizationRequest struct {
+	Subject  *nibbler.User // as loaded from persistence
+	Action   string
+	Resource string    // blank for resource-agnostic actions
+	Time     time.Time // when the request was made
+	IP       net.IP    // the client's IP, if known
+}
+
+// Decision is the result of Authorize, with the rule that decided it
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule"` // "policy:<name>", "privilege", "global-privilege", "role" or "default"
+	Reason  string `json:"reason"`
+}
+
+// RequestAttributes are the attributes of a request that conditions can use, beyond the subject, action and resource
+type RequestAttributes struct {
+	Time time.Time // the current time if zero
+	IP   net.IP
+}
+
+type requestAttributesKey struct{}
+
+// WithRequestAttributes returns a context carrying the attributes, for Authorize
+func WithRequestAttributes(ctx context.Context, attributes RequestAttributes) context.Context {
+	return context.WithValue(ctx, requestAttributesKey{}, attributes)
+}
+
+// RequestAttributesFromRequest gets the attributes of an http request.  The IP comes from RemoteAddr, so behind a
+// proxy, use a middleware that sets RemoteAddr from the forwarding headers the proxy is trusted to set
+func RequestAttributesFromRequest(r *http.Request) RequestAttributes {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return RequestAttributes{Time: time.Now(), IP: net.ParseIP(host)}
+}
+
+// Authorize decides whether the subject can perform the action on the resource (or, with a blank resource, the
+// resource-agnostic action).  In order:
+//
+// - a Deny policy that applies denies the request
+// - an Allow policy that applies allows it
+// - a privilege of one of the subject's groups on the resource (or a group above it) allows it
+// - the subject's role in the resource group (or a group above it) allows it, if the role includes the action
+// - a resource-agnostic privilege of one of the subject's groups allows it
+//
+// and otherwise, the request is denied.  Request attributes (e.g. the IP) come from the context - see
+// WithRequestAttributes.  With ExplainDecisions set, every decision is logged.  With DecisionCacheTTL set, users and
+// privilege decisions are cached (policies are always evaluated, as their conditions can change per request)
+func (s *Extension) Authorize(ctx context.Context, subject *nibbler.User, action string, resource string) (Decision, error) {
+	decision, err := s.decide(ctx, subject, action, resource)
+	if err == nil && s.ExplainDecisions && s.Logger != nil {
+		subjectId := ""
+		if subject != nil {
+			subjectId = subject.ID
+		}
+
+		s.Logger.Debug("authorization of " + action + " on \"" + resource + "\" for user " + subjectId + ": allowed = " +
+			strconv.FormatBool(decision.Allowed) + " by " + decision.Rule + " (" + decision.Reason + ")")
+	}
+	return decision, err
+}
+
+func (s *Extension) decide(ctx context.Context, subject *nibbler.User, action string, resource string) (Decision, error) {
+	if subject == nil {
+		return Decision{Rule: "default", Reason: "there is no subject"}, nil
+	}
+
+	// load the user, as the caller may be out of date (e.g. their current group)
+	userFromDb, err := s.getUser(subject.ID)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if userFromDb == nil {
+		return Decision{Rule: "default", Reason: "the subject does not exist"}, nil
+	}
+
+	// deactivated users may still have a (not yet revoked) token or key, so deny them whatever it says
+	if !user.IsUserActive(*userFromDb) {
+		return Decision{Rule: "default", Reason: "the subject is deactivated"}, nil
+	}
+
+	attributes, _ := ctx.Value(requestAttributesKey{}).(RequestAttributes)
+	if attributes.Time.IsZero() {
+		attributes.Time = time.Now()
+	}
+
+	request := &AuthorizationRequest{
+		Subject:  userFromDb,
+		Action:   action,
+		Resource: resource,
+		Time:     attributes.Time,
+		IP:       attributes.IP,
+	}
+
+	// explicit denies win over everything, then explicit allows
+	subjects := &policySubjects{}
+	for _, effect := range []Effect{Deny, Allow} {
+		for _, policy := range s.Policies {
+			if policy.Effect != effect {
+				continue
+			}
+
+			if applies, err := s.policyApplies(ctx, policy, request, subjects); err != nil {
+				return Decision{}, err
+			} else if applies {
+				return Decision{
+					Allowed: effect == Allow,
+					Rule:    "policy:" + policy.Name,
+					Reason:  "the policy " + string(effect) + "s " + action,
+				}, nil
+			}
+		}
+	}
+
+	return s.cachedPrivilegeDecision(userFromDb, action, resource)
+}
+
+// privilegeDecision decides from the user's privileges and roles, once no policy applies
+func (s *Extension) privilegeDecision(userFromDb *nibbler.User, action string, resource string) (Decision, error) {
+	if resource != "" {
+		resourceIds, err := s.withAncestors(resource)
+		if err != nil {
+			return Decision{}, err
+		}
+
+		if has, err := s.userHasPrivilege(userFromDb, resourceIds, action); err != nil {
+			return Decision{}, err
+		} else if has {
+			return Decision{Allowed: true, Rule: "privilege", Reason: "a group of the subject has the privilege on the resource"}, nil
+		}
+
+		if allowed, err := s.userRoleAllows(userFromDb, resourceIds, action); err != nil {
+			return Decision{}, err
+		} else if allowed {
+			return Decision{Allowed: true, Rule: "role", Reason: "the subject's role in the resource group includes the action"}, nil
+		}
+	}
+
+	if has, err := s.userHasPrivilege(userFromDb, []string{""}, action); err != nil {
+		return Decision{}, err
+	} else if has {
+		return Decision{Allowed: true, Rule: "global-privilege", Reason: "a group of the subject has the resource-agnostic privilege"}, nil
+	}
+
+	return Decision{Rule: "default", Reason: "no policy, privilege or role allows the action"}, nil
+}
+
+// policySubjects are the subject's groups and roles, loaded when a policy first needs them
+type policySubjects struct {
+	loaded bool
+	groups map[string]bool
+	roles  map[string]bool
+}
+
+func (s *Extension) policyApplies(ctx context.Context, policy Policy, request *AuthorizationRequest, subjects *policySubjects) (bool, error) {
+	if !matchesAny(policy.Actions, request.Action) || !matchesAny(policy.Resources, request.Resource) {
+		return false, nil
+	}
+
+	if len(policy.Subjects) > 0 {
+		matched := false
+		for _, subject := range policy.Subjects {
+			if subjectMatched, err := s.subjectMatches(subject, request.Subject, subjects); err != nil {
+				return false, err
+			} else if subjectMatched {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false, nil
+		}
+	}
+
+	for _, condition := range policy.Conditions {
+		if holds, err := condition(ctx, request); err != nil || !holds {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// subjectMatches states whether the policy subject pattern matches the user
+func (s *Extension) subjectMatches(pattern string, userFromDb *nibbler.User, subjects *policySubjects) (bool, error) {
+	if pattern == "*" {
+		return true, nil
+	}
+
+	kind, value := pattern, ""
+	if i := strings.Index(pattern, ":"); i >= 0 {
+		kind, value = pattern[:i], pattern[i+1:]
+	}
+
+	if kind == "user" {
+		return matchesPattern(value, userFromDb.ID), nil
+	}
+
+	if !subjects.loaded {
+		groupIds, err := s.privilegeGroupIds(userFromDb)
+		if err != nil {
+			return false, err
+		}
+
+		memberships, err := s.GetEffectiveMemberships(userFromDb.ID)
+		if err != nil {
+			return false, err
+		}
+
+		subjects.groups = make(map[string]bool)
+		for _, id := range groupIds {
+			subjects.groups[id] = true
+		}
+
+		subjects.roles = make(map[string]bool)
+		for _, membership := range memberships {
+			subjects.roles[membership.Role] = true
+		}
+		subjects.loaded = true
+	}
+
+	names := subjects.groups
+	if kind == "role" {
+		names = subjects.roles
+	} else if kind != "group" {
+		return false, nil
+	}
+
+	for name := range names {
+		if matchesPattern(value, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// matchesAny states whether any of the patterns match the value (or there are no patterns)
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matchesPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPattern matches exactly, or by prefix for patterns ending in "*"
+func matchesPattern(pattern string, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == value
+}
+
+// BetweenHours holds from the start of fromHour until the start of toHour (0-23, in the request time's location),
+// wrapping past midnight if toHour is earlier than fromHour
+func BetweenHours(fromHour int, toHour int) Condition {
+	return func(ctx context.Context, request *AuthorizationRequest) (bool, error) {
+		hour := request.Time.Hour()
+		if fromHour <= toHour {
+			return hour >= fromHour && hour < toHour, nil
+		}
+		return hour >= fromHour || hour < toHour, nil
+	}
+}
+
+// FromNetworks holds when the client IP is in one of the networks (in CIDR notation, e.g. "10.0.0.0/8").  Like
+// regexp.MustCompile, it panics if a network can't be parsed, as policies are defined in code
+func FromNetworks(cidrs ...string) Condition {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("invalid network in policy condition: " + err.Error())
+		}
+		networks = append(networks, network)
+	}
+
+	return func(ctx context.Context, request *AuthorizationRequest) (bool, error) {
+		for _, network := range networks {
+			if request.IP != nil && network.Contains(request.IP) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+// OwnedBySubject holds when the subject owns the resource, according to ownerOf (which returns the owner's user ID, or
+// "" for resources without one)
+func OwnedBySubject(ownerOf func(ctx context.Context, resource string) (string, error)) Condition {
+	return func(ctx context.Context, request *AuthorizationRequest) (bool, error) {
+		if request.Resource == "" {
+			return false, nil
+		}
+
+		ownerId, err := ownerOf(ctx, request.Resource)
+		if err != nil {
+			return false, err
+		}
+		return ownerId != "" && ownerId == request.Subject.ID, nil
+	}
+}
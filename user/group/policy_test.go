@@ -0,0 +1,165 @@
+package nibbler_user_group
+
+import (
+	"context"
+	"github.com/markdicksonjr/nibbler"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExtension_DenyPolicyOverridesPrivileges(t *testing.T) {
+	a := newTestApp(t)
+	a.extension.Policies = []Policy{
+		{Name: "no-listing", Effect: Deny, Subjects: []string{"user:" + a.admin.ID}, Actions: []string{"list-*"}},
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a deny policy did not override a privilege")
+	}
+
+	decision, err := a.extension.Authorize(context.Background(), a.admin, ListGroupsAction, "")
+	if err != nil || decision.Allowed || decision.Rule != "policy:no-listing" {
+		t.Fatal("the deny policy was not reported as the deciding rule")
+	}
+
+	// other actions are unaffected
+	decision, err = a.extension.Authorize(context.Background(), a.admin, CreateGroupAction, "")
+	if err != nil || !decision.Allowed || decision.Rule != "global-privilege" {
+		t.Fatal("the privilege was not reported as the deciding rule")
+	}
+}
+
+func TestExtension_DeactivatedUsersAreDenied(t *testing.T) {
+	a := newTestApp(t)
+	a.extension.Policies = []Policy{{Name: "everyone", Effect: Allow, Actions: []string{"*"}}}
+
+	isActive := false
+	a.admin.IsActive = &isActive
+	if err := a.extension.UserExtension.Update(a.admin); err != nil {
+		t.Fatal(err)
+	}
+
+	// a caller resolver (e.g. with a JWT issued before the deactivation) may still identify them
+	decision, err := a.extension.Authorize(context.Background(), a.admin, CreateGroupAction, "")
+	if err != nil || decision.Allowed {
+		t.Fatal("a deactivated user was allowed by their privileges or a policy")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a deactivated user could use a route")
+	}
+}
+
+func TestExtension_AllowPolicyWildcards(t *testing.T) {
+	a := newTestApp(t)
+	a.extension.Policies = []Policy{
+		{Name: "documents", Effect: Allow, Subjects: []string{"*"}, Actions: []string{"document:*"}, Resources: []string{"doc-*"}},
+		{Name: "drafts", Effect: Deny, Actions: []string{"document:publish"}, Resources: []string{"doc-draft-*"}},
+	}
+
+	for _, check := range []struct {
+		resource string
+		action   string
+		allowed  bool
+	}{
+		{"doc-1", "document:read", true},
+		{"doc-draft-1", "document:read", true},
+		{"doc-draft-1", "document:publish", false},
+		{"report-1", "document:read", false},
+		{"doc-1", "report:read", false},
+		{"", "document:read", false},
+	} {
+		if has, err := a.extension.HasPrivilegeOnResource(a.member.ID, check.resource, check.action); err != nil || has != check.allowed {
+			t.Fatal("the wrong decision was made for " + check.action + " on " + check.resource)
+		}
+	}
+}
+
+func TestExtension_PolicySubjects(t *testing.T) {
+	a := newTestApp(t)
+	editors, _ := a.extension.CreateGroup("editors")
+	if _, err := a.extension.SetGroupMembership(editors.ID, a.member.ID, MemberRole); err != nil {
+		t.Fatal(err)
+	}
+
+	a.extension.Policies = []Policy{
+		{Name: "editors", Effect: Allow, Subjects: []string{"role:" + MemberRole}, Actions: []string{"edit"}},
+		{Name: "admins", Effect: Allow, Subjects: []string{"group:" + *a.admin.CurrentGroupID}, Actions: []string{"audit"}},
+	}
+
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "edit"); !has {
+		t.Fatal("a role subject did not match")
+	}
+	if has, _ := a.extension.HasPrivilege(a.admin.ID, "edit"); has {
+		t.Fatal("a role subject matched a user without the role")
+	}
+	if has, _ := a.extension.HasPrivilege(a.admin.ID, "audit"); !has {
+		t.Fatal("a group subject did not match")
+	}
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "audit"); has {
+		t.Fatal("a group subject matched a user outside the group")
+	}
+}
+
+func TestExtension_PolicyConditions(t *testing.T) {
+	a := newTestApp(t)
+	owners := map[string]string{"doc-1": a.member.ID, "doc-2": a.admin.ID}
+	a.extension.Policies = []Policy{
+		{Name: "office", Effect: Allow, Actions: []string{"read"}, Conditions: []Condition{
+			FromNetworks("10.0.0.0/8"),
+			BetweenHours(9, 17),
+		}},
+		{Name: "owners", Effect: Allow, Actions: []string{"write"}, Conditions: []Condition{
+			OwnedBySubject(func(ctx context.Context, resource string) (string, error) {
+				return owners[resource], nil
+			}),
+		}},
+	}
+
+	authorize := func(ip string, hour int, action string, resource string) bool {
+		ctx := WithRequestAttributes(context.Background(), RequestAttributes{
+			IP:   net.ParseIP(ip),
+			Time: time.Date(2024, 1, 1, hour, 30, 0, 0, time.UTC),
+		})
+
+		decision, err := a.extension.Authorize(ctx, a.member, action, resource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return decision.Allowed
+	}
+
+	if !authorize("10.1.2.3", 10, "read", "doc-1") {
+		t.Fatal("the conditions held, but the policy did not apply")
+	}
+	if authorize("192.168.1.1", 10, "read", "doc-1") {
+		t.Fatal("the policy applied outside the network")
+	}
+	if authorize("10.1.2.3", 20, "read", "doc-1") {
+		t.Fatal("the policy applied outside the hours")
+	}
+	if !authorize("", 0, "write", "doc-1") || authorize("", 0, "write", "doc-2") {
+		t.Fatal("the owner condition was not applied")
+	}
+}
+
+func TestBetweenHours_WrapsPastMidnight(t *testing.T) {
+	condition := BetweenHours(22, 6)
+	for hour, expected := range map[int]bool{23: true, 2: true, 6: false, 12: false, 22: true} {
+		request := &AuthorizationRequest{Subject: &nibbler.User{}, Time: time.Date(2024, 1, 1, hour, 0, 0, 0, time.UTC)}
+		if holds, _ := condition(context.Background(), request); holds != expected {
+			t.Fatal("the wrong result was given for a time past midnight")
+		}
+	}
+}
+
+func TestFromNetworks_PanicsOnInvalidNetwork(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("an invalid network was accepted")
+		}
+	}()
+	FromNetworks("10.0.0.0/33")
+}
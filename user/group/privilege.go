@@ -1,6 +1,7 @@
 package nibbler_user_group
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/mux"
@@ -19,6 +20,19 @@ const CreateGroupPrivilegeAction = "create-group-privilege"
 const DeleteGroupPrivilegeAction = "delete-group-privilege"
 const ListGroupsAction = "list-groups"
 const RemoveMemberFromGroupAction = "remove-member-from-group"
+const GetGroupAction = "get-group"
+const UpdateGroupAction = "update-group"
+const HardDeleteGroupAction = "hard-delete-group"
+const ListGroupMembersAction = "list-group-members"
+const ListGroupPrivilegesAction = "list-group-privileges"
+const ListGroupRolesAction = "list-group-roles"
+const ManageGroupRolesAction = "manage-group-roles"
+
+// actions any caller can take for themselves, so they aren't group privileges - but callers restricted to some
+// privileges (e.g. by an API key's scopes) need a scope that allows them
+const GetUserCompositeAction = "get-user-composite"
+const SetCurrentGroupAction = "set-current-group"
+const AcceptGroupInvitationAction = "accept-group-invitation"
 
 // AddPrivilegeToGroups adds a specific privilege definition to save to multiple groups.  It allows all groups in the
 // groupIdList to perform the provided action on the targetGroupId.  If targetGroupId is blank, it means
@@ -28,49 +42,139 @@ func (s *Extension) AddPrivilegeToGroups(
 	targetGroupId string,
 	action string,
 ) error {
-	return s.PersistenceExtension.AddPrivilegeToGroups(groupIdList, targetGroupId, action)
+	if err := s.PersistenceExtension.AddPrivilegeToGroups(groupIdList, targetGroupId, action); err != nil {
+		return err
+	}
+
+	s.InvalidateDecisions()
+	return nil
+}
+
+// DeletePrivilege deletes the privilege with the given ID
+func (s *Extension) DeletePrivilege(id string, hardDelete bool) error {
+	if err := s.PersistenceExtension.DeletePrivilege(id, hardDelete); err != nil {
+		return err
+	}
+
+	s.InvalidateDecisions()
+	return nil
 }
 
 // HasPrivilege returns whether the caller has a privilege for a resource-agnostic action.  This is suitable
-// for something like "create-admin" or any other "global"-type privilege
+// for something like "create-admin" or any other "global"-type privilege.  Policies are applied (see Authorize), with
+// no request attributes
 func (s *Extension) HasPrivilege(userId, action string) (bool, error) {
-	userFromDb, err := s.UserExtension.GetUserById(userId)
+	decision, err := s.Authorize(context.Background(), &nibbler.User{ID: userId}, action, "")
+	return decision.Allowed, err
+}
+
+// HasPrivilegeOnResource will state whether the caller can perform an action on a specific resource.  If there is no
+// resource-specific privilege, it will check to see if the caller has the global privilege for that action.  For
+// example, some users may have "create-user" privileges for a specific group, but an admin may have a resource-agnostic
+// "create-user" privilege.  This function will check both.
+func (s *Extension) HasPrivilegeOnResource(userId, resourceId, action string) (bool, error) {
+	decision, err := s.Authorize(context.Background(), &nibbler.User{ID: userId}, action, resourceId)
+	return decision.Allowed, err
+}
+
+// userHasPrivilege checks whether the groups of a user that has already been loaded from persistence have a privilege
+// for the action on any of the resources - a blank resource ID checks the resource-agnostic privilege.  Privileges
+// granted to a group above the user's groups count
+func (s *Extension) userHasPrivilege(userFromDb *nibbler.User, resourceIds []string, action string) (bool, error) {
+	groupIds, err := s.privilegeGroupIds(userFromDb)
 	if err != nil {
 		return false, err
 	}
 
-	if userFromDb == nil || userFromDb.CurrentGroupID == nil {
-		return false, nil
+	for _, groupId := range groupIds {
+		for i := range resourceIds {
+			var resource *string
+			if resourceIds[i] != "" {
+				resource = &resourceIds[i]
+			}
+
+			privileges, err := s.PersistenceExtension.GetPrivilegesForAction(groupId, resource, action)
+			if err != nil {
+				return false, err
+			}
+
+			if len(privileges) > 0 {
+				return true, nil
+			}
+		}
 	}
+	return false, nil
+}
 
-	privileges, err := s.PersistenceExtension.GetPrivilegesForAction(*userFromDb.CurrentGroupID, nil, action)
+// privilegeGroupIds returns the IDs of the groups whose privileges the user has, per PrivilegeEvaluation - including
+// the groups above them
+func (s *Extension) privilegeGroupIds(userFromDb *nibbler.User) ([]string, error) {
+	if s.PrivilegeEvaluation != EvaluateAllMemberships {
+		if userFromDb.CurrentGroupID == nil {
+			return nil, nil
+		}
+		return s.withAncestors(*userFromDb.CurrentGroupID)
+	}
+
+	memberships, err := s.GetEffectiveMemberships(userFromDb.ID)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return len(privileges) > 0, nil
+	var groupIds []string
+	seen := make(map[string]bool)
+	for _, membership := range memberships {
+		if !s.roleIsEvaluated(membership.Role) {
+			continue
+		}
+
+		ids, err := s.withAncestors(membership.GroupID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				groupIds = append(groupIds, id)
+			}
+		}
+	}
+	return groupIds, nil
 }
 
-// HasPrivilegeOnResource will state whether the caller can perform an action on a specific resource.  If there is no
-// resource-specific privilege, it will check to see if the caller has the global privilege for that action.  For
-// example, some users may have "create-user" privileges for a specific group, but an admin may have a resource-agnostic
-// "create-user" privilege.  This function will check both.
-func (s *Extension) HasPrivilegeOnResource(userId, resourceId, action string) (bool, error) {
-	userFromDb, err := s.UserExtension.GetUserById(userId)
-	if err != nil {
-		return false, err
+func (s *Extension) roleIsEvaluated(role string) bool {
+	if len(s.EvaluatedRoles) == 0 {
+		return true
 	}
 
-	if userFromDb == nil || userFromDb.CurrentGroupID == nil {
-		return false, nil
+	for _, evaluated := range s.EvaluatedRoles {
+		if evaluated == role {
+			return true
+		}
 	}
+	return false
+}
 
-	privileges, err := s.PersistenceExtension.GetPrivilegesForAction(*userFromDb.CurrentGroupID, &resourceId, action)
+// ListGroupPrivilegesRequestHandler responds with the privileges of the group with the "groupId" path param
+func (s *Extension) ListGroupPrivilegesRequestHandler(w http.ResponseWriter, r *http.Request) {
+	group, err := s.GetGroup(mux.Vars(r)["groupId"], true)
 	if err != nil {
-		return false, err
+		nibbler.Write500Json(w, err.Error())
+		return
 	}
 
-	return len(privileges) > 0, nil
+	if group == nil {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	privileges := group.Privileges
+	if privileges == nil {
+		privileges = []nibbler.GroupPrivilege{}
+	}
+
+	nibbler.WriteStructToJson(w, privileges, http.StatusOK)
 }
 
 // DeleteGroupPrivilegeRequestHandler handles an http request with a privilege in its body and "groupId" in the path params
@@ -86,7 +190,7 @@ func (s *Extension) DeleteGroupPrivilegeRequestHandler(w http.ResponseWriter, r
 	// if a user passes no resource for the privilege, this is a little dangerous - we need to be sure they are allowed
 	// to allocate privileges that are independent of a resource (global privileges)
 	if priv.ResourceID == "" {
-		caller, err := s.SessionExtension.GetCaller(r)
+		caller, err := s.callerResolver().GetCaller(r)
 		if err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
@@ -97,8 +201,16 @@ func (s *Extension) DeleteGroupPrivilegeRequestHandler(w http.ResponseWriter, r
 			return
 		}
 
+		if allowed, err := s.scopesAllow(r, nil, DeletePrivilegeAction); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		} else if !allowed {
+			nibbler.Write404Json(w)
+			return
+		}
+
 		// if the user does not have the right to create such privileges, stop them here
-		if has, err := s.HasPrivilege(caller.ID, DeletePrivilegeAction); err != nil {
+		if has, err := s.authorize(r, caller, DeletePrivilegeAction, ""); err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
 		} else if !has {
@@ -122,16 +234,17 @@ func (s *Extension) DeleteGroupPrivilegeRequestHandler(w http.ResponseWriter, r
 	for _, p := range privileges {
 
 		// TODO: hard del query param
-		if err := s.PersistenceExtension.DeletePrivilege(p.ID, false); err != nil {
+		if err := s.DeletePrivilege(p.ID, false); err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
 		}
 	}
 
-	nibbler.Write200Json(w, "{\"result\":\"ok\"")
+	nibbler.Write200Json(w, `{"result": "ok"}`)
 }
 
-// CreateGroupPrivilegeRequestHandler handles an http request with a path param of groupId and body that is a Privilege
+// CreateGroupPrivilegeRequestHandler handles an http request with a path param of groupId and body that is a Privilege.
+// The caller must have the privilege's action on its resource themselves
 func (s *Extension) CreateGroupPrivilegeRequestHandler(w http.ResponseWriter, r *http.Request) {
 	priv, err := getPrivilegeFromBody(r)
 	if err != nil {
@@ -145,7 +258,7 @@ func (s *Extension) CreateGroupPrivilegeRequestHandler(w http.ResponseWriter, r
 	// if a user passes no resource for the privilege, this is a little dangerous - we need to be sure they are allowed
 	// to allocate privileges that are independent of a resource (global privileges)
 	if priv.ResourceID == "" {
-		caller, err := s.SessionExtension.GetCaller(r)
+		caller, err := s.callerResolver().GetCaller(r)
 		if err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
@@ -156,8 +269,16 @@ func (s *Extension) CreateGroupPrivilegeRequestHandler(w http.ResponseWriter, r
 			return
 		}
 
+		if allowed, err := s.scopesAllow(r, nil, CreatePrivilegeAction); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		} else if !allowed {
+			nibbler.Write404Json(w)
+			return
+		}
+
 		// if the user does not have the right to create such privileges, stop them here
-		if has, err := s.HasPrivilege(caller.ID, CreatePrivilegeAction); err != nil {
+		if has, err := s.authorize(r, caller, CreatePrivilegeAction, ""); err != nil {
 			nibbler.Write500Json(w, err.Error())
 			return
 		} else if !has {
@@ -166,12 +287,21 @@ func (s *Extension) CreateGroupPrivilegeRequestHandler(w http.ResponseWriter, r
 		}
 	}
 
-	if err := s.PersistenceExtension.AddPrivilegeToGroups([]string{priv.GroupID}, priv.ResourceID, priv.Action); err != nil {
+	// callers can only grant what they have, so a privilege on their own group can't be parlayed into others
+	if has, err := s.callerHasActions(r, priv.ResourceID, []string{priv.Action}); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	} else if !has {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	if err := s.AddPrivilegeToGroups([]string{priv.GroupID}, priv.ResourceID, priv.Action); err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
 	}
 
-	nibbler.Write200Json(w, "{\"result\":\"ok\"")
+	nibbler.Write200Json(w, `{"result": "ok"}`)
 }
 
 // getPrivilegeFromBody parses the request body into a GroupPrivilege struct
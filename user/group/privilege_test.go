@@ -0,0 +1,56 @@
+package nibbler_user_group
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"testing"
+)
+
+func TestExtension_InitChecksPrivilegeEvaluation(t *testing.T) {
+	e := Extension{PrivilegeEvaluation: "some-groups"}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err == nil {
+		t.Fatal("an unknown privilege evaluation was accepted")
+	}
+}
+
+func TestExtension_EvaluateAllMemberships(t *testing.T) {
+	a := newTestApp(t)
+	editors, _ := a.extension.CreateGroup("editors")
+	reviewers, _ := a.extension.CreateGroup("reviewers")
+
+	for _, membership := range [][]string{{editors.ID, "member"}, {reviewers.ID, "pending"}} {
+		if _, err := a.extension.SetGroupMembership(membership[0], a.member.ID, membership[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.extension.AddPrivilegeToGroups([]string{editors.ID}, "", "edit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.extension.AddPrivilegeToGroups([]string{reviewers.ID}, "", "review"); err != nil {
+		t.Fatal(err)
+	}
+
+	// by default, only the current group (which the member doesn't have) counts
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "edit"); has {
+		t.Fatal("a privilege was granted without a current group")
+	}
+
+	a.extension.PrivilegeEvaluation = EvaluateAllMemberships
+	for _, action := range []string{"edit", "review"} {
+		if has, err := a.extension.HasPrivilege(a.member.ID, action); err != nil || !has {
+			t.Fatal("the privilege to " + action + " from a membership was not granted")
+		}
+	}
+
+	// only evaluated roles count
+	a.extension.EvaluatedRoles = []string{"member", "admin"}
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "review"); has {
+		t.Fatal("a privilege was granted through a membership with a role that isn't evaluated")
+	}
+
+	// and the current group is only a UI context, so it grants nothing without a membership
+	setCurrentGroup(t, a.extension, a.member, reviewers.ID)
+	if has, _ := a.extension.HasPrivilege(a.member.ID, "review"); has {
+		t.Fatal("a privilege was granted through the current group")
+	}
+}
@@ -0,0 +1,309 @@
+package nibbler_user_group
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"strings"
+)
+
+// the default roles, created (as global roles) in PostInit unless DisableDefaultRoles is set
+const OwnerRole = "owner"
+const AdminRole = "admin"
+const MemberRole = "member"
+const ViewerRole = "viewer"
+
+// DefaultRoles are the actions for the default roles - the creator of a group is made its owner
+var DefaultRoles = map[string][]string{
+	OwnerRole: {GetGroupAction, UpdateGroupAction, DeleteGroupAction, ListGroupMembersAction, CreateGroupMembershipAction,
+		RemoveMemberFromGroupAction, ListGroupPrivilegesAction, ListGroupRolesAction, ManageGroupRolesAction},
+	AdminRole: {GetGroupAction, UpdateGroupAction, ListGroupMembersAction, CreateGroupMembershipAction,
+		RemoveMemberFromGroupAction, ListGroupPrivilegesAction, ListGroupRolesAction},
+	MemberRole: {GetGroupAction, ListGroupMembersAction, ListGroupRolesAction},
+	ViewerRole: {GetGroupAction},
+}
+
+// ErrRolesNotSupported is returned when changing roles, if the persistence extension can't store them
+var ErrRolesNotSupported = errors.New("the group persistence extension does not support roles")
+
+// RolePersistenceExtension is implemented by persistence extensions that can store roles.  It is optional - without
+// it, no roles are created or evaluated, and membership roles are just labels
+type RolePersistenceExtension interface {
+	GetGroupRoles(groupId string) ([]nibbler.GroupRole, error) // the group's own roles, or the global ones for a blank ID
+	CreateGroupRole(role nibbler.GroupRole) error
+	UpdateGroupRole(role nibbler.GroupRole) error
+	DeleteGroupRole(id string) error
+}
+
+// SupportsRoles states whether the persistence extension can store roles
+func (s *Extension) SupportsRoles() bool {
+	_, ok := s.PersistenceExtension.(RolePersistenceExtension)
+	return ok
+}
+
+func (s *Extension) roles() RolePersistenceExtension {
+	return s.PersistenceExtension.(RolePersistenceExtension)
+}
+
+// createDefaultRoles creates the default global roles that don't exist yet
+func (s *Extension) createDefaultRoles() error {
+	existing, err := s.roles().GetGroupRoles("")
+	if err != nil {
+		return err
+	}
+
+	for name, actions := range DefaultRoles {
+		found := false
+		for _, role := range existing {
+			found = found || role.Name == name
+		}
+
+		if !found {
+			if _, err := s.SetGroupRole("", name, actions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetRole returns the role with the given name in the group - the group's own role if it has one, otherwise the global
+// role - or nil if there is no such role
+func (s *Extension) GetRole(groupId string, name string) (*nibbler.GroupRole, error) {
+	roles, err := s.GetRoles(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if role.Name == name {
+			return &role, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetRoles returns the roles available in the group - its own roles, and the global roles it doesn't override
+func (s *Extension) GetRoles(groupId string) ([]nibbler.GroupRole, error) {
+	if !s.SupportsRoles() {
+		return nil, nil
+	}
+
+	roles, err := s.roles().GetGroupRoles(groupId)
+	if err != nil || groupId == "" {
+		return roles, err
+	}
+
+	globalRoles, err := s.roles().GetGroupRoles("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, global := range globalRoles {
+		overridden := false
+		for _, role := range roles {
+			overridden = overridden || role.Name == global.Name
+		}
+
+		if !overridden {
+			roles = append(roles, global)
+		}
+	}
+	return roles, nil
+}
+
+// SetGroupRole creates or replaces the group's role with the given name (a global role, for a blank groupId)
+func (s *Extension) SetGroupRole(groupId string, name string, actions []string) (*nibbler.GroupRole, error) {
+	if name == "" {
+		return nil, errors.New("role name is a required field")
+	}
+
+	if !s.SupportsRoles() {
+		return nil, ErrRolesNotSupported
+	}
+
+	roles, err := s.roles().GetGroupRoles(groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if role.Name == name {
+			role.Actions = strings.Join(actions, " ")
+			if err := s.roles().UpdateGroupRole(role); err != nil {
+				return nil, err
+			}
+
+			s.InvalidateDecisions()
+			return &role, nil
+		}
+	}
+
+	role := nibbler.GroupRole{
+		ID:      uuid.New().String(),
+		GroupID: groupId,
+		Name:    name,
+		Actions: strings.Join(actions, " "),
+	}
+	if err := s.roles().CreateGroupRole(role); err != nil {
+		return nil, err
+	}
+
+	s.InvalidateDecisions()
+	return &role, nil
+}
+
+// roleAllows states whether the role with the given name in the group includes the action
+func (s *Extension) roleAllows(groupId string, name string, action string) (bool, error) {
+	if name == "" || !s.SupportsRoles() {
+		return false, nil
+	}
+
+	role, err := s.GetRole(groupId, name)
+	if err != nil || role == nil {
+		return false, err
+	}
+
+	for _, roleAction := range strings.Fields(role.Actions) {
+		if roleAction == action {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// userRoleAllows states whether the user has a role (in one of the resource groups) that includes the action
+func (s *Extension) userRoleAllows(userFromDb *nibbler.User, resourceIds []string, action string) (bool, error) {
+	memberships, err := s.GetEffectiveMemberships(userFromDb.ID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, membership := range memberships {
+		for _, resourceId := range resourceIds {
+			if membership.GroupID != resourceId {
+				continue
+			}
+
+			if allowed, err := s.roleAllows(membership.GroupID, membership.Role, action); err != nil || allowed {
+				return allowed, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// callerHasActions checks that the caller could perform every action on the group themselves, so that they can't hand
+// out (through roles) more than they have
+func (s *Extension) callerHasActions(r *http.Request, groupId string, actions []string) (bool, error) {
+	caller, err := s.callerResolver().GetCaller(r)
+	if err != nil || caller == nil {
+		return false, err
+	}
+
+	for _, action := range actions {
+		if has, err := s.callerHasPrivilegeOnResource(r, caller, groupId, action); err != nil || !has {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ListGroupRolesRequestHandler responds with the roles available in the group with the "groupId" path param (or the
+// global roles, for routes without it)
+func (s *Extension) ListGroupRolesRequestHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := s.GetRoles(mux.Vars(r)["groupId"])
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if roles == nil {
+		roles = []nibbler.GroupRole{}
+	}
+	nibbler.WriteStructToJson(w, roles, http.StatusOK)
+}
+
+// SetGroupRoleRequestHandler creates or replaces a role (from a body with a name and space-separated actions) in the
+// group with the "groupId" path param, or a global role for routes without it.  Callers can only create roles with
+// actions they have themselves
+func (s *Extension) SetGroupRoleRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name    string `json:"name"`
+		Actions string `json:"actions"`
+	}
+
+	if r.Body == nil {
+		nibbler.Write500Json(w, "no body provided")
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	groupId := mux.Vars(r)["groupId"]
+	actions := strings.Fields(body.Actions)
+
+	if groupId != "" {
+		if group, err := s.GetGroup(groupId, false); err != nil {
+			nibbler.Write500Json(w, err.Error())
+			return
+		} else if group == nil {
+			nibbler.Write404Json(w)
+			return
+		}
+	}
+
+	if has, err := s.callerHasActions(r, groupId, actions); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	} else if !has {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	role, err := s.SetGroupRole(groupId, body.Name, actions)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, role, http.StatusOK)
+}
+
+// DeleteGroupRoleRequestHandler deletes the role with the "roleId" path param from the group with the "groupId" path
+// param (or a global role, for routes without it)
+func (s *Extension) DeleteGroupRoleRequestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if !s.SupportsRoles() {
+		nibbler.Write404Json(w)
+		return
+	}
+
+	roles, err := s.roles().GetGroupRoles(vars["groupId"])
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	for _, role := range roles {
+		if role.ID == vars["roleId"] {
+			if err := s.roles().DeleteGroupRole(role.ID); err != nil {
+				nibbler.Write500Json(w, err.Error())
+				return
+			}
+			s.InvalidateDecisions()
+
+			nibbler.Write200Json(w, `{"result": "ok"}`)
+			return
+		}
+	}
+
+	nibbler.Write404Json(w)
+}
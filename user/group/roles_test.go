@@ -0,0 +1,141 @@
+package nibbler_user_group
+
+import (
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExtension_DefaultRoles(t *testing.T) {
+	a := newTestApp(t)
+
+	roles, err := a.extension.GetRoles("")
+	if err != nil || len(roles) != len(DefaultRoles) {
+		t.Fatal("the default roles were not created")
+	}
+
+	// running PostInit again doesn't duplicate them
+	if err := a.extension.createDefaultRoles(); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := a.extension.GetRoles(""); len(roles) != len(DefaultRoles) {
+		t.Fatal("the default roles were created twice")
+	}
+
+	// the creator of a group is its owner
+	group := a.createGroup(t, "editors")
+	memberships, _ := a.extension.PersistenceExtension.GetGroupMemberships(group.ID)
+	if len(memberships) != 1 || memberships[0].Role != OwnerRole {
+		t.Fatal("the creator was not made the owner of the group")
+	}
+}
+
+// rolelessPersistenceExtension hides the mock's role methods, like persistence extensions that can't store roles
+type rolelessPersistenceExtension struct {
+	PersistenceExtension
+}
+
+func TestExtension_RolesAreOptional(t *testing.T) {
+	a := newTestAppWith(t, func(e *Extension) {
+		e.PersistenceExtension = rolelessPersistenceExtension{PersistenceExtension: e.PersistenceExtension}
+	})
+
+	if a.extension.SupportsRoles() {
+		t.Fatal("roles were supported by a persistence extension that can't store them")
+	}
+
+	if roles, err := a.extension.GetRoles(""); err != nil || len(roles) != 0 {
+		t.Fatal("roles were found without role support")
+	}
+
+	if _, err := a.extension.SetGroupRole("", "editor", []string{GetGroupAction}); err != ErrRolesNotSupported {
+		t.Fatal("a role was set without role support")
+	}
+
+	// memberships can still be given any role, as a label that grants nothing
+	group := a.createGroup(t, "editors")
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/membership", `{"memberId": "`+a.member.ID+`", "role": "viewer"}`); res.Code != http.StatusOK {
+		t.Fatal("a membership with a role could not be created: " + res.Body.String())
+	}
+
+	if res := a.send(a.member, "GET", "/api/group/"+group.ID, ""); res.Code != http.StatusNotFound {
+		t.Fatal("a role granted an action without role support")
+	}
+
+	if res := a.send(a.admin, "GET", "/api/group/"+group.ID+"/role", ""); res.Code != http.StatusNotFound && res.Code != http.StatusMethodNotAllowed {
+		t.Fatal("the role routes were added without role support")
+	}
+}
+
+func TestExtension_RolesGrantActions(t *testing.T) {
+	a := newTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	if _, err := a.extension.SetGroupMembership(group.ID, a.member.ID, ViewerRole); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.member, "GET", "/api/group/"+group.ID, ""); res.Code != http.StatusOK {
+		t.Fatal("a viewer could not get the group")
+	}
+
+	if res := a.send(a.member, "GET", "/api/group/"+group.ID+"/membership", ""); res.Code != http.StatusNotFound {
+		t.Fatal("a viewer could list the members of the group")
+	}
+
+	// the group's own viewer role replaces the global one (the owner can manage the group's roles)
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/role", `{"name": "viewer", "actions": "get-group list-group-members"}`); res.Code != http.StatusOK {
+		t.Fatal("the group's role was not set: " + res.Body.String())
+	}
+
+	if res := a.send(a.member, "GET", "/api/group/"+group.ID+"/membership", ""); res.Code != http.StatusOK {
+		t.Fatal("the group's own role was not used")
+	}
+
+	roles, _ := a.extension.GetRoles(group.ID)
+	if len(roles) != len(DefaultRoles) {
+		t.Fatal("the group's role did not replace the global one")
+	}
+
+	// the role applies to groups below this one
+	team, _ := a.extension.CreateGroup("team")
+	if err := a.extension.SetGroupParent(team.ID, &group.ID); err != nil {
+		t.Fatal(err)
+	}
+	if res := a.send(a.member, "GET", "/api/group/"+team.ID, ""); res.Code != http.StatusOK {
+		t.Fatal("a role did not apply to a group below the member's group")
+	}
+
+	// roles with actions the caller doesn't have can't be created
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/role", `{"name": "editor", "actions": "get-group delete-everything"}`); res.Code != http.StatusNotFound {
+		t.Fatal("a role was created with an action the caller does not have")
+	}
+}
+
+func TestExtension_MembershipRoles(t *testing.T) {
+	a := newTestApp(t)
+	group := a.createGroup(t, "editors")
+
+	other, err := a.extension.UserExtension.Create(&nibbler.User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/membership", `{"memberId": "`+a.member.ID+`", "role": "editor"}`); res.Code != http.StatusInternalServerError || !strings.Contains(res.Body.String(), "unknown role") {
+		t.Fatal("a membership was given an unknown role")
+	}
+
+	if res := a.send(a.admin, "PUT", "/api/group/"+group.ID+"/membership", `{"memberId": "`+a.member.ID+`", "role": "admin"}`); res.Code != http.StatusOK {
+		t.Fatal("the member was not made an admin: " + res.Body.String())
+	}
+
+	// a group admin can add members, but can't make anyone an owner (which can delete the group)
+	if res := a.send(a.member, "PUT", "/api/group/"+group.ID+"/membership", `{"memberId": "`+other.ID+`", "role": "owner"}`); res.Code != http.StatusNotFound {
+		t.Fatal("a group admin handed out a role with more actions than they have")
+	}
+
+	if res := a.send(a.member, "PUT", "/api/group/"+group.ID+"/membership", `{"memberId": "`+other.ID+`", "role": "member"}`); res.Code != http.StatusOK {
+		t.Fatal("a group admin could not add a member: " + res.Body.String())
+	}
+}
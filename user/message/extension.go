@@ -55,6 +55,7 @@ type Extension struct {
 	nibbler.NoOpExtension
 	PersistenceExtension PersistenceExtension
 	SessionExtension     *session.Extension
+	CallerResolver       nibbler.CallerResolver // identifies the caller, defaults to SessionExtension
 }
 
 func (s *Extension) GetName() string {
@@ -66,13 +67,13 @@ func (s *Extension) PostInit(app *nibbler.Application) error {
 		return errors.New(s.GetName() + " requires a persistence extension but none was provided")
 	}
 
-	if s.SessionExtension == nil {
-		return errors.New(s.GetName() + " requires a session extension but none was provided")
+	if s.SessionExtension == nil && s.CallerResolver == nil {
+		return errors.New(s.GetName() + " requires a session extension or caller resolver but none was provided")
 	}
 
 	s.Logger = app.Logger
 
-	app.Router.HandleFunc(app.Config.ApiPrefix + "/message", s.GetMessagesHandler).Queries("userId", "{userId}", "count", "{count}", "offset", "{offset}").Methods("GET")
+	app.Router.HandleFunc(app.Config.ApiPrefix + "/message", s.GetMessagesHandler).Queries("userId", "{userId}").Methods("GET")
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/message", s.SendMessageToUserHandler).Methods("POST")
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/message", s.DeleteUserMessageStateHandler).Queries("userId", "{userId}").Methods("DELETE")
 	app.Router.HandleFunc(app.Config.ApiPrefix + "/message/read", s.MarkUserMessageStateAsReadHandler).Methods("POST")
@@ -80,13 +81,37 @@ func (s *Extension) PostInit(app *nibbler.Application) error {
 	return nil
 }
 
+// callerResolver returns the CallerResolver, or the session extension if none was provided
+func (s *Extension) callerResolver() nibbler.CallerResolver {
+	return nibbler.ResolverOrDefault(s.CallerResolver, s.SessionExtension)
+}
+
+// MaxMessagesSize is the most messages GetMessagesHandler responds with at once
+const MaxMessagesSize = 1000
+
+// GetMessagesHandler lists the caller's messages, paged with the offset and size query params (see
+// nibbler.ParseSearchParameters), up to MaxMessagesSize.  "count" is still accepted in place of size, and (as it was
+// never validated) counts that are too large, zero or not numbers are read as MaxMessagesSize rather than rejected
 func (s *Extension) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	c, _ := strconv.Atoi(v["count"])
-	o, _ := strconv.Atoi(v["offset"])
 
-	// get the caller from the session so we can use it to authorize
-	caller, err := s.SessionExtension.GetCaller(r)
+	values := r.URL.Query()
+	if values.Get("size") == "" && values.Get("count") != "" {
+		count := values.Get("count")
+		if c, err := strconv.Atoi(count); err != nil || c < 1 || c > MaxMessagesSize {
+			count = strconv.Itoa(MaxMessagesSize)
+		}
+		values.Set("size", count)
+	}
+
+	params, err := nibbler.ParseSearchParameters(values, nibbler.SearchParameterOptions{MaxSize: MaxMessagesSize})
+	if err != nil {
+		nibbler.Write400Json(w, err.Error())
+		return
+	}
+
+	// get the caller (from the session, by default) so we can use it to authorize
+	caller, err := s.callerResolver().GetCaller(r)
 	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
@@ -104,7 +129,7 @@ func (s *Extension) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// load the messages and states
-	states, err := s.PersistenceExtension.GetMessagesByUserId(v["userId"], c, o)
+	states, err := s.PersistenceExtension.GetMessagesByUserId(v["userId"], *params.Size, *params.Offset)
 	if err != nil {
 		nibbler.Write500Json(w, err.Error())
 		return
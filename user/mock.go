@@ -0,0 +1,302 @@
+package user
+
+import (
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockPersistenceExtension is an in-memory PersistenceExtension (and LoginTokenPersistenceExtension), for tests and
+// prototyping.  SearchUsers matches the query's text against email, username, first and last names (ignoring case), and
+// supports the filters, sorting and paging in UserSearchOptions
+type MockPersistenceExtension struct {
+	nibbler.NoOpExtension
+
+	users map[string]nibbler.User
+	mutex sync.RWMutex
+}
+
+func (m *MockPersistenceExtension) Create(user *nibbler.User) (*nibbler.User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.users == nil {
+		m.users = make(map[string]nibbler.User)
+	}
+
+	if _, ok := m.users[user.ID]; ok {
+		return nil, errors.New("a user with ID " + user.ID + " already exists")
+	}
+
+	now := time.Now()
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	m.users[user.ID] = *user
+
+	result := *user
+	return &result, nil
+}
+
+func (m *MockPersistenceExtension) GetUserByEmail(email string) (*nibbler.User, error) {
+	return m.find(func(u nibbler.User) bool {
+		return u.Email != nil && *u.Email == email
+	}), nil
+}
+
+func (m *MockPersistenceExtension) GetUserByEmailValidationToken(token string) (*nibbler.User, error) {
+	return m.find(func(u nibbler.User) bool {
+		return u.EmailValidationToken != nil && *u.EmailValidationToken == token
+	}), nil
+}
+
+func (m *MockPersistenceExtension) GetUserById(id string) (*nibbler.User, error) {
+	return m.find(func(u nibbler.User) bool {
+		return u.ID == id
+	}), nil
+}
+
+func (m *MockPersistenceExtension) GetUserByPasswordResetToken(token string) (*nibbler.User, error) {
+	return m.find(func(u nibbler.User) bool {
+		return u.PasswordResetToken != nil && *u.PasswordResetToken == token
+	}), nil
+}
+
+func (m *MockPersistenceExtension) GetUserByUsername(username string) (*nibbler.User, error) {
+	return m.find(func(u nibbler.User) bool {
+		return u.Username != nil && *u.Username == username
+	}), nil
+}
+
+func (m *MockPersistenceExtension) GetUserByLoginToken(token string) (*nibbler.User, error) {
+	return m.find(func(u nibbler.User) bool {
+		return u.LoginToken != nil && *u.LoginToken == token
+	}), nil
+}
+
+func (m *MockPersistenceExtension) ClearLoginToken(userId string, token string) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	existing, ok := m.users[userId]
+	if !ok || existing.LoginToken == nil || *existing.LoginToken != token {
+		return false, nil
+	}
+
+	existing.LoginToken = nil
+	existing.LoginTokenExpiration = nil
+	existing.UpdatedAt = time.Now()
+	m.users[userId] = existing
+	return true, nil
+}
+
+func (m *MockPersistenceExtension) SearchUsers(query nibbler.SearchParameters) (*nibbler.SearchResults, error) {
+	search := query.GetSearchQuery()
+	text := strings.ToLower(search.Text)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var all []nibbler.User
+	for _, u := range m.users {
+		if u.DeletedAt == nil && userMatchesText(u, text) && userMatchesFilters(u, search.Filters) {
+			all = append(all, u)
+		}
+	}
+
+	// map order is random, so order by creation to make paging stable
+	sort.Slice(all, func(a, b int) bool {
+		if all[a].CreatedAt.Equal(all[b].CreatedAt) {
+			return all[a].ID < all[b].ID
+		}
+		return all[a].CreatedAt.Before(all[b].CreatedAt)
+	})
+
+	for i := len(query.SortBy) - 1; i >= 0; i-- {
+		sortBy := query.SortBy[i]
+		sort.SliceStable(all, func(a, b int) bool {
+			first, second := all[a], all[b]
+			if !sortBy.IsAscending {
+				first, second = second, first
+			}
+
+			switch sortBy.Field {
+			case "email":
+				return stringValue(first.Email) < stringValue(second.Email)
+			case "username":
+				return stringValue(first.Username) < stringValue(second.Username)
+			case "firstName":
+				return stringValue(first.FirstName) < stringValue(second.FirstName)
+			case "lastName":
+				return stringValue(first.LastName) < stringValue(second.LastName)
+			case "updatedAt":
+				return first.UpdatedAt.Before(second.UpdatedAt)
+			default:
+				return first.CreatedAt.Before(second.CreatedAt)
+			}
+		})
+	}
+
+	offset := 0
+	if query.Offset != nil && *query.Offset > 0 {
+		offset = *query.Offset
+	}
+	if offset > len(all) {
+		offset = len(all)
+	}
+
+	end := len(all)
+	if query.Size != nil && *query.Size >= 0 && offset+*query.Size < end {
+		end = offset + *query.Size
+	}
+
+	results := nibbler.SearchResults{
+		Hits:   all[offset:end],
+		Offset: &offset,
+	}
+
+	if query.IncludeTotal {
+		total := len(all)
+		results.Total = &total
+	}
+
+	return &results, nil
+}
+
+// userMatchesText states whether the (lower-case) text is in the user's email, username, first or last name
+func userMatchesText(u nibbler.User, text string) bool {
+	if text == "" {
+		return true
+	}
+
+	for _, value := range []*string{u.Email, u.Username, u.FirstName, u.LastName} {
+		if strings.Contains(strings.ToLower(stringValue(value)), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// userMatchesFilters states whether the user matches all of the (UserSearchOptions) filters exactly
+func userMatchesFilters(u nibbler.User, filters map[string]string) bool {
+	for field, value := range filters {
+		switch field {
+		case "email":
+			if stringValue(u.Email) != value {
+				return false
+			}
+		case "username":
+			if stringValue(u.Username) != value {
+				return false
+			}
+		case "companyId":
+			if stringValue(u.CompanyID) != value {
+				return false
+			}
+		case "isActive":
+			if strconv.FormatBool(IsUserActive(u)) != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func (m *MockPersistenceExtension) Update(user *nibbler.User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return errors.New("no user with ID " + user.ID + " exists")
+	}
+
+	// like most persistence extensions, updates don't change the password
+	updated := *user
+	updated.Password = existing.Password
+	updated.UpdatedAt = time.Now()
+	m.users[user.ID] = updated
+	return nil
+}
+
+func (m *MockPersistenceExtension) UpdatePassword(user *nibbler.User) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	existing, ok := m.users[user.ID]
+	if !ok {
+		return errors.New("no user with ID " + user.ID + " exists")
+	}
+
+	existing.Password = user.Password
+	existing.PasswordResetToken = user.PasswordResetToken
+	existing.PasswordResetExpiration = user.PasswordResetExpiration
+	existing.LoginToken = user.LoginToken
+	existing.LoginTokenExpiration = user.LoginTokenExpiration
+	existing.UpdatedAt = time.Now()
+	m.users[user.ID] = existing
+	return nil
+}
+
+// find returns a copy of the first (non-deleted) user that matches
+func (m *MockPersistenceExtension) find(matches func(u nibbler.User) bool) *nibbler.User {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, u := range m.users {
+		if u.DeletedAt == nil && matches(u) {
+			result := u
+			return &result
+		}
+	}
+	return nil
+}
+
+// MockApp is an app (with a silent logger) and an initialized user extension on a MockPersistenceExtension, for tests
+// of extensions that need users
+type MockApp struct {
+	App           *nibbler.Application
+	UserExtension *Extension
+}
+
+// NewMockApp returns a MockApp with no users
+func NewMockApp() (*MockApp, error) {
+	app := &nibbler.Application{Logger: nibbler.SilentLogger{}}
+	userExtension := &Extension{PersistenceExtension: &MockPersistenceExtension{}}
+	if err := userExtension.Init(app); err != nil {
+		return nil, err
+	}
+	return &MockApp{App: app, UserExtension: userExtension}, nil
+}
+
+// CreateUser creates a user with the email
+func (m *MockApp) CreateUser(email string) (*nibbler.User, error) {
+	return m.UserExtension.Create(&nibbler.User{Email: &email})
+}
+
+// CallerIDHeader is the header HeaderCallerResolver reads the caller's user ID from
+const CallerIDHeader = "X-User-Id"
+
+// HeaderCallerResolver identifies the caller by the user ID in the CallerIDHeader, for tests.  Anyone can claim to be
+// any user, so it must never be used outside of tests
+type HeaderCallerResolver struct {
+	UserExtension *Extension
+}
+
+func (h HeaderCallerResolver) GetCaller(r *http.Request) (*nibbler.User, error) {
+	if r.Header.Get(CallerIDHeader) == "" {
+		return nil, nil
+	}
+	return h.UserExtension.GetUserById(r.Header.Get(CallerIDHeader))
+}
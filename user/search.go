@@ -0,0 +1,56 @@
+package user
+
+import (
+	"errors"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+)
+
+// UserSearchOptions are the search params accepted by SearchUsersRequestHandler (see nibbler.ParseSearchParameters)
+var UserSearchOptions = nibbler.SearchParameterOptions{
+	SortFields:   []string{"createdAt", "updatedAt", "email", "username", "firstName", "lastName"},
+	FilterFields: []string{"email", "username", "companyId", "isActive"},
+}
+
+// SearchUsersRequestHandler searches users with the search params in the query string (q, offset, size, sort,
+// includeTotal, and the filters in UserSearchOptions), responding with safe versions of the users.  It's added as
+// GET {ApiPrefix}/user/search when SearchRouteGuard is provided
+func (s *Extension) SearchUsersRequestHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := nibbler.ParseSearchParameters(r.URL.Query(), UserSearchOptions)
+	if err != nil {
+		nibbler.Write400Json(w, err.Error())
+		return
+	}
+
+	results, err := s.SearchUsers(*params)
+	if err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	if results.Hits, err = GetSafeUsers(results.Hits); err != nil {
+		nibbler.Write500Json(w, err.Error())
+		return
+	}
+
+	nibbler.WriteStructToJson(w, results, http.StatusOK)
+}
+
+// GetSafeUsers returns GetSafeUser for each user in search hits ([]nibbler.User or []*nibbler.User)
+func GetSafeUsers(hits interface{}) ([]nibbler.User, error) {
+	safeUsers := []nibbler.User{}
+	switch users := hits.(type) {
+	case nil:
+	case []nibbler.User:
+		for _, u := range users {
+			safeUsers = append(safeUsers, GetSafeUser(u))
+		}
+	case []*nibbler.User:
+		for _, u := range users {
+			safeUsers = append(safeUsers, GetSafeUser(*u))
+		}
+	default:
+		return nil, errors.New("the user search returned hits that are not users")
+	}
+	return safeUsers, nil
+}
@@ -0,0 +1,71 @@
+package user
+
+import (
+	"encoding/json"
+	"github.com/markdicksonjr/nibbler"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtension_SearchUsersRequestHandler(t *testing.T) {
+	e := Extension{PersistenceExtension: &MockPersistenceExtension{}}
+	if err := e.Init(&nibbler.Application{Logger: nibbler.SilentLogger{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	inactive := false
+	for _, u := range []nibbler.User{
+		{Email: strPtr("alice@example.com"), LastName: strPtr("Zimmer")},
+		{Email: strPtr("bob@example.com"), LastName: strPtr("Young"), IsActive: &inactive},
+		{Email: strPtr("carol@elsewhere.com"), LastName: strPtr("Xu"), Password: strPtr("secret")},
+	} {
+		user := u
+		if _, err := e.Create(&user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(query string) (int, []nibbler.User, *int) {
+		res := httptest.NewRecorder()
+		e.SearchUsersRequestHandler(res, httptest.NewRequest("GET", "/api/user/search?"+query, nil))
+
+		var results struct {
+			Hits  []nibbler.User `json:"hits"`
+			Total *int           `json:"total"`
+		}
+		if res.Code == http.StatusOK {
+			if err := json.Unmarshal(res.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return res.Code, results.Hits, results.Total
+	}
+
+	code, hits, total := search("q=EXAMPLE&sort=-email&includeTotal=true")
+	if code != http.StatusOK || len(hits) != 2 || *hits[0].Email != "bob@example.com" || total == nil || *total != 2 {
+		t.Fatal("the text search did not match and sort the users")
+	}
+
+	if _, hits, _ = search("sort=lastName&size=1&offset=1"); len(hits) != 1 || *hits[0].LastName != "Young" {
+		t.Fatal("the search was not sorted and paged")
+	}
+
+	if _, hits, _ = search("isActive=false"); len(hits) != 1 || *hits[0].Email != "bob@example.com" {
+		t.Fatal("the isActive filter was not applied")
+	}
+
+	if _, hits, _ = search("q=carol"); len(hits) != 1 || hits[0].Password != nil {
+		t.Fatal("the password was not removed from the search results")
+	}
+
+	for _, query := range []string{"size=0", "size=101", "offset=-1", "sort=password", "includeTotal=maybe"} {
+		if code, _, _ = search(query); code != http.StatusBadRequest {
+			t.Fatal("an invalid search (" + query + ") was not rejected")
+		}
+	}
+}
+
+func strPtr(value string) *string {
+	return &value
+}
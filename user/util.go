@@ -3,6 +3,7 @@ package user
 import (
 	"encoding/json"
 	"github.com/markdicksonjr/nibbler"
+	"strings"
 )
 
 func FromJson(jsonString string) (*nibbler.User, error) {
@@ -31,6 +32,31 @@ func GetSafeUser(user nibbler.User) nibbler.User {
 	safeUser.PasswordResetToken = nil
 	safeUser.EmailValidationToken = nil
 	safeUser.EmailValidationExpiration = nil
+	safeUser.LoginToken = nil
+	safeUser.LoginTokenExpiration = nil
 	safeUser.ProtectedContext = nil
 	return safeUser
 }
+
+// IsUserActive states whether the user can use the app - they haven't been deleted or deactivated (a nil IsActive
+// counts as active)
+func IsUserActive(user nibbler.User) bool {
+	return user.DeletedAt == nil && user.DeactivatedAt == nil && (user.IsActive == nil || *user.IsActive)
+}
+
+// GetFullName returns "first last" for the user, or an empty string if either is unknown
+func GetFullName(user nibbler.User) string {
+	if user.FirstName != nil && user.LastName != nil {
+		return *user.FirstName + " " + *user.LastName
+	}
+	return ""
+}
+
+// AppendTokenToLink adds the token query param to the given link (which may or may not already have a query), e.g. for
+// the links emailed to users
+func AppendTokenToLink(link string, token string) string {
+	if strings.Contains(link, "?") {
+		return link + "&token=" + token
+	}
+	return link + "?token=" + token
+}